@@ -2,13 +2,13 @@ package main
 
 import (
 	"context"
-	"database/sql"
-	"embed"
 	"errors"
 	"fmt"
 	"github.com/renatus-cartesius/metricserv/api"
+	"github.com/renatus-cartesius/metricserv/pkg/alerting"
 	"github.com/renatus-cartesius/metricserv/pkg/config"
 	"github.com/renatus-cartesius/metricserv/pkg/encryption"
+	"github.com/renatus-cartesius/metricserv/pkg/idempotency"
 	"github.com/renatus-cartesius/metricserv/pkg/server/pb"
 	"github.com/renatus-cartesius/metricserv/pkg/utils"
 	"google.golang.org/grpc"
@@ -22,18 +22,14 @@ import (
 	"time"
 
 	"github.com/go-chi/chi/v5"
-	_ "github.com/jackc/pgx/v5/stdlib"
-	"github.com/pressly/goose/v3"
 	"github.com/renatus-cartesius/metricserv/cmd/helpers"
 	"github.com/renatus-cartesius/metricserv/pkg/logger"
 	"github.com/renatus-cartesius/metricserv/pkg/server/handlers"
+	"github.com/renatus-cartesius/metricserv/pkg/server/service"
 	"github.com/renatus-cartesius/metricserv/pkg/storage"
 	"go.uber.org/zap"
 )
 
-//go:embed migrations/*.sql
-var embedMigrations embed.FS
-
 var (
 	buildDate    string
 	buildCommit  string
@@ -64,50 +60,63 @@ func main() {
 	var s storage.Storager
 
 	if cfg.DBDsn != "" {
-
-		db, err := sql.Open("pgx", cfg.DBDsn)
+		s, err = storage.OpenDatabase(cfg.DBDsn)
 		if err != nil {
-			log.Fatalln(err)
-		}
-
-		goose.SetBaseFS(embedMigrations)
-
-		if err = goose.SetDialect("postgres"); err != nil {
 			logger.Log.Fatal(
-				"error setting goose dialect",
+				"error on opening database storage",
 				zap.Error(err),
 			)
 		}
-
-		if err = goose.Up(db, "migrations"); err != nil {
-			logger.Log.Fatal(
-				"error on applying startup migration",
-				zap.Error(err),
-			)
-		}
-
-		s, err = storage.NewPGStorage(db)
-		if err != nil {
-			log.Fatalln("error on creating postgresql storage")
-		}
-		logger.Log.Info(
-			"using postgresql as a storage backend",
-		)
 		defer func() {
-			if err := db.Close(); err != nil {
+			if err := s.Close(); err != nil {
 				logger.Log.Fatal(
 					"error on closing database",
 					zap.Error(err),
 				)
 			}
 		}()
+
+		if sqlitePath, ok := storage.SQLitePath(cfg.DBDsn); ok {
+			logger.Log.Info(
+				"using sqlite as a storage backend",
+				zap.String("path", sqlitePath),
+			)
+		} else {
+			logger.Log.Info(
+				"using postgresql as a storage backend",
+			)
+		}
 	} else {
-		s, err = storage.NewMemStorage(cfg.SavePath)
+		opts := []storage.MemStorageOption{
+			storage.WithHistoryCapacity(cfg.HistoryCapacity),
+			storage.WithSilencesPath(cfg.SilencesPath),
+			storage.WithSnapshotsKeep(cfg.SnapshotsKeep),
+		}
+		format, err := storage.ParseSnapshotFormat(cfg.SnapshotFormat)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		opts = append(opts, storage.WithSnapshotFormat(format))
+		if cfg.WALPath != "" {
+			policy, err := storage.ParseSyncPolicy(cfg.WALSync)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			opts = append(opts, storage.WithWAL(cfg.WALPath, policy))
+		}
+
+		if cfg.StorageShards > 0 {
+			s, err = storage.NewShardedStorage(cfg.SavePath, cfg.StorageShards, opts...)
+		} else {
+			s, err = storage.NewMemStorage(cfg.SavePath, opts...)
+		}
 		if err != nil {
 			log.Fatalln("error on creating memory storage")
 		}
+		defer s.Close()
 		logger.Log.Info(
 			"using memorystorage as a storage backend",
+			zap.Int("shards", cfg.StorageShards),
 		)
 	}
 
@@ -146,6 +155,123 @@ func main() {
 		}()
 	}
 
+	retentionSig := make(chan os.Signal, 1)
+	signal.Notify(retentionSig, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+
+	if cfg.RetentionInterval > 0 {
+
+		retentionTicker := time.NewTicker(time.Duration(cfg.RetentionInterval) * time.Second)
+		defer retentionTicker.Stop()
+
+		policy := storage.RetentionPolicy{
+			RawAge:    time.Duration(cfg.RawRetention) * time.Second,
+			MinuteAge: time.Duration(cfg.MinuteRetention) * time.Second,
+			HourAge:   time.Duration(cfg.HourRetention) * time.Second,
+		}
+
+		go func() {
+			for {
+				select {
+				case <-retentionSig:
+					return
+				case <-retentionTicker.C:
+					if err := s.Retain(ctx, time.Now(), policy); err != nil {
+						logger.Log.Error(
+							"error on applying retention",
+							zap.Error(err),
+						)
+					}
+				}
+			}
+
+		}()
+	}
+
+	staleness := storage.StalenessPolicy{
+		StaleAfter: time.Duration(cfg.GaugeStaleAfter) * time.Second,
+		EvictAfter: time.Duration(cfg.GaugeEvictAfter) * time.Second,
+	}
+
+	expirySig := make(chan os.Signal, 1)
+	signal.Notify(expirySig, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+
+	if staleness.EvictAfter > 0 && cfg.ExpiryInterval > 0 {
+
+		expiryTicker := time.NewTicker(time.Duration(cfg.ExpiryInterval) * time.Second)
+		defer expiryTicker.Stop()
+
+		go func() {
+			for {
+				select {
+				case <-expirySig:
+					return
+				case <-expiryTicker.C:
+					before, _ := staleness.EvictBefore(time.Now())
+					evicted, err := s.Evict(ctx, before)
+					if err != nil {
+						logger.Log.Error(
+							"error on evicting stale gauges",
+							zap.Error(err),
+						)
+						continue
+					}
+					if len(evicted) > 0 {
+						logger.Log.Info(
+							"evicted stale gauges",
+							zap.Strings("keys", evicted),
+						)
+					}
+				}
+			}
+
+		}()
+	}
+
+	rulesFile := &alerting.RulesFile{}
+	if cfg.AlertRulesPath != "" {
+		rulesFile, err = alerting.LoadRules(cfg.AlertRulesPath)
+		if err != nil {
+			logger.Log.Fatal(
+				"error on loading alerting rules",
+				zap.Error(err),
+			)
+		}
+		logger.Log.Info(
+			"loaded alerting rules",
+			zap.Int("count", len(rulesFile.Rules)),
+		)
+	}
+
+	alertManager := alerting.NewManager(s, rulesFile.Rules)
+
+	dispatcher, err := alerting.NewDispatcher(rulesFile)
+	if err != nil {
+		logger.Log.Fatal(
+			"error on creating alerts dispatcher",
+			zap.Error(err),
+		)
+	}
+	defer dispatcher.Close()
+
+	dispatcher.SetSilences(s)
+	alertManager.SetDispatcher(dispatcher)
+
+	if len(rulesFile.Rules) > 0 && cfg.AlertInterval > 0 {
+
+		alertCtx, alertStopCtx := context.WithCancel(ctx)
+		defer alertStopCtx()
+
+		alertSig := make(chan os.Signal, 1)
+		signal.Notify(alertSig, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+
+		go func() {
+			<-alertSig
+			alertStopCtx()
+		}()
+
+		go alertManager.Run(alertCtx, time.Duration(cfg.AlertInterval)*time.Second)
+	}
+
 	rsaProcessor, err := encryption.NewRSAProcessor()
 	if err != nil {
 		log.Fatalln(err)
@@ -166,7 +292,19 @@ func main() {
 		}
 	}
 
+	var idempotencyStore *idempotency.Store
+	if cfg.IdempotencyWindow > 0 {
+		idempotencyStore = idempotency.NewStore(s, time.Duration(cfg.IdempotencyWindow)*time.Second)
+	}
+
+	// HTTP and gRPC servers share service, so both apply the same policies to metrics
+	metricService := service.NewMetricService(s)
+	metricService.SetStalenessPolicy(staleness)
+
 	srv := handlers.NewServerHandler(s, rsaProcessor, trustedSubnet)
+	srv.SetService(metricService)
+	srv.SetAlertManager(alertManager)
+	srv.SetIdempotencyStore(idempotencyStore)
 
 	r := chi.NewRouter()
 
@@ -190,12 +328,22 @@ func main() {
 	}
 
 	wg := sync.WaitGroup{}
-	gs := grpc.NewServer()
-	api.RegisterMetricsServiceServer(gs, &pb.Server{
+	grpcServer := &pb.Server{
 		TrustedSubnet: trustedSubnet,
+		HashKey:       cfg.HashKey,
 		Storage:       s,
+		Service:       metricService,
 		EncProcessor:  rsaProcessor,
-	})
+		Alerts:        alertManager,
+	}
+
+	// calls are authorized before they are deduplicated, so rejected calls are not remembered
+	gs := grpc.NewServer(grpc.ChainUnaryInterceptor(
+		grpcServer.AuthInterceptor(),
+		pb.IdempotencyInterceptor(idempotencyStore),
+	))
+
+	api.RegisterMetricsServiceServer(gs, grpcServer)
 
 	wg.Add(1)
 	go func() {
@@ -11,6 +11,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/renatus-cartesius/metricserv/pkg/encryption"
+	"github.com/renatus-cartesius/metricserv/pkg/idempotency"
 	"github.com/renatus-cartesius/metricserv/pkg/utils"
 	"github.com/renatus-cartesius/metricserv/pkg/workerpool"
 	"net"
@@ -22,6 +23,7 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/go-resty/resty/v2"
+	"github.com/google/uuid"
 	"github.com/renatus-cartesius/metricserv/pkg/logger"
 	"github.com/renatus-cartesius/metricserv/pkg/metrics"
 	"github.com/renatus-cartesius/metricserv/pkg/monitor"
@@ -237,8 +239,10 @@ func (a *Agent) SendUpdate(metric *models.Metric) (*resty.Response, error) {
 		return nil, err
 	}
 
+	// retries of request reuse its key, so server applies it only once
 	req := a.httpClient.R()
 	req.SetHeader("X-Real-IP", a.agentIP.String())
+	req.SetHeader(idempotency.Header, uuid.NewString())
 
 	if a.hashKey != "" {
 		hash := hmac.New(sha256.New, []byte(a.hashKey))
@@ -269,8 +273,10 @@ func (a *Agent) SendUpdates(metric *models.Metric) (*resty.Response, error) {
 	if err != nil {
 		return nil, err
 	}
+	// retries of request reuse its key, so server applies it only once
 	req := a.httpClient.R()
 	req.SetHeader("X-Real-IP", a.agentIP.String())
+	req.SetHeader(idempotency.Header, uuid.NewString())
 
 	if a.hashKey != "" {
 		hash := hmac.New(sha256.New, []byte(a.hashKey))
@@ -0,0 +1,301 @@
+package alerting
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/renatus-cartesius/metricserv/pkg/metrics"
+	"github.com/renatus-cartesius/metricserv/pkg/storage"
+)
+
+func addGauge(t *testing.T, s storage.Storager, id, host string, value float64) string {
+	gauge := metrics.NewGauge(id, 0)
+	gauge.Labels = map[string]string{"host": host}
+	key := metrics.SeriesKey(gauge.ID, gauge.Labels)
+
+	if err := s.Add(context.Background(), key, gauge); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Update(context.Background(), metrics.TypeGauge, key, value); err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func marshalAlert(t *testing.T, alert Alert) map[string]any {
+	data, err := json.Marshal(alert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := make(map[string]any)
+	if err = json.Unmarshal(data, &body); err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestManagerEval(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := storage.NewMemStorage("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	web1 := addGauge(t, s, "cpu", "web-1", 90)
+	addGauge(t, s, "cpu", "web-2", 50)
+
+	m := NewManager(s, []Rule{
+		{
+			Name:      "HighCPU",
+			Expr:      "cpu",
+			Op:        OpGreater,
+			Threshold: 80,
+			For:       Duration(time.Minute),
+			Severity:  "critical",
+		},
+	})
+
+	now := time.Now()
+
+	changed, err := m.Eval(ctx, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 0 {
+		t.Fatalf("unexpected changed alerts: %v", changed)
+	}
+
+	alerts := m.Alerts()
+	if len(alerts) != 1 || alerts[0].State != StatePending {
+		t.Fatalf("expected one pending alert, got %v", alerts)
+	}
+
+	if body := marshalAlert(t, alerts[0]); body["firedAt"] != nil || body["resolvedAt"] != nil {
+		t.Errorf("pending alert has firing or resolving time: %v", body)
+	}
+
+	wantLabels := map[string]string{"host": "web-1", AlertNameLabel: "HighCPU", SeverityLabel: "critical"}
+	if metrics.FormatLabels(alerts[0].Labels) != metrics.FormatLabels(wantLabels) {
+		t.Errorf("unexpected alert labels: %v", alerts[0].Labels)
+	}
+
+	changed, err = m.Eval(ctx, now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 1 || changed[0].State != StateFiring || changed[0].Value != 90 {
+		t.Fatalf("expected firing alert, got %v", changed)
+	}
+	if body := marshalAlert(t, changed[0]); body["firedAt"] == nil || body["resolvedAt"] != nil {
+		t.Errorf("firing alert must have only firing time: %v", body)
+	}
+
+	if err = s.Update(ctx, metrics.TypeGauge, web1, float64(10)); err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err = m.Eval(ctx, now.Add(2*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 1 || changed[0].State != StateResolved {
+		t.Fatalf("expected resolved alert, got %v", changed)
+	}
+	if resolvedAt := changed[0].ResolvedAt; resolvedAt == nil || !resolvedAt.Equal(now.Add(2*time.Minute)) {
+		t.Errorf("unexpected resolving time: %v", resolvedAt)
+	}
+
+	if _, err = m.Eval(ctx, now.Add(2*time.Minute+DefaultResolvedRetention)); err != nil {
+		t.Fatal(err)
+	}
+	if alerts = m.Alerts(); len(alerts) != 0 {
+		t.Errorf("expected resolved alert to be dropped, got %v", alerts)
+	}
+}
+
+func TestManagerEvalPendingDropped(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := storage.NewMemStorage("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := addGauge(t, s, "free_memory", "db-1", 100)
+
+	m := NewManager(s, []Rule{
+		{Name: "LowMemory", Expr: "free_memory", Op: OpLess, Threshold: 200, For: Duration(time.Hour)},
+	})
+
+	now := time.Now()
+	if _, err = m.Eval(ctx, now); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Update(ctx, metrics.TypeGauge, key, float64(500)); err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := m.Eval(ctx, now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 0 || len(m.Alerts()) != 0 {
+		t.Errorf("expected pending alert to be dropped without notification, got %v", m.Alerts())
+	}
+}
+
+func TestManagerRunNotifiesInOrder(t *testing.T) {
+	var mu sync.Mutex
+	statuses := make([]string, 0)
+
+	// the first notification is delivered slowly, so the next one would overtake it if sent concurrently
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n Notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Error(err)
+		}
+		if n.Status == StateFiring {
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		statuses = append(statuses, n.Status)
+	}))
+	defer receiver.Close()
+
+	s, err := storage.NewMemStorage("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := addGauge(t, s, "cpu", "web-1", 90)
+
+	m := NewManager(s, []Rule{
+		{Name: "HighCPU", Expr: "cpu", Op: OpGreater, Threshold: 80},
+	})
+
+	d, err := NewDispatcher(&RulesFile{
+		Receivers: []ReceiverConfig{
+			{Name: "ops", Webhook: &WebhookConfig{URL: receiver.URL}},
+		},
+		Route: &Route{Receiver: "ops"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	m.SetDispatcher(d)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.Run(ctx, 10*time.Millisecond)
+	}()
+
+	waitFor := func(cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatal("condition is not met in time")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	waitFor(func() bool {
+		alerts := m.Alerts()
+		return len(alerts) == 1 && alerts[0].State == StateFiring
+	})
+	if err = s.Update(context.Background(), metrics.TypeGauge, key, 50.0); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(statuses) == 2
+	})
+
+	cancel()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if statuses[0] != StateFiring || statuses[1] != StateResolved {
+		t.Errorf("notifications are not in order of changes: %v", statuses)
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr error
+		wantFor time.Duration
+	}{
+		{
+			name:    "valid",
+			content: `{"rules": [{"name": "HighCPU", "expr": "avg_over_time(cpu[5m])", "op": ">", "threshold": 90, "for": "10m"}]}`,
+			wantFor: 10 * time.Minute,
+		},
+		{
+			name:    "seconds duration",
+			content: `{"rules": [{"name": "HighCPU", "expr": "cpu", "op": ">=", "threshold": 90, "for": 30}]}`,
+			wantFor: 30 * time.Second,
+		},
+		{
+			name:    "unknown op",
+			content: `{"rules": [{"name": "HighCPU", "expr": "cpu", "op": "=>", "threshold": 90}]}`,
+			wantErr: ErrInvalidRule,
+		},
+		{
+			name:    "invalid expr",
+			content: `{"rules": [{"name": "HighCPU", "expr": "rate(cpu)", "op": ">", "threshold": 90}]}`,
+			wantErr: ErrInvalidRule,
+		},
+		{
+			name:    "duplicated",
+			content: `{"rules": [{"name": "HighCPU", "expr": "cpu", "op": ">", "threshold": 90}, {"name": "HighCPU", "expr": "cpu", "op": ">", "threshold": 95}]}`,
+			wantErr: ErrDuplicatedRule,
+		},
+		{
+			name:    "unknown receiver",
+			content: `{"rules": [{"name": "HighCPU", "expr": "cpu", "op": ">", "threshold": 90, "route": {"receiver": "ops"}}]}`,
+			wantErr: ErrInvalidRoute,
+		},
+		{
+			name:    "receiver without backend",
+			content: `{"receivers": [{"name": "ops"}], "rules": []}`,
+			wantErr: ErrInvalidReceiver,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rules.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			rules, err := LoadRules(path)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("LoadRules() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && time.Duration(rules.Rules[0].For) != tt.wantFor {
+				t.Errorf("unexpected for duration: %v, want %v", time.Duration(rules.Rules[0].For), tt.wantFor)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package alerting
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/renatus-cartesius/metricserv/pkg/logger"
+	"github.com/renatus-cartesius/metricserv/pkg/metrics"
+	"github.com/renatus-cartesius/metricserv/pkg/query"
+	"github.com/renatus-cartesius/metricserv/pkg/storage"
+)
+
+const (
+	StatePending  = "pending"
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+
+	// AlertNameLabel is a label holding name of rule in labels of alert
+	AlertNameLabel = "alertname"
+	// SeverityLabel is a label holding severity of rule in labels of alert
+	SeverityLabel = "severity"
+
+	// DefaultResolvedRetention is a duration for which resolved alerts are still listed
+	DefaultResolvedRetention = 15 * time.Minute
+
+	// dispatchQueueSize is a count of evaluations which changed alerts are waiting for notifying
+	dispatchQueueSize = 16
+)
+
+// Alert is a state of rule for one series
+type Alert struct {
+	Rule        string            `json:"rule"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Severity    string            `json:"severity,omitempty"`
+	State       string            `json:"state"`
+	Value       float64           `json:"value"`
+	ActiveAt    time.Time         `json:"activeAt"`
+	FiredAt     *time.Time        `json:"firedAt,omitempty"`
+	ResolvedAt  *time.Time        `json:"resolvedAt,omitempty"`
+}
+
+// Key identifies alert among alerts of all rules
+func (a *Alert) Key() string {
+	return metrics.SeriesKey(a.Rule, a.Labels)
+}
+
+// Manager periodically evaluates rules and keeps current alerts
+type Manager struct {
+	engine            *query.Engine
+	rules             []Rule
+	resolvedRetention time.Duration
+	dispatcher        *Dispatcher
+
+	mu     sync.RWMutex
+	alerts map[string]*Alert
+}
+
+func NewManager(s storage.Storager, rules []Rule) *Manager {
+	return &Manager{
+		engine:            query.NewEngine(s),
+		rules:             rules,
+		resolvedRetention: DefaultResolvedRetention,
+		alerts:            make(map[string]*Alert),
+	}
+}
+
+// SetDispatcher sets dispatcher notified about alerts which became firing or resolved on Run
+func (m *Manager) SetDispatcher(d *Dispatcher) {
+	m.dispatcher = d
+}
+
+// Rules returns rules evaluated by manager
+func (m *Manager) Rules() []Rule {
+	return slices.Clone(m.rules)
+}
+
+// Run evaluates rules each interval until ctx is done. Changed alerts are notified by single worker in order
+// of evaluations, evaluation waits for room in queue if receivers are too slow.
+func (m *Manager) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var queue chan []Alert
+	if m.dispatcher != nil {
+		queue = make(chan []Alert, dispatchQueueSize)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for alerts := range queue {
+				m.dispatcher.Dispatch(ctx, alerts)
+			}
+		}()
+		defer func() {
+			close(queue)
+			<-done
+		}()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ts := <-ticker.C:
+			changed, err := m.Eval(ctx, ts)
+			if err != nil {
+				logger.Log.Error(
+					"error on evaluating alerting rules",
+					zap.Error(err),
+				)
+			}
+
+			if queue == nil || len(changed) == 0 {
+				continue
+			}
+
+			select {
+			case queue <- changed:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// Eval evaluates all rules at ts and returns alerts which became firing or resolved.
+// Failed rule does not prevent evaluation of others, its alerts keep their state.
+func (m *Manager) Eval(ctx context.Context, ts time.Time) ([]Alert, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	changed := make([]Alert, 0)
+	errs := make([]error, 0)
+
+	for i := range m.rules {
+		rule := &m.rules[i]
+
+		vector, err := m.engine.Query(ctx, rule.Expr, ts)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rule %s: %w", rule.Name, err))
+			continue
+		}
+
+		active := make(map[string]struct{}, len(vector))
+		for _, sample := range vector {
+			if !rule.Compare(sample.Value) {
+				continue
+			}
+
+			labels := alertLabels(rule, sample.Labels)
+			key := metrics.SeriesKey(rule.Name, labels)
+			active[key] = struct{}{}
+
+			alert, ok := m.alerts[key]
+			if !ok || alert.State == StateResolved {
+				alert = &Alert{
+					Rule:        rule.Name,
+					Labels:      labels,
+					Annotations: rule.Annotations,
+					Severity:    rule.Severity,
+					State:       StatePending,
+					ActiveAt:    ts,
+				}
+				m.alerts[key] = alert
+			}
+			alert.Value = sample.Value
+
+			if alert.State == StatePending && ts.Sub(alert.ActiveAt) >= time.Duration(rule.For) {
+				alert.State = StateFiring
+				firedAt := ts
+				alert.FiredAt = &firedAt
+				changed = append(changed, *alert)
+			}
+		}
+
+		for key, alert := range m.alerts {
+			if _, ok := active[key]; ok || alert.Rule != rule.Name {
+				continue
+			}
+
+			switch alert.State {
+			case StatePending:
+				delete(m.alerts, key)
+			case StateFiring:
+				alert.State = StateResolved
+				resolvedAt := ts
+				alert.ResolvedAt = &resolvedAt
+				changed = append(changed, *alert)
+			case StateResolved:
+				if ts.Sub(*alert.ResolvedAt) >= m.resolvedRetention {
+					delete(m.alerts, key)
+				}
+			}
+		}
+	}
+
+	sortAlerts(changed)
+
+	return changed, errors.Join(errs...)
+}
+
+// Alerts returns current pending, firing and recently resolved alerts
+func (m *Manager) Alerts() []Alert {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	alerts := make([]Alert, 0, len(m.alerts))
+	for _, alert := range m.alerts {
+		alerts = append(alerts, *alert)
+	}
+	sortAlerts(alerts)
+
+	return alerts
+}
+
+func alertLabels(rule *Rule, labels map[string]string) map[string]string {
+	result := maps.Clone(labels)
+	if result == nil {
+		result = make(map[string]string)
+	}
+	delete(result, query.NameLabel)
+
+	for k, v := range rule.Labels {
+		result[k] = v
+	}
+	if rule.Severity != "" {
+		result[SeverityLabel] = rule.Severity
+	}
+	result[AlertNameLabel] = rule.Name
+
+	return result
+}
+
+func sortAlerts(alerts []Alert) {
+	slices.SortFunc(alerts, func(a, b Alert) int {
+		return strings.Compare(a.Key(), b.Key())
+	})
+}
@@ -0,0 +1,413 @@
+package alerting
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"go.uber.org/zap"
+
+	"github.com/renatus-cartesius/metricserv/pkg/logger"
+	"github.com/renatus-cartesius/metricserv/pkg/metrics"
+	"github.com/renatus-cartesius/metricserv/pkg/storage"
+)
+
+const (
+	DefaultRetryAttempts   = 3
+	DefaultRetryBackoff    = time.Second
+	DefaultRetryMaxBackoff = time.Minute
+)
+
+var ErrInvalidReceiver = errors.New("invalid notification receiver")
+
+// ReceiverConfig configures one of receiver backends
+type ReceiverConfig struct {
+	Name    string         `json:"name"`
+	Webhook *WebhookConfig `json:"webhook,omitempty"`
+	File    *FileConfig    `json:"file,omitempty"`
+}
+
+// WebhookConfig configures JSON webhook, payload is signed with Key in HashSHA256 header if Key is set
+type WebhookConfig struct {
+	URL string `json:"url"`
+	Key string `json:"key,omitempty"`
+}
+
+// FileConfig configures notifier appending notifications to file at Path, "-" stands for stdout
+type FileConfig struct {
+	Path string `json:"path"`
+}
+
+func (c *ReceiverConfig) Validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("%w: empty name", ErrInvalidReceiver)
+	}
+	if (c.Webhook == nil) == (c.File == nil) {
+		return fmt.Errorf("%w %s: exactly one of webhook or file must be set", ErrInvalidReceiver, c.Name)
+	}
+	if c.Webhook != nil && c.Webhook.URL == "" {
+		return fmt.Errorf("%w %s: empty webhook url", ErrInvalidReceiver, c.Name)
+	}
+	if c.File != nil && c.File.Path == "" {
+		return fmt.Errorf("%w %s: empty file path", ErrInvalidReceiver, c.Name)
+	}
+	return nil
+}
+
+// RetryConfig configures redelivery of failed notifications with exponential backoff
+type RetryConfig struct {
+	Attempts   int      `json:"attempts,omitempty"`
+	Backoff    Duration `json:"backoff,omitempty"`
+	MaxBackoff Duration `json:"max_backoff,omitempty"`
+}
+
+func (c RetryConfig) withDefaults() RetryConfig {
+	if c.Attempts <= 0 {
+		c.Attempts = DefaultRetryAttempts
+	}
+	if c.Backoff <= 0 {
+		c.Backoff = Duration(DefaultRetryBackoff)
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = Duration(DefaultRetryMaxBackoff)
+	}
+	return c
+}
+
+// Notification is a group of alerts sent to receiver at once
+type Notification struct {
+	Receiver    string            `json:"receiver"`
+	Status      string            `json:"status"`
+	GroupLabels map[string]string `json:"groupLabels"`
+	Alerts      []Alert           `json:"alerts"`
+}
+
+// SilenceSource provides silences muting notifications, storage.Storager is used in server
+type SilenceSource interface {
+	Silences(ctx context.Context) ([]storage.Silence, error)
+}
+
+// Notifier delivers notifications to some receiver
+type Notifier interface {
+	Notify(ctx context.Context, n *Notification) error
+}
+
+// WebhookNotifier posts notifications as JSON to URL
+type WebhookNotifier struct {
+	url    string
+	key    string
+	client *resty.Client
+}
+
+func NewWebhookNotifier(cfg *WebhookConfig) *WebhookNotifier {
+	return &WebhookNotifier{
+		url:    cfg.URL,
+		key:    cfg.Key,
+		client: resty.New().SetTimeout(10 * time.Second),
+	}
+}
+
+func (wn *WebhookNotifier) Notify(ctx context.Context, n *Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	req := wn.client.R().SetContext(ctx)
+	req.SetHeader("Content-Type", "application/json")
+
+	if wn.key != "" {
+		hash := hmac.New(sha256.New, []byte(wn.key))
+		hash.Write(body)
+
+		req.SetHeader("HashSHA256", base64.StdEncoding.EncodeToString(hash.Sum(nil)))
+	}
+
+	resp, err := req.SetBody(body).Post(wn.url)
+	if err != nil {
+		return err
+	}
+	if resp.IsError() {
+		return fmt.Errorf("webhook %s responded with %s", wn.url, resp.Status())
+	}
+
+	return nil
+}
+
+// FileNotifier writes notifications as JSON lines
+type FileNotifier struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewFileNotifier(w io.Writer) *FileNotifier {
+	return &FileNotifier{w: w}
+}
+
+func (fn *FileNotifier) Notify(ctx context.Context, n *Notification) error {
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+
+	return json.NewEncoder(fn.w).Encode(n)
+}
+
+// deadLetter is a record of notification which was not delivered after all retries
+type deadLetter struct {
+	Time         time.Time     `json:"time"`
+	Error        string        `json:"error"`
+	Notification *Notification `json:"notification"`
+}
+
+// Dispatcher groups alerts by routes and delivers them to receivers
+type Dispatcher struct {
+	notifiers    map[string]Notifier
+	routes       map[string]*Route
+	defaultRoute *Route
+	retry        RetryConfig
+
+	silences SilenceSource
+
+	closers []io.Closer
+
+	deadLetterMu sync.Mutex
+	deadLetter   io.Writer
+}
+
+// NewDispatcher creates receivers and routes configured in rules file
+func NewDispatcher(file *RulesFile) (*Dispatcher, error) {
+	d := &Dispatcher{
+		notifiers:    make(map[string]Notifier, len(file.Receivers)),
+		routes:       make(map[string]*Route, len(file.Rules)),
+		defaultRoute: file.Route,
+		retry:        file.Retry.withDefaults(),
+	}
+
+	for _, receiver := range file.Receivers {
+		switch {
+		case receiver.Webhook != nil:
+			d.notifiers[receiver.Name] = NewWebhookNotifier(receiver.Webhook)
+		case receiver.File != nil:
+			w, err := d.openFile(receiver.File.Path)
+			if err != nil {
+				d.Close()
+				return nil, err
+			}
+			d.notifiers[receiver.Name] = NewFileNotifier(w)
+		}
+	}
+
+	for i := range file.Rules {
+		if file.Rules[i].Route != nil {
+			d.routes[file.Rules[i].Name] = file.Rules[i].Route
+		}
+	}
+
+	if file.DeadLetter != "" {
+		w, err := d.openFile(file.DeadLetter)
+		if err != nil {
+			d.Close()
+			return nil, err
+		}
+		d.deadLetter = w
+	}
+
+	return d, nil
+}
+
+func (d *Dispatcher) openFile(path string) (io.Writer, error) {
+	if path == "-" {
+		return os.Stdout, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	d.closers = append(d.closers, f)
+
+	return f, nil
+}
+
+// SetNotifier sets notifier of receiver, replacing configured one
+func (d *Dispatcher) SetNotifier(receiver string, n Notifier) {
+	d.notifiers[receiver] = n
+}
+
+// SetSilences sets source of silences, alerts muted by active silence are not notified
+func (d *Dispatcher) SetSilences(s SilenceSource) {
+	d.silences = s
+}
+
+// Close closes files opened by dispatcher
+func (d *Dispatcher) Close() error {
+	errs := make([]error, 0)
+	for _, c := range d.closers {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Dispatch sends alerts grouped by routes, undelivered notifications are written to dead letter log
+func (d *Dispatcher) Dispatch(ctx context.Context, alerts []Alert) {
+	for _, n := range d.group(d.unmuted(ctx, alerts)) {
+		notifier, ok := d.notifiers[n.Receiver]
+		if !ok {
+			continue
+		}
+
+		if err := d.send(ctx, notifier, n); err != nil {
+			logger.Log.Error(
+				"error on sending alerts notification",
+				zap.String("receiver", n.Receiver),
+				zap.Error(err),
+			)
+			d.writeDeadLetter(n, err)
+		}
+	}
+}
+
+// unmuted filters out alerts muted by active silences. If silences are unavailable all alerts are notified,
+// missed notification is worse than one sent during maintenance.
+func (d *Dispatcher) unmuted(ctx context.Context, alerts []Alert) []Alert {
+	if d.silences == nil {
+		return alerts
+	}
+
+	silences, err := d.silences.Silences(ctx)
+	if err != nil {
+		logger.Log.Error(
+			"error on getting silences",
+			zap.Error(err),
+		)
+		return alerts
+	}
+
+	now := time.Now()
+	result := make([]Alert, 0, len(alerts))
+
+	for _, alert := range alerts {
+		muted := slices.ContainsFunc(silences, func(s storage.Silence) bool {
+			return s.Mutes(alert.Labels, now)
+		})
+		if muted {
+			logger.Log.Info(
+				"alert notification is silenced",
+				zap.String("alert", alert.Key()),
+			)
+			continue
+		}
+		result = append(result, alert)
+	}
+
+	return result
+}
+
+// group splits alerts to notifications by receiver and group labels of their routes
+func (d *Dispatcher) group(alerts []Alert) []*Notification {
+	groups := make(map[string]*Notification)
+	keys := make([]string, 0)
+
+	for _, alert := range alerts {
+		route, ok := d.routes[alert.Rule]
+		if !ok {
+			route = d.defaultRoute
+		}
+		if route == nil {
+			continue
+		}
+
+		groupLabels := make(map[string]string, len(route.GroupBy))
+		for _, name := range route.GroupBy {
+			if value, ok := alert.Labels[name]; ok {
+				groupLabels[name] = value
+			}
+		}
+
+		key := metrics.SeriesKey(route.Receiver, groupLabels)
+		n, ok := groups[key]
+		if !ok {
+			n = &Notification{
+				Receiver:    route.Receiver,
+				Status:      StateResolved,
+				GroupLabels: groupLabels,
+			}
+			groups[key] = n
+			keys = append(keys, key)
+		}
+
+		n.Alerts = append(n.Alerts, alert)
+		if alert.State == StateFiring {
+			n.Status = StateFiring
+		}
+	}
+
+	slices.SortFunc(keys, strings.Compare)
+
+	result := make([]*Notification, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, groups[key])
+	}
+
+	return result
+}
+
+func (d *Dispatcher) send(ctx context.Context, notifier Notifier, n *Notification) error {
+	backoff := time.Duration(d.retry.Backoff)
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = notifier.Notify(ctx, n); err == nil {
+			return nil
+		}
+		if attempt >= d.retry.Attempts {
+			return err
+		}
+
+		logger.Log.Warn(
+			"retrying alerts notification",
+			zap.String("receiver", n.Receiver),
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", backoff),
+			zap.Error(err),
+		)
+
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(backoff):
+		}
+
+		backoff = min(2*backoff, time.Duration(d.retry.MaxBackoff))
+	}
+}
+
+func (d *Dispatcher) writeDeadLetter(n *Notification, err error) {
+	if d.deadLetter == nil {
+		return
+	}
+
+	d.deadLetterMu.Lock()
+	defer d.deadLetterMu.Unlock()
+
+	if err := json.NewEncoder(d.deadLetter).Encode(deadLetter{
+		Time:         time.Now(),
+		Error:        err.Error(),
+		Notification: n,
+	}); err != nil {
+		logger.Log.Error(
+			"error on writing dead letter",
+			zap.Error(err),
+		)
+	}
+}
@@ -0,0 +1,185 @@
+package alerting
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/renatus-cartesius/metricserv/pkg/storage"
+)
+
+func TestDispatcherWebhook(t *testing.T) {
+	const key = "secret"
+
+	var mu sync.Mutex
+	received := make([]Notification, 0)
+	attempts := 0
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		hash := hmac.New(sha256.New, []byte(key))
+		hash.Write(body)
+		if r.Header.Get("HashSHA256") != base64.StdEncoding.EncodeToString(hash.Sum(nil)) {
+			t.Errorf("invalid HashSHA256 header %q", r.Header.Get("HashSHA256"))
+		}
+
+		var n Notification
+		if err = json.Unmarshal(body, &n); err != nil {
+			t.Error(err)
+		}
+		received = append(received, n)
+	}))
+	defer receiver.Close()
+
+	d, err := NewDispatcher(&RulesFile{
+		Receivers: []ReceiverConfig{
+			{Name: "ops", Webhook: &WebhookConfig{URL: receiver.URL, Key: key}},
+		},
+		Route: &Route{Receiver: "ops", GroupBy: []string{"region"}},
+		Retry: RetryConfig{Attempts: 3, Backoff: Duration(time.Millisecond)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	d.Dispatch(context.Background(), []Alert{
+		{Rule: "HighCPU", State: StateFiring, Labels: map[string]string{"host": "web-1", "region": "eu"}},
+		{Rule: "HighCPU", State: StateResolved, Labels: map[string]string{"host": "web-2", "region": "eu"}},
+		{Rule: "HighCPU", State: StateResolved, Labels: map[string]string{"host": "web-3", "region": "us"}},
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(received) != 2 {
+		t.Fatalf("expected 2 grouped notifications, got %v", received)
+	}
+
+	eu, us := received[0], received[1]
+	if eu.GroupLabels["region"] != "eu" || eu.Status != StateFiring || len(eu.Alerts) != 2 {
+		t.Errorf("unexpected eu notification: %+v", eu)
+	}
+	if us.GroupLabels["region"] != "us" || us.Status != StateResolved || len(us.Alerts) != 1 {
+		t.Errorf("unexpected us notification: %+v", us)
+	}
+}
+
+func TestDispatcherDeadLetter(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	dir := t.TempDir()
+	deadLetterPath := filepath.Join(dir, "dead_letter.log")
+	filePath := filepath.Join(dir, "alerts.log")
+
+	d, err := NewDispatcher(&RulesFile{
+		Receivers: []ReceiverConfig{
+			{Name: "ops", Webhook: &WebhookConfig{URL: receiver.URL}},
+			{Name: "log", File: &FileConfig{Path: filePath}},
+		},
+		Route:      &Route{Receiver: "log"},
+		Retry:      RetryConfig{Attempts: 2, Backoff: Duration(time.Millisecond)},
+		DeadLetter: deadLetterPath,
+		Rules: []Rule{
+			{Name: "HighCPU", Route: &Route{Receiver: "ops"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.Dispatch(context.Background(), []Alert{
+		{Rule: "HighCPU", State: StateFiring, Labels: map[string]string{"host": "web-1"}},
+		{Rule: "LowMemory", State: StateFiring, Labels: map[string]string{"host": "db-1"}},
+	})
+
+	if err = d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadLetters, err := os.ReadFile(deadLetterPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(deadLetters)), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], "HighCPU") || !strings.Contains(lines[0], "500") {
+		t.Errorf("unexpected dead letters: %s", deadLetters)
+	}
+
+	logged, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var n Notification
+	if err = json.NewDecoder(bytes.NewReader(logged)).Decode(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n.Receiver != "log" || len(n.Alerts) != 1 || n.Alerts[0].Rule != "LowMemory" {
+		t.Errorf("unexpected file notification: %+v", n)
+	}
+}
+
+type silences []storage.Silence
+
+func (s silences) Silences(ctx context.Context) ([]storage.Silence, error) {
+	return s, nil
+}
+
+func TestDispatcherSilences(t *testing.T) {
+	var buf bytes.Buffer
+
+	d, err := NewDispatcher(&RulesFile{Route: &Route{Receiver: "log"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetNotifier("log", NewFileNotifier(&buf))
+
+	now := time.Now()
+	d.SetSilences(silences{
+		{ID: "1", Matchers: []string{"host=web-1"}, StartsAt: now.Add(-time.Minute), EndsAt: now.Add(time.Hour)},
+		{ID: "2", Matchers: []string{"host=web-2"}, StartsAt: now.Add(-time.Hour), EndsAt: now.Add(-time.Minute)},
+	})
+
+	d.Dispatch(context.Background(), []Alert{
+		{Rule: "HighCPU", State: StateFiring, Labels: map[string]string{"host": "web-1"}},
+		{Rule: "HighCPU", State: StateFiring, Labels: map[string]string{"host": "web-2"}},
+	})
+
+	var n Notification
+	if err = json.NewDecoder(&buf).Decode(&n); err != nil {
+		t.Fatal(err)
+	}
+	if len(n.Alerts) != 1 || n.Alerts[0].Labels["host"] != "web-2" {
+		t.Errorf("expected only alert without active silence to be notified, got %+v", n)
+	}
+}
@@ -0,0 +1,212 @@
+// Package alerting evaluates threshold alerting rules against storage and tracks state of resulting alerts.
+//
+// Rules are loaded from JSON file:
+//
+//	{
+//	  "receivers": [
+//	    {"name": "ops", "webhook": {"url": "https://example.com/alerts", "key": "secret"}},
+//	    {"name": "log", "file": {"path": "-"}}
+//	  ],
+//	  "route": {"receiver": "log"},
+//	  "retry": {"attempts": 5, "backoff": "1s", "max_backoff": "1m"},
+//	  "dead_letter": "./alerts_dead_letter.log",
+//	  "rules": [
+//	    {
+//	      "name": "HighCPU",
+//	      "expr": "avg_over_time(cpu_usage{host=~\"web-.*\"}[5m])",
+//	      "op": ">",
+//	      "threshold": 90,
+//	      "for": "10m",
+//	      "severity": "critical",
+//	      "route": {"receiver": "ops", "group_by": ["region"]}
+//	    }
+//	  ]
+//	}
+//
+// Expression of rule is a query of package query, each series of its result is compared with threshold
+// and becomes a separate alert. Alerts which became firing or resolved are sent to receiver of rule route
+// (or the default route), grouped by group_by labels.
+package alerting
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/renatus-cartesius/metricserv/pkg/query"
+)
+
+const (
+	OpGreater      = ">"
+	OpGreaterEqual = ">="
+	OpLess         = "<"
+	OpLessEqual    = "<="
+	OpEqual        = "=="
+	OpNotEqual     = "!="
+)
+
+var AllowedOps = []string{OpGreater, OpGreaterEqual, OpLess, OpLessEqual, OpEqual, OpNotEqual}
+
+var (
+	ErrInvalidRule    = errors.New("invalid alerting rule")
+	ErrDuplicatedRule = errors.New("duplicated alerting rule name")
+	ErrInvalidRoute   = errors.New("invalid notification route")
+)
+
+// Duration is a time.Duration unmarshalled from go duration string or number of seconds
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var raw string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		seconds, err := strconv.ParseFloat(string(data), 64)
+		if err != nil {
+			return fmt.Errorf("invalid duration %s", data)
+		}
+		*d = Duration(seconds * float64(time.Second))
+		return nil
+	}
+
+	parsed, err := time.ParseDuration(raw)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Rule fires alert for each series of Expr result which value satisfies comparison with Threshold
+// for at least For duration
+type Rule struct {
+	Name        string            `json:"name"`
+	Expr        string            `json:"expr"`
+	Op          string            `json:"op"`
+	Threshold   float64           `json:"threshold"`
+	For         Duration          `json:"for,omitempty"`
+	Severity    string            `json:"severity,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Route       *Route            `json:"route,omitempty"`
+}
+
+// Route directs notifications of rule alerts to Receiver, alerts with equal GroupBy labels are sent together
+type Route struct {
+	Receiver string   `json:"receiver"`
+	GroupBy  []string `json:"group_by,omitempty"`
+}
+
+// Validate checks that rule is complete and its expression is parseable
+func (r *Rule) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("%w: empty name", ErrInvalidRule)
+	}
+	if !slices.Contains(AllowedOps, r.Op) {
+		return fmt.Errorf("%w %s: unknown comparison %q", ErrInvalidRule, r.Name, r.Op)
+	}
+	if r.For < 0 {
+		return fmt.Errorf("%w %s: negative for duration", ErrInvalidRule, r.Name)
+	}
+	if _, err := query.Parse(r.Expr); err != nil {
+		return fmt.Errorf("%w %s: %v", ErrInvalidRule, r.Name, err)
+	}
+	return nil
+}
+
+// Compare reports if value satisfies rule comparison
+func (r *Rule) Compare(value float64) bool {
+	switch r.Op {
+	case OpGreater:
+		return value > r.Threshold
+	case OpGreaterEqual:
+		return value >= r.Threshold
+	case OpLess:
+		return value < r.Threshold
+	case OpLessEqual:
+		return value <= r.Threshold
+	case OpEqual:
+		return value == r.Threshold
+	case OpNotEqual:
+		return value != r.Threshold
+	default:
+		return false
+	}
+}
+
+// RulesFile is a content of alerting rules file
+type RulesFile struct {
+	Receivers  []ReceiverConfig `json:"receivers,omitempty"`
+	Route      *Route           `json:"route,omitempty"`
+	Retry      RetryConfig      `json:"retry,omitempty"`
+	DeadLetter string           `json:"dead_letter,omitempty"`
+	Rules      []Rule           `json:"rules"`
+}
+
+// LoadRules reads and validates rules and notification settings from JSON file
+func LoadRules(path string) (*RulesFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file RulesFile
+	if err = json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	if err = file.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &file, nil
+}
+
+// Validate checks rules and that their routes refer to configured receivers
+func (f *RulesFile) Validate() error {
+	receivers := make(map[string]struct{}, len(f.Receivers))
+	for _, receiver := range f.Receivers {
+		if err := receiver.Validate(); err != nil {
+			return err
+		}
+		receivers[receiver.Name] = struct{}{}
+	}
+
+	validateRoute := func(route *Route) error {
+		if route == nil {
+			return nil
+		}
+		if _, ok := receivers[route.Receiver]; !ok {
+			return fmt.Errorf("%w: unknown receiver %q", ErrInvalidRoute, route.Receiver)
+		}
+		return nil
+	}
+
+	if err := validateRoute(f.Route); err != nil {
+		return err
+	}
+
+	names := make(map[string]struct{}, len(f.Rules))
+	for i := range f.Rules {
+		if err := f.Rules[i].Validate(); err != nil {
+			return err
+		}
+		if _, ok := names[f.Rules[i].Name]; ok {
+			return fmt.Errorf("%w: %s", ErrDuplicatedRule, f.Rules[i].Name)
+		}
+		names[f.Rules[i].Name] = struct{}{}
+
+		if err := validateRoute(f.Rules[i].Route); err != nil {
+			return fmt.Errorf("rule %s: %w", f.Rules[i].Name, err)
+		}
+	}
+
+	return nil
+}
@@ -4,6 +4,7 @@ package config
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"github.com/renatus-cartesius/metricserv/pkg/logger"
 	"log"
 	"os"
@@ -21,6 +22,31 @@ type ServerConfig struct {
 	HashKey        string
 	PrivateKey     string
 	TrustedSubnet  string
+
+	HistoryCapacity int
+
+	RetentionInterval int
+	RawRetention      int
+	MinuteRetention   int
+	HourRetention     int
+
+	AlertRulesPath string
+	AlertInterval  int
+	SilencesPath   string
+
+	IdempotencyWindow int
+
+	WALPath string
+	WALSync string
+
+	SnapshotsKeep  int
+	SnapshotFormat string
+
+	StorageShards int
+
+	GaugeStaleAfter int
+	GaugeEvictAfter int
+	ExpiryInterval  int
 }
 
 func LoadServerConfig() (*ServerConfig, error) {
@@ -38,6 +64,31 @@ func LoadServerConfig() (*ServerConfig, error) {
 		HashKey:        "",
 		PrivateKey:     "./private.pem",
 		TrustedSubnet:  "",
+
+		HistoryCapacity: 1000,
+
+		RetentionInterval: 60,
+		RawRetention:      3600,
+		MinuteRetention:   86400,
+		HourRetention:     2592000,
+
+		AlertRulesPath: "",
+		AlertInterval:  30,
+		SilencesPath:   "",
+
+		IdempotencyWindow: 0,
+
+		WALPath: "",
+		WALSync: "1000",
+
+		SnapshotsKeep:  3,
+		SnapshotFormat: "json",
+
+		StorageShards: 0,
+
+		GaugeStaleAfter: 0,
+		GaugeEvictAfter: 0,
+		ExpiryInterval:  60,
 	}
 
 	configPath := "./server.json"
@@ -84,10 +135,27 @@ func LoadServerConfig() (*ServerConfig, error) {
 	flag.BoolVar(&config.RestoreStorage, "r", defaults.RestoreStorage, "if true restoring server from file")
 	flag.StringVar(&config.ServerLogLevel, "l", defaults.ServerLogLevel, "logging level")
 	flag.StringVar(&config.SavePath, "f", defaults.SavePath, "path to storage file save")
-	flag.StringVar(&config.DBDsn, "d", defaults.DBDsn, "connection string to database")
+	flag.StringVar(&config.DBDsn, "d", defaults.DBDsn, "connection string to database, sqlite:// scheme selects embedded SQLite database file")
 	flag.StringVar(&config.HashKey, "k", defaults.HashKey, "key for hashing payload")
 	flag.StringVar(&config.PrivateKey, "p", defaults.PrivateKey, "private key")
 	flag.StringVar(&config.TrustedSubnet, "t", defaults.TrustedSubnet, "agents trusted subnet")
+	flag.IntVar(&config.HistoryCapacity, "history-capacity", defaults.HistoryCapacity, "count of samples kept per series in memory storage")
+	flag.IntVar(&config.RetentionInterval, "retention-interval", defaults.RetentionInterval, "interval of applying retention to stored samples in seconds")
+	flag.IntVar(&config.RawRetention, "raw-retention", defaults.RawRetention, "age of raw samples in seconds to roll them into aggregates")
+	flag.IntVar(&config.MinuteRetention, "minute-retention", defaults.MinuteRetention, "age of 1m aggregates in seconds to drop them")
+	flag.IntVar(&config.HourRetention, "hour-retention", defaults.HourRetention, "age of 1h aggregates in seconds to drop them")
+	flag.StringVar(&config.AlertRulesPath, "alert-rules", defaults.AlertRulesPath, "path to alerting rules file")
+	flag.IntVar(&config.AlertInterval, "alert-interval", defaults.AlertInterval, "interval of evaluating alerting rules in seconds")
+	flag.StringVar(&config.SilencesPath, "silences-path", defaults.SilencesPath, "path to alert silences file of memory storage, empty keeps silences only in memory")
+	flag.IntVar(&config.IdempotencyWindow, "idempotency-window", defaults.IdempotencyWindow, "window of deduplicating updates by idempotency key in seconds, responses are kept in storage for the window, 0 disables deduplication")
+	flag.StringVar(&config.WALPath, "wal-path", defaults.WALPath, "path to write-ahead log of memory storage, empty disables log")
+	flag.StringVar(&config.WALSync, "wal-sync", defaults.WALSync, "fsync policy of write-ahead log: always, never or interval in milliseconds")
+	flag.IntVar(&config.SnapshotsKeep, "snapshots-keep", defaults.SnapshotsKeep, "count of storage file snapshots kept as fallback for restoring")
+	flag.StringVar(&config.SnapshotFormat, "snapshot-format", defaults.SnapshotFormat, "format of storage file snapshots: json, proto or proto+zstd")
+	flag.IntVar(&config.StorageShards, "storage-shards", defaults.StorageShards, "count of memory storage shards, 0 uses storage with single lock")
+	flag.IntVar(&config.GaugeStaleAfter, "gauge-stale-after", defaults.GaugeStaleAfter, "period without updates in seconds after which gauge is stale, 0 disables staleness")
+	flag.IntVar(&config.GaugeEvictAfter, "gauge-evict-after", defaults.GaugeEvictAfter, "period without updates in seconds after which gauge is deleted, 0 disables eviction")
+	flag.IntVar(&config.ExpiryInterval, "expiry-interval", defaults.ExpiryInterval, "interval of evicting gauges in seconds")
 	flag.StringVar(&configPath, "config", "./server.json", "path to config file")
 
 	flag.Parse()
@@ -126,5 +194,106 @@ func LoadServerConfig() (*ServerConfig, error) {
 		config.TrustedSubnet = envTrustedSubnet
 	}
 
+	if envHistoryCapacity := os.Getenv("HISTORY_CAPACITY"); envHistoryCapacity != "" {
+		config.HistoryCapacity, err = strconv.Atoi(envHistoryCapacity)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if envRetentionInterval := os.Getenv("RETENTION_INTERVAL"); envRetentionInterval != "" {
+		config.RetentionInterval, err = strconv.Atoi(envRetentionInterval)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if envRawRetention := os.Getenv("RAW_RETENTION"); envRawRetention != "" {
+		config.RawRetention, err = strconv.Atoi(envRawRetention)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if envMinuteRetention := os.Getenv("MINUTE_RETENTION"); envMinuteRetention != "" {
+		config.MinuteRetention, err = strconv.Atoi(envMinuteRetention)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if envHourRetention := os.Getenv("HOUR_RETENTION"); envHourRetention != "" {
+		config.HourRetention, err = strconv.Atoi(envHourRetention)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if envAlertRulesPath := os.Getenv("ALERT_RULES"); envAlertRulesPath != "" {
+		config.AlertRulesPath = envAlertRulesPath
+	}
+	if envAlertInterval := os.Getenv("ALERT_INTERVAL"); envAlertInterval != "" {
+		config.AlertInterval, err = strconv.Atoi(envAlertInterval)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if envSilencesPath := os.Getenv("SILENCES_FILE_PATH"); envSilencesPath != "" {
+		config.SilencesPath = envSilencesPath
+	}
+
+	if envIdempotencyWindow := os.Getenv("IDEMPOTENCY_WINDOW"); envIdempotencyWindow != "" {
+		config.IdempotencyWindow, err = strconv.Atoi(envIdempotencyWindow)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if envWALPath, ok := os.LookupEnv("WAL_FILE_PATH"); ok {
+		config.WALPath = envWALPath
+	}
+	if envWALSync := os.Getenv("WAL_SYNC"); envWALSync != "" {
+		config.WALSync = envWALSync
+	}
+
+	if envSnapshotsKeep := os.Getenv("SNAPSHOTS_KEEP"); envSnapshotsKeep != "" {
+		config.SnapshotsKeep, err = strconv.Atoi(envSnapshotsKeep)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if envSnapshotFormat := os.Getenv("SNAPSHOT_FORMAT"); envSnapshotFormat != "" {
+		config.SnapshotFormat = envSnapshotFormat
+	}
+
+	if envStorageShards := os.Getenv("STORAGE_SHARDS"); envStorageShards != "" {
+		config.StorageShards, err = strconv.Atoi(envStorageShards)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if envGaugeStaleAfter := os.Getenv("GAUGE_STALE_AFTER"); envGaugeStaleAfter != "" {
+		config.GaugeStaleAfter, err = strconv.Atoi(envGaugeStaleAfter)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if envGaugeEvictAfter := os.Getenv("GAUGE_EVICT_AFTER"); envGaugeEvictAfter != "" {
+		config.GaugeEvictAfter, err = strconv.Atoi(envGaugeEvictAfter)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if envExpiryInterval := os.Getenv("EXPIRY_INTERVAL"); envExpiryInterval != "" {
+		config.ExpiryInterval, err = strconv.Atoi(envExpiryInterval)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if config.HistoryCapacity <= 0 {
+		return nil, fmt.Errorf("history capacity must be positive, got %d", config.HistoryCapacity)
+	}
+
 	return config, nil
 }
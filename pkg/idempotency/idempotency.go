@@ -0,0 +1,137 @@
+// Package idempotency providing deduplication of retried requests by client supplied idempotency keys.
+// Responses are remembered in storage.Storager for a window, duplicates get remembered response
+// instead of applying request again.
+package idempotency
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/renatus-cartesius/metricserv/pkg/storage"
+)
+
+const (
+	// Header is HTTP header and gRPC metadata key carrying idempotency key
+	Header = "Idempotency-Key"
+
+	// ReplayedHeader marks responses replayed for duplicated idempotency key
+	ReplayedHeader = "Idempotent-Replayed"
+
+	// MaxKeyLength limits size of keys remembered in storage
+	MaxKeyLength = 255
+)
+
+var (
+	ErrKeyReused  = errors.New("idempotency key is reused for another request")
+	ErrInvalidKey = errors.New("invalid idempotency key")
+)
+
+// Response is an outcome of request remembered for idempotency key
+type Response struct {
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// Store runs requests once per idempotency key within window
+type Store struct {
+	storage storage.Storager
+	window  time.Duration
+
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+// keyLock serializes requests with the same key, so duplicate arriving while original
+// is still in flight waits for its response instead of applying request concurrently
+type keyLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+func NewStore(s storage.Storager, window time.Duration) *Store {
+	return &Store{
+		storage: s,
+		window:  window,
+		locks:   make(map[string]*keyLock),
+	}
+}
+
+// Fingerprint returns digest identifying request payload
+func Fingerprint(parts ...[]byte) string {
+	hash := sha256.New()
+	for _, part := range parts {
+		hash.Write(part)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Do runs fn for the first request with key in scope, e.g. endpoint, and remembers its response if fn reports it
+// as final. Duplicates get remembered response with replayed set. Not remembered responses, e.g. server errors,
+// let client retry request with the same key. Response is returned along with error if request was applied,
+// but its response could not be remembered.
+func (st *Store) Do(ctx context.Context, scope, key, fingerprint string, fn func() (resp Response, remember bool)) (resp Response, replayed bool, err error) {
+	if key == "" || len(key) > MaxKeyLength {
+		return Response{}, false, ErrInvalidKey
+	}
+	key = scope + " " + key
+
+	unlock := st.lock(key)
+	defer unlock()
+
+	record, err := st.storage.IdempotencyKey(ctx, key)
+	switch {
+	case err == nil:
+		if record.Fingerprint != fingerprint {
+			return Response{}, false, ErrKeyReused
+		}
+		return Response{Status: record.Status, ContentType: record.ContentType, Body: record.Body}, true, nil
+	case !errors.Is(err, storage.ErrIdempotencyKeyNotFound):
+		return Response{}, false, err
+	}
+
+	resp, remember := fn()
+	if !remember {
+		return resp, false, nil
+	}
+
+	err = st.storage.SaveIdempotencyKey(ctx, storage.IdempotencyRecord{
+		Key:         key,
+		Fingerprint: fingerprint,
+		Status:      resp.Status,
+		ContentType: resp.ContentType,
+		Body:        resp.Body,
+		ExpiresAt:   time.Now().Add(st.window),
+	})
+
+	// request is already applied, so its response is returned even if it is not remembered
+	return resp, false, err
+}
+
+func (st *Store) lock(key string) func() {
+	st.mu.Lock()
+	l, ok := st.locks[key]
+	if !ok {
+		l = &keyLock{}
+		st.locks[key] = l
+	}
+	l.refs++
+	st.mu.Unlock()
+
+	l.mu.Lock()
+
+	return func() {
+		l.mu.Unlock()
+
+		st.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(st.locks, key)
+		}
+		st.mu.Unlock()
+	}
+}
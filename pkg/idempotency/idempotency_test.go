@@ -0,0 +1,96 @@
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/renatus-cartesius/metricserv/pkg/storage"
+)
+
+func TestStoreDo(t *testing.T) {
+	s, err := storage.NewMemStorage("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := NewStore(s, time.Minute)
+	ctx := context.Background()
+
+	var calls atomic.Int32
+	status := http.StatusInternalServerError
+	fn := func() (Response, bool) {
+		calls.Add(1)
+		return Response{Status: status, Body: []byte("body")}, status < http.StatusInternalServerError
+	}
+
+	if _, replayed, err := st.Do(ctx, "POST /updates/", "k", "f", fn); err != nil || replayed {
+		t.Fatalf("unexpected first call result: replayed %v, err %v", replayed, err)
+	}
+
+	status = http.StatusOK
+
+	var wg sync.WaitGroup
+	var replays atomic.Int32
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			resp, replayed, err := st.Do(ctx, "POST /updates/", "k", "f", fn)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if resp.Status != http.StatusOK || string(resp.Body) != "body" {
+				t.Errorf("unexpected response %+v", resp)
+			}
+			if replayed {
+				replays.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls.Load() != 2 || replays.Load() != 4 {
+		t.Errorf("server error must not be remembered and retries must be applied once, got %d calls and %d replays", calls.Load(), replays.Load())
+	}
+
+	if _, _, err = st.Do(ctx, "POST /updates/", "k", "other", fn); !errors.Is(err, ErrKeyReused) {
+		t.Errorf("expected ErrKeyReused, got %v", err)
+	}
+	if _, replayed, err := st.Do(ctx, "POST /update/", "k", "other", fn); err != nil || replayed {
+		t.Errorf("key must be scoped, got replayed %v, err %v", replayed, err)
+	}
+	if _, _, err = st.Do(ctx, "POST /updates/", "", "f", fn); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("expected ErrInvalidKey, got %v", err)
+	}
+}
+
+func TestStoreExpiry(t *testing.T) {
+	s, err := storage.NewMemStorage("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := NewStore(s, time.Millisecond)
+	ctx := context.Background()
+
+	fn := func() (Response, bool) {
+		return Response{Status: http.StatusOK}, true
+	}
+
+	if _, _, err = st.Do(ctx, "POST /updates/", "k", "f", fn); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	if _, replayed, err := st.Do(ctx, "POST /updates/", "k", "f", fn); err != nil || replayed {
+		t.Errorf("expired key must not be replayed, got replayed %v, err %v", replayed, err)
+	}
+}
@@ -3,9 +3,10 @@ package metrics
 import "fmt"
 
 type CounterMetric struct {
-	ID    string `json:"id"`
-	Value int64  `json:"value"`
-	Type  string `json:"type"`
+	ID     string            `json:"id"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  int64             `json:"value"`
+	Type   string            `json:"type"`
 }
 
 func NewCounter(id string, value int64) *CounterMetric {
@@ -20,12 +21,20 @@ func (m CounterMetric) GetID() string {
 	return m.ID
 }
 
+func (m *CounterMetric) GetLabels() map[string]string {
+	return m.Labels
+}
+
 func (m *CounterMetric) String() string {
-	return fmt.Sprintf("%s:%s:%d", TypeCounter, m.ID, m.Value)
+	return fmt.Sprintf("%s:%s:%d", TypeCounter, SeriesKey(m.ID, m.Labels), m.Value)
 }
 
 func (m *CounterMetric) Change(value interface{}) error {
-	m.Value += value.(int64)
+	delta, ok := value.(int64)
+	if !ok {
+		return ErrWrongChangeType
+	}
+	m.Value += delta
 	return nil
 }
 
@@ -3,9 +3,10 @@ package metrics
 import "fmt"
 
 type GaugeMetric struct {
-	ID    string  `json:"id"`
-	Value float64 `json:"value"`
-	Type  string  `json:"type"`
+	ID     string            `json:"id"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+	Type   string            `json:"type"`
 }
 
 func NewGauge(id string, value float64) *GaugeMetric {
@@ -20,12 +21,20 @@ func (m *GaugeMetric) GetID() string {
 	return m.ID
 }
 
+func (m *GaugeMetric) GetLabels() map[string]string {
+	return m.Labels
+}
+
 func (m *GaugeMetric) Change(value interface{}) error {
-	m.Value = value.(float64)
+	v, ok := value.(float64)
+	if !ok {
+		return ErrWrongChangeType
+	}
+	m.Value = v
 	return nil
 }
 func (m GaugeMetric) String() string {
-	return fmt.Sprintf("%s:%s:%f", TypeGauge, m.ID, m.Value)
+	return fmt.Sprintf("%s:%s:%f", TypeGauge, SeriesKey(m.ID, m.Labels), m.Value)
 }
 
 func (m *GaugeMetric) GetValue() string {
@@ -0,0 +1,158 @@
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"go.uber.org/zap"
+
+	"github.com/renatus-cartesius/metricserv/pkg/logger"
+)
+
+var (
+	ErrBucketsMismatch = errors.New("histogram bucket boundaries are not matching")
+	ErrInvalidBuckets  = errors.New("histogram bucket boundaries must be sorted and unique")
+	ErrInvalidCounts   = errors.New("histogram counts must have one more element than bucket boundaries")
+	ErrWrongChangeType = errors.New("wrong type of value for changing metric")
+
+	// DefaultBuckets used for histograms created from single observations, when boundaries are not passed
+	DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+)
+
+// HistogramMetric counts observations in buckets with configurable upper bounds. Counts are not cumulative:
+// Counts[i] is the number of observations in (Buckets[i-1], Buckets[i]], and the last element of Counts
+// holds observations greater than the last boundary (+Inf bucket).
+type HistogramMetric struct {
+	ID      string            `json:"id"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Buckets []float64         `json:"buckets"`
+	Counts  []uint64          `json:"counts"`
+	Sum     float64           `json:"sum"`
+	Count   uint64            `json:"count"`
+	Type    string            `json:"type"`
+}
+
+func NewHistogram(id string, buckets []float64) *HistogramMetric {
+	return &HistogramMetric{
+		ID:      id,
+		Buckets: slices.Clone(buckets),
+		Counts:  make([]uint64, len(buckets)+1),
+		Type:    TypeHistogram,
+	}
+}
+
+// ValidateHistogram checks that bucket boundaries are finite and sorted and counts are matching them
+func ValidateHistogram(buckets []float64, counts []uint64) error {
+	for i := range buckets {
+		if checkFinite(buckets[i]) != nil || i > 0 && buckets[i] <= buckets[i-1] {
+			return ErrInvalidBuckets
+		}
+	}
+	if len(counts) != len(buckets)+1 {
+		return ErrInvalidCounts
+	}
+	return nil
+}
+
+func (m *HistogramMetric) GetID() string {
+	return m.ID
+}
+
+func (m *HistogramMetric) GetLabels() map[string]string {
+	return m.Labels
+}
+
+// Observe adds single observation to histogram, non-finite value is rejected with ErrNonFiniteValue
+func (m *HistogramMetric) Observe(value float64) error {
+	if err := checkFinite(value); err != nil {
+		return err
+	}
+
+	i, _ := slices.BinarySearch(m.Buckets, value)
+	m.Counts[i]++
+	m.Sum += value
+	m.Count++
+
+	return nil
+}
+
+// Merge adds counts of another histogram with the same bucket boundaries, histogram is not changed
+// if sum of other one is not finite or merged sum overflows
+func (m *HistogramMetric) Merge(other *HistogramMetric) error {
+	if !slices.Equal(m.Buckets, other.Buckets) || len(m.Counts) != len(other.Counts) {
+		return ErrBucketsMismatch
+	}
+
+	sum := m.Sum + other.Sum
+	if checkFinite(other.Sum) != nil || checkFinite(sum) != nil {
+		return ErrNonFiniteValue
+	}
+
+	for i, c := range other.Counts {
+		m.Counts[i] += c
+	}
+	m.Sum = sum
+	m.Count += other.Count
+
+	return nil
+}
+
+// Change merges another *HistogramMetric or observes single float64 value
+func (m *HistogramMetric) Change(value interface{}) error {
+	switch v := value.(type) {
+	case *HistogramMetric:
+		return m.Merge(v)
+	case float64:
+		return m.Observe(v)
+	default:
+		return ErrWrongChangeType
+	}
+}
+
+func (m *HistogramMetric) String() string {
+	return fmt.Sprintf("%s:%s:count=%d,sum=%f", TypeHistogram, SeriesKey(m.ID, m.Labels), m.Count, m.Sum)
+}
+
+// GetValue returns JSON with buckets, counts, sum and count of histogram, error of marshaling is logged
+// and empty value is returned
+func (m *HistogramMetric) GetValue() string {
+	value, err := json.Marshal(struct {
+		Buckets []float64 `json:"buckets"`
+		Counts  []uint64  `json:"counts"`
+		Sum     float64   `json:"sum"`
+		Count   uint64    `json:"count"`
+	}{m.Buckets, m.Counts, m.Sum, m.Count})
+	if err != nil {
+		logger.Log.Error(
+			"error on marshaling histogram value",
+			zap.String("key", SeriesKey(m.ID, m.Labels)),
+			zap.Error(err),
+		)
+		return ""
+	}
+	return string(value)
+}
+
+func (m *HistogramMetric) GetType() string {
+	return TypeHistogram
+}
+
+// ParseHistogramValue restores histogram from value returned by HistogramMetric.GetValue
+func ParseHistogramValue(id, value string) (*HistogramMetric, error) {
+	histogram := &HistogramMetric{
+		ID:   id,
+		Type: TypeHistogram,
+	}
+
+	if err := json.Unmarshal([]byte(value), histogram); err != nil {
+		return nil, err
+	}
+
+	if err := ValidateHistogram(histogram.Buckets, histogram.Counts); err != nil {
+		return nil, err
+	}
+
+	return histogram, nil
+}
@@ -0,0 +1,161 @@
+package metrics
+
+import (
+	"errors"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	MatchEqual     = "="
+	MatchNotEqual  = "!="
+	MatchRegexp    = "=~"
+	MatchNotRegexp = "!~"
+)
+
+var (
+	ErrInvalidLabelName = errors.New("invalid label name")
+	ErrInvalidMatcher   = errors.New("invalid label matcher")
+
+	labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// SeriesKey builds storage key of metric from its name and label set. Labels are sorted by name,
+// so the same label set always gives the same key. Metric without labels is keyed by its name only.
+func SeriesKey(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	var key strings.Builder
+	key.WriteString(name)
+	key.WriteString(FormatLabels(labels))
+
+	return key.String()
+}
+
+// FormatLabels formats label set as {name="value",...} sorted by label names
+func FormatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var b strings.Builder
+	b.WriteString("{")
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(name)
+		b.WriteString("=\"")
+		b.WriteString(escapeLabelValue(labels[name]))
+		b.WriteString("\"")
+	}
+	b.WriteString("}")
+
+	return b.String()
+}
+
+// ValidateLabels checks that all label names are matching [a-zA-Z_][a-zA-Z0-9_]*
+func ValidateLabels(labels map[string]string) error {
+	for name := range labels {
+		if !labelNameRe.MatchString(name) {
+			return ErrInvalidLabelName
+		}
+	}
+	return nil
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// LabelMatcher matches label value of a metric with one of operations: =, !=, =~, !~
+type LabelMatcher struct {
+	Name  string
+	Op    string
+	Value string
+	re    *regexp.Regexp
+}
+
+func NewLabelMatcher(name, op, value string) (*LabelMatcher, error) {
+	if !labelNameRe.MatchString(name) {
+		return nil, ErrInvalidLabelName
+	}
+
+	m := &LabelMatcher{
+		Name:  name,
+		Op:    op,
+		Value: value,
+	}
+
+	switch op {
+	case MatchEqual, MatchNotEqual:
+	case MatchRegexp, MatchNotRegexp:
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, err
+		}
+		m.re = re
+	default:
+		return nil, ErrInvalidMatcher
+	}
+
+	return m, nil
+}
+
+// ParseLabelMatcher parses matcher in form of name<op>value, e.g. host=~web-.*
+func ParseLabelMatcher(s string) (*LabelMatcher, error) {
+	i := strings.IndexAny(s, "=!")
+	if i <= 0 {
+		return nil, ErrInvalidMatcher
+	}
+
+	name, rest := s[:i], s[i:]
+	for _, op := range []string{MatchRegexp, MatchNotRegexp, MatchNotEqual, MatchEqual} {
+		if strings.HasPrefix(rest, op) {
+			return NewLabelMatcher(name, op, strings.TrimPrefix(rest, op))
+		}
+	}
+
+	return nil, ErrInvalidMatcher
+}
+
+// Matches checks if label set satisfies matcher. Missing label is treated as empty value.
+func (m *LabelMatcher) Matches(labels map[string]string) bool {
+	value := labels[m.Name]
+
+	switch m.Op {
+	case MatchEqual:
+		return value == m.Value
+	case MatchNotEqual:
+		return value != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(value)
+	case MatchNotRegexp:
+		return !m.re.MatchString(value)
+	}
+
+	return false
+}
+
+func (m *LabelMatcher) String() string {
+	return m.Name + m.Op + "\"" + escapeLabelValue(m.Value) + "\""
+}
+
+// MatchAll checks if label set satisfies all of the matchers
+func MatchAll(labels map[string]string, matchers []*LabelMatcher) bool {
+	for _, m := range matchers {
+		if !m.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
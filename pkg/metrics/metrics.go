@@ -1,22 +1,42 @@
-// Package metrics providing common Metric interface and some its implementations (GaugeMetric, CounterMetric)
+// Package metrics providing common Metric interface and some its implementations (GaugeMetric, CounterMetric, HistogramMetric, SummaryMetric)
 package metrics
 
+import (
+	"errors"
+	"math"
+)
+
 const (
-	TypeGauge   = "gauge"
-	TypeCounter = "counter"
+	TypeGauge     = "gauge"
+	TypeCounter   = "counter"
+	TypeHistogram = "histogram"
+	TypeSummary   = "summary"
 )
 
 var (
 	AllowedTypes = []string{
 		TypeCounter,
 		TypeGauge,
+		TypeHistogram,
+		TypeSummary,
 	}
+
+	ErrNonFiniteValue = errors.New("observed value must be finite")
 )
 
+// checkFinite rejects NaN and infinite observations, which would break sum of histogram and indexing of sketch
+func checkFinite(value float64) error {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return ErrNonFiniteValue
+	}
+	return nil
+}
+
 type Metric interface {
 	String() string
 	Change(interface{}) error
 	GetValue() string
 	GetType() string
 	GetID() string
+	GetLabels() map[string]string
 }
@@ -2,6 +2,7 @@ package metrics
 
 import (
 	"fmt"
+	"math"
 	"testing"
 )
 
@@ -36,3 +37,205 @@ func TestNewCounterMetric(t *testing.T) {
 
 	fmt.Println(metric)
 }
+
+func TestSeriesKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		id     string
+		labels map[string]string
+		want   string
+	}{
+		{
+			name: "without labels",
+			id:   "cpu_usage",
+			want: "cpu_usage",
+		},
+		{
+			name:   "sorted labels",
+			id:     "cpu_usage",
+			labels: map[string]string{"region": "eu", "host": "h1"},
+			want:   `cpu_usage{host="h1",region="eu"}`,
+		},
+		{
+			name:   "escaped value",
+			id:     "cpu_usage",
+			labels: map[string]string{"host": `h"1`},
+			want:   `cpu_usage{host="h\"1"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SeriesKey(tt.id, tt.labels); got != tt.want {
+				t.Errorf("SeriesKey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLabelMatcher(t *testing.T) {
+	labels := map[string]string{"host": "web-1", "region": "eu"}
+
+	tests := []struct {
+		matcher string
+		want    bool
+		wantErr bool
+	}{
+		{matcher: "host=web-1", want: true},
+		{matcher: "host!=web-1", want: false},
+		{matcher: "host=~web-.*", want: true},
+		{matcher: "region!~e.*", want: false},
+		{matcher: "zone=", want: true},
+		{matcher: "=web-1", wantErr: true},
+		{matcher: "host", wantErr: true},
+		{matcher: "host=~(", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.matcher, func(t *testing.T) {
+			m, err := ParseLabelMatcher(tt.matcher)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseLabelMatcher() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := m.Matches(labels); got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistogramMetric(t *testing.T) {
+	histogram := NewHistogram("latency", []float64{0.1, 1})
+
+	for _, v := range []float64{0.05, 0.1, 0.5, 5} {
+		if err := histogram.Change(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	other := NewHistogram("latency", []float64{0.1, 1})
+	other.Observe(2)
+
+	if err := histogram.Change(other); err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(histogram.Counts) != "[2 1 2]" || histogram.Count != 5 || histogram.Sum != 7.65 {
+		t.Errorf("unexpected histogram state: %v", histogram.GetValue())
+	}
+
+	if err := histogram.Change(NewHistogram("latency", []float64{1})); err != ErrBucketsMismatch {
+		t.Errorf("expected ErrBucketsMismatch, got %v", err)
+	}
+
+	parsed, err := ParseHistogramValue("latency", histogram.GetValue())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.GetValue() != histogram.GetValue() {
+		t.Errorf("histogram value changed after parsing: %v", parsed.GetValue())
+	}
+}
+
+func TestSummaryMetric(t *testing.T) {
+	first := NewSummary("latency")
+	second := NewSummary("latency")
+
+	for i := 1; i <= 10000; i++ {
+		if i%2 == 0 {
+			first.Change(float64(i))
+		} else {
+			second.Change(float64(i))
+		}
+	}
+
+	if err := first.Change(second); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, q := range []float64{0.5, 0.9, 0.99} {
+		got, err := first.Quantile(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := q * 10000
+		if math.Abs(got-want)/want > 0.02 {
+			t.Errorf("quantile %v = %v, want %v within 2%%", q, got, want)
+		}
+	}
+
+	restored, err := ParseSummaryValue("latency", first.GetValue())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.GetValue() != first.GetValue() {
+		t.Errorf("summary value changed after parsing")
+	}
+
+	if err := first.Change(&Sketch{RelativeAccuracy: 0.05}); err != ErrSketchMismatch {
+		t.Errorf("expected ErrSketchMismatch, got %v", err)
+	}
+
+	if _, err := NewSummary("empty").Quantile(0.5); err != ErrEmptySketch {
+		t.Errorf("expected ErrEmptySketch, got %v", err)
+	}
+}
+
+func TestNonFiniteObservations(t *testing.T) {
+	for _, v := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		histogram := NewHistogram("latency", []float64{0.1, 1})
+		if err := histogram.Change(v); err != ErrNonFiniteValue {
+			t.Errorf("histogram observed %v: %v", v, err)
+		}
+		if histogram.Count != 0 || histogram.Sum != 0 {
+			t.Errorf("histogram is changed by %v: %v", v, histogram.GetValue())
+		}
+
+		delta := NewHistogram("latency", []float64{0.1, 1})
+		delta.Counts[0], delta.Count, delta.Sum = 1, 1, v
+		if err := histogram.Change(delta); err != ErrNonFiniteValue {
+			t.Errorf("histogram merged sum %v: %v", v, err)
+		}
+		if histogram.Count != 0 || histogram.Sum != 0 {
+			t.Errorf("histogram is changed by merging sum %v: %v", v, histogram.GetValue())
+		}
+		if err := ValidateHistogram([]float64{0.1, v}, make([]uint64, 3)); err != ErrInvalidBuckets {
+			t.Errorf("histogram with bucket %v is valid: %v", v, err)
+		}
+
+		summary := NewSummary("latency")
+		if err := summary.Change(v); err != ErrNonFiniteValue {
+			t.Errorf("summary observed %v: %v", v, err)
+		}
+		if err := summary.Change([]float64{1, v}); err != ErrNonFiniteValue {
+			t.Errorf("summary observed %v in batch: %v", v, err)
+		}
+		if summary.Sketch.Count != 0 {
+			t.Errorf("summary is changed by %v: %v", v, summary.GetValue())
+		}
+
+		sketch := NewSketch(DefaultRelativeAccuracy)
+		sketch.Zero, sketch.Count, sketch.Sum = 1, 1, v
+		if err := summary.Change(sketch); err != ErrNonFiniteValue {
+			t.Errorf("summary merged sketch with sum %v: %v", v, err)
+		}
+		if summary.Sketch.Count != 0 {
+			t.Errorf("summary is changed by merging sum %v: %v", v, summary.GetValue())
+		}
+	}
+
+	// sums overflowing on merge are rejected as well
+	histogram := NewHistogram("latency", []float64{1})
+	delta := NewHistogram("latency", []float64{1})
+	delta.Counts[1], delta.Count, delta.Sum = 1, 1, math.MaxFloat64
+	if err := histogram.Merge(delta); err != nil {
+		t.Fatal(err)
+	}
+	if err := histogram.Merge(delta); err != ErrNonFiniteValue {
+		t.Errorf("histogram merged overflowing sum: %v", err)
+	}
+	if histogram.Count != 1 || histogram.Sum != math.MaxFloat64 {
+		t.Errorf("histogram is changed by overflowing sum: %v", histogram.GetValue())
+	}
+}
@@ -0,0 +1,191 @@
+package metrics
+
+import (
+	"errors"
+	"math"
+	"slices"
+)
+
+const (
+	// DefaultRelativeAccuracy is a relative error of quantiles estimated by Sketch
+	DefaultRelativeAccuracy = 0.01
+
+	// minIndexableValue is the smallest absolute value tracked in bins, lesser values are counted as zeros
+	minIndexableValue = 1e-9
+)
+
+var (
+	ErrSketchMismatch  = errors.New("sketches with different relative accuracy cannot be merged")
+	ErrEmptySketch     = errors.New("sketch has no observations")
+	ErrInvalidQuantile = errors.New("quantile must be in [0, 1] range")
+	ErrInvalidSketch   = errors.New("sketch relative accuracy must be in (0, 1) range")
+)
+
+// Sketch is a DDSketch streaming quantile estimator with relative accuracy guarantee.
+// Values are counted in logarithmic bins, so sketches with the same relative accuracy are mergeable
+// without any loss of accuracy: merge just adds counts of the bins.
+type Sketch struct {
+	RelativeAccuracy float64        `json:"relativeAccuracy"`
+	Positive         map[int]uint64 `json:"positive,omitempty"`
+	Negative         map[int]uint64 `json:"negative,omitempty"`
+	Zero             uint64         `json:"zero,omitempty"`
+	Count            uint64         `json:"count"`
+	Sum              float64        `json:"sum"`
+	Min              float64        `json:"min"`
+	Max              float64        `json:"max"`
+}
+
+func NewSketch(relativeAccuracy float64) *Sketch {
+	return &Sketch{
+		RelativeAccuracy: relativeAccuracy,
+		Positive:         make(map[int]uint64),
+		Negative:         make(map[int]uint64),
+	}
+}
+
+// Validate checks that sketch relative accuracy is in (0, 1) range
+func (s *Sketch) Validate() error {
+	if s.RelativeAccuracy <= 0 || s.RelativeAccuracy >= 1 {
+		return ErrInvalidSketch
+	}
+	return nil
+}
+
+func (s *Sketch) gamma() float64 {
+	return (1 + s.RelativeAccuracy) / (1 - s.RelativeAccuracy)
+}
+
+func (s *Sketch) index(value float64) int {
+	return int(math.Ceil(math.Log(value) / math.Log(s.gamma())))
+}
+
+func (s *Sketch) binValue(index int) float64 {
+	gamma := s.gamma()
+	return 2 * math.Pow(gamma, float64(index)) / (gamma + 1)
+}
+
+// Add adds single observation to sketch, non-finite value is rejected with ErrNonFiniteValue
+func (s *Sketch) Add(value float64) error {
+	if err := checkFinite(value); err != nil {
+		return err
+	}
+
+	switch {
+	case value > minIndexableValue:
+		if s.Positive == nil {
+			s.Positive = make(map[int]uint64)
+		}
+		s.Positive[s.index(value)]++
+	case value < -minIndexableValue:
+		if s.Negative == nil {
+			s.Negative = make(map[int]uint64)
+		}
+		s.Negative[s.index(-value)]++
+	default:
+		s.Zero++
+	}
+
+	if s.Count == 0 || value < s.Min {
+		s.Min = value
+	}
+	if s.Count == 0 || value > s.Max {
+		s.Max = value
+	}
+	s.Count++
+	s.Sum += value
+
+	return nil
+}
+
+// Merge adds all observations of other sketch with the same relative accuracy, sketch is not changed
+// if min, max or sum of other one is not finite or merged sum overflows
+func (s *Sketch) Merge(other *Sketch) error {
+	if s.RelativeAccuracy != other.RelativeAccuracy {
+		return ErrSketchMismatch
+	}
+
+	if other.Count == 0 {
+		return nil
+	}
+
+	sum := s.Sum + other.Sum
+	if checkFinite(other.Min) != nil || checkFinite(other.Max) != nil || checkFinite(sum) != nil {
+		return ErrNonFiniteValue
+	}
+
+	if s.Positive == nil {
+		s.Positive = make(map[int]uint64)
+	}
+	for i, c := range other.Positive {
+		s.Positive[i] += c
+	}
+
+	if s.Negative == nil {
+		s.Negative = make(map[int]uint64)
+	}
+	for i, c := range other.Negative {
+		s.Negative[i] += c
+	}
+
+	if s.Count == 0 || other.Min < s.Min {
+		s.Min = other.Min
+	}
+	if s.Count == 0 || other.Max > s.Max {
+		s.Max = other.Max
+	}
+	s.Zero += other.Zero
+	s.Count += other.Count
+	s.Sum = sum
+
+	return nil
+}
+
+// Quantile estimates value at quantile q within sketch relative accuracy
+func (s *Sketch) Quantile(q float64) (float64, error) {
+	if q < 0 || q > 1 || math.IsNaN(q) {
+		return 0, ErrInvalidQuantile
+	}
+	if s.Count == 0 {
+		return 0, ErrEmptySketch
+	}
+
+	rank := q * float64(s.Count-1)
+	var cumulative float64
+
+	// the most negative values have the biggest indexes
+	negative := sortedIndexes(s.Negative)
+	slices.Reverse(negative)
+	for _, i := range negative {
+		cumulative += float64(s.Negative[i])
+		if cumulative > rank {
+			return s.clamp(-s.binValue(i)), nil
+		}
+	}
+
+	cumulative += float64(s.Zero)
+	if cumulative > rank {
+		return s.clamp(0), nil
+	}
+
+	for _, i := range sortedIndexes(s.Positive) {
+		cumulative += float64(s.Positive[i])
+		if cumulative > rank {
+			return s.clamp(s.binValue(i)), nil
+		}
+	}
+
+	return s.Max, nil
+}
+
+func (s *Sketch) clamp(value float64) float64 {
+	return math.Max(s.Min, math.Min(s.Max, value))
+}
+
+func sortedIndexes(bins map[int]uint64) []int {
+	indexes := make([]int, 0, len(bins))
+	for i := range bins {
+		indexes = append(indexes, i)
+	}
+	slices.Sort(indexes)
+	return indexes
+}
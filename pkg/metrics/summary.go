@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"go.uber.org/zap"
+
+	"github.com/renatus-cartesius/metricserv/pkg/logger"
+)
+
+var (
+	// SummaryQuantiles are quantiles reported for summary metrics when no quantile is requested explicitly
+	SummaryQuantiles = []float64{0.5, 0.9, 0.99}
+)
+
+// SummaryMetric keeps streaming quantile Sketch of all reported observations
+type SummaryMetric struct {
+	ID     string            `json:"id"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Sketch *Sketch           `json:"sketch"`
+	Type   string            `json:"type"`
+}
+
+func NewSummary(id string) *SummaryMetric {
+	return &SummaryMetric{
+		ID:     id,
+		Sketch: NewSketch(DefaultRelativeAccuracy),
+		Type:   TypeSummary,
+	}
+}
+
+func (m *SummaryMetric) GetID() string {
+	return m.ID
+}
+
+func (m *SummaryMetric) GetLabels() map[string]string {
+	return m.Labels
+}
+
+// Change merges another *SummaryMetric or *Sketch, observes single float64 value or []float64 values
+func (m *SummaryMetric) Change(value interface{}) error {
+	switch v := value.(type) {
+	case *SummaryMetric:
+		return m.Sketch.Merge(v.Sketch)
+	case *Sketch:
+		return m.Sketch.Merge(v)
+	case float64:
+		return m.Sketch.Add(v)
+	case []float64:
+		// observations are checked first, so invalid batch is not applied partially
+		for _, observation := range v {
+			if err := checkFinite(observation); err != nil {
+				return err
+			}
+		}
+		for _, observation := range v {
+			m.Sketch.Add(observation)
+		}
+		return nil
+	default:
+		return ErrWrongChangeType
+	}
+}
+
+// Quantile estimates value at quantile q of all observations
+func (m *SummaryMetric) Quantile(q float64) (float64, error) {
+	return m.Sketch.Quantile(q)
+}
+
+func (m *SummaryMetric) String() string {
+	result := fmt.Sprintf("%s:%s:count=%d,sum=%f", TypeSummary, SeriesKey(m.ID, m.Labels), m.Sketch.Count, m.Sketch.Sum)
+	for _, q := range SummaryQuantiles {
+		if value, err := m.Quantile(q); err == nil {
+			result += fmt.Sprintf(",q%v=%f", q, value)
+		}
+	}
+	return result
+}
+
+// GetValue returns JSON of the underlying sketch
+// GetValue returns JSON of sketch of summary, error of marshaling is logged and empty value is returned
+func (m *SummaryMetric) GetValue() string {
+	value, err := json.Marshal(m.Sketch)
+	if err != nil {
+		logger.Log.Error(
+			"error on marshaling summary value",
+			zap.String("key", SeriesKey(m.ID, m.Labels)),
+			zap.Error(err),
+		)
+		return ""
+	}
+	return string(value)
+}
+
+func (m *SummaryMetric) GetType() string {
+	return TypeSummary
+}
+
+// ParseSummaryValue restores summary from value returned by SummaryMetric.GetValue
+func ParseSummaryValue(id, value string) (*SummaryMetric, error) {
+	summary := &SummaryMetric{
+		ID:     id,
+		Sketch: &Sketch{},
+		Type:   TypeSummary,
+	}
+
+	if err := json.Unmarshal([]byte(value), summary.Sketch); err != nil {
+		return nil, err
+	}
+
+	if err := summary.Sketch.Validate(); err != nil {
+		return nil, err
+	}
+
+	return summary, nil
+}
@@ -0,0 +1,322 @@
+package query
+
+import (
+	"context"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/renatus-cartesius/metricserv/pkg/metrics"
+	"github.com/renatus-cartesius/metricserv/pkg/storage"
+)
+
+const (
+	// DefaultLookback is a window in which the latest sample is taken as a value of instant vector selector
+	DefaultLookback = 5 * time.Minute
+
+	// maxPoints limits count of evaluation steps of a range query
+	maxPoints = 11000
+)
+
+// Engine evaluates queries against storage
+type Engine struct {
+	storage  storage.Storager
+	lookback time.Duration
+	now      func() time.Time
+}
+
+func NewEngine(s storage.Storager) *Engine {
+	return &Engine{
+		storage:  s,
+		lookback: DefaultLookback,
+		now:      time.Now,
+	}
+}
+
+// Query evaluates query at ts time
+func (e *Engine) Query(ctx context.Context, q string, ts time.Time) (Vector, error) {
+	expr, err := Parse(q)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.eval(ctx, expr, ts)
+}
+
+// QueryRange evaluates query at each step in [start, end] range
+func (e *Engine) QueryRange(ctx context.Context, q string, start, end time.Time, step time.Duration) (Matrix, error) {
+	if step <= 0 {
+		return nil, ErrInvalidStep
+	}
+	if end.Sub(start)/step > maxPoints {
+		return nil, ErrTooManyPoints
+	}
+
+	expr, err := Parse(q)
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(map[string]int)
+	matrix := make(Matrix, 0)
+
+	for ts := start; !ts.After(end); ts = ts.Add(step) {
+		vector, err := e.eval(ctx, expr, ts)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, sample := range vector {
+			key := metrics.FormatLabels(sample.Labels)
+			i, ok := index[key]
+			if !ok {
+				i = len(matrix)
+				index[key] = i
+				matrix = append(matrix, Series{Labels: sample.Labels})
+			}
+			matrix[i].Points = append(matrix[i].Points, Point{Timestamp: ts, Value: sample.Value})
+		}
+	}
+
+	slices.SortFunc(matrix, func(a, b Series) int {
+		return strings.Compare(metrics.FormatLabels(a.Labels), metrics.FormatLabels(b.Labels))
+	})
+
+	return matrix, nil
+}
+
+func (e *Engine) eval(ctx context.Context, expr Expr, ts time.Time) (Vector, error) {
+	switch ex := expr.(type) {
+	case *VectorSelector:
+		return e.evalSelector(ctx, ex, ts)
+	case *Call:
+		return e.evalCall(ctx, ex, ts)
+	case *Aggregation:
+		return e.evalAggregation(ctx, ex, ts)
+	default:
+		return nil, &ParseError{Msg: "unsupported expression " + expr.String()}
+	}
+}
+
+// selectSeries returns keys and metrics of all series matching selector
+func (e *Engine) selectSeries(ctx context.Context, vs *VectorSelector) ([]string, []metrics.Metric, error) {
+	selected, err := storage.Select(ctx, e.storage, vs.Name, vs.Matchers)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys := make([]string, 0, len(selected))
+	for _, metric := range selected {
+		keys = append(keys, metrics.SeriesKey(metric.GetID(), metric.GetLabels()))
+	}
+
+	return keys, selected, nil
+}
+
+func (e *Engine) evalSelector(ctx context.Context, vs *VectorSelector, ts time.Time) (Vector, error) {
+	keys, selected, err := e.selectSeries(ctx, vs)
+	if err != nil {
+		return nil, err
+	}
+
+	vector := make(Vector, 0, len(selected))
+	for i, metric := range selected {
+		samples, err := e.storage.History(ctx, keys[i], ts.Add(-e.lookback), ts)
+		if err != nil {
+			return nil, err
+		}
+
+		var value float64
+		switch {
+		case len(samples) > 0:
+			value = samples[len(samples)-1].Value
+		case e.now().Sub(ts) < e.lookback:
+			// metric could be set without recording history, its current value is still actual
+			var ok bool
+			if value, ok = currentValue(metric); !ok {
+				continue
+			}
+		default:
+			continue
+		}
+
+		labels := copyLabels(metric.GetLabels())
+		labels[NameLabel] = metric.GetID()
+
+		vector = append(vector, Sample{Labels: labels, Value: value})
+	}
+
+	return vector, nil
+}
+
+func currentValue(metric metrics.Metric) (float64, bool) {
+	if metric.GetType() != metrics.TypeCounter && metric.GetType() != metrics.TypeGauge {
+		return 0, false
+	}
+
+	value, err := strconv.ParseFloat(metric.GetValue(), 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return value, true
+}
+
+func (e *Engine) evalCall(ctx context.Context, call *Call, ts time.Time) (Vector, error) {
+	keys, selected, err := e.selectSeries(ctx, call.Arg.Selector)
+	if err != nil {
+		return nil, err
+	}
+
+	vector := make(Vector, 0, len(selected))
+	for i, metric := range selected {
+		samples, err := e.storage.History(ctx, keys[i], ts.Add(-call.Arg.Range), ts)
+		if err != nil {
+			return nil, err
+		}
+
+		value, ok, err := applyFunction(call.Func, samples, call.Arg.Range)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		vector = append(vector, Sample{Labels: copyLabels(metric.GetLabels()), Value: value})
+	}
+
+	return vector, nil
+}
+
+// applyFunction calculates function over samples ordered by time, reporting false if there is not enough samples
+func applyFunction(function string, samples []storage.Sample, rng time.Duration) (float64, bool, error) {
+	if len(samples) == 0 {
+		return 0, false, nil
+	}
+
+	switch function {
+	case "rate", "increase":
+		if len(samples) < 2 {
+			return 0, false, nil
+		}
+
+		var increase float64
+		for i := 1; i < len(samples); i++ {
+			delta := samples[i].Value - samples[i-1].Value
+			if delta < 0 {
+				// counter reset, counting from zero
+				delta = samples[i].Value
+			}
+			increase += delta
+		}
+
+		if function == "increase" {
+			return increase, true, nil
+		}
+		return increase / rng.Seconds(), true, nil
+	case "avg_over_time":
+		var sum float64
+		for _, s := range samples {
+			sum += s.Value
+		}
+		return sum / float64(len(samples)), true, nil
+	case "min_over_time":
+		value := math.Inf(1)
+		for _, s := range samples {
+			value = math.Min(value, s.Value)
+		}
+		return value, true, nil
+	case "max_over_time":
+		value := math.Inf(-1)
+		for _, s := range samples {
+			value = math.Max(value, s.Value)
+		}
+		return value, true, nil
+	case "sum_over_time":
+		var sum float64
+		for _, s := range samples {
+			sum += s.Value
+		}
+		return sum, true, nil
+	case "count_over_time":
+		return float64(len(samples)), true, nil
+	case "last_over_time":
+		return samples[len(samples)-1].Value, true, nil
+	default:
+		return 0, false, ErrUnknownFunction
+	}
+}
+
+func (e *Engine) evalAggregation(ctx context.Context, aggregation *Aggregation, ts time.Time) (Vector, error) {
+	vector, err := e.eval(ctx, aggregation.Expr, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	type group struct {
+		labels map[string]string
+		values []float64
+	}
+
+	groups := make(map[string]*group)
+	order := make([]string, 0)
+
+	for _, sample := range vector {
+		labels := make(map[string]string, len(aggregation.By))
+		for _, name := range aggregation.By {
+			if value, ok := sample.Labels[name]; ok {
+				labels[name] = value
+			}
+		}
+
+		key := metrics.FormatLabels(labels)
+		g, ok := groups[key]
+		if !ok {
+			g = &group{labels: labels}
+			groups[key] = g
+			order = append(order, key)
+		}
+		g.values = append(g.values, sample.Value)
+	}
+
+	slices.Sort(order)
+
+	result := make(Vector, 0, len(groups))
+	for _, key := range order {
+		g := groups[key]
+
+		var value float64
+		switch aggregation.Op {
+		case "sum", "avg":
+			for _, v := range g.values {
+				value += v
+			}
+			if aggregation.Op == "avg" {
+				value /= float64(len(g.values))
+			}
+		case "min":
+			value = slices.Min(g.values)
+		case "max":
+			value = slices.Max(g.values)
+		case "count":
+			value = float64(len(g.values))
+		default:
+			return nil, ErrUnknownAggregation
+		}
+
+		result = append(result, Sample{Labels: g.labels, Value: value})
+	}
+
+	return result, nil
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	result := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		result[k] = v
+	}
+	return result
+}
@@ -0,0 +1,362 @@
+package query
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/renatus-cartesius/metricserv/pkg/metrics"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenDuration
+	tokenPunct
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+var (
+	functions = []string{
+		"rate",
+		"increase",
+		"avg_over_time",
+		"min_over_time",
+		"max_over_time",
+		"sum_over_time",
+		"count_over_time",
+		"last_over_time",
+	}
+	aggregations = []string{
+		"sum",
+		"avg",
+		"min",
+		"max",
+		"count",
+	}
+)
+
+// ParseError describes position and reason of query syntax error
+type ParseError struct {
+	Pos int
+	Msg string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parse error at position %d: %s", e.Pos, e.Msg)
+}
+
+func isIdentRune(r rune, first bool) bool {
+	if r == '_' || r == ':' || unicode.IsLetter(r) && r < unicode.MaxASCII {
+		return true
+	}
+	return !first && r >= '0' && r <= '9'
+}
+
+func lex(input string) ([]token, error) {
+	tokens := make([]token, 0)
+
+	for i := 0; i < len(input); {
+		c := rune(input[i])
+
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case isIdentRune(c, true):
+			start := i
+			for i < len(input) && isIdentRune(rune(input[i]), false) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, value: input[start:i], pos: start})
+		case c == '"' || c == '\'':
+			start := i
+			i++
+			for i < len(input) && rune(input[i]) != c {
+				if input[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(input) {
+				return nil, &ParseError{Pos: start, Msg: "unterminated string"}
+			}
+			i++
+
+			raw := input[start:i]
+			if c == '\'' {
+				raw = "\"" + strings.ReplaceAll(raw[1:len(raw)-1], "\"", "\\\"") + "\""
+			}
+			value, err := strconv.Unquote(raw)
+			if err != nil {
+				return nil, &ParseError{Pos: start, Msg: "invalid string " + raw}
+			}
+			tokens = append(tokens, token{kind: tokenString, value: value, pos: start})
+		case c == '[':
+			start := i
+			end := strings.IndexByte(input[i:], ']')
+			if end < 0 {
+				return nil, &ParseError{Pos: start, Msg: "unterminated range"}
+			}
+			tokens = append(tokens, token{kind: tokenDuration, value: strings.TrimSpace(input[i+1 : i+end]), pos: start})
+			i += end + 1
+		case c == '=' || c == '!':
+			start := i
+			i++
+			if i < len(input) && (input[i] == '=' || input[i] == '~') {
+				i++
+			}
+			op := input[start:i]
+			if op == "!" {
+				return nil, &ParseError{Pos: start, Msg: "unexpected !"}
+			}
+			tokens = append(tokens, token{kind: tokenPunct, value: op, pos: start})
+		case strings.ContainsRune("{}(),", c):
+			tokens = append(tokens, token{kind: tokenPunct, value: string(c), pos: i})
+			i++
+		default:
+			return nil, &ParseError{Pos: i, Msg: fmt.Sprintf("unexpected character %q", c)}
+		}
+	}
+
+	return append(tokens, token{kind: tokenEOF, pos: len(input)}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Parse parses query to expression tree
+func Parse(input string) (Expr, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+
+	expr, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, &ParseError{Pos: t.pos, Msg: "unexpected " + t.value}
+	}
+
+	return expr, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expect(kind tokenKind, value string) (token, error) {
+	t := p.next()
+	if t.kind != kind || value != "" && t.value != value {
+		expected := value
+		if expected == "" {
+			expected = "identifier"
+		}
+		return t, &ParseError{Pos: t.pos, Msg: fmt.Sprintf("expected %s, got %q", expected, t.value)}
+	}
+	return t, nil
+}
+
+func (p *parser) parseExpr() (Expr, error) {
+	t, err := p.expect(tokenIdent, "")
+	if err != nil {
+		return nil, err
+	}
+
+	next := p.peek()
+	isCall := next.kind == tokenPunct && next.value == "("
+	isGrouped := next.kind == tokenIdent && next.value == "by"
+
+	switch {
+	case slices.Contains(aggregations, t.value) && (isCall || isGrouped):
+		return p.parseAggregation(t.value)
+	case slices.Contains(functions, t.value) && isCall:
+		return p.parseCall(t.value)
+	case isCall:
+		return nil, &ParseError{Pos: t.pos, Msg: fmt.Sprintf("%v: %s", ErrUnknownFunction, t.value)}
+	default:
+		return p.parseSelector(t.value)
+	}
+}
+
+func (p *parser) parseAggregation(op string) (Expr, error) {
+	aggregation := &Aggregation{Op: op}
+
+	var err error
+	if t := p.peek(); t.kind == tokenIdent && t.value == "by" {
+		p.next()
+		if aggregation.By, err = p.parseLabelList(); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err = p.expect(tokenPunct, "("); err != nil {
+		return nil, err
+	}
+	if aggregation.Expr, err = p.parseExpr(); err != nil {
+		return nil, err
+	}
+	if _, err = p.expect(tokenPunct, ")"); err != nil {
+		return nil, err
+	}
+
+	// by clause is allowed after aggregated expression as well
+	if t := p.peek(); aggregation.By == nil && t.kind == tokenIdent && t.value == "by" {
+		p.next()
+		if aggregation.By, err = p.parseLabelList(); err != nil {
+			return nil, err
+		}
+	}
+
+	return aggregation, nil
+}
+
+func (p *parser) parseLabelList() ([]string, error) {
+	if _, err := p.expect(tokenPunct, "("); err != nil {
+		return nil, err
+	}
+
+	labels := make([]string, 0)
+	for {
+		if t := p.peek(); t.kind == tokenPunct && t.value == ")" {
+			p.next()
+			return labels, nil
+		}
+
+		t, err := p.expect(tokenIdent, "")
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, t.value)
+
+		if t := p.peek(); t.kind == tokenPunct && t.value == "," {
+			p.next()
+		}
+	}
+}
+
+func (p *parser) parseCall(function string) (Expr, error) {
+	if _, err := p.expect(tokenPunct, "("); err != nil {
+		return nil, err
+	}
+
+	name, err := p.expect(tokenIdent, "")
+	if err != nil {
+		return nil, err
+	}
+
+	selector, err := p.parseSelector(name.value)
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.next()
+	if t.kind != tokenDuration {
+		return nil, &ParseError{Pos: t.pos, Msg: "expected range vector selector in " + function}
+	}
+	rng, err := parseDuration(t.value)
+	if err != nil {
+		return nil, &ParseError{Pos: t.pos, Msg: err.Error()}
+	}
+
+	if _, err = p.expect(tokenPunct, ")"); err != nil {
+		return nil, err
+	}
+
+	return &Call{
+		Func: function,
+		Arg: &MatrixSelector{
+			Selector: selector.(*VectorSelector),
+			Range:    rng,
+		},
+	}, nil
+}
+
+func (p *parser) parseSelector(name string) (Expr, error) {
+	selector := &VectorSelector{Name: name}
+
+	if t := p.peek(); t.kind != tokenPunct || t.value != "{" {
+		return selector, nil
+	}
+	p.next()
+
+	for {
+		if t := p.peek(); t.kind == tokenPunct && t.value == "}" {
+			p.next()
+			return selector, nil
+		}
+
+		label, err := p.expect(tokenIdent, "")
+		if err != nil {
+			return nil, err
+		}
+
+		op := p.next()
+		if op.kind != tokenPunct {
+			return nil, &ParseError{Pos: op.pos, Msg: "expected label matching operator"}
+		}
+
+		value, err := p.expect(tokenString, "")
+		if err != nil {
+			return nil, &ParseError{Pos: value.pos, Msg: "expected label value string"}
+		}
+
+		matcher, err := metrics.NewLabelMatcher(label.value, op.value, value.value)
+		if err != nil {
+			return nil, &ParseError{Pos: label.pos, Msg: err.Error()}
+		}
+		selector.Matchers = append(selector.Matchers, matcher)
+
+		if t := p.peek(); t.kind == tokenPunct && t.value == "," {
+			p.next()
+		}
+	}
+}
+
+// parseDuration parses go durations with additional d (day) and w (week) units
+func parseDuration(s string) (time.Duration, error) {
+	for unit, d := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(s, unit); ok {
+			count, err := strconv.Atoi(n)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %s", s)
+			}
+			return time.Duration(count) * d, nil
+		}
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration must be positive: %s", s)
+	}
+
+	return d, nil
+}
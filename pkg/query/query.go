@@ -0,0 +1,111 @@
+// Package query implements small PromQL-like query language and its evaluator working over storage.Storager.
+//
+// Supported expressions:
+//
+//	cpu_usage{host="web-1",region=~"eu-.*"}         instant vector selector
+//	rate(requests_total{host="web-1"}[5m])          functions over range vector selector
+//	sum by (region) (avg_over_time(cpu_usage[10m])) aggregations of instant vectors
+//
+// Functions: rate, increase, avg_over_time, min_over_time, max_over_time, sum_over_time, count_over_time, last_over_time.
+// Aggregations: sum, avg, min, max, count with optional by (label, ...) clause.
+package query
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/renatus-cartesius/metricserv/pkg/metrics"
+)
+
+// NameLabel is a label holding metric name in results of selectors
+const NameLabel = "__name__"
+
+var (
+	ErrUnknownFunction    = errors.New("unknown function")
+	ErrUnknownAggregation = errors.New("unknown aggregation")
+	ErrInvalidStep        = errors.New("step of range query must be positive")
+	ErrTooManyPoints      = errors.New("range query exceeds maximum resolution, increase step")
+)
+
+// Expr is a node of parsed query
+type Expr interface {
+	String() string
+}
+
+// VectorSelector selects latest values of series with Name which labels satisfy all Matchers
+type VectorSelector struct {
+	Name     string
+	Matchers []*metrics.LabelMatcher
+}
+
+func (vs *VectorSelector) String() string {
+	if len(vs.Matchers) == 0 {
+		return vs.Name
+	}
+
+	matchers := make([]string, 0, len(vs.Matchers))
+	for _, m := range vs.Matchers {
+		matchers = append(matchers, m.String())
+	}
+	return vs.Name + "{" + strings.Join(matchers, ",") + "}"
+}
+
+// MatrixSelector selects samples of series in Range window
+type MatrixSelector struct {
+	Selector *VectorSelector
+	Range    time.Duration
+}
+
+func (ms *MatrixSelector) String() string {
+	return ms.Selector.String() + "[" + ms.Range.String() + "]"
+}
+
+// Call applies function to samples of range vector
+type Call struct {
+	Func string
+	Arg  *MatrixSelector
+}
+
+func (c *Call) String() string {
+	return c.Func + "(" + c.Arg.String() + ")"
+}
+
+// Aggregation aggregates instant vector, grouping series by labels listed in By
+type Aggregation struct {
+	Op   string
+	By   []string
+	Expr Expr
+}
+
+func (a *Aggregation) String() string {
+	by := ""
+	if len(a.By) > 0 {
+		by = " by (" + strings.Join(a.By, ", ") + ")"
+	}
+	return a.Op + by + " (" + a.Expr.String() + ")"
+}
+
+// Sample is a value of one series of instant vector
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// Vector is a result of instant query
+type Vector []Sample
+
+// Point is a value of series at some point of time
+type Point struct {
+	Timestamp time.Time
+	Value     float64
+}
+
+// Series is a result of range query for one label set
+type Series struct {
+	Labels map[string]string
+	Points []Point
+}
+
+// Matrix is a result of range query
+type Matrix []Series
@@ -0,0 +1,191 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/renatus-cartesius/metricserv/pkg/metrics"
+	"github.com/renatus-cartesius/metricserv/pkg/storage"
+)
+
+type historyStorage struct {
+	storage.Storager
+	metrics map[string]metrics.Metric
+	history map[string][]storage.Sample
+}
+
+func (s *historyStorage) ListAll(ctx context.Context) (map[string]metrics.Metric, error) {
+	return s.metrics, nil
+}
+
+func (s *historyStorage) Iterate(ctx context.Context, fn func(key string, metric metrics.Metric) error) error {
+	for key, metric := range s.metrics {
+		if err := fn(key, metric); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *historyStorage) History(ctx context.Context, id string, from, to time.Time) ([]storage.Sample, error) {
+	result := make([]storage.Sample, 0)
+	for _, sample := range s.history[id] {
+		if !sample.Timestamp.Before(from) && !sample.Timestamp.After(to) {
+			result = append(result, sample)
+		}
+	}
+	return result, nil
+}
+
+func newHistoryStorage(now time.Time) *historyStorage {
+	s := &historyStorage{
+		metrics: make(map[string]metrics.Metric),
+		history: make(map[string][]storage.Sample),
+	}
+
+	series := []struct {
+		host   string
+		region string
+		values []float64
+	}{
+		{host: "web-1", region: "eu", values: []float64{10, 20, 40, 5}},
+		{host: "web-2", region: "eu", values: []float64{0, 60, 120, 180}},
+		{host: "web-3", region: "us", values: []float64{100, 100, 100, 100}},
+	}
+
+	for _, ss := range series {
+		counter := metrics.NewCounter("requests_total", 0)
+		counter.Labels = map[string]string{"host": ss.host, "region": ss.region}
+		key := metrics.SeriesKey(counter.ID, counter.Labels)
+		s.metrics[key] = counter
+
+		for i, v := range ss.values {
+			s.history[key] = append(s.history[key], storage.Sample{
+				Timestamp: now.Add(time.Duration(i-len(ss.values)+1) * time.Minute),
+				Value:     v,
+			})
+		}
+	}
+
+	return s
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{query: "cpu_usage", want: "cpu_usage"},
+		{query: `cpu_usage{host="web-1", region=~'eu-.*'}`, want: `cpu_usage{host="web-1",region=~"eu-.*"}`},
+		{query: "rate(requests_total[5m])", want: "rate(requests_total[5m0s])"},
+		{query: `sum by (region) (avg_over_time(cpu{host!="db"}[1h]))`, want: `sum by (region) (avg_over_time(cpu{host!="db"}[1h0m0s]))`},
+		{query: "max(cpu) by (host)", want: "max by (host) (cpu)"},
+		{query: "count_over_time(cpu[1d])", want: "count_over_time(cpu[24h0m0s])"},
+		{query: "rate(cpu)", wantErr: true},
+		{query: "unknown(cpu[5m])", wantErr: true},
+		{query: `cpu{host="web-1"`, wantErr: true},
+		{query: `cpu{host=web}`, wantErr: true},
+		{query: "sum(cpu", wantErr: true},
+		{query: "cpu cpu", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			expr, err := Parse(tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && expr.String() != tt.want {
+				t.Errorf("Parse() = %v, want %v", expr, tt.want)
+			}
+		})
+	}
+}
+
+func TestEngineQuery(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	engine := NewEngine(newHistoryStorage(now))
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{
+			query: `requests_total{host="web-1"}`,
+			want:  `[{__name__="requests_total",host="web-1",region="eu"}=5]`,
+		},
+		{
+			query: `increase(requests_total{host="web-1"}[5m])`,
+			want:  `[{host="web-1",region="eu"}=35]`,
+		},
+		{
+			query: `rate(requests_total{host="web-2"}[5m])`,
+			want:  `[{host="web-2",region="eu"}=0.6]`,
+		},
+		{
+			query: `sum by (region) (rate(requests_total[5m]))`,
+			want:  `[{region="eu"}=0.7166666666666667 {region="us"}=0]`,
+		},
+		{
+			query: `max_over_time(requests_total{region="eu"}[2m])`,
+			want:  `[{host="web-1",region="eu"}=40 {host="web-2",region="eu"}=180]`,
+		},
+		{
+			query: `count(requests_total)`,
+			want:  `[{}=3]`,
+		},
+		{
+			query: `avg_over_time(requests_total{host=~"web-[13]"}[10m])`,
+			want:  `[{host="web-1",region="eu"}=18.75 {host="web-3",region="us"}=100]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			vector, err := engine.Query(context.Background(), tt.query, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := make([]string, 0, len(vector))
+			for _, sample := range vector {
+				got = append(got, fmt.Sprintf("%s=%v", formatLabels(sample.Labels), sample.Value))
+			}
+			if fmt.Sprint(got) != tt.want {
+				t.Errorf("Query() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEngineQueryRange(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	engine := NewEngine(newHistoryStorage(now))
+
+	matrix, err := engine.QueryRange(context.Background(), `requests_total{host="web-2"}`, now.Add(-2*time.Minute), now, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(matrix) != 1 || len(matrix[0].Points) != 3 {
+		t.Fatalf("unexpected matrix: %v", matrix)
+	}
+
+	for i, want := range []float64{60, 120, 180} {
+		if matrix[0].Points[i].Value != want {
+			t.Errorf("unexpected point %d: %v, want %v", i, matrix[0].Points[i].Value, want)
+		}
+	}
+
+	if _, err := engine.QueryRange(context.Background(), "requests_total", now, now, 0); err != ErrInvalidStep {
+		t.Errorf("expected ErrInvalidStep, got %v", err)
+	}
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return "{}"
+	}
+	return metrics.FormatLabels(labels)
+}
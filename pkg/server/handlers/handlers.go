@@ -2,6 +2,7 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"github.com/renatus-cartesius/metricserv/pkg/encryption"
@@ -9,14 +10,21 @@ import (
 	"net/http"
 	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
 	"go.uber.org/zap"
 
+	"github.com/renatus-cartesius/metricserv/pkg/alerting"
+	"github.com/renatus-cartesius/metricserv/pkg/idempotency"
 	"github.com/renatus-cartesius/metricserv/pkg/logger"
 	"github.com/renatus-cartesius/metricserv/pkg/metrics"
+	"github.com/renatus-cartesius/metricserv/pkg/query"
 	"github.com/renatus-cartesius/metricserv/pkg/server/middlewares"
 	"github.com/renatus-cartesius/metricserv/pkg/server/models"
+	"github.com/renatus-cartesius/metricserv/pkg/server/service"
 	"github.com/renatus-cartesius/metricserv/pkg/storage"
 )
 
@@ -31,14 +39,29 @@ func Setup(r *chi.Mux, srv *ServerHandler, hashKey string) {
 	r.Route("/", func(r chi.Router) {
 		r.Get("/", middlewares.HmacValidator(hashKey, middlewares.Gzipper(logger.RequestLogger(srv.AllMetrics))))
 		r.Get("/ping", middlewares.Gzipper(logger.RequestLogger(srv.Ping)))
+		r.Get("/metrics", middlewares.Gzipper(logger.RequestLogger(srv.PrometheusMetrics)))
 		r.Route("/value", func(r chi.Router) {
 			r.Post("/", middlewares.HmacValidator(hashKey, middlewares.Gzipper(logger.RequestLogger(srv.GetValueJSON))))
 			r.Get("/{type}/{id}", middlewares.Gzipper(logger.RequestLogger(srv.GetValue)))
+			r.Delete("/{type}/{id}", middlewares.HmacValidator(hashKey, middlewares.Gzipper(logger.RequestLogger(srv.DeleteValue))))
 		})
-		r.Post("/updates/", middlewares.Decryptor(srv.encProcessor, middlewares.HmacValidator(hashKey, middlewares.Gzipper(logger.RequestLogger(srv.UpdatesJSON)))))
+		r.Get("/series/{id}", middlewares.Gzipper(logger.RequestLogger(srv.Series)))
+		r.Get("/history/{type}/{id}", middlewares.Gzipper(logger.RequestLogger(srv.History)))
+		r.Route("/api/v1", func(r chi.Router) {
+			r.Get("/query", middlewares.Gzipper(logger.RequestLogger(srv.Query)))
+			r.Get("/query_range", middlewares.Gzipper(logger.RequestLogger(srv.QueryRange)))
+			r.Get("/metrics", middlewares.Gzipper(logger.RequestLogger(srv.ListMetrics)))
+			r.Get("/alerts", middlewares.Gzipper(logger.RequestLogger(srv.Alerts)))
+			r.Route("/silences", func(r chi.Router) {
+				r.Get("/", middlewares.Gzipper(logger.RequestLogger(srv.Silences)))
+				r.Post("/", middlewares.HmacValidator(hashKey, middlewares.Gzipper(logger.RequestLogger(srv.CreateSilence))))
+				r.Delete("/{id}", middlewares.HmacValidator(hashKey, middlewares.Gzipper(logger.RequestLogger(srv.ExpireSilence))))
+			})
+		})
+		r.Post("/updates/", middlewares.Decryptor(srv.encProcessor, middlewares.HmacValidator(hashKey, middlewares.Gzipper(middlewares.Idempotency(srv.idempotency, logger.RequestLogger(srv.UpdatesJSON))))))
 		r.Route("/update", func(r chi.Router) {
-			r.Post("/", middlewares.Decryptor(srv.encProcessor, middlewares.HmacValidator(hashKey, middlewares.Gzipper(logger.RequestLogger(srv.UpdateJSON)))))
-			r.Post("/{type}/{id}/{value}", middlewares.Gzipper(logger.RequestLogger(srv.Update)))
+			r.Post("/", middlewares.Decryptor(srv.encProcessor, middlewares.HmacValidator(hashKey, middlewares.Gzipper(middlewares.Idempotency(srv.idempotency, logger.RequestLogger(srv.UpdateJSON))))))
+			r.Post("/{type}/{id}/{value}", middlewares.Gzipper(middlewares.Idempotency(srv.idempotency, logger.RequestLogger(srv.Update))))
 		})
 	})
 
@@ -48,6 +71,10 @@ type ServerHandler struct {
 	trustedSubnet *net.IPNet
 	storage       storage.Storager
 	encProcessor  encryption.Processor
+	queryEngine   *query.Engine
+	alertManager  *alerting.Manager
+	idempotency   *idempotency.Store
+	service       *service.MetricService
 }
 
 func NewServerHandler(storage storage.Storager, encP encryption.Processor, tSubnet *net.IPNet) *ServerHandler {
@@ -55,158 +82,153 @@ func NewServerHandler(storage storage.Storager, encP encryption.Processor, tSubn
 		trustedSubnet: tSubnet,
 		storage:       storage,
 		encProcessor:  encP,
+		queryEngine:   query.NewEngine(storage),
+		service:       service.NewMetricService(storage),
 	}
 }
 
+// SetAlertManager sets manager which alerts are listed by Alerts handler
+func (srv *ServerHandler) SetAlertManager(m *alerting.Manager) {
+	srv.alertManager = m
+}
+
+// SetIdempotencyStore sets store deduplicating updates retried with the same Idempotency-Key header
+func (srv *ServerHandler) SetIdempotencyStore(store *idempotency.Store) {
+	srv.idempotency = store
+}
+
+// SetService sets metric service shared with other transports instead of service of handler's own
+func (srv *ServerHandler) SetService(svc *service.MetricService) {
+	srv.service = svc
+}
+
+// SetStalenessPolicy sets policy by which gauges are marked stale in listings and dropped from Prometheus exposition
+func (srv *ServerHandler) SetStalenessPolicy(policy storage.StalenessPolicy) {
+	srv.service.SetStalenessPolicy(policy)
+}
+
 func (srv ServerHandler) Update(w http.ResponseWriter, r *http.Request) {
 
 	metricType := chi.URLParam(r, "type")
 	metricID := chi.URLParam(r, "id")
 	metricValue := chi.URLParam(r, "value")
 
-	if !slices.Contains(metrics.AllowedTypes, metricType) {
-		logger.Log.Warn(
-			"passed type is not allowed",
-			zap.String("type", metricType),
-		)
-		w.WriteHeader(http.StatusBadRequest)
+	labels, err := labelsFromQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
+	var value any
 	switch metricType {
 	case metrics.TypeCounter:
-		value, err := strconv.ParseInt(metricValue, 10, 64)
+		value, err = strconv.ParseInt(metricValue, 10, 64)
+	case metrics.TypeGauge, metrics.TypeHistogram, metrics.TypeSummary:
+		value, err = strconv.ParseFloat(metricValue, 64)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
 
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
+	update, err := service.NewUpdate(metricType, metricID, labels, value)
+	if err != nil {
+		logger.Log.Warn(
+			"invalid metric",
+			zap.String("type", metricType),
+			zap.Error(err),
+		)
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
 
-		ok, err := srv.storage.CheckMetric(r.Context(), metricID)
-		if err != nil {
-			logger.Log.Error(
-				"error on checking metric",
-				zap.Error(err),
-			)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+	if _, err = srv.service.Update(r.Context(), update); err != nil {
+		logStorageError("error on updating metric", err,
+			zap.String("metric", metricID),
+			zap.String("metricType", metricType),
+		)
+		writeError(w, errorStatus(err), err)
+		return
+	}
 
-		}
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+}
 
-		if !ok {
-			metric := &metrics.CounterMetric{
-				ID:    metricID,
-				Value: int64(0),
-			}
-			err = srv.storage.Add(r.Context(), metricID, metric)
-			if err != nil {
-				logger.Log.Error(
-					"error on adding new counter metric",
-					zap.Error(err),
-				)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-		}
+func (srv ServerHandler) GetValue(w http.ResponseWriter, r *http.Request) {
+	metricType := chi.URLParam(r, "type")
+	metricID := chi.URLParam(r, "id")
 
-		err = srv.storage.Update(r.Context(), metricType, metricID, value)
-		if err != nil {
-			if err == storage.ErrWrongUpdateType {
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+	labels, err := labelsFromQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	metricKey := metrics.SeriesKey(metricID, labels)
 
-	case metrics.TypeGauge:
-		value, err := strconv.ParseFloat(metricValue, 64)
+	value, err := srv.service.Value(r.Context(), metricType, metricKey)
+	if err != nil {
+		logStorageError("error on getting value from storage", err)
+		writeError(w, errorStatus(err), err)
+		return
+	}
 
+	if rawQuantile := r.URL.Query().Get("q"); metricType == metrics.TypeSummary && rawQuantile != "" {
+		q, err := strconv.ParseFloat(rawQuantile, 64)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, err)
 			return
 		}
 
-		ok, err := srv.storage.CheckMetric(r.Context(), metricID)
+		summary, err := metrics.ParseSummaryValue(metricID, value)
 		if err != nil {
 			logger.Log.Error(
-				"error on checking metric",
+				"error on parsing value",
 				zap.Error(err),
 			)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
 
-		if !ok {
-			metric := &metrics.GaugeMetric{
-				ID:    metricID,
-				Value: float64(0),
-			}
-			err = srv.storage.Add(r.Context(), metricID, metric)
-			if err != nil {
-				logger.Log.Error(
-					"error on adding new gauge metric",
-					zap.Error(err),
-				)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-		}
-
-		err = srv.storage.Update(r.Context(), metricType, metricID, value)
+		quantile, err := summary.Quantile(q)
 		if err != nil {
-			if errors.Is(err, storage.ErrWrongUpdateType) {
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, http.StatusBadRequest, err)
 			return
 		}
-	default:
-		w.WriteHeader(http.StatusNotImplemented)
-		return
+
+		value = strconv.FormatFloat(quantile, 'g', -1, 64)
 	}
 
 	w.Header().Set("Content-Type", "text/plain")
-	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(value))
 }
 
-func (srv ServerHandler) GetValue(w http.ResponseWriter, r *http.Request) {
+// DeleteValue deletes metric with its history
+func (srv ServerHandler) DeleteValue(w http.ResponseWriter, r *http.Request) {
 	metricType := chi.URLParam(r, "type")
 	metricID := chi.URLParam(r, "id")
 
-	ok, err := srv.storage.CheckMetric(r.Context(), metricID)
+	labels, err := labelsFromQuery(r)
 	if err != nil {
-		logger.Log.Error(
-			"error on checking metric",
-			zap.Error(err),
-		)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	if !ok {
-		w.WriteHeader(http.StatusNotFound)
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
+	metricKey := metrics.SeriesKey(metricID, labels)
 
-	value, err := srv.storage.GetValue(r.Context(), metricType, metricID)
-	if err != nil {
-		logger.Log.Error(
-			"error on getting value from storage",
-			zap.Error(err),
-		)
-		w.WriteHeader(http.StatusInternalServerError)
+	if err = srv.service.Delete(r.Context(), metricType, metricKey); err != nil {
+		logStorageError("error on deleting metric", err)
+		writeError(w, errorStatus(err), err)
 		return
 	}
 
-	if value == "" {
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
+	logger.Log.Info(
+		"deleted metric",
+		zap.String("type", metricType),
+		zap.String("key", metricKey),
+	)
 
 	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte(value))
+	w.WriteHeader(http.StatusOK)
 }
 
 func (srv ServerHandler) GetValueJSON(w http.ResponseWriter, r *http.Request) {
@@ -220,74 +242,62 @@ func (srv ServerHandler) GetValueJSON(w http.ResponseWriter, r *http.Request) {
 			"error on unmarshaling request body",
 			zap.Error(err),
 		)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	ok, err := srv.storage.CheckMetric(r.Context(), metric.ID)
+	value, err := srv.service.Value(r.Context(), metric.MType, metric.Key())
 	if err != nil {
-		logger.Log.Error(
-			"error on checking metric",
-			zap.Error(err),
-		)
-		w.WriteHeader(http.StatusInternalServerError)
+		logStorageError("error on getting value from storage", err)
+		writeError(w, errorStatus(err), err)
 		return
-
 	}
 
-	if !ok {
-		w.WriteHeader(http.StatusNotFound)
+	if err = setValue(&metric, value); err != nil {
+		logStorageError("error on parsing value", err)
+		writeError(w, errorStatus(err), err)
 		return
 	}
 
-	value, err := srv.storage.GetValue(r.Context(), metric.MType, metric.ID)
+	result, err := json.Marshal(metric)
 	if err != nil {
-		logger.Log.Error(
-			"error on getting value from storage",
-			zap.Error(err),
-		)
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	if value == "" {
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
 
+// setValue fills JSON representation of metric with its value got from storage
+func setValue(metric *models.Metric, value string) error {
 	switch metric.MType {
 	case metrics.TypeCounter:
-		metric.Delta = new(int64)
-		*metric.Delta, err = strconv.ParseInt(value, 10, 64)
+		delta, err := strconv.ParseInt(value, 10, 64)
 		if err != nil {
-			logger.Log.Error(
-				"error on parsing value",
-				zap.Error(err),
-			)
-			return
+			return err
 		}
+		metric.Delta = &delta
 	case metrics.TypeGauge:
-		metric.Value = new(float64)
-		*metric.Value, err = strconv.ParseFloat(value, 64)
+		gauge, err := strconv.ParseFloat(value, 64)
 		if err != nil {
-			logger.Log.Error(
-				"error on parsing value",
-				zap.Error(err),
-			)
-			return
+			return err
 		}
-	default:
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	result, err := json.Marshal(metric)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		metric.Value = &gauge
+	case metrics.TypeHistogram:
+		histogram, err := metrics.ParseHistogramValue(metric.ID, value)
+		if err != nil {
+			return err
+		}
+		metric.SetHistogram(histogram)
+	case metrics.TypeSummary:
+		summary, err := metrics.ParseSummaryValue(metric.ID, value)
+		if err != nil {
+			return err
+		}
+		return metric.SetSummary(summary)
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(result)
+	return nil
 }
 
 func (srv ServerHandler) UpdateJSON(w http.ResponseWriter, r *http.Request) {
@@ -299,126 +309,23 @@ func (srv ServerHandler) UpdateJSON(w http.ResponseWriter, r *http.Request) {
 			"error on unmarshaling request body",
 			zap.Error(err),
 		)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	if !slices.Contains(metrics.AllowedTypes, metric.MType) {
-		w.WriteHeader(http.StatusBadRequest)
+	value, _, err := srv.updateOne(r.Context(), &metric)
+	if err != nil {
+		logStorageError("error on updating metric", err,
+			zap.String("metric", metric.ID),
+			zap.String("metricType", metric.MType),
+		)
+		writeError(w, errorStatus(err), err)
 		return
 	}
 
-	switch metric.MType {
-	case metrics.TypeCounter:
-		if metric.Delta == nil {
-			metric.Delta = new(int64)
-		}
-		delta := *metric.Delta
-
-		ok, err := srv.storage.CheckMetric(r.Context(), metric.ID)
-		if err != nil {
-			logger.Log.Error(
-				"error on checking metric",
-				zap.Error(err),
-			)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-
-		}
-
-		if !ok {
-			newMetric := metrics.NewCounter(metric.ID, int64(0))
-			err = srv.storage.Add(r.Context(), metric.ID, newMetric)
-			if err != nil {
-				logger.Log.Error(
-					"error on adding new counter metric",
-					zap.Error(err),
-				)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-		}
-
-		if err = srv.storage.Update(r.Context(), metric.MType, metric.ID, delta); err != nil {
-			if err == storage.ErrWrongUpdateType {
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
-			logger.Log.Error(
-				"error on updating metric",
-				zap.String("metric", metric.ID),
-				zap.String("metricType", metric.MType),
-				zap.Error(err),
-			)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		stringDelta, err := srv.storage.GetValue(r.Context(), metric.MType, metric.ID)
-		if err != nil {
-			logger.Log.Error(
-				"error on getting value from storage",
-				zap.Error(err),
-			)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		actualDelta, err := strconv.ParseInt(stringDelta, 10, 64)
-
-		if err != nil {
-			logger.Log.Error(
-				"error on getting metric",
-				zap.String("metric", metric.ID),
-				zap.String("metricType", metric.MType),
-				zap.Error(err),
-			)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		*metric.Delta = actualDelta
-
-	case metrics.TypeGauge:
-		if metric.Value == nil {
-			metric.Value = new(float64)
-		}
-		value := *metric.Value
-
-		ok, err := srv.storage.CheckMetric(r.Context(), metric.ID)
-		if err != nil {
-			logger.Log.Error(
-				"error on checking metric",
-				zap.Error(err),
-			)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		if !ok {
-			newMetric := metrics.NewGauge(metric.ID, float64(0))
-			err := srv.storage.Add(r.Context(), metric.ID, newMetric)
-			if err != nil {
-				logger.Log.Error(
-					"error on adding new gauge metric",
-					zap.Error(err),
-				)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-		}
-
-		if err := srv.storage.Update(r.Context(), metric.MType, metric.ID, value); err != nil {
-			if err == storage.ErrWrongUpdateType {
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-	default:
-		w.WriteHeader(http.StatusNotImplemented)
+	if err = setValue(&metric, value); err != nil {
+		logStorageError("error on parsing value", err)
+		writeError(w, errorStatus(err), err)
 		return
 	}
 
@@ -428,7 +335,7 @@ func (srv ServerHandler) UpdateJSON(w http.ResponseWriter, r *http.Request) {
 			"error on marshaling result",
 			zap.String("err", err.Error()),
 		)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, errorStatus(err), err)
 		return
 	}
 
@@ -438,168 +345,1013 @@ func (srv ServerHandler) UpdateJSON(w http.ResponseWriter, r *http.Request) {
 }
 
 func (srv ServerHandler) AllMetrics(w http.ResponseWriter, r *http.Request) {
-	allMetrics, err := srv.storage.ListAll(r.Context())
+	stale, err := srv.service.StaleKeys(r.Context())
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, errorStatus(err), err)
 		return
 	}
 
-	body := ""
-	for _, v := range allMetrics {
-		body += "<p>" + v.String() + "</p>"
+	var body strings.Builder
+	err = srv.storage.Iterate(r.Context(), func(key string, metric metrics.Metric) error {
+		if stale[key] {
+			body.WriteString("<p>" + metric.String() + " (stale)</p>")
+			return nil
+		}
+		body.WriteString("<p>" + metric.String() + "</p>")
+		return nil
+	})
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
 	}
 
 	w.Header().Set("Content-Type", "text/html")
-	w.Write([]byte(body))
+	w.Write([]byte(body.String()))
 }
 
-func (srv ServerHandler) UpdatesJSON(w http.ResponseWriter, r *http.Request) {
+// ListMetrics lists metrics filtered by type, prefix of id and label query parameters in order of their keys.
+// Page of limit metrics starts after key passed in after parameter, all metrics are listed if limit is not set.
+func (srv ServerHandler) ListMetrics(w http.ResponseWriter, r *http.Request) {
+	labels, err := labelsFromQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
 
-	var metricsBatch models.MetricsBatch
+	opts := service.ListOptions{
+		Type:   r.URL.Query().Get("type"),
+		Prefix: r.URL.Query().Get("prefix"),
+		Labels: labels,
+		After:  r.URL.Query().Get("after"),
+	}
+	if rawLimit := r.URL.Query().Get("limit"); rawLimit != "" {
+		opts.Limit, err = strconv.Atoi(rawLimit)
+		if err != nil || opts.Limit < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("limit must be non-negative integer"))
+			return
+		}
+	}
 
-	if err := json.NewDecoder(r.Body).Decode(&metricsBatch); err != nil {
+	listed, next, err := srv.service.List(r.Context(), opts)
+	if err != nil {
+		logStorageError("error on listing metrics", err)
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	page := models.MetricsPage{
+		Metrics: make([]models.ListedMetric, 0, len(listed)),
+		Next:    next,
+	}
+	for _, l := range listed {
+		metric := models.Metric{ID: l.Metric.GetID(), MType: l.Metric.GetType(), Labels: l.Metric.GetLabels()}
+		if err = setValue(&metric, l.Metric.GetValue()); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		page.Metrics = append(page.Metrics, models.ListedMetric{Key: l.Key, Metric: metric, Stale: l.Stale})
+	}
+
+	body, err := json.Marshal(page)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// PrometheusMetrics renders all metrics from storage in the Prometheus text exposition format.
+// Stale gauges are not exposed, so scraper marks their series stale.
+func (srv ServerHandler) PrometheusMetrics(w http.ResponseWriter, r *http.Request) {
+	allMetrics, err := srv.storage.ListAll(r.Context())
+	if err != nil {
 		logger.Log.Error(
-			"error on unmarshaling request body",
+			"error on listing metrics",
 			zap.Error(err),
 		)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, errorStatus(err), err)
 		return
 	}
 
-	for _, metric := range metricsBatch {
+	stale, err := srv.service.StaleKeys(r.Context())
+	if err != nil {
+		logger.Log.Error(
+			"error on listing stale metrics",
+			zap.Error(err),
+		)
+		writeError(w, errorStatus(err), err)
+		return
+	}
 
-		if !slices.Contains(metrics.AllowedTypes, metric.MType) {
-			w.WriteHeader(http.StatusBadRequest)
-			return
+	keys := make([]string, 0, len(allMetrics))
+	for key := range allMetrics {
+		if stale[key] {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	// samples of one metric family must be grouped together, so sorting by family name first
+	slices.SortFunc(keys, func(a, b string) int {
+		if c := strings.Compare(prometheusFamily(allMetrics[a]), prometheusFamily(allMetrics[b])); c != 0 {
+			return c
 		}
+		return strings.Compare(a, b)
+	})
 
-		switch metric.MType {
-		case metrics.TypeCounter:
-			if metric.Delta == nil {
-				metric.Delta = new(int64)
-			}
-			delta := *metric.Delta
-
-			ok, err := srv.storage.CheckMetric(r.Context(), metric.ID)
-			if err != nil {
-				logger.Log.Error(
-					"error on checking metric",
-					zap.Error(err),
-				)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
+	var body strings.Builder
 
-			}
+	// families are types by family names, sample names are owned by families, so metrics of different types
+	// sanitised to the same name do not produce conflicting families rejected by scraper
+	families := make(map[string]string, len(keys))
+	owners := make(map[string]string, len(keys))
+	series := make(map[string]bool, len(keys))
 
-			if !ok {
-				newMetric := metrics.NewCounter(metric.ID, int64(0))
-				err = srv.storage.Add(r.Context(), metric.ID, newMetric)
-				if err != nil {
-					logger.Log.Error(
-						"error on adding new counter metric",
-						zap.Error(err),
-					)
-					w.WriteHeader(http.StatusInternalServerError)
-					return
-				}
-			}
+	for _, key := range keys {
+		metric := allMetrics[key]
 
-			if err = srv.storage.Update(r.Context(), metric.MType, metric.ID, delta); err != nil {
-				if err == storage.ErrWrongUpdateType {
-					w.WriteHeader(http.StatusBadRequest)
-					return
-				}
-				logger.Log.Error(
-					"error on updating metric",
-					zap.String("metric", metric.ID),
-					zap.String("metricType", metric.MType),
-					zap.Error(err),
-				)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+		promType, ok := prometheusTypes[metric.GetType()]
+		if !ok {
+			continue
+		}
+		name := prometheusFamily(metric)
 
-			stringDelta, err := srv.storage.GetValue(r.Context(), metric.MType, metric.ID)
-			if err != nil {
-				logger.Log.Error(
-					"error on getting value from storage",
-					zap.Error(err),
-				)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+		if conflict := prometheusConflict(families, owners, name, promType); conflict != "" {
+			logger.Log.Warn(
+				"skipping metric conflicting with other metric family in exposition",
+				zap.String("key", key),
+				zap.String("family", conflict),
+			)
+			continue
+		}
 
-			actualDelta, err := strconv.ParseInt(stringDelta, 10, 64)
-			if err != nil {
-				logger.Log.Error(
-					"error on getting metric",
-					zap.String("metric", metric.ID),
-					zap.String("metricType", metric.MType),
-					zap.Error(err),
-				)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
+		// metrics of ids sanitised to the same name are merged into family, unless they have the same labels
+		seriesKey := name + metrics.FormatLabels(metric.GetLabels())
+		if series[seriesKey] {
+			logger.Log.Warn(
+				"skipping metric duplicating series of other metric in exposition",
+				zap.String("key", key),
+				zap.String("series", seriesKey),
+			)
+			continue
+		}
+		series[seriesKey] = true
+
+		if _, ok := families[name]; !ok {
+			families[name] = promType
+			for _, sample := range prometheusSamples(name, promType) {
+				owners[sample] = name
 			}
+			body.WriteString("# TYPE " + name + " " + promType + "\n")
+		}
 
-			*metric.Delta = actualDelta
+		switch m := metric.(type) {
+		case *metrics.HistogramMetric:
+			writePrometheusHistogram(&body, name, m)
+		case *metrics.SummaryMetric:
+			writePrometheusSummary(&body, name, m)
+		default:
+			body.WriteString(name + metrics.FormatLabels(metric.GetLabels()) + " " + metric.GetValue() + "\n")
+		}
+	}
 
-		case metrics.TypeGauge:
-			if metric.Value == nil {
-				metric.Value = new(float64)
-			}
-			value := *metric.Value
-
-			ok, err := srv.storage.CheckMetric(r.Context(), metric.ID)
-			if err != nil {
-				logger.Log.Error(
-					"error on checking metric",
-					zap.Error(err),
-				)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(body.String()))
+}
+
+// prometheusTypes are types of metric families by types of metrics
+var prometheusTypes = map[string]string{
+	metrics.TypeCounter:   "counter",
+	metrics.TypeGauge:     "gauge",
+	metrics.TypeHistogram: "histogram",
+	metrics.TypeSummary:   "summary",
+}
+
+// prometheusFamily returns name of metric family of metric, counters are named with _total suffix
+func prometheusFamily(metric metrics.Metric) string {
+	name := prometheusName(metric.GetID())
+	if metric.GetType() == metrics.TypeCounter && !strings.HasSuffix(name, "_total") {
+		name += "_total"
+	}
+	return name
+}
+
+// prometheusSamples returns names of samples of family
+func prometheusSamples(name, promType string) []string {
+	switch promType {
+	case "histogram":
+		return []string{name, name + "_bucket", name + "_sum", name + "_count"}
+	case "summary":
+		return []string{name, name + "_sum", name + "_count"}
+	}
+	return []string{name}
+}
 
+// prometheusConflict returns name of already written family, which has other type than family of name or owns
+// any of its samples, empty name is returned if there is no conflict
+func prometheusConflict(families, owners map[string]string, name, promType string) string {
+	if existing, ok := families[name]; ok {
+		if existing != promType {
+			return name
+		}
+		return ""
+	}
+
+	for _, sample := range prometheusSamples(name, promType) {
+		if owner, ok := owners[sample]; ok {
+			return owner
+		}
+	}
+	return ""
+}
+
+// writePrometheusHistogram writes cumulative _bucket series with le label, _sum and _count series of histogram
+func writePrometheusHistogram(body *strings.Builder, name string, histogram *metrics.HistogramMetric) {
+	labels := make(map[string]string, len(histogram.Labels)+1)
+	for k, v := range histogram.Labels {
+		labels[k] = v
+	}
+
+	var cumulative uint64
+	for i, count := range histogram.Counts {
+		cumulative += count
+
+		labels["le"] = "+Inf"
+		if i < len(histogram.Buckets) {
+			labels["le"] = strconv.FormatFloat(histogram.Buckets[i], 'g', -1, 64)
+		}
+
+		body.WriteString(name + "_bucket" + metrics.FormatLabels(labels) + " " + strconv.FormatUint(cumulative, 10) + "\n")
+	}
+
+	body.WriteString(name + "_sum" + metrics.FormatLabels(histogram.Labels) + " " + strconv.FormatFloat(histogram.Sum, 'g', -1, 64) + "\n")
+	body.WriteString(name + "_count" + metrics.FormatLabels(histogram.Labels) + " " + strconv.FormatUint(histogram.Count, 10) + "\n")
+}
+
+// writePrometheusSummary writes series with quantile label for each of metrics.SummaryQuantiles, _sum and _count series of summary
+func writePrometheusSummary(body *strings.Builder, name string, summary *metrics.SummaryMetric) {
+	labels := make(map[string]string, len(summary.Labels)+1)
+	for k, v := range summary.Labels {
+		labels[k] = v
+	}
+
+	for _, q := range metrics.SummaryQuantiles {
+		value, err := summary.Quantile(q)
+		if err != nil {
+			continue
+		}
+
+		labels["quantile"] = strconv.FormatFloat(q, 'g', -1, 64)
+		body.WriteString(name + metrics.FormatLabels(labels) + " " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+	}
+
+	body.WriteString(name + "_sum" + metrics.FormatLabels(summary.Labels) + " " + strconv.FormatFloat(summary.Sketch.Sum, 'g', -1, 64) + "\n")
+	body.WriteString(name + "_count" + metrics.FormatLabels(summary.Labels) + " " + strconv.FormatUint(summary.Sketch.Count, 10) + "\n")
+}
+
+// prometheusName replaces all characters out of [a-zA-Z0-9_:] charset with underscore, so metric id could be used as a prometheus metric name
+func prometheusName(id string) string {
+	var name strings.Builder
+
+	for i, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+			name.WriteRune(c)
+		case c >= '0' && c <= '9':
+			if i == 0 {
+				name.WriteRune('_')
 			}
+			name.WriteRune(c)
+		default:
+			name.WriteRune('_')
+		}
+	}
+
+	if name.Len() == 0 {
+		return "_"
+	}
 
-			if !ok {
-				newMetric := metrics.NewGauge(metric.ID, float64(0))
-				err := srv.storage.Add(r.Context(), metric.ID, newMetric)
-				if err != nil {
-					logger.Log.Error(
-						"error on adding new gauge metric",
-						zap.Error(err),
-					)
-					w.WriteHeader(http.StatusInternalServerError)
-					return
-				}
+	return name.String()
+}
+
+// Series returns all metrics with given name which labels are satisfying label matchers passed
+// in match query parameters, e.g. /series/cpu?match=host=~web-.*&match=region!=eu
+func (srv ServerHandler) Series(w http.ResponseWriter, r *http.Request) {
+	metricID := chi.URLParam(r, "id")
+
+	matchers := make([]*metrics.LabelMatcher, 0)
+	for _, rawMatcher := range r.URL.Query()["match"] {
+		matcher, err := metrics.ParseLabelMatcher(rawMatcher)
+		if err != nil {
+			logger.Log.Warn(
+				"invalid label matcher",
+				zap.String("matcher", rawMatcher),
+				zap.Error(err),
+			)
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		matchers = append(matchers, matcher)
+	}
+
+	selected, err := storage.Select(r.Context(), srv.storage, metricID, matchers)
+	if err != nil {
+		logger.Log.Error(
+			"error on selecting metrics",
+			zap.Error(err),
+		)
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	result := make(models.MetricsBatch, 0, len(selected))
+	for _, m := range selected {
+		metric := &models.Metric{
+			ID:     m.GetID(),
+			MType:  m.GetType(),
+			Labels: m.GetLabels(),
+		}
+
+		switch m.GetType() {
+		case metrics.TypeCounter:
+			metric.Delta = new(int64)
+			*metric.Delta, err = strconv.ParseInt(m.GetValue(), 10, 64)
+		case metrics.TypeGauge:
+			metric.Value = new(float64)
+			*metric.Value, err = strconv.ParseFloat(m.GetValue(), 64)
+		case metrics.TypeHistogram:
+			var histogram *metrics.HistogramMetric
+			histogram, err = metrics.ParseHistogramValue(m.GetID(), m.GetValue())
+			if err == nil {
+				metric.SetHistogram(histogram)
 			}
+		case metrics.TypeSummary:
+			var summary *metrics.SummaryMetric
+			summary, err = metrics.ParseSummaryValue(m.GetID(), m.GetValue())
+			if err == nil {
+				err = metric.SetSummary(summary)
+			}
+		}
+		if err != nil {
+			logger.Log.Error(
+				"error on parsing value",
+				zap.Error(err),
+			)
+			writeError(w, errorStatus(err), err)
+			return
+		}
+
+		result = append(result, metric)
+	}
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// History returns samples of metric recorded in time range passed in from and to query parameters.
+// Time could be passed as unix timestamp in seconds or in RFC3339 format, range is not limited by default.
+// If resolution query parameter is passed (1m or 1h), aggregates of samples rolled up on retention are returned.
+func (srv ServerHandler) History(w http.ResponseWriter, r *http.Request) {
+	metricType := chi.URLParam(r, "type")
+	metricID := chi.URLParam(r, "id")
+
+	labels, err := labelsFromQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	metricKey := metrics.SeriesKey(metricID, labels)
+
+	from, err := parseTime(r.URL.Query().Get("from"), time.Unix(0, 0))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	to, err := parseTime(r.URL.Query().Get("to"), time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
 
-			if err := srv.storage.Update(r.Context(), metric.MType, metric.ID, value); err != nil {
-				if err == storage.ErrWrongUpdateType {
-					w.WriteHeader(http.StatusBadRequest)
-					return
-				}
-				w.WriteHeader(http.StatusInternalServerError)
+	if _, err = srv.storage.GetValue(r.Context(), metricType, metricKey); err != nil {
+		logStorageError("error on getting value from storage", err)
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	var history any
+
+	if rawResolution := r.URL.Query().Get("resolution"); rawResolution != "" {
+		resolution, err := time.ParseDuration(rawResolution)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		history, err = srv.storage.Aggregates(r.Context(), metricKey, resolution, from, to)
+		if err != nil {
+			if errors.Is(err, storage.ErrUnknownResolution) {
+				writeError(w, http.StatusBadRequest, err)
 				return
 			}
+			logger.Log.Error(
+				"error on getting aggregates from storage",
+				zap.Error(err),
+			)
+			writeError(w, errorStatus(err), err)
+			return
+		}
+	} else {
+		history, err = srv.storage.History(r.Context(), metricKey, from, to)
+		if err != nil {
+			logger.Log.Error(
+				"error on getting history from storage",
+				zap.Error(err),
+			)
+			writeError(w, errorStatus(err), err)
+			return
+		}
+	}
 
-		default:
-			w.WriteHeader(http.StatusNotImplemented)
+	body, err := json.Marshal(history)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// Query evaluates instant query passed in query parameter at time parameter (now by default)
+func (srv ServerHandler) Query(w http.ResponseWriter, r *http.Request) {
+	ts, err := parseTime(r.URL.Query().Get("time"), time.Now())
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	vector, err := srv.queryEngine.Query(r.Context(), r.URL.Query().Get("query"), ts)
+	if err != nil {
+		writeQueryError(w, queryErrorStatus(err), err)
+		return
+	}
+
+	result := make([]models.QueryResult, 0, len(vector))
+	for _, sample := range vector {
+		result = append(result, models.QueryResult{
+			Metric: sample.Labels,
+			Value:  queryPoint(ts, sample.Value),
+		})
+	}
+
+	writeQueryResult(w, "vector", result)
+}
+
+// QueryRange evaluates query passed in query parameter at each step in range from start to end parameters,
+// range is the last hour by default
+func (srv ServerHandler) QueryRange(w http.ResponseWriter, r *http.Request) {
+	start, err := parseTime(r.URL.Query().Get("start"), time.Now().Add(-time.Hour))
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	end, err := parseTime(r.URL.Query().Get("end"), time.Now())
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	step, err := parseStep(r.URL.Query().Get("step"))
+	if err != nil {
+		writeQueryError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	matrix, err := srv.queryEngine.QueryRange(r.Context(), r.URL.Query().Get("query"), start, end, step)
+	if err != nil {
+		writeQueryError(w, queryErrorStatus(err), err)
+		return
+	}
+
+	result := make([]models.QueryResult, 0, len(matrix))
+	for _, series := range matrix {
+		values := make([][]any, 0, len(series.Points))
+		for _, point := range series.Points {
+			values = append(values, queryPoint(point.Timestamp, point.Value))
+		}
+
+		result = append(result, models.QueryResult{
+			Metric: series.Labels,
+			Values: values,
+		})
+	}
+
+	writeQueryResult(w, "matrix", result)
+}
+
+// Alerts lists current alerts, optionally filtered by state parameter
+func (srv ServerHandler) Alerts(w http.ResponseWriter, r *http.Request) {
+	state := r.URL.Query().Get("state")
+
+	alerts := make([]models.Alert, 0)
+	if srv.alertManager != nil {
+		for _, alert := range srv.alertManager.Alerts() {
+			if state == "" || alert.State == state {
+				alerts = append(alerts, alertModel(alert))
+			}
+		}
+	}
+
+	body, err := json.Marshal(models.AlertsResponse{
+		Status: "success",
+		Data:   &models.AlertsData{Alerts: alerts},
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// alertModel converts alert to its JSON representation
+func alertModel(alert alerting.Alert) models.Alert {
+	return models.Alert{
+		Rule:        alert.Rule,
+		Labels:      alert.Labels,
+		Annotations: alert.Annotations,
+		Severity:    alert.Severity,
+		State:       alert.State,
+		Value:       alert.Value,
+		ActiveAt:    alert.ActiveAt,
+		FiredAt:     alert.FiredAt,
+		ResolvedAt:  alert.ResolvedAt,
+	}
+}
+
+// silenceModel converts silence to its JSON representation with its state at now
+func silenceModel(silence storage.Silence, now time.Time) models.Silence {
+	return models.Silence{
+		ID:        silence.ID,
+		Matchers:  silence.Matchers,
+		StartsAt:  silence.StartsAt,
+		EndsAt:    silence.EndsAt,
+		CreatedBy: silence.CreatedBy,
+		Comment:   silence.Comment,
+		State:     silence.State(now),
+	}
+}
+
+// Silences lists silences, optionally filtered by state parameter (pending, active or expired)
+func (srv ServerHandler) Silences(w http.ResponseWriter, r *http.Request) {
+	silences, err := srv.storage.Silences(r.Context())
+	if err != nil {
+		logger.Log.Error(
+			"error on listing silences",
+			zap.Error(err),
+		)
+		writeSilences(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+
+	state := r.URL.Query().Get("state")
+	now := time.Now()
+
+	result := make([]models.Silence, 0, len(silences))
+	for _, silence := range silences {
+		if state != "" && silence.State(now) != state {
+			continue
+		}
+		result = append(result, silenceModel(silence, now))
+	}
+
+	writeSilences(w, http.StatusOK, result, nil)
+}
+
+// CreateSilence creates silence from JSON body, silence starts now if its start is not set
+func (srv ServerHandler) CreateSilence(w http.ResponseWriter, r *http.Request) {
+	var request models.Silence
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeSilences(w, http.StatusBadRequest, nil, err)
+		return
+	}
+
+	now := time.Now()
+
+	silence := storage.Silence{
+		ID:        uuid.NewString(),
+		Matchers:  request.Matchers,
+		StartsAt:  request.StartsAt,
+		EndsAt:    request.EndsAt,
+		CreatedBy: request.CreatedBy,
+		Comment:   request.Comment,
+	}
+	if silence.StartsAt.IsZero() {
+		silence.StartsAt = now
+	}
+
+	if err := silence.Validate(); err != nil {
+		writeSilences(w, http.StatusBadRequest, nil, err)
+		return
+	}
+
+	if err := srv.storage.AddSilence(r.Context(), silence); err != nil {
+		logger.Log.Error(
+			"error on adding silence",
+			zap.Error(err),
+		)
+		writeSilences(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+
+	logger.Log.Info(
+		"created silence",
+		zap.String("id", silence.ID),
+		zap.Strings("matchers", silence.Matchers),
+		zap.String("createdBy", silence.CreatedBy),
+	)
+
+	writeSilences(w, http.StatusOK, []models.Silence{silenceModel(silence, now)}, nil)
+}
+
+// ExpireSilence ends silence with id now
+func (srv ServerHandler) ExpireSilence(w http.ResponseWriter, r *http.Request) {
+	err := srv.storage.ExpireSilence(r.Context(), chi.URLParam(r, "id"), time.Now())
+	if err != nil {
+		if errors.Is(err, storage.ErrSilenceNotFound) {
+			writeSilences(w, http.StatusNotFound, nil, err)
 			return
 		}
+		logger.Log.Error(
+			"error on expiring silence",
+			zap.Error(err),
+		)
+		writeSilences(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+
+	writeSilences(w, http.StatusOK, nil, nil)
+}
+
+func writeSilences(w http.ResponseWriter, status int, silences []models.Silence, err error) {
+	response := models.SilencesResponse{
+		Status: "success",
+		Data:   silences,
+	}
+	if err != nil {
+		response.Status = "error"
+		response.Error = err.Error()
+	}
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// parseStep parses step of range query as go duration or float number of seconds
+func parseStep(raw string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(raw, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
 	}
+	return time.ParseDuration(raw)
+}
+
+func queryPoint(ts time.Time, value float64) []any {
+	return []any{float64(ts.UnixMilli()) / 1000, strconv.FormatFloat(value, 'g', -1, 64)}
+}
+
+func queryErrorStatus(err error) int {
+	var parseErr *query.ParseError
+	if errors.As(err, &parseErr) ||
+		errors.Is(err, query.ErrInvalidStep) ||
+		errors.Is(err, query.ErrTooManyPoints) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func writeQueryResult(w http.ResponseWriter, resultType string, result []models.QueryResult) {
+	body, err := json.Marshal(models.QueryResponse{
+		Status: "success",
+		Data: &models.QueryData{
+			ResultType: resultType,
+			Result:     result,
+		},
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func writeQueryError(w http.ResponseWriter, status int, err error) {
+	errorType := "bad_data"
+	if status == http.StatusInternalServerError {
+		errorType = "internal"
+		logger.Log.Error(
+			"error on evaluating query",
+			zap.Error(err),
+		)
+	}
+
+	body, _ := json.Marshal(models.QueryResponse{
+		Status:    "error",
+		ErrorType: errorType,
+		Error:     err.Error(),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// parseTime parses unix timestamp in seconds or RFC3339 time, returning def for empty string
+func parseTime(raw string, def time.Time) (time.Time, error) {
+	if raw == "" {
+		return def, nil
+	}
+
+	if seconds, err := strconv.ParseFloat(raw, 64); err == nil {
+		return time.Unix(0, int64(seconds*float64(time.Second))), nil
+	}
+
+	return time.Parse(time.RFC3339, raw)
+}
+
+// labelsFromQuery collects metric labels passed in label query parameters as name:value
+func labelsFromQuery(r *http.Request) (map[string]string, error) {
+	rawLabels := r.URL.Query()["label"]
+	if len(rawLabels) == 0 {
+		return nil, nil
+	}
+
+	labels := make(map[string]string, len(rawLabels))
+	for _, rawLabel := range rawLabels {
+		name, value, ok := strings.Cut(rawLabel, ":")
+		if !ok {
+			return nil, metrics.ErrInvalidLabelName
+		}
+		labels[name] = value
+	}
+
+	if err := metrics.ValidateLabels(labels); err != nil {
+		return nil, err
+	}
+
+	return labels, nil
+}
+
+// PartialSuccessHeader enables partial mode of batch updates, as well as partial query parameter
+const PartialSuccessHeader = "X-Partial-Success"
+
+// UpdatesJSON applies batch of metrics atomically: on any error nothing is changed, so agents can retry whole batch.
+// In partial mode valid metrics are applied and outcome of each metric is reported in response.
+func (srv ServerHandler) UpdatesJSON(w http.ResponseWriter, r *http.Request) {
+
+	var metricsBatch models.MetricsBatch
+
+	if err := json.NewDecoder(r.Body).Decode(&metricsBatch); err != nil {
+		logger.Log.Error(
+			"error on unmarshaling request body",
+			zap.Error(err),
+		)
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if isPartial(r) {
+		srv.updatesPartial(w, r, metricsBatch)
+		return
+	}
+
+	updates := make([]storage.BatchUpdate, 0, len(metricsBatch))
+	for _, metric := range metricsBatch {
+		update, err := batchUpdate(metric)
+		if err != nil {
+			logger.Log.Warn(
+				"invalid metric in batch",
+				zap.String("metric", metric.ID),
+				zap.String("metricType", metric.MType),
+				zap.Error(err),
+			)
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		updates = append(updates, update)
+	}
+
+	if err := srv.service.UpdateBatch(r.Context(), updates); err != nil {
+		logStorageError("error on updating batch of metrics", err,
+			zap.Int("size", len(updates)),
+		)
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("{\"result\": \"ok\"}"))
 }
 
+func isPartial(r *http.Request) bool {
+	for _, raw := range []string{r.URL.Query().Get("partial"), r.Header.Get(PartialSuccessHeader)} {
+		if partial, err := strconv.ParseBool(raw); err == nil && partial {
+			return true
+		}
+	}
+	return false
+}
+
+// updatesPartial applies each metric of batch separately and reports their outcomes
+func (srv ServerHandler) updatesPartial(w http.ResponseWriter, r *http.Request, metricsBatch models.MetricsBatch) {
+	response := models.BatchResponse{
+		Results: make([]models.BatchItemResult, 0, len(metricsBatch)),
+	}
+
+	for i, metric := range metricsBatch {
+		result := models.BatchItemResult{Index: i}
+		if metric != nil {
+			result.ID = metric.ID
+			result.MType = metric.MType
+		}
+
+		value, code, err := srv.updateOne(r.Context(), metric)
+		if err != nil {
+			logStorageError("error on updating metric of batch", err,
+				zap.Int("index", i),
+				zap.String("metric", result.ID),
+			)
+			result.Status = models.BatchItemRejected
+			result.Code = code
+			result.Error = err.Error()
+			response.Rejected++
+		} else {
+			result.Status = models.BatchItemApplied
+			result.Value = value
+			response.Applied++
+		}
+
+		response.Results = append(response.Results, result)
+	}
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	if response.Rejected > 0 {
+		status = http.StatusMultiStatus
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// updateOne applies single metric, returns its new value or HTTP status of error
+func (srv ServerHandler) updateOne(ctx context.Context, metric *models.Metric) (string, int, error) {
+	update, err := batchUpdate(metric)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+
+	value, err := srv.service.Update(ctx, update)
+	if err != nil {
+		return "", errorStatus(err), err
+	}
+
+	return value, http.StatusOK, nil
+}
+
+// batchUpdate validates metric and converts it to storage update with initial state of metric
+func batchUpdate(metric *models.Metric) (storage.BatchUpdate, error) {
+	if metric == nil {
+		return storage.BatchUpdate{}, errors.New("metric is not set")
+	}
+
+	var value any
+	switch metric.MType {
+	case metrics.TypeCounter:
+		var delta int64
+		if metric.Delta != nil {
+			delta = *metric.Delta
+		}
+		value = delta
+	case metrics.TypeGauge:
+		var gauge float64
+		if metric.Value != nil {
+			gauge = *metric.Value
+		}
+		value = gauge
+	case metrics.TypeHistogram:
+		delta, err := metric.Histogram()
+		if err != nil {
+			return storage.BatchUpdate{}, err
+		}
+		value = delta
+	case metrics.TypeSummary:
+		delta, err := metric.Summary()
+		if err != nil {
+			return storage.BatchUpdate{}, err
+		}
+		value = delta
+	}
+
+	return service.NewUpdate(metric.MType, metric.ID, metric.Labels, value)
+}
+
+// errorStatus maps error of operation on metric to HTTP status
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, storage.ErrTypeMismatch):
+		return http.StatusConflict
+	case errors.Is(err, storage.ErrUnavailable):
+		return http.StatusServiceUnavailable
+	case service.IsInvalid(err):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// errorTypes are types of errors in response body by their statuses, other statuses are of internal errors
+var errorTypes = map[int]string{
+	http.StatusBadRequest:         "bad_data",
+	http.StatusNotFound:           "not_found",
+	http.StatusConflict:           "type_mismatch",
+	http.StatusServiceUnavailable: "unavailable",
+}
+
+// writeError writes error with status as JSON body, metric of storage error is added to it
+func writeError(w http.ResponseWriter, status int, err error) {
+	errorType, ok := errorTypes[status]
+	if !ok {
+		errorType = "internal"
+	}
+
+	response := models.ErrorResponse{
+		Status:    "error",
+		ErrorType: errorType,
+		Error:     err.Error(),
+	}
+
+	var metricErr *storage.MetricError
+	if errors.As(err, &metricErr) {
+		response.Key = metricErr.Key
+		response.Type = metricErr.Type
+		response.StoredType = metricErr.StoredType
+	}
+
+	body, _ := json.Marshal(response)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// logStorageError logs error of operation on metric unless it is caused by request, e.g. metric is not found
+func logStorageError(msg string, err error, fields ...zap.Field) {
+	if errorStatus(err) < http.StatusInternalServerError {
+		return
+	}
+	logger.Log.Error(msg, append(fields, zap.Error(err))...)
+}
+
 func (srv ServerHandler) Ping(w http.ResponseWriter, r *http.Request) {
-	if err := srv.storage.Ping(r.Context()); err != nil {
+	if err := srv.service.Ping(r.Context()); err != nil {
 		logger.Log.Error(
 			"error on pinging db",
 			zap.Error(err),
 		)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, errorStatus(err), err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
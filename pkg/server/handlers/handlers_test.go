@@ -1,5 +1,226 @@
 package handlers
 
+import (
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/renatus-cartesius/metricserv/pkg/idempotency"
+	"github.com/renatus-cartesius/metricserv/pkg/metrics"
+	"github.com/renatus-cartesius/metricserv/pkg/server/models"
+	"github.com/renatus-cartesius/metricserv/pkg/storage"
+)
+
+func TestGetValueSummaryQuantile(t *testing.T) {
+	s, err := storage.NewMemStorage("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary := metrics.NewSummary("latency")
+	for i := 1; i <= 100; i++ {
+		summary.Change(float64(i))
+	}
+	s.Add(context.Background(), summary.ID, summary)
+
+	r := chi.NewRouter()
+	Setup(r, NewServerHandler(s, nil, nil), "")
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		query     string
+		wantCode  int
+		wantValue float64
+	}{
+		{
+			name:      "p99",
+			query:     "?q=0.99",
+			wantCode:  http.StatusOK,
+			wantValue: 99,
+		},
+		{
+			name:     "invalid quantile",
+			query:    "?q=2",
+			wantCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := http.Get(server.URL + "/value/summary/latency" + tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+
+			if response.StatusCode != tt.wantCode {
+				t.Fatalf("unexpected status code: %d", response.StatusCode)
+			}
+
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			body, _ := io.ReadAll(response.Body)
+			value, err := strconv.ParseFloat(string(body), 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(value-tt.wantValue)/tt.wantValue > metrics.DefaultRelativeAccuracy {
+				t.Errorf("unexpected value: %v, want %v", value, tt.wantValue)
+			}
+		})
+	}
+}
+
+func TestUpdateJSONHistogram(t *testing.T) {
+	s, err := storage.NewMemStorage("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServerHandler(s, nil, nil)
+
+	tests := []struct {
+		name       string
+		body       string
+		wantCode   int
+		wantCounts []uint64
+	}{
+		{
+			name:       "first report",
+			body:       `{"id":"latency","type":"histogram","buckets":[0.1,1],"counts":[1,2,0],"sum":1.5}`,
+			wantCode:   http.StatusOK,
+			wantCounts: []uint64{1, 2, 0},
+		},
+		{
+			name:       "merged report",
+			body:       `{"id":"latency","type":"histogram","buckets":[0.1,1],"counts":[0,1,1],"sum":3}`,
+			wantCode:   http.StatusOK,
+			wantCounts: []uint64{1, 3, 1},
+		},
+		{
+			name:     "buckets mismatch",
+			body:     `{"id":"latency","type":"histogram","buckets":[0.5],"counts":[1,0]}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid counts",
+			body:     `{"id":"latency","type":"histogram","buckets":[0.1,1],"counts":[1]}`,
+			wantCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			srv.UpdateJSON(w, httptest.NewRequest(http.MethodPost, "/update/", strings.NewReader(tt.body)))
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("unexpected status code: %d", w.Code)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			var metric models.Metric
+			if err := json.NewDecoder(w.Body).Decode(&metric); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(metric.Counts, tt.wantCounts) {
+				t.Errorf("unexpected counts: %v, want %v", metric.Counts, tt.wantCounts)
+			}
+		})
+	}
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := storage.NewMemStorage("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(ctx, "PollCount", metrics.NewCounter("PollCount", 5))
+	s.Add(ctx, "1host.cpu-usage", metrics.NewGauge("1host.cpu-usage", 0.5))
+
+	labeled := metrics.NewGauge("load", 1.5)
+	labeled.Labels = map[string]string{"host": "h1"}
+	s.Add(ctx, metrics.SeriesKey(labeled.ID, labeled.Labels), labeled)
+
+	// ids sanitised to the same name are merged into one family, duplicated series are skipped
+	s.Add(ctx, "cpu-usage", metrics.NewGauge("cpu-usage", 1))
+	s.Add(ctx, "cpu.usage", metrics.NewGauge("cpu.usage", 2))
+	merged := metrics.NewGauge("cpu.usage", 3)
+	merged.Labels = map[string]string{"host": "h1"}
+	s.Add(ctx, metrics.SeriesKey(merged.ID, merged.Labels), merged)
+
+	// metrics conflicting with families of other types are skipped
+	s.Add(ctx, "requests", metrics.NewCounter("requests", 7))
+	s.Add(ctx, "requests_total", metrics.NewGauge("requests_total", 1))
+	latency := metrics.NewHistogram("latency", []float64{1})
+	if err = latency.Observe(0.5); err != nil {
+		t.Fatal(err)
+	}
+	s.Add(ctx, "latency", latency)
+	s.Add(ctx, "latency_sum", metrics.NewGauge("latency_sum", 1))
+
+	r := chi.NewRouter()
+	Setup(r, NewServerHandler(s, nil, nil), "")
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	request, _ := http.NewRequest(http.MethodGet, server.URL+"/metrics", nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+
+	transport := &http.Transport{DisableCompression: true}
+	response, err := (&http.Client{Transport: transport}).Do(request)
+	if err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", response.StatusCode)
+	}
+
+	if response.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("response is not gzipped")
+	}
+
+	zr, err := gzip.NewReader(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "# TYPE PollCount_total counter\nPollCount_total 5\n" +
+		"# TYPE _1host_cpu_usage gauge\n_1host_cpu_usage 0.5\n" +
+		"# TYPE cpu_usage gauge\ncpu_usage 1\ncpu_usage{host=\"h1\"} 3\n" +
+		"# TYPE latency histogram\nlatency_bucket{le=\"1\"} 1\nlatency_bucket{le=\"+Inf\"} 1\nlatency_sum 0.5\nlatency_count 1\n" +
+		"# TYPE load gauge\nload{host=\"h1\"} 1.5\n" +
+		"# TYPE requests_total counter\nrequests_total 7\n"
+	if string(body) != want {
+		t.Errorf("unexpected exposition:\n%s\nwant:\n%s", body, want)
+	}
+}
+
 // func TestUpdateHandler(t *testing.T) {
 // 	type want struct {
 // 		code        int
@@ -48,3 +269,565 @@ package handlers
 // 		})
 // 	}
 // }
+
+func TestSilences(t *testing.T) {
+	s, err := storage.NewMemStorage("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := chi.NewRouter()
+	Setup(r, NewServerHandler(s, nil, nil), "")
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	body := `{"matchers": ["alertname=HighCPU"], "endsAt": "` + time.Now().Add(time.Hour).Format(time.RFC3339) + `", "createdBy": "ops", "comment": "maintenance"}`
+	response, err := http.Post(server.URL+"/api/v1/silences/", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var created models.SilencesResponse
+	err = json.NewDecoder(response.Body).Decode(&created)
+	response.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK || len(created.Data) != 1 || created.Data[0].ID == "" || created.Data[0].State != storage.SilenceActive {
+		t.Fatalf("unexpected create response %d: %+v", response.StatusCode, created)
+	}
+
+	response, err = http.Post(server.URL+"/api/v1/silences/", "application/json", strings.NewReader(`{"matchers": ["alertname=HighCPU"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected bad request for silence without end, got %d", response.StatusCode)
+	}
+
+	for _, tt := range []struct {
+		id        string
+		signature string
+		wantCode  int
+	}{
+		{id: created.Data[0].ID, signature: base64.StdEncoding.EncodeToString([]byte("invalid")), wantCode: http.StatusBadRequest},
+		{id: created.Data[0].ID, wantCode: http.StatusOK},
+		{id: "unknown", wantCode: http.StatusNotFound},
+	} {
+		req, err := http.NewRequest(http.MethodDelete, server.URL+"/api/v1/silences/"+tt.id, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.signature != "" {
+			req.Header.Set("HashSHA256", tt.signature)
+		}
+		response, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != tt.wantCode {
+			t.Errorf("unexpected status of expiring %s: %d, want %d", tt.id, response.StatusCode, tt.wantCode)
+		}
+	}
+
+	response, err = http.Get(server.URL + "/api/v1/silences/?state=expired")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	var listed models.SilencesResponse
+	if err = json.NewDecoder(response.Body).Decode(&listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed.Data) != 1 || listed.Data[0].ID != created.Data[0].ID {
+		t.Errorf("expected expired silence to be listed, got %+v", listed)
+	}
+}
+
+func TestUpdatesJSONAtomic(t *testing.T) {
+	s, err := storage.NewMemStorage("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := NewServerHandler(s, nil, nil)
+
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+		wantPoll string
+	}{
+		{
+			name:     "valid batch",
+			body:     `[{"id": "PollCount", "type": "counter", "delta": 3}, {"id": "PollCount", "type": "counter", "delta": 2}, {"id": "Alloc", "type": "gauge", "value": 1.5}]`,
+			wantCode: http.StatusOK,
+			wantPoll: "5",
+		},
+		{
+			name:     "invalid histogram",
+			body:     `[{"id": "PollCount", "type": "counter", "delta": 10}, {"id": "latency", "type": "histogram", "buckets": [2, 1]}]`,
+			wantCode: http.StatusBadRequest,
+			wantPoll: "5",
+		},
+		{
+			name:     "conflicting buckets",
+			body:     `[{"id": "PollCount", "type": "counter", "delta": 10}, {"id": "latency", "type": "histogram", "buckets": [1], "counts": [1, 0]}, {"id": "latency", "type": "histogram", "buckets": [1, 2], "counts": [1, 0, 0]}]`,
+			wantCode: http.StatusBadRequest,
+			wantPoll: "5",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			srv.UpdatesJSON(w, httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(tt.body)))
+
+			if w.Code != tt.wantCode {
+				t.Errorf("unexpected status %d, want %d", w.Code, tt.wantCode)
+			}
+
+			value, err := s.GetValue(context.Background(), metrics.TypeCounter, "PollCount")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value != tt.wantPoll {
+				t.Errorf("unexpected PollCount %s, want %s", value, tt.wantPoll)
+			}
+		})
+	}
+}
+
+func TestUpdatesJSONPartial(t *testing.T) {
+	s, err := storage.NewMemStorage("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := NewServerHandler(s, nil, nil)
+
+	body := `[{"id": "PollCount", "type": "counter", "delta": 3}, {"id": "latency", "type": "histogram", "buckets": [2, 1]}, {"id": "PollCount", "type": "counter", "delta": 2}, {"id": "Alloc", "type": "unknown"}]`
+
+	r := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(body))
+	r.Header.Set(PartialSuccessHeader, "true")
+
+	w := httptest.NewRecorder()
+	srv.UpdatesJSON(w, r)
+
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("unexpected status %d, want %d", w.Code, http.StatusMultiStatus)
+	}
+
+	var response models.BatchResponse
+	if err = json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Applied != 2 || response.Rejected != 2 || len(response.Results) != 4 {
+		t.Fatalf("unexpected response %+v", response)
+	}
+
+	want := []struct {
+		status string
+		value  string
+		code   int
+	}{
+		{models.BatchItemApplied, "3", 0},
+		{models.BatchItemRejected, "", http.StatusBadRequest},
+		{models.BatchItemApplied, "5", 0},
+		{models.BatchItemRejected, "", http.StatusBadRequest},
+	}
+	for i, result := range response.Results {
+		if result.Index != i || result.Status != want[i].status || result.Value != want[i].value || result.Code != want[i].code {
+			t.Errorf("unexpected result %d: %+v", i, result)
+		}
+		if result.Status == models.BatchItemRejected && result.Error == "" {
+			t.Errorf("expected error message of result %d", i)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	srv.UpdatesJSON(w, httptest.NewRequest(http.MethodPost, "/updates/?partial=true", strings.NewReader(`[{"id": "PollCount", "type": "counter", "delta": 1}]`)))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("unexpected status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestUpdateIdempotency(t *testing.T) {
+	s, err := storage.NewMemStorage("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := NewServerHandler(s, nil, nil)
+	srv.SetIdempotencyStore(idempotency.NewStore(s, time.Minute))
+
+	r := chi.NewRouter()
+	Setup(r, srv, "")
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	send := func(path, key string) *http.Response {
+		request, _ := http.NewRequest(http.MethodPost, server.URL+path, nil)
+		request.Header.Set(idempotency.Header, key)
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("failed to send request: %v", err)
+		}
+		response.Body.Close()
+
+		return response
+	}
+
+	tests := []struct {
+		name         string
+		path         string
+		key          string
+		wantCode     int
+		wantReplayed bool
+		wantPoll     string
+	}{
+		{
+			name:     "first request",
+			path:     "/update/counter/PollCount/3",
+			key:      "k1",
+			wantCode: http.StatusOK,
+			wantPoll: "3",
+		},
+		{
+			name:         "retried request",
+			path:         "/update/counter/PollCount/3",
+			key:          "k1",
+			wantCode:     http.StatusOK,
+			wantReplayed: true,
+			wantPoll:     "3",
+		},
+		{
+			name:     "reused key",
+			path:     "/update/counter/PollCount/5",
+			key:      "k1",
+			wantCode: http.StatusUnprocessableEntity,
+			wantPoll: "3",
+		},
+		{
+			name:     "new key",
+			path:     "/update/counter/PollCount/3",
+			key:      "k2",
+			wantCode: http.StatusOK,
+			wantPoll: "6",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := send(tt.path, tt.key)
+
+			if response.StatusCode != tt.wantCode {
+				t.Errorf("unexpected status %d, want %d", response.StatusCode, tt.wantCode)
+			}
+			if replayed := response.Header.Get(idempotency.ReplayedHeader) == "true"; replayed != tt.wantReplayed {
+				t.Errorf("unexpected replayed %v, want %v", replayed, tt.wantReplayed)
+			}
+
+			value, err := s.GetValue(context.Background(), metrics.TypeCounter, "PollCount")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value != tt.wantPoll {
+				t.Errorf("unexpected PollCount %s, want %s", value, tt.wantPoll)
+			}
+		})
+	}
+}
+
+func TestDeleteValue(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := storage.NewMemStorage("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(ctx, "PollCount", metrics.NewCounter("PollCount", 5))
+
+	r := chi.NewRouter()
+	Setup(r, NewServerHandler(s, nil, nil), "")
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	// request with invalid signature is rejected before deleting
+	request, _ := http.NewRequest(http.MethodDelete, server.URL+"/value/counter/PollCount", nil)
+	request.Header.Set("HashSHA256", base64.StdEncoding.EncodeToString([]byte("invalid")))
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("unexpected status code of invalid signature: %d", response.StatusCode)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		wantCode int
+	}{
+		{
+			name:     "type mismatch",
+			path:     "/value/gauge/PollCount",
+			wantCode: http.StatusConflict,
+		},
+		{
+			name:     "counter",
+			path:     "/value/counter/PollCount",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "deleted counter",
+			path:     "/value/counter/PollCount",
+			wantCode: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, _ := http.NewRequest(http.MethodDelete, server.URL+tt.path, nil)
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+
+			if response.StatusCode != tt.wantCode {
+				t.Fatalf("unexpected status code: %d", response.StatusCode)
+			}
+		})
+	}
+
+	response, err = http.Get(server.URL + "/value/counter/PollCount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("deleted metric is got with status code: %d", response.StatusCode)
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := storage.NewMemStorage("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(ctx, "PollCount", metrics.NewCounter("PollCount", 5))
+
+	r := chi.NewRouter()
+	Setup(r, NewServerHandler(s, nil, nil), "")
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		path     string
+		wantCode int
+		want     models.ErrorResponse
+	}{
+		{
+			name:     "not found",
+			path:     "/value/counter/Missing",
+			wantCode: http.StatusNotFound,
+			want:     models.ErrorResponse{Status: "error", ErrorType: "not_found", Key: "Missing", Type: metrics.TypeCounter},
+		},
+		{
+			name:     "type mismatch",
+			path:     "/value/gauge/PollCount",
+			wantCode: http.StatusConflict,
+			want:     models.ErrorResponse{Status: "error", ErrorType: "type_mismatch", Key: "PollCount", Type: metrics.TypeGauge, StoredType: metrics.TypeCounter},
+		},
+		{
+			name:     "invalid type",
+			path:     "/value/unknown/PollCount",
+			wantCode: http.StatusBadRequest,
+			want:     models.ErrorResponse{Status: "error", ErrorType: "bad_data", Key: "PollCount", Type: "unknown"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := http.Get(server.URL + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+
+			if response.StatusCode != tt.wantCode {
+				t.Fatalf("unexpected status code: %d", response.StatusCode)
+			}
+
+			var body models.ErrorResponse
+			if err = json.NewDecoder(response.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Error == "" {
+				t.Error("error message is empty")
+			}
+			body.Error = ""
+			if body != tt.want {
+				t.Errorf("unexpected error response %+v, want %+v", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestListMetrics(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := storage.NewMemStorage("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(ctx, "PollCount", metrics.NewCounter("PollCount", 5))
+	s.Add(ctx, "cpu", metrics.NewGauge("cpu", 0.5))
+	s.Add(ctx, "mem", metrics.NewGauge("mem", 1.5))
+
+	r := chi.NewRouter()
+	Setup(r, NewServerHandler(s, nil, nil), "")
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		query    string
+		wantCode int
+		wantKeys []string
+		wantNext string
+	}{
+		{
+			name:     "all",
+			wantCode: http.StatusOK,
+			wantKeys: []string{"PollCount", "cpu", "mem"},
+		},
+		{
+			name:     "gauges page",
+			query:    "?type=gauge&limit=1",
+			wantCode: http.StatusOK,
+			wantKeys: []string{"cpu"},
+			wantNext: "cpu",
+		},
+		{
+			name:     "next gauges page",
+			query:    "?type=gauge&limit=1&after=cpu",
+			wantCode: http.StatusOK,
+			wantKeys: []string{"mem"},
+		},
+		{
+			name:     "invalid type",
+			query:    "?type=unknown",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid limit",
+			query:    "?limit=-1",
+			wantCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := http.Get(server.URL + "/api/v1/metrics" + tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+
+			if response.StatusCode != tt.wantCode {
+				t.Fatalf("unexpected status code: %d", response.StatusCode)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			var page models.MetricsPage
+			if err = json.NewDecoder(response.Body).Decode(&page); err != nil {
+				t.Fatal(err)
+			}
+
+			keys := make([]string, 0, len(page.Metrics))
+			for _, m := range page.Metrics {
+				keys = append(keys, m.Key)
+			}
+			if !slices.Equal(keys, tt.wantKeys) {
+				t.Errorf("unexpected keys %v, want %v", keys, tt.wantKeys)
+			}
+			if page.Next != tt.wantNext {
+				t.Errorf("unexpected next %q, want %q", page.Next, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestStaleGauges(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := storage.NewMemStorage("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(ctx, "PollCount", metrics.NewCounter("PollCount", 5))
+	s.Add(ctx, "cpu", metrics.NewGauge("cpu", 0.5))
+
+	time.Sleep(50 * time.Millisecond)
+	s.Add(ctx, "mem", metrics.NewGauge("mem", 1.5))
+
+	srv := NewServerHandler(s, nil, nil)
+	srv.SetStalenessPolicy(storage.StalenessPolicy{StaleAfter: 25 * time.Millisecond})
+
+	r := chi.NewRouter()
+	Setup(r, srv, "")
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	get := func(path string) string {
+		t.Helper()
+
+		response, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code: %d", response.StatusCode)
+		}
+
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+
+	exposition := get("/metrics")
+	want := "# TYPE PollCount_total counter\nPollCount_total 5\n# TYPE mem gauge\nmem 1.5\n"
+	if exposition != want {
+		t.Errorf("unexpected exposition:\n%s\nwant:\n%s", exposition, want)
+	}
+
+	listing := get("/")
+	if strings.Count(listing, "(stale)") != 1 {
+		t.Errorf("expected only cpu gauge marked stale: %s", listing)
+	}
+	for _, line := range strings.Split(listing, "</p>") {
+		if strings.Contains(line, "(stale)") && !strings.Contains(line, "cpu") {
+			t.Errorf("unexpected stale metric: %s", line)
+		}
+	}
+}
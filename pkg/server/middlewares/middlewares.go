@@ -7,12 +7,15 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"github.com/renatus-cartesius/metricserv/pkg/encryption"
+	"github.com/renatus-cartesius/metricserv/pkg/idempotency"
 	"io"
 	"net"
 	"net/http"
 	"strings"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/renatus-cartesius/metricserv/pkg/logger"
 	"go.uber.org/zap"
 )
@@ -214,3 +217,103 @@ func CheckSubnet(subnet *net.IPNet) func(http.Handler) http.Handler {
 		})
 	}
 }
+
+// responseRecorder buffers response of handler, so it can be remembered for idempotency key
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *responseRecorder) Header() http.Header {
+	return rr.header
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	return rr.body.Write(b)
+}
+
+func (rr *responseRecorder) WriteHeader(statusCode int) {
+	if rr.status == 0 {
+		rr.status = statusCode
+	}
+}
+
+// Idempotency runs request with Idempotency-Key header once per store window and replays its response for duplicates.
+// Responses with server errors are not remembered, so such requests can be retried. Requests without header
+// or with nil store are passed through.
+func Idempotency(store *idempotency.Store, h http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotency.Header)
+		if store == nil || key == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			logger.Log.Error(
+				"error on reading request body",
+				zap.Error(err),
+			)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewBuffer(body))
+
+		// keys are scoped by route, so metric path parameters are part of fingerprint
+		scope := r.URL.Path
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			scope = rctx.RoutePattern()
+		}
+
+		resp, replayed, err := store.Do(r.Context(), r.Method+" "+scope, key, idempotency.Fingerprint([]byte(r.URL.RequestURI()), body),
+			func() (idempotency.Response, bool) {
+				rec := &responseRecorder{header: make(http.Header)}
+				h.ServeHTTP(rec, r)
+
+				if rec.status == 0 {
+					rec.status = http.StatusOK
+				}
+
+				return idempotency.Response{
+					Status:      rec.status,
+					ContentType: rec.header.Get("Content-Type"),
+					Body:        rec.body.Bytes(),
+				}, rec.status < http.StatusInternalServerError
+			},
+		)
+		if err != nil {
+			switch {
+			case errors.Is(err, idempotency.ErrInvalidKey):
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			case errors.Is(err, idempotency.ErrKeyReused):
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				return
+			}
+
+			logger.Log.Error(
+				"error on deduplicating request",
+				zap.String("key", key),
+				zap.Error(err),
+			)
+			if resp.Status == 0 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if resp.ContentType != "" {
+			w.Header().Set("Content-Type", resp.ContentType)
+		}
+		if replayed {
+			w.Header().Set(idempotency.ReplayedHeader, "true")
+		}
+		w.WriteHeader(resp.Status)
+		w.Write(resp.Body)
+	})
+}
@@ -1,11 +1,215 @@
 // Package models consists of types that used in metric server handlers
 package models
 
+import (
+	"time"
+
+	"github.com/renatus-cartesius/metricserv/pkg/metrics"
+)
+
+// Metric is a JSON representation of metric. Delta is used by counters, Value by gauges,
+// Buckets, Counts, Sum and Count by histograms (Counts are per bucket with the last one for +Inf).
+// Summaries are reported with raw Values and/or Sketch, Quantile is used to request estimated Value of summary.
 type Metric struct {
-	ID    string   `json:"id"`
-	MType string   `json:"type"`
-	Delta *int64   `json:"delta,omitempty"`
-	Value *float64 `json:"value,omitempty"`
+	ID      string            `json:"id"`
+	MType   string            `json:"type"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Delta   *int64            `json:"delta,omitempty"`
+	Value   *float64          `json:"value,omitempty"`
+	Buckets []float64         `json:"buckets,omitempty"`
+	Counts  []uint64          `json:"counts,omitempty"`
+	Sum     *float64          `json:"sum,omitempty"`
+	Count   *uint64           `json:"count,omitempty"`
+
+	Values   []float64       `json:"values,omitempty"`
+	Sketch   *metrics.Sketch `json:"sketch,omitempty"`
+	Quantile *float64        `json:"quantile,omitempty"`
+}
+
+// Key returns storage key of metric built from its id and label set
+func (m *Metric) Key() string {
+	return metrics.SeriesKey(m.ID, m.Labels)
+}
+
+// Histogram builds histogram metric from JSON representation
+func (m *Metric) Histogram() (*metrics.HistogramMetric, error) {
+	if err := metrics.ValidateHistogram(m.Buckets, m.Counts); err != nil {
+		return nil, err
+	}
+
+	histogram := metrics.NewHistogram(m.ID, m.Buckets)
+	histogram.Labels = m.Labels
+	copy(histogram.Counts, m.Counts)
+
+	if m.Sum != nil {
+		histogram.Sum = *m.Sum
+	}
+
+	for _, c := range m.Counts {
+		histogram.Count += c
+	}
+
+	return histogram, nil
+}
+
+// SetHistogram fills JSON representation with state of histogram
+func (m *Metric) SetHistogram(histogram *metrics.HistogramMetric) {
+	m.Buckets = histogram.Buckets
+	m.Counts = histogram.Counts
+	m.Sum = &histogram.Sum
+	m.Count = &histogram.Count
+}
+
+// Summary builds summary metric from observations and sketch of JSON representation
+func (m *Metric) Summary() (*metrics.SummaryMetric, error) {
+	summary := metrics.NewSummary(m.ID)
+	summary.Labels = m.Labels
+
+	if m.Sketch != nil {
+		if err := m.Sketch.Validate(); err != nil {
+			return nil, err
+		}
+		if err := summary.Change(m.Sketch); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := summary.Change(m.Values); err != nil {
+		return nil, err
+	}
+
+	return summary, nil
+}
+
+// SetSummary fills JSON representation with sum and count of summary and value at requested Quantile
+func (m *Metric) SetSummary(summary *metrics.SummaryMetric) error {
+	m.Values = nil
+	m.Sketch = nil
+	m.Sum = &summary.Sketch.Sum
+	m.Count = &summary.Sketch.Count
+
+	if m.Quantile == nil {
+		return nil
+	}
+
+	value, err := summary.Quantile(*m.Quantile)
+	if err != nil {
+		return err
+	}
+	m.Value = &value
+
+	return nil
 }
 
 type MetricsBatch []*Metric
+
+const (
+	BatchItemApplied  = "applied"
+	BatchItemRejected = "rejected"
+)
+
+// BatchItemResult is an outcome of one metric of batch applied in partial mode.
+// Value is a state of metric after update, Code is HTTP status of rejected metric.
+type BatchItemResult struct {
+	Index  int    `json:"index"`
+	ID     string `json:"id"`
+	MType  string `json:"type"`
+	Status string `json:"status"`
+	Value  string `json:"value,omitempty"`
+	Code   int    `json:"code,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BatchResponse is a response of batch update in partial mode
+type BatchResponse struct {
+	Applied  int               `json:"applied"`
+	Rejected int               `json:"rejected"`
+	Results  []BatchItemResult `json:"results"`
+}
+
+// ListedMetric is a metric listed with its key in storage, Stale is set for gauge without recent updates
+type ListedMetric struct {
+	Key    string `json:"key"`
+	Metric Metric `json:"metric"`
+	Stale  bool   `json:"stale,omitempty"`
+}
+
+// MetricsPage is a page of listed metrics, Next is passed as after parameter to list the next page
+type MetricsPage struct {
+	Metrics []ListedMetric `json:"metrics"`
+	Next    string         `json:"next,omitempty"`
+}
+
+// ErrorResponse is a response of failed request on metrics. Key, Type and StoredType of metric are set
+// if error is caused by metric in storage, e.g. it is not found or stored with other type.
+type ErrorResponse struct {
+	Status     string `json:"status"`
+	ErrorType  string `json:"errorType"`
+	Error      string `json:"error"`
+	Key        string `json:"key,omitempty"`
+	Type       string `json:"type,omitempty"`
+	StoredType string `json:"storedType,omitempty"`
+}
+
+// QueryResponse is a response of query API in Prometheus HTTP API format
+type QueryResponse struct {
+	Status    string     `json:"status"`
+	Data      *QueryData `json:"data,omitempty"`
+	ErrorType string     `json:"errorType,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+type QueryData struct {
+	ResultType string        `json:"resultType"`
+	Result     []QueryResult `json:"result"`
+}
+
+// QueryResult is a series of query result. Value is set for instant queries and Values for range queries,
+// each point is a pair of unix timestamp in seconds and string value.
+type QueryResult struct {
+	Metric map[string]string `json:"metric"`
+	Value  []any             `json:"value,omitempty"`
+	Values [][]any           `json:"values,omitempty"`
+}
+
+// AlertsResponse is a response of alerts API
+type AlertsResponse struct {
+	Status string      `json:"status"`
+	Data   *AlertsData `json:"data,omitempty"`
+}
+
+type AlertsData struct {
+	Alerts []Alert `json:"alerts"`
+}
+
+// Alert is a state of alerting rule for one series
+type Alert struct {
+	Rule        string            `json:"rule"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Severity    string            `json:"severity,omitempty"`
+	State       string            `json:"state"`
+	Value       float64           `json:"value"`
+	ActiveAt    time.Time         `json:"activeAt"`
+	FiredAt     *time.Time        `json:"firedAt,omitempty"`
+	ResolvedAt  *time.Time        `json:"resolvedAt,omitempty"`
+}
+
+// SilencesResponse is a response of silences API, Data holds listed or created silences
+type SilencesResponse struct {
+	Status string    `json:"status"`
+	Data   []Silence `json:"data"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// Silence is a silence of alerts matching all Matchers from StartsAt to EndsAt with its State at the time
+// of response. State is ignored in request creating silence.
+type Silence struct {
+	ID        string    `json:"id"`
+	Matchers  []string  `json:"matchers"`
+	StartsAt  time.Time `json:"startsAt"`
+	EndsAt    time.Time `json:"endsAt"`
+	CreatedBy string    `json:"createdBy"`
+	Comment   string    `json:"comment"`
+	State     string    `json:"state"`
+}
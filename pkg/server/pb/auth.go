@@ -0,0 +1,124 @@
+package pb
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	api2 "github.com/renatus-cartesius/metricserv/api"
+	"github.com/renatus-cartesius/metricserv/pkg/logger"
+)
+
+const (
+	// realIPHeader is metadata with address of client, address of peer is used if it is not set
+	realIPHeader = "x-real-ip"
+
+	// hashHeader is metadata with base64 HMAC-SHA256 of deterministically marshaled request
+	hashHeader = "hashsha256"
+)
+
+// signedMethods are methods which must be signed if server has hash key, other calls are verified only if they
+// are signed as HTTP requests are
+var signedMethods = map[string]bool{
+	api2.MetricsService_DeleteMetric_FullMethodName: true,
+}
+
+// AuthInterceptor applies policy of HTTP server to calls: calls are accepted only from TrustedSubnet if it is set,
+// and signatures are verified with HashKey if it is set
+func (s *Server) AuthInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+
+		if s.TrustedSubnet != nil {
+			ip := clientIP(ctx, md)
+			if ip == nil || !s.TrustedSubnet.Contains(ip) {
+				logger.Log.Info(
+					"call from untrusted subnet",
+					zap.String("method", info.FullMethod),
+					zap.String("trusted_subnet", s.TrustedSubnet.String()),
+					zap.Stringer("ip", ip),
+				)
+				return nil, status.Error(codes.PermissionDenied, "call from untrusted subnet")
+			}
+		}
+
+		if s.HashKey == "" {
+			return handler(ctx, req)
+		}
+
+		sums := md.Get(hashHeader)
+		if len(sums) == 0 {
+			if signedMethods[info.FullMethod] {
+				return nil, status.Errorf(codes.Unauthenticated, "call must be signed in %s metadata", hashHeader)
+			}
+			return handler(ctx, req)
+		}
+
+		if err := verifySignature(s.HashKey, req, sums[0]); err != nil {
+			logger.Log.Error(
+				"captured invalid sha256 sum",
+				zap.String("method", info.FullMethod),
+				zap.Error(err),
+			)
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// clientIP returns address from x-real-ip metadata or address of peer
+func clientIP(ctx context.Context, md metadata.MD) net.IP {
+	if ips := md.Get(realIPHeader); len(ips) > 0 {
+		return net.ParseIP(ips[0])
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	if addr, ok := p.Addr.(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// Sign returns base64 HMAC-SHA256 of request for hashsha256 metadata
+func Sign(key string, req proto.Message) (string, error) {
+	payload, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+
+	hash := hmac.New(sha256.New, []byte(key))
+	hash.Write(payload)
+
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
+func verifySignature(key string, req any, sum string) error {
+	msg, ok := req.(proto.Message)
+	if !ok {
+		return status.Error(codes.Internal, "error when verifying signature of request")
+	}
+
+	expected, err := Sign(key, msg)
+	if err != nil {
+		return status.Errorf(codes.Internal, "error when marshaling request: %v", err)
+	}
+
+	if !hmac.Equal([]byte(sum), []byte(expected)) {
+		return status.Error(codes.Unauthenticated, "invalid signature of request")
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package pb
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	api2 "github.com/renatus-cartesius/metricserv/api"
+)
+
+func TestAuthInterceptor(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("10.0.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleteReq := &api2.DeleteMetricRequest{MetricID: "cpu", Type: api2.MetricType_GAUGE}
+	signed, err := Sign("secret", deleteReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := Sign("other", deleteReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		server *Server
+		method string
+		peerIP string
+		md     metadata.MD
+		want   codes.Code
+	}{
+		{
+			name:   "no policy",
+			server: &Server{},
+			method: api2.MetricsService_DeleteMetric_FullMethodName,
+			peerIP: "192.168.0.1",
+			want:   codes.OK,
+		},
+		{
+			name:   "peer in trusted subnet",
+			server: &Server{TrustedSubnet: subnet},
+			method: api2.MetricsService_DeleteMetric_FullMethodName,
+			peerIP: "10.0.0.5",
+			want:   codes.OK,
+		},
+		{
+			name:   "peer out of trusted subnet",
+			server: &Server{TrustedSubnet: subnet},
+			method: api2.MetricsService_DeleteMetric_FullMethodName,
+			peerIP: "192.168.0.1",
+			want:   codes.PermissionDenied,
+		},
+		{
+			name:   "real ip in trusted subnet",
+			server: &Server{TrustedSubnet: subnet},
+			method: api2.MetricsService_DeleteMetric_FullMethodName,
+			peerIP: "192.168.0.1",
+			md:     metadata.Pairs(realIPHeader, "10.0.0.7"),
+			want:   codes.OK,
+		},
+		{
+			name:   "real ip out of trusted subnet",
+			server: &Server{TrustedSubnet: subnet},
+			method: api2.MetricsService_DeleteMetric_FullMethodName,
+			peerIP: "10.0.0.5",
+			md:     metadata.Pairs(realIPHeader, "192.168.0.1"),
+			want:   codes.PermissionDenied,
+		},
+		{
+			name:   "unsigned deletion",
+			server: &Server{HashKey: "secret"},
+			method: api2.MetricsService_DeleteMetric_FullMethodName,
+			peerIP: "10.0.0.5",
+			want:   codes.Unauthenticated,
+		},
+		{
+			name:   "signed deletion",
+			server: &Server{HashKey: "secret"},
+			method: api2.MetricsService_DeleteMetric_FullMethodName,
+			peerIP: "10.0.0.5",
+			md:     metadata.Pairs(hashHeader, signed),
+			want:   codes.OK,
+		},
+		{
+			name:   "deletion signed with other key",
+			server: &Server{HashKey: "secret"},
+			method: api2.MetricsService_DeleteMetric_FullMethodName,
+			peerIP: "10.0.0.5",
+			md:     metadata.Pairs(hashHeader, forged),
+			want:   codes.Unauthenticated,
+		},
+		{
+			name:   "unsigned update",
+			server: &Server{HashKey: "secret"},
+			method: api2.MetricsService_UpdateMetric_FullMethodName,
+			peerIP: "10.0.0.5",
+			want:   codes.OK,
+		},
+		{
+			name:   "update signed with other key",
+			server: &Server{HashKey: "secret"},
+			method: api2.MetricsService_UpdateMetric_FullMethodName,
+			peerIP: "10.0.0.5",
+			md:     metadata.Pairs(hashHeader, forged),
+			want:   codes.Unauthenticated,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := peer.NewContext(context.Background(), &peer.Peer{
+				Addr: &net.TCPAddr{IP: net.ParseIP(tt.peerIP), Port: 40000},
+			})
+			if tt.md != nil {
+				ctx = metadata.NewIncomingContext(ctx, tt.md)
+			}
+
+			called := false
+			handler := func(ctx context.Context, req any) (any, error) {
+				called = true
+				return &emptypb.Empty{}, nil
+			}
+
+			_, err := tt.server.AuthInterceptor()(ctx, deleteReq, &grpc.UnaryServerInfo{FullMethod: tt.method}, handler)
+			if code := status.Code(err); code != tt.want {
+				t.Errorf("call returned %v, want %v", err, tt.want)
+			}
+			if called != (tt.want == codes.OK) {
+				t.Errorf("handler is called %v, call returned %v", called, err)
+			}
+		})
+	}
+}
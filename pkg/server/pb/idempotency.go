@@ -0,0 +1,135 @@
+package pb
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	api2 "github.com/renatus-cartesius/metricserv/api"
+	"github.com/renatus-cartesius/metricserv/pkg/idempotency"
+	"github.com/renatus-cartesius/metricserv/pkg/logger"
+)
+
+// idempotentMethods are methods changing metrics, which are deduplicated by idempotency key
+var idempotentMethods = map[string]bool{
+	api2.MetricsService_AddMetric_FullMethodName:    true,
+	api2.MetricsService_UpdateMetric_FullMethodName: true,
+	api2.MetricsService_UpdateBatch_FullMethodName:  true,
+}
+
+// IdempotencyInterceptor runs changing calls with idempotency-key metadata once per store window and replays
+// their responses for duplicates. Only successful calls and calls rejected as invalid are remembered.
+func IdempotencyInterceptor(store *idempotency.Store) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if store == nil || !idempotentMethods[info.FullMethod] {
+			return handler(ctx, req)
+		}
+
+		md, _ := metadata.FromIncomingContext(ctx)
+		keys := md.Get(strings.ToLower(idempotency.Header))
+		if len(keys) == 0 {
+			return handler(ctx, req)
+		}
+
+		msg, ok := req.(proto.Message)
+		if !ok {
+			return handler(ctx, req)
+		}
+		payload, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "error when marshaling request: %v", err)
+		}
+
+		var handlerResp any
+		var handlerErr error
+		var called bool
+
+		resp, replayed, err := store.Do(ctx, info.FullMethod, keys[0], idempotency.Fingerprint(payload),
+			func() (idempotency.Response, bool) {
+				handlerResp, handlerErr = handler(ctx, req)
+				called = true
+				return rememberedResponse(handlerResp, handlerErr)
+			},
+		)
+		if err != nil {
+			switch {
+			case errors.Is(err, idempotency.ErrInvalidKey):
+				return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+			case errors.Is(err, idempotency.ErrKeyReused):
+				return nil, status.Errorf(codes.FailedPrecondition, "%v", err)
+			}
+
+			logger.Log.Error(
+				"error on deduplicating call",
+				zap.String("method", info.FullMethod),
+				zap.String("key", keys[0]),
+				zap.Error(err),
+			)
+			if !called {
+				return nil, status.Errorf(codes.Internal, "error when deduplicating call: %v", err)
+			}
+		}
+
+		if !replayed {
+			return handlerResp, handlerErr
+		}
+
+		grpc.SetHeader(ctx, metadata.Pairs(strings.ToLower(idempotency.ReplayedHeader), "true"))
+
+		return replayedResponse(resp)
+	}
+}
+
+// rememberedResponse converts outcome of call to response remembered by store
+func rememberedResponse(resp any, err error) (idempotency.Response, bool) {
+	if err != nil {
+		st, _ := status.FromError(err)
+		return idempotency.Response{
+			Status: int(st.Code()),
+			Body:   []byte(st.Message()),
+		}, st.Code() == codes.InvalidArgument
+	}
+
+	msg, ok := resp.(proto.Message)
+	if !ok {
+		return idempotency.Response{}, false
+	}
+
+	body, err := anypb.New(msg)
+	if err != nil {
+		return idempotency.Response{}, false
+	}
+
+	data, err := proto.Marshal(body)
+	if err != nil {
+		return idempotency.Response{}, false
+	}
+
+	return idempotency.Response{Status: int(codes.OK), Body: data}, true
+}
+
+func replayedResponse(resp idempotency.Response) (any, error) {
+	if codes.Code(resp.Status) != codes.OK {
+		return nil, status.Error(codes.Code(resp.Status), string(resp.Body))
+	}
+
+	var body anypb.Any
+	if err := proto.Unmarshal(resp.Body, &body); err != nil {
+		return nil, status.Errorf(codes.Internal, "error when unmarshaling remembered response: %v", err)
+	}
+
+	msg, err := body.UnmarshalNew()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error when unmarshaling remembered response: %v", err)
+	}
+
+	return msg, nil
+}
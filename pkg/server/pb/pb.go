@@ -2,84 +2,515 @@ package pb
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	api2 "github.com/renatus-cartesius/metricserv/api"
+	"github.com/renatus-cartesius/metricserv/pkg/alerting"
 	"github.com/renatus-cartesius/metricserv/pkg/encryption"
 	"github.com/renatus-cartesius/metricserv/pkg/logger"
 	"github.com/renatus-cartesius/metricserv/pkg/metrics"
+	"github.com/renatus-cartesius/metricserv/pkg/query"
+	"github.com/renatus-cartesius/metricserv/pkg/server/service"
 	"github.com/renatus-cartesius/metricserv/pkg/storage"
 	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"net"
 	"strconv"
+	"time"
 )
 
+// errorDomain is a domain of error info details
+const errorDomain = "metricserv"
+
 type Server struct {
 	api2.UnimplementedMetricsServiceServer
 
 	TrustedSubnet *net.IPNet
-	Storage       storage.Storager
-	EncProcessor  encryption.Processor
+	// HashKey is a key of HMAC signatures of calls, see AuthInterceptor
+	HashKey      string
+	Storage      storage.Storager
+	Service      *service.MetricService
+	EncProcessor encryption.Processor
+	Alerts       *alerting.Manager
 }
 
+// AddMetric changes metric as UpdateMetric does without returning its new value
 func (s *Server) AddMetric(ctx context.Context, in *api2.AddMetricRequest) (*emptypb.Empty, error) {
+	update, err := batchUpdate(in)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid metric %v: %v", in.GetMetricID(), err)
+	}
 
-	var metric metrics.Metric
-	var metricType string
+	if _, err = s.Service.Update(ctx, update); err != nil {
+		return nil, metricError(err, "error when adding metric %v", in.MetricID)
+	}
 
-	switch in.Metric.Type {
-	case api2.MetricType_COUNTER:
+	logger.Log.Info(
+		"added metric",
+		zap.String("metricID", in.MetricID),
+		zap.String("type", update.Metric.GetType()),
+	)
+
+	return &emptypb.Empty{}, nil
+}
+
+func (s *Server) GetMetric(ctx context.Context, in *api2.GetMetricRequest) (*api2.GetMetricResponse, error) {
+	metricType, ok := metricTypes[in.Type]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown type of metric: %v", in.MetricID)
+	}
+
+	value, err := s.Service.Value(ctx, metricType, metrics.SeriesKey(in.MetricID, in.Labels))
+	if err != nil {
+		return nil, metricError(err, "error when getting %s metric %v", metricType, in.MetricID)
+	}
+
+	return metricResponse(in.MetricID, metricType, value, in.Quantile)
+}
+
+// UpdateMetric changes metric as batch of single metric does and returns its new value
+func (s *Server) UpdateMetric(ctx context.Context, in *api2.AddMetricRequest) (*api2.GetMetricResponse, error) {
+	update, err := batchUpdate(in)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid metric %v: %v", in.GetMetricID(), err)
+	}
 
-		metricType = metrics.TypeCounter
-		value, err := strconv.ParseInt(in.Metric.Value, 10, 64)
+	value, err := s.Service.Update(ctx, update)
+	if err != nil {
+		return nil, metricError(err, "error when updating metric %v", in.MetricID)
+	}
+
+	return metricResponse(in.MetricID, update.Metric.GetType(), value, nil)
+}
+
+// metricResponse converts value of metric from storage to response, histogram is parsed into its buckets
+// and summary value is replaced with estimated quantile if it is requested
+func metricResponse(id, mtype, value string, quantile *float64) (*api2.GetMetricResponse, error) {
+	response := &api2.GetMetricResponse{Value: value}
+
+	switch mtype {
+	case metrics.TypeHistogram:
+		histogram, err := metrics.ParseHistogramValue(id, value)
 		if err != nil {
-			return nil, status.Errorf(codes.Internal, "error when parsing int64: %v", in.Metric.Value)
+			return nil, status.Errorf(codes.Internal, "error when parsing histogram metric: %v", id)
+		}
+		response.Histogram = protoHistogram(histogram)
+	case metrics.TypeSummary:
+		if quantile == nil {
+			break
 		}
 
-		metric = metrics.NewCounter(in.MetricID, value)
-	case api2.MetricType_GAUGE:
-		metricType = metrics.TypeGauge
-		value, err := strconv.ParseFloat(in.Metric.Value, 32)
+		summary, err := metrics.ParseSummaryValue(id, value)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "error when parsing summary metric: %v", id)
+		}
+
+		estimated, err := summary.Quantile(*quantile)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "error when estimating quantile of %v: %v", id, err)
+		}
+		response.Value = strconv.FormatFloat(estimated, 'g', -1, 64)
+	}
+
+	return response, nil
+}
+
+func protoHistogram(histogram *metrics.HistogramMetric) *api2.Histogram {
+	return &api2.Histogram{
+		Buckets: histogram.Buckets,
+		Counts:  histogram.Counts,
+		Sum:     histogram.Sum,
+		Count:   histogram.Count,
+	}
+}
+
+// protoMetric converts metric to its api representation, summary value is JSON of its sketch
+func protoMetric(metric metrics.Metric) (*api2.Metric, error) {
+	m := &api2.Metric{
+		Labels: metric.GetLabels(),
+		Value:  metric.GetValue(),
+	}
+
+	switch metric := metric.(type) {
+	case *metrics.CounterMetric:
+		m.Type = api2.MetricType_COUNTER
+	case *metrics.GaugeMetric:
+		m.Type = api2.MetricType_GAUGE
+	case *metrics.HistogramMetric:
+		m.Type = api2.MetricType_HISTOGRAM
+		m.Value = ""
+		m.Histogram = protoHistogram(metric)
+	case *metrics.SummaryMetric:
+		m.Type = api2.MetricType_SUMMARY
+	default:
+		return nil, service.InvalidType(metric.GetType(), metric.GetID())
+	}
+
+	return m, nil
+}
+
+// ListMetrics lists page of metrics filtered by type, prefix of id and labels
+func (s *Server) ListMetrics(ctx context.Context, in *api2.ListMetricsRequest) (*api2.ListMetricsResponse, error) {
+	opts := service.ListOptions{
+		Prefix: in.Prefix,
+		Labels: in.Labels,
+		After:  in.PageToken,
+		Limit:  int(in.PageSize),
+	}
+	if in.Type != nil {
+		metricType, ok := metricTypes[in.GetType()]
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "unknown type of metrics: %v", in.GetType())
+		}
+		opts.Type = metricType
+	}
+
+	listed, next, err := s.Service.List(ctx, opts)
+	if err != nil {
+		return nil, metricError(err, "error when listing metrics")
+	}
 
+	response := &api2.ListMetricsResponse{
+		Metrics:       make([]*api2.ListedMetric, 0, len(listed)),
+		NextPageToken: next,
+	}
+	for _, l := range listed {
+		metric, err := protoMetric(l.Metric)
 		if err != nil {
-			return nil, status.Errorf(codes.Internal, "error when parsing float32: %v", in.Metric.Value)
+			return nil, status.Errorf(codes.Internal, "error when converting metric %v: %v", l.Key, err)
 		}
+		response.Metrics = append(response.Metrics, &api2.ListedMetric{
+			Key:      l.Key,
+			MetricID: l.Metric.GetID(),
+			Metric:   metric,
+			Stale:    l.Stale,
+		})
+	}
+
+	return response, nil
+}
+
+// Ping checks if storage is reachable
+func (s *Server) Ping(ctx context.Context, _ *emptypb.Empty) (*emptypb.Empty, error) {
+	if err := s.Service.Ping(ctx); err != nil {
+		return nil, metricError(err, "error when pinging storage")
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// metricTypes maps types of metrics in api to storage ones
+var metricTypes = map[api2.MetricType]string{
+	api2.MetricType_COUNTER:   metrics.TypeCounter,
+	api2.MetricType_GAUGE:     metrics.TypeGauge,
+	api2.MetricType_HISTOGRAM: metrics.TypeHistogram,
+	api2.MetricType_SUMMARY:   metrics.TypeSummary,
+}
 
-		metric = metrics.NewGauge(in.MetricID, value)
+// DeleteMetric deletes metric with its history
+func (s *Server) DeleteMetric(ctx context.Context, in *api2.DeleteMetricRequest) (*emptypb.Empty, error) {
+	metricType, ok := metricTypes[in.Type]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown type of metric: %v", in.MetricID)
+	}
+
+	key := metrics.SeriesKey(in.MetricID, in.Labels)
+	if err := s.Service.Delete(ctx, metricType, key); err != nil {
+		return nil, metricError(err, "error when deleting metric %v", in.MetricID)
 	}
 
 	logger.Log.Info(
-		"added metric",
-		zap.String("metricID", in.MetricID),
+		"deleted metric",
 		zap.String("type", metricType),
+		zap.String("key", key),
 	)
 
-	err := s.Storage.Add(ctx, metric.GetID(), metric)
+	return &emptypb.Empty{}, nil
+}
+
+func (s *Server) Query(ctx context.Context, in *api2.QueryRequest) (*api2.QueryResponse, error) {
+	engine := query.NewEngine(s.Storage)
+	response := &api2.QueryResponse{}
+
+	if in.Step == nil {
+		ts := time.Now()
+		if in.Time != nil {
+			ts = in.Time.AsTime()
+		}
 
-	return &emptypb.Empty{}, err
+		vector, err := engine.Query(ctx, in.Query, ts)
+		if err != nil {
+			return nil, queryError(err)
+		}
+
+		for _, sample := range vector {
+			response.Series = append(response.Series, &api2.Series{
+				Labels: sample.Labels,
+				Points: []*api2.Point{{Timestamp: timestamppb.New(ts), Value: sample.Value}},
+			})
+		}
+
+		return response, nil
+	}
+
+	end := time.Now()
+	if in.End != nil {
+		end = in.End.AsTime()
+	}
+	start := end.Add(-time.Hour)
+	if in.Start != nil {
+		start = in.Start.AsTime()
+	}
+
+	matrix, err := engine.QueryRange(ctx, in.Query, start, end, in.Step.AsDuration())
+	if err != nil {
+		return nil, queryError(err)
+	}
+
+	for _, series := range matrix {
+		points := make([]*api2.Point, 0, len(series.Points))
+		for _, point := range series.Points {
+			points = append(points, &api2.Point{Timestamp: timestamppb.New(point.Timestamp), Value: point.Value})
+		}
+		response.Series = append(response.Series, &api2.Series{
+			Labels: series.Labels,
+			Points: points,
+		})
+	}
+
+	return response, nil
 }
 
-func (s *Server) GetMetric(ctx context.Context, in *api2.GetMetricRequest) (*api2.GetMetricResponse, error) {
-	var response api2.GetMetricResponse
-	var err error
+func queryError(err error) error {
+	var parseErr *query.ParseError
+	if errors.As(err, &parseErr) || errors.Is(err, query.ErrInvalidStep) || errors.Is(err, query.ErrTooManyPoints) {
+		return status.Errorf(codes.InvalidArgument, "invalid query: %v", err)
+	}
+	return status.Errorf(codes.Internal, "error when evaluating query: %v", err)
+}
 
-	switch in.Type {
-	case api2.MetricType_COUNTER:
-		response.Value, err = s.Storage.GetValue(ctx, metrics.TypeCounter, in.MetricID)
+var alertStates = map[string]api2.AlertState{
+	alerting.StatePending:  api2.AlertState_PENDING,
+	alerting.StateFiring:   api2.AlertState_FIRING,
+	alerting.StateResolved: api2.AlertState_RESOLVED,
+}
+
+// ListAlerts lists current alerts, optionally filtered by state
+func (s *Server) ListAlerts(ctx context.Context, in *api2.ListAlertsRequest) (*api2.ListAlertsResponse, error) {
+	response := &api2.ListAlertsResponse{}
+
+	if s.Alerts == nil {
+		return response, nil
+	}
+
+	for _, alert := range s.Alerts.Alerts() {
+		state := alertStates[alert.State]
+		if in.State != nil && *in.State != state {
+			continue
+		}
+
+		a := &api2.Alert{
+			Rule:        alert.Rule,
+			Labels:      alert.Labels,
+			Annotations: alert.Annotations,
+			Severity:    alert.Severity,
+			State:       state,
+			Value:       alert.Value,
+			ActiveAt:    timestamppb.New(alert.ActiveAt),
+		}
+		if alert.FiredAt != nil {
+			a.FiredAt = timestamppb.New(*alert.FiredAt)
+		}
+		if alert.ResolvedAt != nil {
+			a.ResolvedAt = timestamppb.New(*alert.ResolvedAt)
+		}
+
+		response.Alerts = append(response.Alerts, a)
+	}
 
+	return response, nil
+}
+
+// UpdateBatch applies batch of metrics atomically, or each metric separately in partial mode
+func (s *Server) UpdateBatch(ctx context.Context, in *api2.UpdateBatchRequest) (*api2.UpdateBatchResponse, error) {
+	if in.Partial {
+		return s.updateBatchPartial(ctx, in), nil
+	}
+
+	updates := make([]storage.BatchUpdate, 0, len(in.Metrics))
+	for i, m := range in.Metrics {
+		update, err := batchUpdate(m)
 		if err != nil {
-			return nil, status.Errorf(codes.Internal, "error when getting counter metric: %v", in.MetricID)
+			return nil, status.Errorf(codes.InvalidArgument, "invalid metric %d of batch: %v", i, err)
 		}
+		updates = append(updates, update)
+	}
 
-	case api2.MetricType_GAUGE:
-		response.Value, err = s.Storage.GetValue(ctx, metrics.TypeGauge, in.MetricID)
+	if err := s.Service.UpdateBatch(ctx, updates); err != nil {
+		return nil, metricError(err, "error when updating batch")
+	}
 
+	response := &api2.UpdateBatchResponse{Results: make([]*api2.BatchItemResult, 0, len(updates))}
+	for i, update := range updates {
+		value, err := s.Service.Value(ctx, update.Metric.GetType(), update.Key)
 		if err != nil {
-			return nil, status.Errorf(codes.Internal, "error when getting gauge metric: %v", in.MetricID)
+			return nil, metricError(err, "error when getting metric %v", in.Metrics[i].MetricID)
 		}
+		response.Results = append(response.Results, &api2.BatchItemResult{
+			Index:    uint32(i),
+			MetricID: in.Metrics[i].MetricID,
+			Applied:  true,
+			Value:    value,
+		})
 	}
 
-	return &response, err
+	return response, nil
+}
 
+func (s *Server) updateBatchPartial(ctx context.Context, in *api2.UpdateBatchRequest) *api2.UpdateBatchResponse {
+	response := &api2.UpdateBatchResponse{Results: make([]*api2.BatchItemResult, 0, len(in.Metrics))}
+
+	for i, m := range in.Metrics {
+		result := &api2.BatchItemResult{
+			Index:    uint32(i),
+			MetricID: m.GetMetricID(),
+		}
+
+		value, err := s.updateOne(ctx, m)
+		if err != nil {
+			st, _ := status.FromError(err)
+			result.Code = uint32(st.Code())
+			result.Message = st.Message()
+		} else {
+			result.Applied = true
+			result.Value = value
+		}
+
+		response.Results = append(response.Results, result)
+	}
+
+	return response
+}
+
+// updateOne applies single metric of batch and returns its new value
+func (s *Server) updateOne(ctx context.Context, in *api2.AddMetricRequest) (string, error) {
+	update, err := batchUpdate(in)
+	if err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "invalid metric: %v", err)
+	}
+
+	value, err := s.Service.Update(ctx, update)
+	if err != nil {
+		return "", metricError(err, "error when updating metric")
+	}
+
+	return value, nil
+}
+
+// batchUpdate converts metric of batch to storage update
+func batchUpdate(in *api2.AddMetricRequest) (storage.BatchUpdate, error) {
+	if in.GetMetric() == nil {
+		return storage.BatchUpdate{}, errors.New("metric is not set")
+	}
+
+	metricType, ok := metricTypes[in.Metric.Type]
+	if !ok {
+		metricType = in.Metric.Type.String()
+	}
+
+	var value any
+	switch in.Metric.Type {
+	case api2.MetricType_COUNTER:
+		delta, err := strconv.ParseInt(in.Metric.Value, 10, 64)
+		if err != nil {
+			return storage.BatchUpdate{}, err
+		}
+		value = delta
+	case api2.MetricType_GAUGE:
+		gauge, err := strconv.ParseFloat(in.Metric.Value, 64)
+		if err != nil {
+			return storage.BatchUpdate{}, err
+		}
+		value = gauge
+	case api2.MetricType_HISTOGRAM:
+		if in.Metric.Histogram == nil {
+			return storage.BatchUpdate{}, errors.New("histogram is not set")
+		}
+		if err := metrics.ValidateHistogram(in.Metric.Histogram.Buckets, in.Metric.Histogram.Counts); err != nil {
+			return storage.BatchUpdate{}, err
+		}
+
+		delta := metrics.NewHistogram(in.MetricID, in.Metric.Histogram.Buckets)
+		delta.Labels = in.Metric.Labels
+		copy(delta.Counts, in.Metric.Histogram.Counts)
+		delta.Sum = in.Metric.Histogram.Sum
+		for _, c := range delta.Counts {
+			delta.Count += c
+		}
+		value = delta
+	case api2.MetricType_SUMMARY:
+		delta := metrics.NewSummary(in.MetricID)
+		delta.Labels = in.Metric.Labels
+		if err := delta.Change(in.Metric.Observations); err != nil {
+			return storage.BatchUpdate{}, err
+		}
+		value = delta
+	}
+
+	return service.NewUpdate(metricType, in.MetricID, in.Metric.Labels, value)
+}
+
+// errorReasons are reasons of error info details by codes of errors
+var errorReasons = map[codes.Code]string{
+	codes.NotFound:           "METRIC_NOT_FOUND",
+	codes.FailedPrecondition: "METRIC_TYPE_MISMATCH",
+	codes.InvalidArgument:    "INVALID_METRIC",
+	codes.Unavailable:        "STORAGE_UNAVAILABLE",
+}
+
+// errorCode maps error of operation on metric to grpc code
+func errorCode(err error) codes.Code {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return codes.NotFound
+	case errors.Is(err, storage.ErrTypeMismatch):
+		return codes.FailedPrecondition
+	case errors.Is(err, storage.ErrUnavailable):
+		return codes.Unavailable
+	case service.IsInvalid(err):
+		return codes.InvalidArgument
+	}
+	return codes.Internal
+}
+
+// metricError converts error of operation on metric to status with code of error. Status has error info
+// in details, metric of storage error is passed in its metadata.
+func metricError(err error, format string, args ...any) error {
+	code := errorCode(err)
+	st := status.New(code, fmt.Sprintf(format, args...)+": "+err.Error())
+
+	reason, ok := errorReasons[code]
+	if !ok {
+		reason = "INTERNAL"
+	}
+	info := &errdetails.ErrorInfo{Reason: reason, Domain: errorDomain}
+
+	var metricErr *storage.MetricError
+	if errors.As(err, &metricErr) {
+		info.Metadata = map[string]string{
+			"key":  metricErr.Key,
+			"type": metricErr.Type,
+		}
+		if metricErr.StoredType != "" {
+			info.Metadata["storedType"] = metricErr.StoredType
+		}
+	}
+
+	if detailed, err := st.WithDetails(info); err == nil {
+		st = detailed
+	}
+	return st.Err()
 }
@@ -0,0 +1,418 @@
+package pb
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+
+	api2 "github.com/renatus-cartesius/metricserv/api"
+	"github.com/renatus-cartesius/metricserv/pkg/idempotency"
+	"github.com/renatus-cartesius/metricserv/pkg/server/service"
+	"github.com/renatus-cartesius/metricserv/pkg/storage"
+)
+
+// newClient serves storage over in-memory connection with interceptors of server and returns client of it
+func newClient(t *testing.T, s storage.Storager) api2.MetricsServiceClient {
+	t.Helper()
+
+	server := &Server{Storage: s, Service: service.NewMetricService(s)}
+
+	listener := bufconn.Listen(1 << 20)
+	gs := grpc.NewServer(grpc.ChainUnaryInterceptor(
+		server.AuthInterceptor(),
+		IdempotencyInterceptor(idempotency.NewStore(s, time.Hour)),
+	))
+	api2.RegisterMetricsServiceServer(gs, server)
+	go gs.Serve(listener)
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return api2.NewMetricsServiceClient(conn)
+}
+
+func newMemClient(t *testing.T) api2.MetricsServiceClient {
+	t.Helper()
+
+	s, err := storage.NewMemStorage("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return newClient(t, s)
+}
+
+func counter(id, value string) *api2.AddMetricRequest {
+	return &api2.AddMetricRequest{MetricID: id, Metric: &api2.Metric{Type: api2.MetricType_COUNTER, Value: value}}
+}
+
+func gauge(id, value string) *api2.AddMetricRequest {
+	return &api2.AddMetricRequest{MetricID: id, Metric: &api2.Metric{Type: api2.MetricType_GAUGE, Value: value}}
+}
+
+// checkError checks code of error and reason and metadata of its error info if reason is set
+func checkError(t *testing.T, err error, code codes.Code, reason string, md map[string]string) {
+	t.Helper()
+
+	st := status.Convert(err)
+	if st.Code() != code {
+		t.Fatalf("call returned %v, want %v", err, code)
+	}
+	if reason == "" {
+		return
+	}
+
+	for _, detail := range st.Details() {
+		info, ok := detail.(*errdetails.ErrorInfo)
+		if !ok {
+			continue
+		}
+		if info.Reason != reason || info.Domain != errorDomain {
+			t.Errorf("unexpected error info %v, want reason %s", info, reason)
+		}
+		for name, value := range md {
+			if info.Metadata[name] != value {
+				t.Errorf("error info metadata %s is %q, want %q", name, info.Metadata[name], value)
+			}
+		}
+		return
+	}
+	t.Errorf("error %v has no error info", err)
+}
+
+func getValue(t *testing.T, client api2.MetricsServiceClient, id string, mtype api2.MetricType) string {
+	t.Helper()
+
+	resp, err := client.GetMetric(context.Background(), &api2.GetMetricRequest{MetricID: id, Type: mtype})
+	if err != nil {
+		t.Fatalf("error on getting %s: %v", id, err)
+	}
+	return resp.Value
+}
+
+func TestAddMetric(t *testing.T) {
+	ctx := context.Background()
+	client := newMemClient(t)
+
+	for _, req := range []*api2.AddMetricRequest{counter("requests", "5"), counter("requests", "3"), gauge("cpu", "0.5")} {
+		if _, err := client.AddMetric(ctx, req); err != nil {
+			t.Fatalf("error on adding %s: %v", req.MetricID, err)
+		}
+	}
+	if value := getValue(t, client, "requests", api2.MetricType_COUNTER); value != "8" {
+		t.Errorf("unexpected counter value %s", value)
+	}
+	if value := getValue(t, client, "cpu", api2.MetricType_GAUGE); value != "0.5" {
+		t.Errorf("unexpected gauge value %s", value)
+	}
+
+	_, err := client.AddMetric(ctx, gauge("requests", "1.5"))
+	checkError(t, err, codes.FailedPrecondition, "METRIC_TYPE_MISMATCH", map[string]string{
+		"key":        "requests",
+		"type":       "gauge",
+		"storedType": "counter",
+	})
+
+	_, err = client.AddMetric(ctx, counter("requests", "1.5"))
+	checkError(t, err, codes.InvalidArgument, "", nil)
+
+	_, err = client.AddMetric(ctx, &api2.AddMetricRequest{MetricID: "requests"})
+	checkError(t, err, codes.InvalidArgument, "", nil)
+
+	// non-finite sum is rejected when merged, histogram is left unchanged
+	histogram := func(sum float64) *api2.AddMetricRequest {
+		return &api2.AddMetricRequest{MetricID: "latency", Metric: &api2.Metric{
+			Type:      api2.MetricType_HISTOGRAM,
+			Histogram: &api2.Histogram{Buckets: []float64{1}, Counts: []uint64{1, 0}, Sum: sum},
+		}}
+	}
+	if _, err = client.AddMetric(ctx, histogram(0.5)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.AddMetric(ctx, histogram(math.Inf(1)))
+	checkError(t, err, codes.InvalidArgument, "INVALID_METRIC", nil)
+
+	resp, err := client.GetMetric(ctx, &api2.GetMetricRequest{MetricID: "latency", Type: api2.MetricType_HISTOGRAM})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Histogram.GetCount() != 1 || resp.Histogram.GetSum() != 0.5 {
+		t.Errorf("histogram is changed by rejected sum: %v", resp.Histogram)
+	}
+}
+
+func TestUpdateMetric(t *testing.T) {
+	ctx := context.Background()
+	client := newMemClient(t)
+
+	for _, want := range []string{"5", "10"} {
+		resp, err := client.UpdateMetric(ctx, counter("requests", "5"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Value != want {
+			t.Errorf("update returned value %s, want %s", resp.Value, want)
+		}
+	}
+
+	resp, err := client.UpdateMetric(ctx, &api2.AddMetricRequest{MetricID: "latency", Metric: &api2.Metric{
+		Type:      api2.MetricType_HISTOGRAM,
+		Histogram: &api2.Histogram{Buckets: []float64{0.1, 1}, Counts: []uint64{1, 2, 0}, Sum: 1.5},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Histogram.GetCount() != 3 || resp.Histogram.GetSum() != 1.5 {
+		t.Errorf("unexpected histogram %v", resp.Histogram)
+	}
+
+	_, err = client.UpdateMetric(ctx, &api2.AddMetricRequest{MetricID: "latency", Metric: &api2.Metric{
+		Type:      api2.MetricType_HISTOGRAM,
+		Histogram: &api2.Histogram{Buckets: []float64{0.5}, Counts: []uint64{1, 0}},
+	}})
+	checkError(t, err, codes.InvalidArgument, "INVALID_METRIC", nil)
+
+	_, err = client.UpdateMetric(ctx, gauge("requests", "1"))
+	checkError(t, err, codes.FailedPrecondition, "METRIC_TYPE_MISMATCH", map[string]string{"storedType": "counter"})
+
+	_, err = client.UpdateMetric(ctx, gauge("cpu", "high"))
+	checkError(t, err, codes.InvalidArgument, "", nil)
+}
+
+func TestUpdateBatch(t *testing.T) {
+	ctx := context.Background()
+	client := newMemClient(t)
+
+	if _, err := client.AddMetric(ctx, counter("requests", "1")); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.UpdateBatch(ctx, &api2.UpdateBatchRequest{
+		Metrics: []*api2.AddMetricRequest{counter("requests", "2"), gauge("cpu", "0.5"), counter("requests", "3")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Results) != 3 || !resp.Results[0].Applied || resp.Results[1].Value != "0.5" || resp.Results[2].Value != "6" {
+		t.Errorf("unexpected results %v", resp.Results)
+	}
+
+	// batch is rejected as a whole
+	_, err = client.UpdateBatch(ctx, &api2.UpdateBatchRequest{
+		Metrics: []*api2.AddMetricRequest{counter("requests", "2"), gauge("requests", "0.5")},
+	})
+	checkError(t, err, codes.FailedPrecondition, "METRIC_TYPE_MISMATCH", map[string]string{"key": "requests"})
+
+	_, err = client.UpdateBatch(ctx, &api2.UpdateBatchRequest{
+		Metrics: []*api2.AddMetricRequest{counter("requests", "2"), counter("requests", "two")},
+	})
+	checkError(t, err, codes.InvalidArgument, "", nil)
+
+	if value := getValue(t, client, "requests", api2.MetricType_COUNTER); value != "6" {
+		t.Errorf("rejected batch changed counter: %s", value)
+	}
+
+	// valid metrics of partial batch are applied
+	resp, err = client.UpdateBatch(ctx, &api2.UpdateBatchRequest{
+		Metrics: []*api2.AddMetricRequest{counter("requests", "2"), gauge("requests", "0.5"), counter("errors", "two")},
+		Partial: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []codes.Code{codes.OK, codes.FailedPrecondition, codes.InvalidArgument} {
+		result := resp.Results[i]
+		if codes.Code(result.Code) != want || result.Applied != (want == codes.OK) {
+			t.Errorf("unexpected result %d: %v, want %v", i, result, want)
+		}
+	}
+	if value := getValue(t, client, "requests", api2.MetricType_COUNTER); value != "8" {
+		t.Errorf("unexpected counter value after partial batch: %s", value)
+	}
+}
+
+func TestDeleteMetric(t *testing.T) {
+	ctx := context.Background()
+	client := newMemClient(t)
+
+	labels := map[string]string{"host": "web-1"}
+	_, err := client.AddMetric(ctx, &api2.AddMetricRequest{
+		MetricID: "cpu",
+		Metric:   &api2.Metric{Type: api2.MetricType_GAUGE, Value: "0.5", Labels: labels},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.DeleteMetric(ctx, &api2.DeleteMetricRequest{MetricID: "cpu", Type: api2.MetricType_COUNTER, Labels: labels})
+	checkError(t, err, codes.FailedPrecondition, "METRIC_TYPE_MISMATCH", map[string]string{"storedType": "gauge"})
+
+	if _, err = client.DeleteMetric(ctx, &api2.DeleteMetricRequest{MetricID: "cpu", Type: api2.MetricType_GAUGE, Labels: labels}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.GetMetric(ctx, &api2.GetMetricRequest{MetricID: "cpu", Type: api2.MetricType_GAUGE, Labels: labels})
+	checkError(t, err, codes.NotFound, "METRIC_NOT_FOUND", map[string]string{"key": `cpu{host="web-1"}`, "type": "gauge"})
+
+	_, err = client.DeleteMetric(ctx, &api2.DeleteMetricRequest{MetricID: "cpu", Type: api2.MetricType_GAUGE, Labels: labels})
+	checkError(t, err, codes.NotFound, "METRIC_NOT_FOUND", map[string]string{"type": "gauge"})
+
+	_, err = client.DeleteMetric(ctx, &api2.DeleteMetricRequest{MetricID: "cpu", Type: api2.MetricType(42)})
+	checkError(t, err, codes.InvalidArgument, "", nil)
+}
+
+func TestListMetrics(t *testing.T) {
+	ctx := context.Background()
+	client := newMemClient(t)
+
+	for _, req := range []*api2.AddMetricRequest{
+		counter("requests", "1"), gauge("cpu", "0.5"), gauge("cpu_load", "1.5"), counter("errors", "2"),
+	} {
+		if _, err := client.AddMetric(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var keys []string
+	token := ""
+	for {
+		resp, err := client.ListMetrics(ctx, &api2.ListMetricsRequest{PageSize: 3, PageToken: token})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range resp.Metrics {
+			keys = append(keys, m.Key)
+		}
+		if token = resp.NextPageToken; token == "" {
+			break
+		}
+	}
+	if got := strings.Join(keys, ","); got != "cpu,cpu_load,errors,requests" {
+		t.Errorf("unexpected listed keys %s", got)
+	}
+
+	gaugeType := api2.MetricType_GAUGE
+	resp, err := client.ListMetrics(ctx, &api2.ListMetricsRequest{Type: &gaugeType, Prefix: "cpu_"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Metrics) != 1 || resp.Metrics[0].MetricID != "cpu_load" || resp.Metrics[0].Metric.Value != "1.5" {
+		t.Errorf("unexpected filtered metrics %v", resp.Metrics)
+	}
+
+	unknownType := api2.MetricType(42)
+	_, err = client.ListMetrics(ctx, &api2.ListMetricsRequest{Type: &unknownType})
+	checkError(t, err, codes.InvalidArgument, "", nil)
+}
+
+func TestStorageUnavailable(t *testing.T) {
+	ctx := context.Background()
+
+	// nothing listens on port 1, so connection is refused
+	db, err := sql.Open("pgx", "postgres://metricserv@127.0.0.1:1/metricserv?connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := storage.NewPGStorage(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	client := newClient(t, s)
+
+	for name, call := range map[string]func() error{
+		"add": func() error {
+			_, err := client.AddMetric(ctx, counter("requests", "1"))
+			return err
+		},
+		"update": func() error {
+			_, err := client.UpdateMetric(ctx, counter("requests", "1"))
+			return err
+		},
+		"batch": func() error {
+			_, err := client.UpdateBatch(ctx, &api2.UpdateBatchRequest{Metrics: []*api2.AddMetricRequest{counter("requests", "1")}})
+			return err
+		},
+		"delete": func() error {
+			_, err := client.DeleteMetric(ctx, &api2.DeleteMetricRequest{MetricID: "requests", Type: api2.MetricType_COUNTER})
+			return err
+		},
+		"list": func() error {
+			_, err := client.ListMetrics(ctx, &api2.ListMetricsRequest{})
+			return err
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			checkError(t, call(), codes.Unavailable, "STORAGE_UNAVAILABLE", nil)
+		})
+	}
+}
+
+func TestIdempotencyInterceptorReplay(t *testing.T) {
+	client := newMemClient(t)
+
+	call := func(key string, req *api2.AddMetricRequest) (*api2.GetMetricResponse, metadata.MD, error) {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), idempotency.Header, key)
+
+		var header metadata.MD
+		resp, err := client.UpdateMetric(ctx, req, grpc.Header(&header))
+		return resp, header, err
+	}
+
+	first, header, err := call("key-1", counter("requests", "5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header.Get(idempotency.ReplayedHeader)) != 0 {
+		t.Errorf("first call is marked as replayed: %v", header)
+	}
+
+	replayed, header, err := call("key-1", counter("requests", "5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(first, replayed) {
+		t.Errorf("replayed response %v differs from first %v", replayed, first)
+	}
+	if got := header.Get(idempotency.ReplayedHeader); len(got) != 1 || got[0] != "true" {
+		t.Errorf("duplicate call is not marked as replayed: %v", header)
+	}
+	if value := getValue(t, client, "requests", api2.MetricType_COUNTER); value != "5" {
+		t.Errorf("duplicate call is applied again: %s", value)
+	}
+
+	// key is bound to payload of the first call
+	_, _, err = call("key-1", counter("requests", "7"))
+	checkError(t, err, codes.FailedPrecondition, "", nil)
+
+	if _, _, err = call("key-2", counter("requests", "7")); err != nil {
+		t.Fatal(err)
+	}
+	if value := getValue(t, client, "requests", api2.MetricType_COUNTER); value != "12" {
+		t.Errorf("call with new key is not applied: %s", value)
+	}
+}
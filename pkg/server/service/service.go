@@ -0,0 +1,220 @@
+// Package service consists of MetricService type, that implements operations on metrics shared by HTTP handlers
+// and gRPC server, so both transports behave identically
+package service
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/renatus-cartesius/metricserv/pkg/metrics"
+	"github.com/renatus-cartesius/metricserv/pkg/storage"
+)
+
+type MetricService struct {
+	storage   storage.Storager
+	staleness storage.StalenessPolicy
+}
+
+func NewMetricService(storage storage.Storager) *MetricService {
+	return &MetricService{
+		storage: storage,
+	}
+}
+
+// SetStalenessPolicy sets policy by which gauges are marked stale in listings
+func (s *MetricService) SetStalenessPolicy(policy storage.StalenessPolicy) {
+	s.staleness = policy
+}
+
+// NewUpdate validates change of metric and converts it to storage update with initial state of metric.
+// Value is int64 delta of counter, float64 value of gauge, float64 observation or delta metric of histogram
+// and summary. Histogram is created with buckets of its delta, or with default buckets for observation.
+func NewUpdate(mtype, id string, labels map[string]string, value any) (storage.BatchUpdate, error) {
+	key := metrics.SeriesKey(id, labels)
+
+	if err := metrics.ValidateLabels(labels); err != nil {
+		return storage.BatchUpdate{}, err
+	}
+
+	var metric metrics.Metric
+	switch mtype {
+	case metrics.TypeCounter:
+		counter := metrics.NewCounter(id, 0)
+		counter.Labels = labels
+		metric = counter
+	case metrics.TypeGauge:
+		gauge := metrics.NewGauge(id, 0)
+		gauge.Labels = labels
+		metric = gauge
+	case metrics.TypeHistogram:
+		buckets := metrics.DefaultBuckets
+		if delta, ok := value.(*metrics.HistogramMetric); ok {
+			buckets = delta.Buckets
+		}
+		histogram := metrics.NewHistogram(id, buckets)
+		histogram.Labels = labels
+		metric = histogram
+	case metrics.TypeSummary:
+		summary := metrics.NewSummary(id)
+		summary.Labels = labels
+		metric = summary
+	default:
+		return storage.BatchUpdate{}, InvalidType(mtype, key)
+	}
+
+	return storage.BatchUpdate{Key: key, Metric: metric, Value: value}, nil
+}
+
+// InvalidType returns error of metric with type out of metrics.AllowedTypes
+func InvalidType(mtype, key string) error {
+	return &storage.MetricError{Err: storage.ErrInvalidType, Key: key, Type: mtype}
+}
+
+// IsInvalid checks if error of operation on metric is caused by invalid request rather than by storage,
+// e.g. by unknown type of metric or change of wrong type. Transports report such errors as bad requests.
+func IsInvalid(err error) bool {
+	return errors.Is(err, storage.ErrInvalidType) ||
+		errors.Is(err, metrics.ErrInvalidLabelName) ||
+		errors.Is(err, metrics.ErrWrongChangeType) ||
+		errors.Is(err, metrics.ErrBucketsMismatch) ||
+		errors.Is(err, metrics.ErrInvalidBuckets) ||
+		errors.Is(err, metrics.ErrInvalidCounts) ||
+		errors.Is(err, metrics.ErrSketchMismatch) ||
+		errors.Is(err, metrics.ErrInvalidSketch) ||
+		errors.Is(err, metrics.ErrInvalidQuantile) ||
+		errors.Is(err, metrics.ErrNonFiniteValue)
+}
+
+// Update applies update to metric and returns its new value: counter is incremented, gauge is set,
+// histogram and summary are merged. Missing metric is added in its initial state first.
+func (s *MetricService) Update(ctx context.Context, update storage.BatchUpdate) (string, error) {
+	if err := s.storage.UpdateBatch(ctx, []storage.BatchUpdate{update}); err != nil {
+		return "", err
+	}
+
+	return s.storage.GetValue(ctx, update.Metric.GetType(), update.Key)
+}
+
+// UpdateBatch applies updates atomically: on any error nothing is changed
+func (s *MetricService) UpdateBatch(ctx context.Context, updates []storage.BatchUpdate) error {
+	return s.storage.UpdateBatch(ctx, updates)
+}
+
+// Value returns value of metric of type with key
+func (s *MetricService) Value(ctx context.Context, mtype, key string) (string, error) {
+	if !slices.Contains(metrics.AllowedTypes, mtype) {
+		return "", InvalidType(mtype, key)
+	}
+
+	return s.storage.GetValue(ctx, mtype, key)
+}
+
+// Delete deletes metric of type with key and its history
+func (s *MetricService) Delete(ctx context.Context, mtype, key string) error {
+	if !slices.Contains(metrics.AllowedTypes, mtype) {
+		return InvalidType(mtype, key)
+	}
+
+	return s.storage.Delete(ctx, mtype, key)
+}
+
+// StaleKeys returns set of keys of stale gauges, it is empty if staleness is disabled
+func (s *MetricService) StaleKeys(ctx context.Context) (map[string]bool, error) {
+	before, ok := s.staleness.StaleBefore(time.Now())
+	if !ok {
+		return nil, nil
+	}
+
+	keys, err := s.storage.Stale(ctx, before)
+	if err != nil {
+		return nil, err
+	}
+
+	stale := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		stale[key] = true
+	}
+	return stale, nil
+}
+
+// ListOptions filters listed metrics by Type, Prefix of their id and Labels they have, empty fields match any
+// metric. Metrics are listed in order of their keys, page of Limit metrics starts after key After, all metrics
+// are listed if Limit is not positive.
+type ListOptions struct {
+	Type   string
+	Prefix string
+	Labels map[string]string
+	After  string
+	Limit  int
+}
+
+// ListedMetric is a metric with its key in storage, Stale is set for stale gauge
+type ListedMetric struct {
+	Key    string
+	Metric metrics.Metric
+	Stale  bool
+}
+
+// List returns page of metrics matching options and key to list next page after, which is empty on the last page
+func (s *MetricService) List(ctx context.Context, opts ListOptions) ([]ListedMetric, string, error) {
+	if opts.Type != "" && !slices.Contains(metrics.AllowedTypes, opts.Type) {
+		return nil, "", InvalidType(opts.Type, "")
+	}
+
+	all, err := s.storage.ListAll(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	stale, err := s.StaleKeys(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	page := make([]ListedMetric, 0)
+	for _, key := range slices.Sorted(maps.Keys(all)) {
+		if opts.After != "" && key <= opts.After {
+			continue
+		}
+
+		metric := all[key]
+		if !matches(metric, opts) {
+			continue
+		}
+
+		if opts.Limit > 0 && len(page) == opts.Limit {
+			return page, page[len(page)-1].Key, nil
+		}
+
+		page = append(page, ListedMetric{Key: key, Metric: metric, Stale: stale[key]})
+	}
+
+	return page, "", nil
+}
+
+// matches checks if metric passes filters of options
+func matches(metric metrics.Metric, opts ListOptions) bool {
+	if opts.Type != "" && metric.GetType() != opts.Type {
+		return false
+	}
+	if !strings.HasPrefix(metric.GetID(), opts.Prefix) {
+		return false
+	}
+
+	labels := metric.GetLabels()
+	for name, value := range opts.Labels {
+		if v, ok := labels[name]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Ping checks if storage is reachable
+func (s *MetricService) Ping(ctx context.Context) error {
+	return s.storage.Ping(ctx)
+}
@@ -0,0 +1,221 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/renatus-cartesius/metricserv/pkg/metrics"
+	"github.com/renatus-cartesius/metricserv/pkg/storage"
+)
+
+func TestUpdate(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := storage.NewMemStorage("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := NewMetricService(s)
+
+	tests := []struct {
+		name      string
+		mtype     string
+		value     any
+		wantValue string
+		wantErr   error
+	}{
+		{
+			name:      "new counter",
+			mtype:     metrics.TypeCounter,
+			value:     int64(5),
+			wantValue: "5",
+		},
+		{
+			name:      "counter is incremented",
+			mtype:     metrics.TypeCounter,
+			value:     int64(3),
+			wantValue: "8",
+		},
+		{
+			name:    "type mismatch",
+			mtype:   metrics.TypeGauge,
+			value:   1.5,
+			wantErr: storage.ErrTypeMismatch,
+		},
+		{
+			name:    "invalid type",
+			mtype:   "unknown",
+			value:   1.5,
+			wantErr: storage.ErrInvalidType,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			update, err := NewUpdate(tt.mtype, "requests", nil, tt.value)
+			if err == nil {
+				var value string
+				value, err = svc.Update(ctx, update)
+				if err == nil && value != tt.wantValue {
+					t.Errorf("unexpected value %s, want %s", value, tt.wantValue)
+				}
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("unexpected error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	for _, value := range []float64{1.5, 2.5} {
+		update, err := NewUpdate(metrics.TypeGauge, "cpu", nil, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = svc.Update(ctx, update); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if value, err := svc.Value(ctx, metrics.TypeGauge, "cpu"); err != nil || value != "2.5" {
+		t.Errorf("gauge is not set: %s, %v", value, err)
+	}
+
+	update, err := NewUpdate(metrics.TypeHistogram, "latency", nil, 0.2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(update.Metric.(*metrics.HistogramMetric).Buckets, metrics.DefaultBuckets) {
+		t.Errorf("histogram of observation is not created with default buckets")
+	}
+}
+
+func TestList(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := storage.NewMemStorage("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := NewMetricService(s)
+
+	added := []struct {
+		mtype  string
+		id     string
+		labels map[string]string
+		value  any
+	}{
+		{metrics.TypeCounter, "requests", map[string]string{"host": "a"}, int64(1)},
+		{metrics.TypeCounter, "requests", map[string]string{"host": "b"}, int64(2)},
+		{metrics.TypeGauge, "cpu", map[string]string{"host": "a"}, 0.5},
+		{metrics.TypeGauge, "cpu_temp", nil, 40.0},
+		{metrics.TypeGauge, "mem", nil, 1.5},
+	}
+	for _, a := range added {
+		update, err := NewUpdate(a.mtype, a.id, a.labels, a.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = svc.Update(ctx, update); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys := func(listed []ListedMetric) []string {
+		result := make([]string, 0, len(listed))
+		for _, l := range listed {
+			result = append(result, l.Key)
+		}
+		return result
+	}
+
+	tests := []struct {
+		name     string
+		opts     ListOptions
+		wantKeys []string
+		wantNext string
+	}{
+		{
+			name:     "all",
+			wantKeys: []string{"cpu_temp", `cpu{host="a"}`, "mem", `requests{host="a"}`, `requests{host="b"}`},
+		},
+		{
+			name:     "type",
+			opts:     ListOptions{Type: metrics.TypeCounter},
+			wantKeys: []string{`requests{host="a"}`, `requests{host="b"}`},
+		},
+		{
+			name:     "prefix",
+			opts:     ListOptions{Prefix: "cpu"},
+			wantKeys: []string{"cpu_temp", `cpu{host="a"}`},
+		},
+		{
+			name:     "labels",
+			opts:     ListOptions{Labels: map[string]string{"host": "a"}},
+			wantKeys: []string{`cpu{host="a"}`, `requests{host="a"}`},
+		},
+		{
+			name:     "first page",
+			opts:     ListOptions{Limit: 2},
+			wantKeys: []string{"cpu_temp", `cpu{host="a"}`},
+			wantNext: `cpu{host="a"}`,
+		},
+		{
+			name:     "next page",
+			opts:     ListOptions{Limit: 2, After: `cpu{host="a"}`},
+			wantKeys: []string{"mem", `requests{host="a"}`},
+			wantNext: `requests{host="a"}`,
+		},
+		{
+			name:     "last page",
+			opts:     ListOptions{Limit: 2, After: `requests{host="a"}`},
+			wantKeys: []string{`requests{host="b"}`},
+		},
+		{
+			name:     "filtered page",
+			opts:     ListOptions{Type: metrics.TypeGauge, Limit: 3},
+			wantKeys: []string{"cpu_temp", `cpu{host="a"}`, "mem"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listed, next, err := svc.List(ctx, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := keys(listed); !slices.Equal(got, tt.wantKeys) {
+				t.Errorf("unexpected keys %v, want %v", got, tt.wantKeys)
+			}
+			if next != tt.wantNext {
+				t.Errorf("unexpected next %q, want %q", next, tt.wantNext)
+			}
+		})
+	}
+
+	if _, _, err = svc.List(ctx, ListOptions{Type: "unknown"}); !errors.Is(err, storage.ErrInvalidType) {
+		t.Errorf("unexpected error of unknown type: %v", err)
+	}
+}
+
+func TestIsInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "invalid type", err: InvalidType("unknown", "requests"), want: true},
+		{name: "invalid label", err: fmt.Errorf("labels: %w", metrics.ErrInvalidLabelName), want: true},
+		{name: "wrong change type", err: metrics.ErrWrongChangeType, want: true},
+		{name: "non-finite value", err: metrics.ErrNonFiniteValue, want: true},
+		{name: "not found", err: &storage.MetricError{Err: storage.ErrNotFound, Key: "requests"}},
+		{name: "unavailable", err: storage.ErrUnavailable},
+		{name: "internal", err: errors.New("internal")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsInvalid(tt.err); got != tt.want {
+				t.Errorf("IsInvalid(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
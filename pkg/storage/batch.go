@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"slices"
+
+	"github.com/renatus-cartesius/metricserv/pkg/metrics"
+)
+
+// BatchUpdate is a change of one metric in batch. Metric is added to storage in its initial state
+// if there is no metric with Key yet, then Value is applied to it as in Storager.Update.
+type BatchUpdate struct {
+	Key    string
+	Metric metrics.Metric
+	Value  any
+}
+
+// cloneMetric returns deep copy of metric, so changes can be staged without touching stored metric
+func cloneMetric(metric metrics.Metric) (metrics.Metric, error) {
+	switch m := metric.(type) {
+	case *metrics.CounterMetric:
+		c := *m
+		return &c, nil
+	case *metrics.GaugeMetric:
+		c := *m
+		return &c, nil
+	case *metrics.HistogramMetric:
+		c := metrics.NewHistogram(m.ID, slices.Clone(m.Buckets))
+		c.Labels = m.Labels
+		if err := c.Merge(m); err != nil {
+			return nil, err
+		}
+		return c, nil
+	case *metrics.SummaryMetric:
+		c := metrics.NewSummary(m.ID)
+		c.Labels = m.Labels
+		c.Sketch = metrics.NewSketch(m.Sketch.RelativeAccuracy)
+		if err := c.Sketch.Merge(m.Sketch); err != nil {
+			return nil, err
+		}
+		return c, nil
+	default:
+		return nil, invalidType(metric.GetType(), metric.GetID())
+	}
+}
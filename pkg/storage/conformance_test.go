@@ -0,0 +1,136 @@
+package storage_test
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	"github.com/pressly/goose/v3"
+
+	"github.com/renatus-cartesius/metricserv/pkg/storage"
+	"github.com/renatus-cartesius/metricserv/pkg/storage/storagetest"
+)
+
+func TestMemStorageConformance(t *testing.T) {
+	t.Run("snapshot", func(t *testing.T) {
+		storagetest.Run(t, func(dir string) (storage.Storager, error) {
+			return storage.NewMemStorage(filepath.Join(dir, "storage"))
+		})
+	})
+	t.Run("wal", func(t *testing.T) {
+		storagetest.Run(t, func(dir string) (storage.Storager, error) {
+			return storage.NewMemStorage(
+				filepath.Join(dir, "storage"),
+				storage.WithWAL(filepath.Join(dir, "storage.wal"), storage.SyncPolicy{Always: true}),
+				storage.WithSnapshotFormat(storage.SnapshotProtoZstd),
+			)
+		})
+	})
+}
+
+func TestShardedStorageConformance(t *testing.T) {
+	storagetest.Run(t, func(dir string) (storage.Storager, error) {
+		return storage.NewShardedStorage(filepath.Join(dir, "storage"), 4)
+	})
+}
+
+func TestSQLiteStorageConformance(t *testing.T) {
+	goose.SetLogger(goose.NopLogger())
+
+	storagetest.Run(t, func(dir string) (storage.Storager, error) {
+		return storage.OpenDatabase(storage.SQLiteScheme + filepath.Join(dir, "metrics.db"))
+	})
+}
+
+// TestPGStorageConformance runs suite against database of TEST_DATABASE_DSN if it is set, otherwise against
+// embedded postgres started for the test if TEST_EMBEDDED_POSTGRES is set. Test is skipped if neither is set.
+func TestPGStorageConformance(t *testing.T) {
+	goose.SetLogger(goose.NopLogger())
+
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		if os.Getenv("TEST_EMBEDDED_POSTGRES") == "" {
+			t.Skip("set TEST_DATABASE_DSN or TEST_EMBEDDED_POSTGRES=1 to run conformance tests of PostgreSQL")
+		}
+		dsn = startEmbeddedPostgres(t)
+	}
+
+	admin, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	// every dir of suite gets its own database, so tests start with empty storage and reopening keeps metrics
+	var mx sync.Mutex
+	databases := make(map[string]string)
+
+	storagetest.Run(t, func(dir string) (storage.Storager, error) {
+		mx.Lock()
+		defer mx.Unlock()
+
+		name, ok := databases[dir]
+		if !ok {
+			name = fmt.Sprintf("conformance_%d", len(databases))
+			if _, err := admin.Exec("DROP DATABASE IF EXISTS " + name); err != nil {
+				return nil, err
+			}
+			if _, err := admin.Exec("CREATE DATABASE " + name); err != nil {
+				return nil, err
+			}
+			databases[dir] = name
+		}
+
+		databaseDSN, err := url.Parse(dsn)
+		if err != nil {
+			return nil, err
+		}
+		databaseDSN.Path = "/" + name
+
+		return storage.OpenDatabase(databaseDSN.String())
+	})
+}
+
+// startEmbeddedPostgres starts postgres in temporary dir and returns its DSN. Downloaded binaries are cached
+// between runs. Test fails if postgres can not be started, e.g. binaries can not be downloaded or test runs as root,
+// since embedded postgres is requested explicitly.
+func startEmbeddedPostgres(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := uint32(listener.Addr().(*net.TCPAddr).Port)
+	listener.Close()
+
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		cache = os.TempDir()
+	}
+	cache = filepath.Join(cache, "metricserv", "embedded-postgres")
+
+	dir := t.TempDir()
+	config := embeddedpostgres.DefaultConfig().
+		Port(port).
+		CachePath(cache).
+		BinariesPath(filepath.Join(cache, "binaries")).
+		RuntimePath(filepath.Join(dir, "runtime")).
+		DataPath(filepath.Join(dir, "data")).
+		Logger(io.Discard)
+
+	postgres := embeddedpostgres.NewDatabase(config)
+	if err = postgres.Start(); err != nil {
+		t.Fatalf("embedded postgres is not available: %v", err)
+	}
+	t.Cleanup(func() { postgres.Stop() })
+
+	return config.GetConnectionURL() + "?sslmode=disable"
+}
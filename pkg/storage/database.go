@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"database/sql"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/pressly/goose/v3"
+	"go.uber.org/zap"
+
+	"github.com/renatus-cartesius/metricserv/pkg/logger"
+	"github.com/renatus-cartesius/metricserv/pkg/storage/migrations"
+)
+
+// OpenDatabase opens storage in database of dsn and applies migrations to it. DSN with SQLiteScheme selects
+// SQLite database file, other DSNs are passed to Postgres driver. Database is closed by Close of storage.
+func OpenDatabase(dsn string) (Storager, error) {
+	driver, dialect, migrationsDir := "pgx", "postgres", migrations.PostgresDir
+	sqlitePath, isSQLite := SQLitePath(dsn)
+	if isSQLite {
+		driver, dialect, migrationsDir, dsn = SQLiteDriver, "sqlite3", migrations.SQLiteDir, sqlitePath
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	goose.SetBaseFS(migrations.FS)
+
+	if err = goose.SetDialect(dialect); err != nil {
+		logger.Log.Error(
+			"error setting goose dialect",
+			zap.Error(err),
+		)
+		db.Close()
+		return nil, err
+	}
+
+	if err = goose.Up(db, migrationsDir); err != nil {
+		logger.Log.Error(
+			"error on applying migrations",
+			zap.Error(err),
+		)
+		db.Close()
+		return nil, err
+	}
+
+	var s Storager
+	if isSQLite {
+		s, err = NewSQLiteStorage(db)
+	} else {
+		s, err = NewPGStorage(db)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
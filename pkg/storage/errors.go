@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Errors of operations on metrics, backends return them wrapped into *MetricError, so kind of error is checked
+// with errors.Is and its details are got with errors.As.
+var (
+	// ErrNotFound is returned if there is no metric with key in storage
+	ErrNotFound = errors.New("metric not found")
+
+	// ErrTypeMismatch is returned if metric with key is stored with other type than requested one
+	ErrTypeMismatch = errors.New("metric type mismatch")
+
+	// ErrInvalidType is returned for metric of unknown type
+	ErrInvalidType = errors.New("invalid metric type")
+
+	// ErrUnavailable is returned if underlying datastore can not be reached, so operation may be retried later
+	ErrUnavailable = errors.New("storage is unavailable")
+)
+
+// MetricError is an error of operation on metric with Key and Type. StoredType is set to type of stored metric
+// on ErrTypeMismatch.
+type MetricError struct {
+	Err        error
+	Key        string
+	Type       string
+	StoredType string
+}
+
+func (e *MetricError) Error() string {
+	if e.StoredType != "" {
+		return fmt.Sprintf("%s %s: %v, stored as %s", e.Type, e.Key, e.Err, e.StoredType)
+	}
+	return fmt.Sprintf("%s %s: %v", e.Type, e.Key, e.Err)
+}
+
+func (e *MetricError) Unwrap() error {
+	return e.Err
+}
+
+func notFound(mtype, key string) error {
+	return &MetricError{Err: ErrNotFound, Key: key, Type: mtype}
+}
+
+func typeMismatch(mtype, key, storedType string) error {
+	return &MetricError{Err: ErrTypeMismatch, Key: key, Type: mtype, StoredType: storedType}
+}
+
+func invalidType(mtype, key string) error {
+	return &MetricError{Err: ErrInvalidType, Key: key, Type: mtype}
+}
+
+// queryRower is either database or transaction
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// missingMetric tells why there is no row of metric with key and type in database: metric is either not stored
+// or stored with other type
+func missingMetric(ctx context.Context, db queryRower, mtype, key string) error {
+	var storedType string
+	err := db.QueryRowContext(ctx, "SELECT type FROM metrics WHERE id = $1 AND type <> $2 LIMIT 1", key, mtype).Scan(&storedType)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return notFound(mtype, key)
+		}
+		return err
+	}
+	return typeMismatch(mtype, key, storedType)
+}
+
+// checkStoredType returns ErrTypeMismatch if metric with key is stored with other type than mtype, so metric
+// of other type is not added with the same key
+func checkStoredType(ctx context.Context, db queryRower, mtype, key string) error {
+	if err := missingMetric(ctx, db, mtype, key); !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// unavailable wraps errors of reaching database into ErrUnavailable, other errors are returned as is
+func unavailable(err error) error {
+	if err == nil || errors.Is(err, ErrUnavailable) {
+		return err
+	}
+
+	var (
+		netErr     net.Error
+		connectErr *pgconn.ConnectError
+		pgErr      *pgconn.PgError
+		sqliteErr  *sqlite.Error
+	)
+
+	switch {
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, sql.ErrConnDone),
+		errors.As(err, &netErr), errors.As(err, &connectErr):
+	case errors.As(err, &pgErr):
+		// connection exception, insufficient resources and operator intervention classes, e.g. shutdown
+		if !strings.HasPrefix(pgErr.Code, "08") && !strings.HasPrefix(pgErr.Code, "53") && !strings.HasPrefix(pgErr.Code, "57P") {
+			return err
+		}
+	case errors.As(err, &sqliteErr):
+		switch sqliteErr.Code() & 0xff {
+		case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED, sqlite3.SQLITE_CANTOPEN:
+		default:
+			return err
+		}
+	default:
+		return err
+	}
+
+	return fmt.Errorf("%w: %w", ErrUnavailable, err)
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/renatus-cartesius/metricserv/pkg/metrics"
+)
+
+// DefaultHistoryCapacity is a count of samples kept per series by MemStorage
+const DefaultHistoryCapacity = 1000
+
+// Sample is a value of metric at some point of time
+type Sample struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+// sampleValue returns numeric value of metric for history, only counters and gauges have one
+func sampleValue(metric metrics.Metric) (float64, bool) {
+	switch m := metric.(type) {
+	case *metrics.CounterMetric:
+		return float64(m.Value), true
+	case *metrics.GaugeMetric:
+		return m.Value, true
+	default:
+		return 0, false
+	}
+}
+
+// ring is a fixed capacity buffer of samples, overwriting the oldest ones when full
+type ring struct {
+	samples []Sample
+	start   int
+	size    int
+}
+
+func newRing(capacity int) *ring {
+	return &ring{
+		samples: make([]Sample, capacity),
+	}
+}
+
+func (r *ring) push(sample Sample) {
+	if len(r.samples) == 0 {
+		return
+	}
+
+	end := (r.start + r.size) % len(r.samples)
+	r.samples[end] = sample
+
+	if r.size < len(r.samples) {
+		r.size++
+		return
+	}
+	r.start = (r.start + 1) % len(r.samples)
+}
+
+// between returns samples in [from, to] range ordered by time
+func (r *ring) between(from, to time.Time) []Sample {
+	result := make([]Sample, 0)
+	for i := 0; i < r.size; i++ {
+		sample := r.samples[(r.start+i)%len(r.samples)]
+		if sample.Timestamp.Before(from) || sample.Timestamp.After(to) {
+			continue
+		}
+		result = append(result, sample)
+	}
+	return result
+}
+
+// dropBefore removes samples older than before and returns them ordered by time
+func (r *ring) dropBefore(before time.Time) []Sample {
+	dropped := make([]Sample, 0)
+	for r.size > 0 && r.samples[r.start].Timestamp.Before(before) {
+		dropped = append(dropped, r.samples[r.start])
+		r.start = (r.start + 1) % len(r.samples)
+		r.size--
+	}
+	return dropped
+}
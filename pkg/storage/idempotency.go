@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"container/heap"
+	"errors"
+	"time"
+)
+
+var ErrIdempotencyKeyNotFound = errors.New("idempotency key not found")
+
+// IdempotencyRecord is a response remembered for idempotency key until ExpiresAt.
+// Fingerprint identifies request, so reuse of key for another request can be detected.
+// Status and Body are transport specific: HTTP status and body, or gRPC code and marshaled response.
+type IdempotencyRecord struct {
+	Key         string
+	Fingerprint string
+	Status      int
+	ContentType string
+	Body        []byte
+	ExpiresAt   time.Time
+}
+
+// Expired reports if record is outdated at now
+func (r *IdempotencyRecord) Expired(now time.Time) bool {
+	return !now.Before(r.ExpiresAt)
+}
+
+// idempotencyExpiry is an expiration time of record of key
+type idempotencyExpiry struct {
+	key       string
+	expiresAt time.Time
+}
+
+// expiryQueue is a min-heap of expiration times of records, so expired records are dropped without scanning
+// all of them. Key saved again is queued again, its previous expiration is skipped when it is popped.
+type expiryQueue []idempotencyExpiry
+
+func (q expiryQueue) Len() int           { return len(q) }
+func (q expiryQueue) Less(i, j int) bool { return q[i].expiresAt.Before(q[j].expiresAt) }
+func (q expiryQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+func (q *expiryQueue) Push(x any) {
+	*q = append(*q, x.(idempotencyExpiry))
+}
+
+func (q *expiryQueue) Pop() any {
+	old := *q
+	last := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return last
+}
+
+// expired pops keys of expiration times not after now
+func (q *expiryQueue) expired(now time.Time) []string {
+	var keys []string
+	for q.Len() > 0 && !now.Before((*q)[0].expiresAt) {
+		keys = append(keys, heap.Pop(q).(idempotencyExpiry).key)
+	}
+	return keys
+}
@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS name TEXT;
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}'::jsonb;
+UPDATE metrics SET name = id WHERE name IS NULL;
+ALTER TABLE metrics ALTER COLUMN name SET NOT NULL;
+CREATE INDEX IF NOT EXISTS metrics_name_idx ON metrics (name);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS metrics_name_idx;
+ALTER TABLE metrics DROP COLUMN labels;
+ALTER TABLE metrics DROP COLUMN name;
+-- +goose StatementEnd
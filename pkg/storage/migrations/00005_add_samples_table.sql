@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS samples (
+    id TEXT NOT NULL,
+    ts TIMESTAMPTZ NOT NULL,
+    value double precision NOT NULL
+);
+CREATE INDEX IF NOT EXISTS samples_id_ts_idx ON samples (id, ts);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE samples;
+-- +goose StatementEnd
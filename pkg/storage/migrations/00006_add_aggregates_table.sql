@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS aggregates (
+    id TEXT NOT NULL,
+    resolution INTEGER NOT NULL,
+    ts TIMESTAMPTZ NOT NULL,
+    min double precision NOT NULL,
+    max double precision NOT NULL,
+    sum double precision NOT NULL,
+    count BIGINT NOT NULL,
+    last double precision NOT NULL,
+    PRIMARY KEY (id, resolution, ts)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE aggregates;
+-- +goose StatementEnd
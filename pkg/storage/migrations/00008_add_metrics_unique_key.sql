@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS int_value BIGINT;
+UPDATE metrics SET int_value = value::bigint, value = NULL WHERE type = 'counter';
+DELETE FROM metrics a USING metrics b WHERE a.id = b.id AND a.type = b.type AND a.ctid < b.ctid;
+ALTER TABLE metrics ADD CONSTRAINT metrics_id_type_key UNIQUE (id, type);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE metrics DROP CONSTRAINT IF EXISTS metrics_id_type_key;
+UPDATE metrics SET value = int_value WHERE type = 'counter';
+ALTER TABLE metrics DROP COLUMN int_value;
+-- +goose StatementEnd
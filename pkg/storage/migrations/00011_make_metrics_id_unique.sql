@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+-- metric is identified by key only, the most recently updated row is kept if key is stored with several types
+DELETE FROM metrics a USING metrics b WHERE a.id = b.id AND (a.updated_at, a.ctid) < (b.updated_at, b.ctid);
+ALTER TABLE metrics DROP CONSTRAINT IF EXISTS metrics_id_type_key;
+ALTER TABLE metrics ADD CONSTRAINT metrics_id_key UNIQUE (id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE metrics DROP CONSTRAINT IF EXISTS metrics_id_key;
+ALTER TABLE metrics ADD CONSTRAINT metrics_id_type_key UNIQUE (id, type);
+-- +goose StatementEnd
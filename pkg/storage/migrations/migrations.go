@@ -0,0 +1,15 @@
+// Package migrations embeds goose migrations of database storage backends.
+package migrations
+
+import "embed"
+
+const (
+	// PostgresDir is a directory of Postgres migrations in FS
+	PostgresDir = "."
+
+	// SQLiteDir is a directory of SQLite migrations in FS
+	SQLiteDir = "sqlite"
+)
+
+//go:embed *.sql sqlite/*.sql
+var FS embed.FS
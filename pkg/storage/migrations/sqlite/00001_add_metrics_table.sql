@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS metrics (
+    id TEXT NOT NULL,
+    type TEXT NOT NULL,
+    value REAL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE metrics;
+-- +goose StatementEnd
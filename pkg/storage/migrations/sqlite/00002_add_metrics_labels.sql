@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE metrics ADD COLUMN name TEXT NOT NULL DEFAULT '';
+ALTER TABLE metrics ADD COLUMN labels TEXT NOT NULL DEFAULT '{}';
+UPDATE metrics SET name = id WHERE name = '';
+CREATE INDEX IF NOT EXISTS metrics_name_idx ON metrics (name);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS metrics_name_idx;
+ALTER TABLE metrics DROP COLUMN labels;
+ALTER TABLE metrics DROP COLUMN name;
+-- +goose StatementEnd
@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+-- ts is unix time in nanoseconds
+CREATE TABLE IF NOT EXISTS samples (
+    id TEXT NOT NULL,
+    ts INTEGER NOT NULL,
+    value REAL NOT NULL
+);
+CREATE INDEX IF NOT EXISTS samples_id_ts_idx ON samples (id, ts);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE samples;
+-- +goose StatementEnd
@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+-- ts is unix time in nanoseconds
+CREATE TABLE IF NOT EXISTS aggregates (
+    id TEXT NOT NULL,
+    resolution INTEGER NOT NULL,
+    ts INTEGER NOT NULL,
+    min REAL NOT NULL,
+    max REAL NOT NULL,
+    sum REAL NOT NULL,
+    count INTEGER NOT NULL,
+    last REAL NOT NULL,
+    PRIMARY KEY (id, resolution, ts)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE aggregates;
+-- +goose StatementEnd
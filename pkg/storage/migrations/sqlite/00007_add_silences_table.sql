@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+-- starts_at and ends_at are unix time in nanoseconds
+CREATE TABLE IF NOT EXISTS silences (
+    id TEXT PRIMARY KEY,
+    matchers TEXT NOT NULL,
+    starts_at INTEGER NOT NULL,
+    ends_at INTEGER NOT NULL,
+    created_by TEXT NOT NULL,
+    comment TEXT NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE silences;
+-- +goose StatementEnd
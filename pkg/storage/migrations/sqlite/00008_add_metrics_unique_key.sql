@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE metrics ADD COLUMN int_value INTEGER;
+UPDATE metrics SET int_value = CAST(value AS INTEGER), value = NULL WHERE type = 'counter';
+DELETE FROM metrics WHERE rowid NOT IN (SELECT max(rowid) FROM metrics GROUP BY id, type);
+CREATE UNIQUE INDEX IF NOT EXISTS metrics_id_type_key ON metrics (id, type);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS metrics_id_type_key;
+UPDATE metrics SET value = int_value WHERE type = 'counter';
+ALTER TABLE metrics DROP COLUMN int_value;
+-- +goose StatementEnd
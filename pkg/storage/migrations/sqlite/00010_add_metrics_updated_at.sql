@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+-- updated_at is unix time in nanoseconds, existing metrics are considered updated on migration
+ALTER TABLE metrics ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0;
+UPDATE metrics SET updated_at = CAST(strftime('%s', 'now') AS INTEGER) * 1000000000;
+CREATE INDEX IF NOT EXISTS metrics_type_updated_at_idx ON metrics (type, updated_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS metrics_type_updated_at_idx;
+ALTER TABLE metrics DROP COLUMN updated_at;
+-- +goose StatementEnd
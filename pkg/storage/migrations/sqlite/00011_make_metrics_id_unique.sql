@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+-- metric is identified by key only, the most recently updated row is kept if key is stored with several types
+DELETE FROM metrics WHERE EXISTS (
+    SELECT 1 FROM metrics b WHERE b.id = metrics.id AND (b.updated_at, b.rowid) > (metrics.updated_at, metrics.rowid)
+);
+DROP INDEX IF EXISTS metrics_id_type_key;
+CREATE UNIQUE INDEX IF NOT EXISTS metrics_id_key ON metrics (id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS metrics_id_key;
+CREATE UNIQUE INDEX IF NOT EXISTS metrics_id_type_key ON metrics (id, type);
+-- +goose StatementEnd
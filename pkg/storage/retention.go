@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrUnknownResolution = errors.New("unknown resolution of aggregates")
+
+	// Resolutions are time intervals raw samples are rolled into on retention
+	Resolutions = []time.Duration{time.Minute, time.Hour}
+)
+
+// RetentionPolicy sets how long raw samples and aggregates of each resolution are kept.
+// Raw samples older than RawAge are rolled into aggregates of all Resolutions and dropped.
+type RetentionPolicy struct {
+	RawAge    time.Duration
+	MinuteAge time.Duration
+	HourAge   time.Duration
+}
+
+// AggregateAge returns how long aggregates of resolution are kept
+func (p RetentionPolicy) AggregateAge(resolution time.Duration) time.Duration {
+	if resolution == time.Minute {
+		return p.MinuteAge
+	}
+	return p.HourAge
+}
+
+// Aggregate summarizes samples of a series in [Timestamp, Timestamp+Resolution) interval
+type Aggregate struct {
+	Timestamp time.Time `json:"timestamp"`
+	Min       float64   `json:"min"`
+	Max       float64   `json:"max"`
+	Avg       float64   `json:"avg"`
+	Sum       float64   `json:"sum"`
+	Count     int64     `json:"count"`
+	Last      float64   `json:"last"`
+}
+
+func newAggregate(timestamp time.Time, sample Sample) Aggregate {
+	return Aggregate{
+		Timestamp: timestamp,
+		Min:       sample.Value,
+		Max:       sample.Value,
+		Avg:       sample.Value,
+		Sum:       sample.Value,
+		Count:     1,
+		Last:      sample.Value,
+	}
+}
+
+// add accounts sample which is not older than samples already aggregated
+func (a *Aggregate) add(sample Sample) {
+	a.Min = min(a.Min, sample.Value)
+	a.Max = max(a.Max, sample.Value)
+	a.Sum += sample.Value
+	a.Count++
+	a.Avg = a.Sum / float64(a.Count)
+	a.Last = sample.Value
+}
+
+// validResolution checks if aggregates of resolution are kept by storages
+func validResolution(resolution time.Duration) bool {
+	for _, r := range Resolutions {
+		if r == resolution {
+			return true
+		}
+	}
+	return false
+}
+
+// rollup adds samples ordered by time to aggregates ordered by time, merging samples into the last aggregate
+// if they are in its interval
+func rollup(aggregates []Aggregate, samples []Sample, resolution time.Duration) []Aggregate {
+	for _, sample := range samples {
+		timestamp := sample.Timestamp.Truncate(resolution)
+
+		if n := len(aggregates); n > 0 && aggregates[n-1].Timestamp.Equal(timestamp) {
+			aggregates[n-1].add(sample)
+			continue
+		}
+
+		aggregates = append(aggregates, newAggregate(timestamp, sample))
+	}
+
+	return aggregates
+}
+
+// retainSeries rolls samples of series older than policy allows into its aggregates of all Resolutions
+// and drops outdated aggregates
+func retainSeries(series *ring, aggregates map[time.Duration][]Aggregate, now time.Time, policy RetentionPolicy) {
+	dropped := series.dropBefore(now.Add(-policy.RawAge))
+
+	for _, resolution := range Resolutions {
+		rolled := rollup(aggregates[resolution], dropped, resolution)
+
+		outdated := now.Add(-policy.AggregateAge(resolution))
+		i := 0
+		for i < len(rolled) && rolled[i].Timestamp.Before(outdated) {
+			i++
+		}
+
+		aggregates[resolution] = rolled[i:]
+	}
+}
+
+// aggregatesBetween returns aggregates in [from, to] time range
+func aggregatesBetween(aggregates []Aggregate, from, to time.Time) []Aggregate {
+	result := make([]Aggregate, 0)
+	for _, aggregate := range aggregates {
+		if aggregate.Timestamp.Before(from) || aggregate.Timestamp.After(to) {
+			continue
+		}
+		result = append(result, aggregate)
+	}
+
+	return result
+}
@@ -0,0 +1,608 @@
+package storage
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/renatus-cartesius/metricserv/pkg/metrics"
+)
+
+// DefaultShards is a count of shards of ShardedStorage used if it is not set
+const DefaultShards = 64
+
+// ShardedStorage implements Storager in memory like MemStorage, but spreads metrics across shards by hash of key,
+// so updates of different metrics do not contend for single lock. Each series is changed under its own lock,
+// values of counters are stored atomically, so they are read without locking series. Silences, idempotency keys,
+// snapshots and write-ahead log are handled as in MemStorage.
+type ShardedStorage struct {
+	base   *MemStorage
+	shards []*shard
+
+	// freezeMx serializes freezing all series, so concurrent listings do not lock series in different order
+	freezeMx sync.Mutex
+}
+
+type shard struct {
+	mx     sync.RWMutex
+	series map[string]*shardSeries
+}
+
+// shardSeries is a metric with its history. Series are changed under read lock of shard and mx of series,
+// batches replace them under write locks of all affected shards.
+type shardSeries struct {
+	mx     sync.Mutex
+	metric metrics.Metric
+
+	// mtype is a type of metric, which is read without series lock
+	mtype string
+	// updated is a time of last change in unix nanoseconds
+	updated atomic.Int64
+
+	// counter is a metric itself if it is counter, its Value is accessed atomically
+	counter *metrics.CounterMetric
+
+	history    *ring
+	aggregates map[time.Duration][]Aggregate
+}
+
+func NewShardedStorage(savePath string, shards int, opts ...MemStorageOption) (Storager, error) {
+	base, err := newMemStorage(savePath, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if shards <= 0 {
+		shards = DefaultShards
+	}
+
+	s := &ShardedStorage{
+		base:   base,
+		shards: make([]*shard, shards),
+	}
+	for i := range s.shards {
+		s.shards[i] = &shard{series: make(map[string]*shardSeries)}
+	}
+
+	return s, nil
+}
+
+// shardIndex returns index of shard holding key by its FNV-1a hash
+func (s *ShardedStorage) shardIndex(key string) int {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return int(hash % uint32(len(s.shards)))
+}
+
+func (s *ShardedStorage) shardOf(key string) *shard {
+	return s.shards[s.shardIndex(key)]
+}
+
+// setMetric replaces metric of series keeping its history, shard write lock must be held
+func (sh *shard) setMetric(key string, metric metrics.Metric) *shardSeries {
+	series := &shardSeries{metric: metric, mtype: metric.GetType()}
+	series.updated.Store(time.Now().UnixNano())
+	if counter, ok := metric.(*metrics.CounterMetric); ok {
+		series.counter = counter
+	}
+
+	if previous, ok := sh.series[key]; ok {
+		series.history = previous.history
+		series.aggregates = previous.aggregates
+	}
+	sh.series[key] = series
+
+	return series
+}
+
+// get returns series of metric of type, shard lock must be held
+func (sh *shard) get(mtype, key string) (*shardSeries, error) {
+	series, ok := sh.series[key]
+	if !ok {
+		return nil, notFound(mtype, key)
+	}
+	if series.mtype != mtype {
+		return nil, typeMismatch(mtype, key, series.mtype)
+	}
+	return series, nil
+}
+
+// current returns copy of metric, which is safe to use after series lock is released
+func (ss *shardSeries) current() (metrics.Metric, error) {
+	if ss.counter != nil {
+		return &metrics.CounterMetric{
+			ID:     ss.counter.ID,
+			Labels: ss.counter.Labels,
+			Value:  atomic.LoadInt64(&ss.counter.Value),
+			Type:   ss.counter.Type,
+		}, nil
+	}
+
+	ss.mx.Lock()
+	defer ss.mx.Unlock()
+
+	return cloneMetric(ss.metric)
+}
+
+// record pushes sample of metric value to history, series lock must be held
+func (ss *shardSeries) record(capacity int, timestamp time.Time, value float64) {
+	if ss.history == nil {
+		ss.history = newRing(capacity)
+	}
+	ss.history.push(Sample{Timestamp: timestamp, Value: value})
+}
+
+func (s *ShardedStorage) Add(ctx context.Context, id string, metric metrics.Metric) error {
+	sh := s.shardOf(id)
+	sh.mx.Lock()
+	defer sh.mx.Unlock()
+
+	if s.base.wal != nil {
+		if err := s.base.wal.append(newWALEntry(id, metric)); err != nil {
+			return err
+		}
+	}
+
+	sh.setMetric(id, metric)
+	return nil
+}
+
+// restore sets metric loaded from snapshot or wal without logging it, nil metric is deleted
+func (s *ShardedStorage) restore(id string, metric metrics.Metric) {
+	sh := s.shardOf(id)
+	sh.mx.Lock()
+	defer sh.mx.Unlock()
+
+	if metric == nil {
+		delete(sh.series, id)
+		return
+	}
+	sh.setMetric(id, metric)
+}
+
+func (s *ShardedStorage) Delete(ctx context.Context, mtype, id string) error {
+	sh := s.shardOf(id)
+	sh.mx.Lock()
+	defer sh.mx.Unlock()
+
+	if _, err := sh.get(mtype, id); err != nil {
+		return err
+	}
+
+	if s.base.wal != nil {
+		if err := s.base.wal.append(newDeleteEntry(id, mtype)); err != nil {
+			return err
+		}
+	}
+
+	delete(sh.series, id)
+	return nil
+}
+
+func (s *ShardedStorage) Stale(ctx context.Context, before time.Time) ([]string, error) {
+	keys := make([]string, 0)
+	for _, sh := range s.shards {
+		sh.mx.RLock()
+		keys = append(keys, sh.stale(before)...)
+		sh.mx.RUnlock()
+	}
+	slices.Sort(keys)
+
+	return keys, nil
+}
+
+// stale returns keys of gauges of shard last updated before time before, shard lock must be held
+func (sh *shard) stale(before time.Time) []string {
+	var keys []string
+	for key, series := range sh.series {
+		if series.mtype == metrics.TypeGauge && series.updated.Load() < before.UnixNano() {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Evict deletes stale gauges of one shard at a time
+func (s *ShardedStorage) Evict(ctx context.Context, before time.Time) ([]string, error) {
+	evicted := make([]string, 0)
+	for _, sh := range s.shards {
+		keys, err := s.evictShard(sh, before)
+		if err != nil {
+			return nil, err
+		}
+		evicted = append(evicted, keys...)
+	}
+	slices.Sort(evicted)
+
+	return evicted, nil
+}
+
+func (s *ShardedStorage) evictShard(sh *shard, before time.Time) ([]string, error) {
+	sh.mx.Lock()
+	defer sh.mx.Unlock()
+
+	keys := sh.stale(before)
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	if s.base.wal != nil {
+		entries := make([]walEntry, 0, len(keys))
+		for _, key := range keys {
+			entries = append(entries, newDeleteEntry(key, metrics.TypeGauge))
+		}
+		if err := s.base.wal.append(entries...); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, key := range keys {
+		delete(sh.series, key)
+	}
+
+	return keys, nil
+}
+
+func (s *ShardedStorage) CheckMetric(ctx context.Context, id string) (bool, error) {
+	sh := s.shardOf(id)
+	sh.mx.RLock()
+	defer sh.mx.RUnlock()
+
+	_, ok := sh.series[id]
+	return ok, nil
+}
+
+// ListAll returns point-in-time copies of metrics, all series are frozen while they are copied
+func (s *ShardedStorage) ListAll(ctx context.Context) (map[string]metrics.Metric, error) {
+	defer s.freeze()()
+
+	return s.collect()
+}
+
+// freeze blocks all changes and returns function releasing them. Shards are locked for reading in order of their
+// indexes, so metrics are not added or deleted, then every series is locked, so updates holding read lock of shard
+// are finished and new ones wait.
+func (s *ShardedStorage) freeze() func() {
+	s.freezeMx.Lock()
+
+	locked := make([]*shardSeries, 0)
+	for _, sh := range s.shards {
+		sh.mx.RLock()
+		for _, series := range sh.series {
+			series.mx.Lock()
+			locked = append(locked, series)
+		}
+	}
+
+	return func() {
+		for _, series := range locked {
+			series.mx.Unlock()
+		}
+		for _, sh := range s.shards {
+			sh.mx.RUnlock()
+		}
+		s.freezeMx.Unlock()
+	}
+}
+
+// Iterate copies metrics of one shard at a time, shard lock is not held while fn runs
+func (s *ShardedStorage) Iterate(ctx context.Context, fn func(key string, metric metrics.Metric) error) error {
+	type item struct {
+		key    string
+		metric metrics.Metric
+	}
+
+	for _, sh := range s.shards {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		sh.mx.RLock()
+		items := make([]item, 0, len(sh.series))
+		for key, series := range sh.series {
+			metric, err := series.current()
+			if err != nil {
+				sh.mx.RUnlock()
+				return err
+			}
+			items = append(items, item{key: key, metric: metric})
+		}
+		sh.mx.RUnlock()
+
+		for _, it := range items {
+			if err := fn(it.key, it.metric); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// collect copies all metrics, storage must be frozen
+func (s *ShardedStorage) collect() (map[string]metrics.Metric, error) {
+	all := make(map[string]metrics.Metric)
+	for _, sh := range s.shards {
+		for key, series := range sh.series {
+			metric, err := cloneMetric(series.metric)
+			if err != nil {
+				return nil, err
+			}
+			all[key] = metric
+		}
+	}
+
+	return all, nil
+}
+
+func (s *ShardedStorage) GetValue(ctx context.Context, mtype, id string) (string, error) {
+	sh := s.shardOf(id)
+	sh.mx.RLock()
+	defer sh.mx.RUnlock()
+
+	series, err := sh.get(mtype, id)
+	if err != nil {
+		return "", err
+	}
+
+	if series.counter != nil {
+		return strconv.FormatInt(atomic.LoadInt64(&series.counter.Value), 10), nil
+	}
+
+	series.mx.Lock()
+	defer series.mx.Unlock()
+
+	return series.metric.GetValue(), nil
+}
+
+func (s *ShardedStorage) Update(ctx context.Context, mtype, id string, value any) error {
+	sh := s.shardOf(id)
+	sh.mx.RLock()
+	defer sh.mx.RUnlock()
+
+	series, err := sh.get(mtype, id)
+	if err != nil {
+		return err
+	}
+
+	series.mx.Lock()
+	defer series.mx.Unlock()
+
+	if series.counter != nil {
+		return s.updateCounter(id, series, value)
+	}
+
+	metric := series.metric
+	if s.base.wal != nil {
+		// change is applied to copy, so metric is not changed if it can not be logged
+		changed, err := cloneMetric(metric)
+		if err != nil {
+			return err
+		}
+		if err = changed.Change(value); err != nil {
+			return err
+		}
+		if err = s.base.wal.append(newWALEntry(id, changed)); err != nil {
+			return err
+		}
+		series.metric = changed
+		metric = changed
+	} else if err := metric.Change(value); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	series.updated.Store(now.UnixNano())
+
+	if value, ok := sampleValue(metric); ok {
+		series.record(s.base.historyCapacity, now, value)
+	}
+
+	return nil
+}
+
+// updateCounter adds delta to counter, series lock must be held
+func (s *ShardedStorage) updateCounter(id string, series *shardSeries, value any) error {
+	delta, ok := value.(int64)
+	if !ok {
+		return metrics.ErrWrongChangeType
+	}
+
+	counter := series.counter
+	changed := atomic.LoadInt64(&counter.Value) + delta
+
+	if s.base.wal != nil {
+		entry := newWALEntry(id, &metrics.CounterMetric{ID: counter.ID, Labels: counter.Labels, Value: changed, Type: counter.Type})
+		if err := s.base.wal.append(entry); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	atomic.StoreInt64(&counter.Value, changed)
+	series.updated.Store(now.UnixNano())
+	series.record(s.base.historyCapacity, now, float64(changed))
+
+	return nil
+}
+
+// UpdateBatch locks shards of all updated metrics in order of their indexes, so concurrent batches do not deadlock
+func (s *ShardedStorage) UpdateBatch(ctx context.Context, updates []BatchUpdate) error {
+	indexes := make([]int, 0, len(updates))
+	for _, u := range updates {
+		indexes = append(indexes, s.shardIndex(u.Key))
+	}
+	slices.Sort(indexes)
+	indexes = slices.Compact(indexes)
+
+	for _, i := range indexes {
+		s.shards[i].mx.Lock()
+		defer s.shards[i].mx.Unlock()
+	}
+
+	// changes are applied to copies of metrics and stored only if all of them succeed
+	staged := make(map[string]metrics.Metric, len(updates))
+	order := make([]string, 0, len(updates))
+
+	for _, u := range updates {
+		metric, ok := staged[u.Key]
+		if !ok {
+			var err error
+			if series, exists := s.shardOf(u.Key).series[u.Key]; exists {
+				metric, err = series.current()
+			} else {
+				metric, err = cloneMetric(u.Metric)
+			}
+			if err != nil {
+				return err
+			}
+			staged[u.Key] = metric
+			order = append(order, u.Key)
+		}
+
+		if metric.GetType() != u.Metric.GetType() {
+			return typeMismatch(u.Metric.GetType(), u.Key, metric.GetType())
+		}
+		if err := metric.Change(u.Value); err != nil {
+			return err
+		}
+	}
+
+	if s.base.wal != nil {
+		entries := make([]walEntry, 0, len(order))
+		for _, key := range order {
+			entries = append(entries, newWALEntry(key, staged[key]))
+		}
+		if err := s.base.wal.append(entries...); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	for _, key := range order {
+		metric := staged[key]
+		series := s.shardOf(key).setMetric(key, metric)
+
+		if value, ok := sampleValue(metric); ok {
+			series.record(s.base.historyCapacity, now, value)
+		}
+	}
+
+	return nil
+}
+
+func (s *ShardedStorage) History(ctx context.Context, id string, from, to time.Time) ([]Sample, error) {
+	sh := s.shardOf(id)
+	sh.mx.RLock()
+	defer sh.mx.RUnlock()
+
+	series, ok := sh.series[id]
+	if !ok {
+		return []Sample{}, nil
+	}
+
+	series.mx.Lock()
+	defer series.mx.Unlock()
+
+	if series.history == nil {
+		return []Sample{}, nil
+	}
+
+	return series.history.between(from, to), nil
+}
+
+func (s *ShardedStorage) Retain(ctx context.Context, now time.Time, policy RetentionPolicy) error {
+	for _, sh := range s.shards {
+		sh.mx.RLock()
+		for _, series := range sh.series {
+			series.mx.Lock()
+			if series.history != nil {
+				if series.aggregates == nil {
+					series.aggregates = make(map[time.Duration][]Aggregate, len(Resolutions))
+				}
+				retainSeries(series.history, series.aggregates, now, policy)
+			}
+			series.mx.Unlock()
+		}
+		sh.mx.RUnlock()
+	}
+
+	return nil
+}
+
+func (s *ShardedStorage) Aggregates(ctx context.Context, id string, resolution time.Duration, from, to time.Time) ([]Aggregate, error) {
+	if !validResolution(resolution) {
+		return nil, ErrUnknownResolution
+	}
+
+	sh := s.shardOf(id)
+	sh.mx.RLock()
+	defer sh.mx.RUnlock()
+
+	series, ok := sh.series[id]
+	if !ok {
+		return []Aggregate{}, nil
+	}
+
+	series.mx.Lock()
+	defer series.mx.Unlock()
+
+	return aggregatesBetween(series.aggregates[resolution], from, to), nil
+}
+
+// Save copies metrics and cuts wal while all series are frozen, so every cut wal record is included in snapshot,
+// which is written after changes are released
+func (s *ShardedStorage) Save(ctx context.Context) error {
+	s.base.saveMx.Lock()
+	defer s.base.saveMx.Unlock()
+
+	release := s.freeze()
+	all, err := s.collect()
+	if err == nil {
+		err = s.base.cutWAL()
+	}
+	release()
+	if err != nil {
+		return err
+	}
+
+	return s.base.save(all)
+}
+
+func (s *ShardedStorage) Load(ctx context.Context) error {
+	return s.base.load(ctx, s.restore)
+}
+
+func (s *ShardedStorage) AddSilence(ctx context.Context, silence Silence) error {
+	return s.base.AddSilence(ctx, silence)
+}
+
+func (s *ShardedStorage) Silences(ctx context.Context) ([]Silence, error) {
+	return s.base.Silences(ctx)
+}
+
+func (s *ShardedStorage) ExpireSilence(ctx context.Context, id string, at time.Time) error {
+	return s.base.ExpireSilence(ctx, id, at)
+}
+
+func (s *ShardedStorage) SaveIdempotencyKey(ctx context.Context, record IdempotencyRecord) error {
+	return s.base.SaveIdempotencyKey(ctx, record)
+}
+
+func (s *ShardedStorage) IdempotencyKey(ctx context.Context, key string) (IdempotencyRecord, error) {
+	return s.base.IdempotencyKey(ctx, key)
+}
+
+func (s *ShardedStorage) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *ShardedStorage) Close() error {
+	return s.base.Close()
+}
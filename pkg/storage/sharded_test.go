@@ -0,0 +1,268 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/renatus-cartesius/metricserv/pkg/metrics"
+)
+
+func TestShardedStorage(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := NewShardedStorage("/dev/null", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Add(ctx, "requests", metrics.NewCounter("requests", 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Add(ctx, "cpu", metrics.NewGauge("cpu", 0.5)); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Update(ctx, metrics.TypeCounter, "requests", int64(5)); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Update(ctx, metrics.TypeGauge, "cpu", 1.5); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Update(ctx, metrics.TypeGauge, "requests", 1.5); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("expected ErrTypeMismatch on type mismatch, got %v", err)
+	}
+	if err = s.Update(ctx, metrics.TypeCounter, "missing", int64(1)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound on missing metric, got %v", err)
+	}
+	if err = s.Update(ctx, metrics.TypeCounter, "requests", 1.5); !errors.Is(err, metrics.ErrWrongChangeType) {
+		t.Errorf("expected ErrWrongChangeType, got %v", err)
+	}
+
+	// batch with invalid update is not applied at all
+	err = s.UpdateBatch(ctx, []BatchUpdate{
+		{Key: "requests", Metric: metrics.NewCounter("requests", 0), Value: int64(100)},
+		{Key: "memory", Metric: metrics.NewGauge("memory", 0), Value: int64(1)},
+	})
+	if !errors.Is(err, metrics.ErrWrongChangeType) {
+		t.Fatalf("expected ErrWrongChangeType, got %v", err)
+	}
+	if ok, _ := s.CheckMetric(ctx, "memory"); ok {
+		t.Error("metric added by failed batch")
+	}
+
+	err = s.UpdateBatch(ctx, []BatchUpdate{
+		{Key: "requests", Metric: metrics.NewCounter("requests", 0), Value: int64(1)},
+		{Key: "memory", Metric: metrics.NewGauge("memory", 0), Value: 2.5},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		key   string
+		mtype string
+		want  string
+	}{
+		{key: "requests", mtype: metrics.TypeCounter, want: "16"},
+		{key: "cpu", mtype: metrics.TypeGauge, want: "1.5"},
+		{key: "memory", mtype: metrics.TypeGauge, want: "2.5"},
+	} {
+		value, err := s.GetValue(ctx, tt.mtype, tt.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != tt.want {
+			t.Errorf("unexpected value of %s: %q, want %q", tt.key, value, tt.want)
+		}
+	}
+
+	samples, err := s.History(ctx, "requests", time.Now().Add(-time.Minute), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 2 || samples[0].Value != 15 || samples[1].Value != 16 {
+		t.Errorf("unexpected samples %v", samples)
+	}
+
+	now := time.Now().Add(time.Minute)
+	if err = s.Retain(ctx, now, RetentionPolicy{MinuteAge: time.Hour, HourAge: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	aggregates, err := s.Aggregates(ctx, "requests", time.Minute, now.Add(-time.Hour), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	for _, a := range aggregates {
+		count += a.Count
+	}
+	if count != 2 {
+		t.Errorf("unexpected aggregates %+v", aggregates)
+	}
+}
+
+func TestShardedStorageConcurrentUpdates(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := NewShardedStorage("/dev/null", 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := make([]string, 16)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("counter_%d", i)
+		s.Add(ctx, keys[i], metrics.NewCounter(keys[i], 0))
+	}
+
+	workers, updates := 8, 500
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < updates; i++ {
+				key := keys[i%len(keys)]
+				if i%10 == 0 {
+					err := s.UpdateBatch(ctx, []BatchUpdate{
+						{Key: key, Metric: metrics.NewCounter(key, 0), Value: int64(1)},
+						{Key: keys[0], Metric: metrics.NewCounter(keys[0], 0), Value: int64(0)},
+					})
+					if err != nil {
+						t.Error(err)
+					}
+				} else if err := s.Update(ctx, metrics.TypeCounter, key, int64(1)); err != nil {
+					t.Error(err)
+				}
+				s.GetValue(ctx, metrics.TypeCounter, key)
+				if i%100 == 0 {
+					s.ListAll(ctx)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	all, err := s.ListAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var total int64
+	for _, metric := range all {
+		total += metric.(*metrics.CounterMetric).Value
+	}
+	if total != int64(workers*updates) {
+		t.Errorf("lost updates: total %d, want %d", total, workers*updates)
+	}
+}
+
+func TestShardedStorageListAllPointInTime(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := NewShardedStorage("/dev/null", 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharded := s.(*ShardedStorage)
+
+	// first is updated before second, but its shard is copied first
+	first, second := "", ""
+	for i := 0; first == "" || second == ""; i++ {
+		key := fmt.Sprintf("counter_%d", i)
+		switch sharded.shardIndex(key) {
+		case 0:
+			first = key
+		case 7:
+			second = key
+		}
+	}
+	s.Add(ctx, first, metrics.NewCounter(first, 0))
+	s.Add(ctx, second, metrics.NewCounter(second, 0))
+
+	// other metrics make copying long enough to overlap updates
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("gauge_%d", i)
+		s.Add(ctx, key, metrics.NewGauge(key, 0))
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			s.Update(ctx, metrics.TypeCounter, first, int64(1))
+			s.Update(ctx, metrics.TypeCounter, second, int64(1))
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		all, err := s.ListAll(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, b := all[first].(*metrics.CounterMetric).Value, all[second].(*metrics.CounterMetric).Value
+		if a != b && a != b+1 {
+			t.Errorf("listing is not point-in-time: %s is %d, %s is %d", first, a, second, b)
+			break
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestShardedStorageWAL(t *testing.T) {
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	savePath := filepath.Join(dir, "storage")
+	walPath := filepath.Join(dir, "storage.wal")
+
+	s, err := NewShardedStorage(savePath, 4, WithWAL(walPath, SyncPolicy{Always: true}), WithSnapshotFormat(SnapshotProto))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Add(ctx, "requests", metrics.NewCounter("requests", 10))
+	s.Add(ctx, "cpu", metrics.NewGauge("cpu", 0.5))
+	if err = s.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Update(ctx, metrics.TypeCounter, "requests", int64(5)); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Update(ctx, metrics.TypeGauge, "cpu", 2.5); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// snapshots and wal are shared with MemStorage
+	restored, err := NewMemStorage(savePath, WithWAL(walPath, SyncPolicy{Always: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if err = restored.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := restored.GetValue(ctx, metrics.TypeCounter, "requests"); value != "15" {
+		t.Errorf("unexpected restored counter %q", value)
+	}
+	if value, _ := restored.GetValue(ctx, metrics.TypeGauge, "cpu"); value != "2.5" {
+		t.Errorf("unexpected restored gauge %q", value)
+	}
+}
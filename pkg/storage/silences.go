@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/renatus-cartesius/metricserv/pkg/metrics"
+)
+
+const (
+	SilencePending = "pending"
+	SilenceActive  = "active"
+	SilenceExpired = "expired"
+)
+
+var (
+	ErrSilenceNotFound = errors.New("silence not found")
+	ErrInvalidSilence  = errors.New("invalid silence")
+)
+
+// Silence mutes notifications of alerts which labels satisfy all Matchers in [StartsAt, EndsAt) time range.
+// Matchers are in form of name<op>value, e.g. host=~web-.*
+type Silence struct {
+	ID        string    `json:"id"`
+	Matchers  []string  `json:"matchers"`
+	StartsAt  time.Time `json:"startsAt"`
+	EndsAt    time.Time `json:"endsAt"`
+	CreatedBy string    `json:"createdBy"`
+	Comment   string    `json:"comment"`
+}
+
+// Validate checks that silence has matchers and valid time range
+func (s *Silence) Validate() error {
+	if len(s.Matchers) == 0 {
+		return fmt.Errorf("%w: no matchers", ErrInvalidSilence)
+	}
+	if _, err := s.labelMatchers(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSilence, err)
+	}
+	if !s.EndsAt.After(s.StartsAt) {
+		return fmt.Errorf("%w: end must be after start", ErrInvalidSilence)
+	}
+	return nil
+}
+
+func (s *Silence) labelMatchers() ([]*metrics.LabelMatcher, error) {
+	matchers := make([]*metrics.LabelMatcher, 0, len(s.Matchers))
+	for _, raw := range s.Matchers {
+		matcher, err := metrics.ParseLabelMatcher(raw)
+		if err != nil {
+			return nil, fmt.Errorf("matcher %q: %w", raw, err)
+		}
+		matchers = append(matchers, matcher)
+	}
+	return matchers, nil
+}
+
+// State returns pending, active or expired state of silence at now
+func (s *Silence) State(now time.Time) string {
+	switch {
+	case now.Before(s.StartsAt):
+		return SilencePending
+	case now.Before(s.EndsAt):
+		return SilenceActive
+	default:
+		return SilenceExpired
+	}
+}
+
+// Mutes reports if silence is active at now and matches labels
+func (s *Silence) Mutes(labels map[string]string, now time.Time) bool {
+	if s.State(now) != SilenceActive {
+		return false
+	}
+
+	matchers, err := s.labelMatchers()
+	if err != nil {
+		return false
+	}
+
+	return metrics.MatchAll(labels, matchers)
+}
+
+// loadSilences reads silences saved by saveSilences, missing file means no silences
+func loadSilences(path string) (map[string]Silence, error) {
+	silences := make(map[string]Silence)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return silences, nil
+		}
+		return nil, err
+	}
+
+	if len(data) == 0 {
+		return silences, nil
+	}
+
+	list := make([]Silence, 0)
+	if err = json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+
+	for _, silence := range list {
+		silences[silence.ID] = silence
+	}
+
+	return silences, nil
+}
+
+// saveSilences writes silences to temporary file and renames it over path, so file is never left half written
+func saveSilences(path string, silences []Silence) error {
+	data, err := json.Marshal(silences)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,256 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+
+	"github.com/renatus-cartesius/metricserv/pkg/logger"
+	"github.com/renatus-cartesius/metricserv/pkg/metrics"
+	"github.com/renatus-cartesius/metricserv/pkg/utils"
+)
+
+const (
+	// DefaultSnapshotsKeep is a count of snapshots kept by MemStorage.Save including the newest one
+	DefaultSnapshotsKeep = 3
+
+	snapshotMagic   = "MSNP"
+	snapshotVersion = 1
+
+	// snapshotHeaderSize is a size of magic, version, format, payload length and its crc32 checksum
+	snapshotHeaderSize = 4 + 1 + 1 + 8 + 4
+)
+
+var (
+	ErrSnapshotCorrupted     = errors.New("snapshot is corrupted")
+	ErrSnapshotVersion       = errors.New("unsupported snapshot version")
+	ErrInvalidSnapshotFormat = errors.New("invalid snapshot format")
+)
+
+// SnapshotFormat is an encoding of snapshot payload, it is stored in snapshot header, so Load detects it
+type SnapshotFormat byte
+
+const (
+	SnapshotJSON SnapshotFormat = iota
+	SnapshotProto
+	SnapshotProtoZstd
+)
+
+var snapshotFormatNames = map[string]SnapshotFormat{
+	"json":       SnapshotJSON,
+	"proto":      SnapshotProto,
+	"proto+zstd": SnapshotProtoZstd,
+}
+
+// ParseSnapshotFormat parses json, proto or proto+zstd
+func ParseSnapshotFormat(raw string) (SnapshotFormat, error) {
+	format, ok := snapshotFormatNames[raw]
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidSnapshotFormat, raw)
+	}
+	return format, nil
+}
+
+var snapshotTable = crc32.MakeTable(crc32.Castagnoli)
+
+// snapshot is a verified content of snapshot file
+type snapshot struct {
+	format  SnapshotFormat
+	payload []byte
+}
+
+// encodeSnapshot frames payload by versioned header with its length and checksum
+func encodeSnapshot(format SnapshotFormat, payload []byte) []byte {
+	data := make([]byte, snapshotHeaderSize+len(payload))
+	copy(data[0:4], snapshotMagic)
+	data[4] = snapshotVersion
+	data[5] = byte(format)
+	binary.BigEndian.PutUint64(data[6:14], uint64(len(payload)))
+	binary.BigEndian.PutUint32(data[14:18], crc32.Checksum(payload, snapshotTable))
+	copy(data[snapshotHeaderSize:], payload)
+
+	return data
+}
+
+// decodeSnapshot verifies header and checksum of snapshot. Snapshots saved before header was introduced
+// are plain JSON and are accepted without verification.
+func decodeSnapshot(data []byte) (snapshot, error) {
+	if !bytes.HasPrefix(data, []byte(snapshotMagic)) {
+		if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+			return snapshot{format: SnapshotJSON, payload: data}, nil
+		}
+		return snapshot{}, fmt.Errorf("%w: unknown header", ErrSnapshotCorrupted)
+	}
+
+	if len(data) < snapshotHeaderSize {
+		return snapshot{}, fmt.Errorf("%w: truncated header", ErrSnapshotCorrupted)
+	}
+	if data[4] != snapshotVersion {
+		return snapshot{}, fmt.Errorf("%w: %d", ErrSnapshotVersion, data[4])
+	}
+
+	payload := data[snapshotHeaderSize:]
+	if binary.BigEndian.Uint64(data[6:14]) != uint64(len(payload)) {
+		return snapshot{}, fmt.Errorf("%w: payload length mismatch", ErrSnapshotCorrupted)
+	}
+	if binary.BigEndian.Uint32(data[14:18]) != crc32.Checksum(payload, snapshotTable) {
+		return snapshot{}, fmt.Errorf("%w: checksum mismatch", ErrSnapshotCorrupted)
+	}
+
+	return snapshot{format: SnapshotFormat(data[5]), payload: payload}, nil
+}
+
+// snapshotPaths returns paths of kept snapshots from the newest to the oldest one:
+// path itself and path.1, path.2 and so on for previous ones
+func snapshotPaths(path string, keep int) []string {
+	paths := []string{path}
+	for i := 1; i < keep; i++ {
+		paths = append(paths, fmt.Sprintf("%s.%d", path, i))
+	}
+	return paths
+}
+
+// writeSnapshot atomically replaces snapshot at path: data is written to temporary file, fsynced and renamed,
+// previous snapshots are shifted, so keep snapshots are left. Crash at any moment leaves either new or previous
+// snapshot intact.
+func writeSnapshot(path string, keep int, data []byte) error {
+	// special files, e.g. /dev/null, are written in place
+	if info, err := os.Stat(path); err == nil && !info.Mode().IsRegular() {
+		return os.WriteFile(path, data, 0666)
+	}
+
+	dir := filepath.Dir(path)
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		utils.SafeClose(tmp)
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		utils.SafeClose(tmp)
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	paths := snapshotPaths(path, max(keep, 1))
+	for i := len(paths) - 1; i > 0; i-- {
+		if err = os.Rename(paths[i-1], paths[i]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir makes renames in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer utils.SafeClose(d)
+
+	return d.Sync()
+}
+
+// readSnapshot passes the newest of kept snapshots passing verification to fn, older snapshot is tried if fn fails.
+// Missing and empty files are skipped, error of the oldest tried snapshot is returned if no snapshot is valid.
+// Index of passed snapshot is returned, it is keep if there is no snapshot at all.
+func readSnapshot(path string, keep int, fn func(snapshot) error) (int, error) {
+	var lastErr error
+
+	paths := snapshotPaths(path, max(keep, 1))
+	for i, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return i, err
+		}
+		if len(data) == 0 {
+			continue
+		}
+
+		snap, err := decodeSnapshot(data)
+		if err == nil {
+			err = fn(snap)
+		}
+		if err != nil {
+			logger.Log.Warn(
+				"skipping snapshot failed verification",
+				zap.String("filepath", p),
+				zap.Error(err),
+			)
+			lastErr = err
+			continue
+		}
+
+		if i > 0 {
+			logger.Log.Warn(
+				"falling back to previous snapshot",
+				zap.String("filepath", p),
+			)
+		}
+
+		return i, nil
+	}
+
+	return len(paths), lastErr
+}
+
+// decode decodes metrics from payload according to its format
+func (snap snapshot) decode() (map[string]metrics.Metric, error) {
+	switch snap.format {
+	case SnapshotJSON:
+		return decodeMetrics(snap.payload)
+	case SnapshotProto:
+		return decodeProtoMetrics(snap.payload)
+	case SnapshotProtoZstd:
+		payload, err := decompressZstd(snap.payload)
+		if err != nil {
+			return nil, err
+		}
+		return decodeProtoMetrics(payload)
+	}
+
+	return nil, fmt.Errorf("%w: unknown format %d", ErrSnapshotCorrupted, snap.format)
+}
+
+// encodeSnapshotPayload encodes metrics in snapshot format
+func encodeSnapshotPayload(format SnapshotFormat, all map[string]metrics.Metric) ([]byte, error) {
+	switch format {
+	case SnapshotJSON:
+		return json.Marshal(struct {
+			Metrics map[string]metrics.Metric `json:"metrics"`
+		}{Metrics: all})
+	case SnapshotProto:
+		return encodeProtoMetrics(all)
+	case SnapshotProtoZstd:
+		payload, err := encodeProtoMetrics(all)
+		if err != nil {
+			return nil, err
+		}
+		return compressZstd(payload)
+	}
+
+	return nil, fmt.Errorf("%w: %d", ErrInvalidSnapshotFormat, format)
+}
@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/proto"
+
+	api2 "github.com/renatus-cartesius/metricserv/api"
+	"github.com/renatus-cartesius/metricserv/pkg/metrics"
+)
+
+// encodeProtoMetrics encodes metrics to binary snapshot payload
+func encodeProtoMetrics(all map[string]metrics.Metric) ([]byte, error) {
+	snap := &api2.Snapshot{
+		Metrics: make([]*api2.AddMetricRequest, 0, len(all)),
+	}
+
+	for key, metric := range all {
+		m, err := snapshotMetric(metric)
+		if err != nil {
+			return nil, fmt.Errorf("error on encoding metric %s: %w", key, err)
+		}
+		snap.Metrics = append(snap.Metrics, m)
+	}
+
+	return proto.Marshal(snap)
+}
+
+func snapshotMetric(metric metrics.Metric) (*api2.AddMetricRequest, error) {
+	m := &api2.Metric{
+		Labels: metric.GetLabels(),
+	}
+
+	switch metric.GetType() {
+	case metrics.TypeCounter:
+		m.Type = api2.MetricType_COUNTER
+		m.Value = metric.GetValue()
+	case metrics.TypeGauge:
+		m.Type = api2.MetricType_GAUGE
+		m.Value = metric.GetValue()
+	case metrics.TypeHistogram:
+		histogram, ok := metric.(*metrics.HistogramMetric)
+		if !ok {
+			return nil, invalidType(metric.GetType(), metric.GetID())
+		}
+		m.Type = api2.MetricType_HISTOGRAM
+		m.Histogram = &api2.Histogram{
+			Buckets: histogram.Buckets,
+			Counts:  histogram.Counts,
+			Sum:     histogram.Sum,
+			Count:   histogram.Count,
+		}
+	case metrics.TypeSummary:
+		m.Type = api2.MetricType_SUMMARY
+		m.Value = metric.GetValue()
+	default:
+		return nil, invalidType(metric.GetType(), metric.GetID())
+	}
+
+	return &api2.AddMetricRequest{MetricID: metric.GetID(), Metric: m}, nil
+}
+
+// decodeProtoMetrics decodes binary snapshot payload, metrics are returned only if whole payload is valid
+func decodeProtoMetrics(payload []byte) (map[string]metrics.Metric, error) {
+	var snap api2.Snapshot
+	if err := proto.Unmarshal(payload, &snap); err != nil {
+		return nil, err
+	}
+
+	loaded := make(map[string]metrics.Metric, len(snap.Metrics))
+
+	for _, in := range snap.Metrics {
+		metric, err := restoredMetric(in)
+		if err != nil {
+			return nil, fmt.Errorf("error on decoding metric %s: %w", in.MetricID, err)
+		}
+		loaded[metrics.SeriesKey(in.MetricID, in.GetMetric().GetLabels())] = metric
+	}
+
+	return loaded, nil
+}
+
+func restoredMetric(in *api2.AddMetricRequest) (metrics.Metric, error) {
+	if in.Metric == nil {
+		return nil, fmt.Errorf("%w: metric is not set", ErrSnapshotCorrupted)
+	}
+
+	// labels of empty set are decoded as nil map, as in JSON snapshot
+	labels := in.Metric.Labels
+	if len(labels) == 0 {
+		labels = nil
+	}
+
+	switch in.Metric.Type {
+	case api2.MetricType_COUNTER:
+		value, err := strconv.ParseInt(in.Metric.Value, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		counter := metrics.NewCounter(in.MetricID, value)
+		counter.Labels = labels
+		return counter, nil
+	case api2.MetricType_GAUGE:
+		value, err := strconv.ParseFloat(in.Metric.Value, 64)
+		if err != nil {
+			return nil, err
+		}
+		gauge := metrics.NewGauge(in.MetricID, value)
+		gauge.Labels = labels
+		return gauge, nil
+	case api2.MetricType_HISTOGRAM:
+		if in.Metric.Histogram == nil {
+			return nil, fmt.Errorf("%w: histogram is not set", ErrSnapshotCorrupted)
+		}
+		if err := metrics.ValidateHistogram(in.Metric.Histogram.Buckets, in.Metric.Histogram.Counts); err != nil {
+			return nil, err
+		}
+		histogram := metrics.NewHistogram(in.MetricID, in.Metric.Histogram.Buckets)
+		copy(histogram.Counts, in.Metric.Histogram.Counts)
+		histogram.Sum = in.Metric.Histogram.Sum
+		histogram.Count = in.Metric.Histogram.Count
+		histogram.Labels = labels
+		return histogram, nil
+	case api2.MetricType_SUMMARY:
+		summary, err := metrics.ParseSummaryValue(in.MetricID, in.Metric.Value)
+		if err != nil {
+			return nil, err
+		}
+		summary.Labels = labels
+		return summary, nil
+	}
+
+	return nil, invalidType(in.Metric.Type.String(), in.MetricID)
+}
+
+func compressZstd(payload []byte) ([]byte, error) {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer encoder.Close()
+
+	return encoder.EncodeAll(payload, nil), nil
+}
+
+func decompressZstd(payload []byte) ([]byte, error) {
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+
+	return decoder.DecodeAll(payload, nil)
+}
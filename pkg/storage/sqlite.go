@@ -0,0 +1,552 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	_ "modernc.org/sqlite"
+
+	"github.com/renatus-cartesius/metricserv/pkg/logger"
+	"github.com/renatus-cartesius/metricserv/pkg/metrics"
+)
+
+const (
+	// SQLiteScheme is a scheme of DSN selecting SQLite storage, e.g. sqlite:///var/lib/metricserv/metrics.db
+	SQLiteScheme = "sqlite://"
+
+	// SQLiteDriver is a name of pure Go SQLite driver registered in database/sql
+	SQLiteDriver = "sqlite"
+)
+
+// SQLitePath returns database path of DSN with SQLiteScheme, ok is false for DSN of other storages
+func SQLitePath(dsn string) (path string, ok bool) {
+	return strings.CutPrefix(dsn, SQLiteScheme)
+}
+
+// SQLiteStorage implements Storager using embedded SQLite database.
+// Timestamps are stored as unix time in nanoseconds, so they are compared as numbers.
+type SQLiteStorage struct {
+	Storager
+	db *sql.DB
+}
+
+// NewSQLiteStorage uses db with schema of sqlite migrations. Database is accessed through single connection:
+// SQLite allows only one writer anyway, and serialized transactions make read-modify-write updates safe
+// without row locks.
+func NewSQLiteStorage(db *sql.DB) (Storager, error) {
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec("PRAGMA journal_mode = WAL"); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec("PRAGMA busy_timeout = 5000"); err != nil {
+		return nil, err
+	}
+
+	return &SQLiteStorage{
+		db: db,
+	}, nil
+}
+
+func (ss *SQLiteStorage) Close() error {
+	return ss.db.Close()
+}
+
+func (ss *SQLiteStorage) Ping(ctx context.Context) error {
+	return unavailable(ss.db.PingContext(ctx))
+}
+
+// Add inserts metric or replaces stored metric with the same key and type
+func (ss *SQLiteStorage) Add(ctx context.Context, id string, metric metrics.Metric) (err error) {
+	defer func() { err = unavailable(err) }()
+
+	labels, err := marshalLabels(metric.GetLabels())
+	if err != nil {
+		return err
+	}
+
+	columns, err := metricColumns(metric)
+	if err != nil {
+		return err
+	}
+
+	_, err = ss.db.ExecContext(ctx, `
+		INSERT INTO metrics (id, name, labels, type, value, int_value, histogram, sketch, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (id) DO UPDATE SET
+			name = excluded.name,
+			type = excluded.type,
+			labels = excluded.labels,
+			value = excluded.value,
+			int_value = excluded.int_value,
+			histogram = excluded.histogram,
+			sketch = excluded.sketch,
+			updated_at = excluded.updated_at`,
+		append(append([]any{id, metric.GetID(), labels, metric.GetType()}, columns...), time.Now().UnixNano())...)
+	return err
+}
+
+func (ss *SQLiteStorage) ListAll(ctx context.Context) (all map[string]metrics.Metric, err error) {
+	defer func() { err = unavailable(err) }()
+
+	rows, err := ss.db.QueryContext(ctx, "SELECT id, name, labels, type, value, int_value, histogram, sketch FROM metrics")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanMetrics(rows)
+}
+
+func (ss *SQLiteStorage) Iterate(ctx context.Context, fn func(key string, metric metrics.Metric) error) (err error) {
+	defer func() { err = unavailable(err) }()
+
+	rows, err := ss.db.QueryContext(ctx, "SELECT id, name, labels, type, value, int_value, histogram, sketch FROM metrics")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	return iterateRows(rows, fn)
+}
+
+func (ss *SQLiteStorage) CheckMetric(ctx context.Context, id string) (bool, error) {
+	var exists bool
+	err := ss.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM metrics WHERE id = $1)", id).Scan(&exists)
+	return exists, unavailable(err)
+}
+
+// sqliteScalarUpdateQuery returns query changing counter or gauge and returning its new value, checking type of value
+func sqliteScalarUpdateQuery(mtype string, value any) (string, error) {
+	switch mtype {
+	case metrics.TypeCounter:
+		if _, ok := value.(int64); !ok {
+			return "", metrics.ErrWrongChangeType
+		}
+		return "UPDATE metrics SET int_value = int_value + $1, updated_at = $4 WHERE id = $2 AND type = $3 RETURNING int_value", nil
+	case metrics.TypeGauge:
+		if _, ok := value.(float64); !ok {
+			return "", metrics.ErrWrongChangeType
+		}
+		return "UPDATE metrics SET value = $1, updated_at = $4 WHERE id = $2 AND type = $3 RETURNING value", nil
+	default:
+		return "", ErrInvalidType
+	}
+}
+
+// update changes metric in transaction tx, counters and gauges new values are recorded as samples
+func (ss *SQLiteStorage) update(ctx context.Context, tx *sql.Tx, mtype, id string, value any) error {
+	if _, ok := jsonColumns[mtype]; ok {
+		return updateJSONMetric(ctx, tx, "", mtype, id, value)
+	}
+
+	query, err := sqliteScalarUpdateQuery(mtype, value)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UnixNano()
+
+	var sample float64
+	if err = tx.QueryRowContext(ctx, query, value, id, mtype, now).Scan(&sample); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return missingMetric(ctx, tx, mtype, id)
+		}
+		logger.Log.Error(
+			"error on updating metric in db",
+			zap.String("type", mtype),
+			zap.Error(err),
+		)
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO samples (id, ts, value) VALUES ($1, $2, $3)", id, now, sample)
+	return err
+}
+
+func (ss *SQLiteStorage) Update(ctx context.Context, mtype, id string, value any) (err error) {
+	defer func() { err = unavailable(err) }()
+
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = ss.update(ctx, tx, mtype, id, value); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UpdateBatch applies updates in single transaction
+func (ss *SQLiteStorage) UpdateBatch(ctx context.Context, updates []BatchUpdate) (err error) {
+	defer func() { err = unavailable(err) }()
+
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, u := range updates {
+		mtype := u.Metric.GetType()
+
+		labels, err := marshalLabels(u.Metric.GetLabels())
+		if err != nil {
+			return err
+		}
+		columns, err := metricColumns(u.Metric)
+		if err != nil {
+			return err
+		}
+		if err = checkStoredType(ctx, tx, mtype, u.Key); err != nil {
+			return err
+		}
+		if _, err = tx.ExecContext(ctx, insertMissingQuery, append([]any{u.Key, u.Metric.GetID(), labels, mtype}, columns...)...); err != nil {
+			return err
+		}
+
+		if err = ss.update(ctx, tx, mtype, u.Key, u.Value); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (ss *SQLiteStorage) Delete(ctx context.Context, mtype, id string) (err error) {
+	defer func() { err = unavailable(err) }()
+
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	deleted, err := deleteMetrics(ctx, tx, deleteMetricQuery, id, mtype)
+	if err != nil {
+		return err
+	}
+	if len(deleted) == 0 {
+		return missingMetric(ctx, tx, mtype, id)
+	}
+
+	return tx.Commit()
+}
+
+func (ss *SQLiteStorage) Stale(ctx context.Context, before time.Time) (keys []string, err error) {
+	defer func() { err = unavailable(err) }()
+
+	rows, err := ss.db.QueryContext(ctx, staleQuery, metrics.TypeGauge, before.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+
+	return scanIDs(rows)
+}
+
+func (ss *SQLiteStorage) Evict(ctx context.Context, before time.Time) (keys []string, err error) {
+	defer func() { err = unavailable(err) }()
+
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	evicted, err := deleteMetrics(ctx, tx, evictQuery, metrics.TypeGauge, before.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+
+	return evicted, tx.Commit()
+}
+
+func (ss *SQLiteStorage) GetValue(ctx context.Context, mtype, id string) (value string, err error) {
+	defer func() { err = unavailable(err) }()
+
+	column, err := valueColumn(mtype, id)
+	if err != nil {
+		return "", err
+	}
+
+	var raw sql.NullString
+	row := ss.db.QueryRowContext(ctx, "SELECT CAST("+column+" AS TEXT) FROM metrics WHERE id = $1 and type = $2", id, mtype)
+	if err := row.Scan(&raw); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", missingMetric(ctx, ss.db, mtype, id)
+		}
+		return "", err
+	}
+
+	if mtype == metrics.TypeGauge && raw.Valid {
+		// format gauges the same way as metrics.GaugeMetric does
+		value, err := strconv.ParseFloat(raw.String, 64)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%v", value), nil
+	}
+
+	return raw.String, nil
+}
+
+func (ss *SQLiteStorage) History(ctx context.Context, id string, from, to time.Time) (samples []Sample, err error) {
+	defer func() { err = unavailable(err) }()
+
+	rows, err := ss.db.QueryContext(ctx, "SELECT ts, value FROM samples WHERE id = $1 AND ts BETWEEN $2 AND $3 ORDER BY ts", id, from.UnixNano(), to.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	samples = make([]Sample, 0)
+	for rows.Next() {
+		var sample Sample
+		var ts int64
+		if err = rows.Scan(&ts, &sample.Value); err != nil {
+			return nil, err
+		}
+		sample.Timestamp = time.Unix(0, ts)
+		samples = append(samples, sample)
+	}
+
+	return samples, rows.Err()
+}
+
+// ImportHistory replaces samples and aggregates of series
+func (ss *SQLiteStorage) ImportHistory(ctx context.Context, id string, samples []Sample, aggregates map[time.Duration][]Aggregate) (err error) {
+	defer func() { err = unavailable(err) }()
+
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM samples WHERE id = $1", id); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM aggregates WHERE id = $1", id); err != nil {
+		return err
+	}
+
+	for _, sample := range samples {
+		if _, err = tx.ExecContext(ctx, "INSERT INTO samples (id, ts, value) VALUES ($1, $2, $3)", id, sample.Timestamp.UnixNano(), sample.Value); err != nil {
+			return err
+		}
+	}
+
+	for resolution, resolutionAggregates := range aggregates {
+		for _, a := range resolutionAggregates {
+			_, err = tx.ExecContext(ctx, "INSERT INTO aggregates (id, resolution, ts, min, max, sum, count, last) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+				id, int64(resolution.Seconds()), a.Timestamp.UnixNano(), a.Min, a.Max, a.Sum, a.Count, a.Last)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (ss *SQLiteStorage) Retain(ctx context.Context, now time.Time, policy RetentionPolicy) (err error) {
+	defer func() { err = unavailable(err) }()
+
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rawBefore := now.Add(-policy.RawAge).UnixNano()
+
+	for _, resolution := range Resolutions {
+		// last value of bucket is taken from its latest sample, WHERE true disambiguates upsert clause
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO aggregates (id, resolution, ts, min, max, sum, count, last)
+			SELECT id, $1, bucket, min(value), max(value), sum(value), count(*),
+				(SELECT l.value FROM samples l WHERE l.id = b.id AND l.ts >= b.bucket AND l.ts < b.bucket + $2 AND l.ts < $3 ORDER BY l.ts DESC LIMIT 1)
+			FROM (SELECT id, value, ts - ts % $2 AS bucket FROM samples WHERE ts < $3) b
+			WHERE true
+			GROUP BY id, bucket
+			ON CONFLICT (id, resolution, ts) DO UPDATE SET
+				min = min(aggregates.min, excluded.min),
+				max = max(aggregates.max, excluded.max),
+				sum = aggregates.sum + excluded.sum,
+				count = aggregates.count + excluded.count,
+				last = excluded.last`, int64(resolution.Seconds()), resolution.Nanoseconds(), rawBefore)
+		if err != nil {
+			logger.Log.Error(
+				"error on rolling up samples",
+				zap.Duration("resolution", resolution),
+				zap.Error(err),
+			)
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "DELETE FROM aggregates WHERE resolution = $1 AND ts < $2", int64(resolution.Seconds()), now.Add(-policy.AggregateAge(resolution)).UnixNano())
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM samples WHERE ts < $1", rawBefore); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (ss *SQLiteStorage) Aggregates(ctx context.Context, id string, resolution time.Duration, from, to time.Time) (aggregates []Aggregate, err error) {
+	defer func() { err = unavailable(err) }()
+
+	if !validResolution(resolution) {
+		return nil, ErrUnknownResolution
+	}
+
+	rows, err := ss.db.QueryContext(ctx, "SELECT ts, min, max, sum, count, last FROM aggregates WHERE id = $1 AND resolution = $2 AND ts BETWEEN $3 AND $4 ORDER BY ts",
+		id, int64(resolution.Seconds()), from.UnixNano(), to.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	aggregates = make([]Aggregate, 0)
+	for rows.Next() {
+		var aggregate Aggregate
+		var ts int64
+		if err = rows.Scan(&ts, &aggregate.Min, &aggregate.Max, &aggregate.Sum, &aggregate.Count, &aggregate.Last); err != nil {
+			return nil, err
+		}
+		aggregate.Timestamp = time.Unix(0, ts)
+		aggregate.Avg = aggregate.Sum / float64(aggregate.Count)
+		aggregates = append(aggregates, aggregate)
+	}
+
+	return aggregates, rows.Err()
+}
+
+func (ss *SQLiteStorage) AddSilence(ctx context.Context, silence Silence) (err error) {
+	defer func() { err = unavailable(err) }()
+
+	matchers, err := json.Marshal(silence.Matchers)
+	if err != nil {
+		return err
+	}
+
+	_, err = ss.db.ExecContext(ctx, "INSERT INTO silences (id, matchers, starts_at, ends_at, created_by, comment) VALUES ($1, $2, $3, $4, $5, $6)",
+		silence.ID, string(matchers), silence.StartsAt.UnixNano(), silence.EndsAt.UnixNano(), silence.CreatedBy, silence.Comment)
+	return err
+}
+
+func (ss *SQLiteStorage) Silences(ctx context.Context) (silences []Silence, err error) {
+	defer func() { err = unavailable(err) }()
+
+	rows, err := ss.db.QueryContext(ctx, "SELECT id, matchers, starts_at, ends_at, created_by, comment FROM silences ORDER BY starts_at, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	silences = make([]Silence, 0)
+	for rows.Next() {
+		var silence Silence
+		var matchers string
+		var startsAt, endsAt int64
+		if err = rows.Scan(&silence.ID, &matchers, &startsAt, &endsAt, &silence.CreatedBy, &silence.Comment); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(matchers), &silence.Matchers); err != nil {
+			return nil, err
+		}
+		silence.StartsAt = time.Unix(0, startsAt)
+		silence.EndsAt = time.Unix(0, endsAt)
+		silences = append(silences, silence)
+	}
+
+	return silences, rows.Err()
+}
+
+func (ss *SQLiteStorage) ExpireSilence(ctx context.Context, id string, at time.Time) (err error) {
+	defer func() { err = unavailable(err) }()
+
+	result, err := ss.db.ExecContext(ctx, "UPDATE silences SET ends_at = min(ends_at, $2) WHERE id = $1", id, at.UnixNano())
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrSilenceNotFound
+	}
+
+	return nil
+}
+
+// SaveIdempotencyKey upserts record and drops expired ones
+func (ss *SQLiteStorage) SaveIdempotencyKey(ctx context.Context, record IdempotencyRecord) (err error) {
+	defer func() { err = unavailable(err) }()
+
+	if record.Body == nil {
+		record.Body = []byte{}
+	}
+
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at <= $1", time.Now().UnixNano()); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO idempotency_keys (key, fingerprint, status, content_type, body, expires_at) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (key) DO UPDATE SET fingerprint = excluded.fingerprint, status = excluded.status, content_type = excluded.content_type, body = excluded.body, expires_at = excluded.expires_at`,
+		record.Key, record.Fingerprint, record.Status, record.ContentType, record.Body, record.ExpiresAt.UnixNano())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (ss *SQLiteStorage) IdempotencyKey(ctx context.Context, key string) (record IdempotencyRecord, err error) {
+	defer func() { err = unavailable(err) }()
+
+	record = IdempotencyRecord{Key: key}
+
+	var expiresAt int64
+	err = ss.db.QueryRowContext(ctx, "SELECT fingerprint, status, content_type, body, expires_at FROM idempotency_keys WHERE key = $1 AND expires_at > $2", key, time.Now().UnixNano()).
+		Scan(&record.Fingerprint, &record.Status, &record.ContentType, &record.Body, &expiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return IdempotencyRecord{}, ErrIdempotencyKeyNotFound
+		}
+		return IdempotencyRecord{}, err
+	}
+	record.ExpiresAt = time.Unix(0, expiresAt)
+
+	return record, nil
+}
+
+// Save is a no-op, every change is committed to database immediately
+func (ss *SQLiteStorage) Save(ctx context.Context) error {
+	return nil
+}
+
+func (ss *SQLiteStorage) Load(ctx context.Context) error {
+	return unavailable(ss.db.PingContext(ctx))
+}
@@ -0,0 +1,29 @@
+package storage
+
+import (
+	"time"
+)
+
+// StalenessPolicy sets how long gauges may go without updates. Gauges not updated for StaleAfter are reported
+// as stale and ones not updated for EvictAfter are deleted. Zero period disables the check.
+// Counters, histograms and summaries accumulate values, so they never become stale.
+type StalenessPolicy struct {
+	StaleAfter time.Duration
+	EvictAfter time.Duration
+}
+
+// StaleBefore returns time of last update before which gauge is stale at now, ok is false if staleness is disabled
+func (p StalenessPolicy) StaleBefore(now time.Time) (before time.Time, ok bool) {
+	if p.StaleAfter <= 0 {
+		return time.Time{}, false
+	}
+	return now.Add(-p.StaleAfter), true
+}
+
+// EvictBefore returns time of last update before which gauge is evicted at now, ok is false if eviction is disabled
+func (p StalenessPolicy) EvictBefore(now time.Time) (before time.Time, ok bool) {
+	if p.EvictAfter <= 0 {
+		return time.Time{}, false
+	}
+	return now.Add(-p.EvictAfter), true
+}
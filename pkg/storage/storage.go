@@ -2,51 +2,92 @@
 package storage
 
 import (
+	"container/heap"
 	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/renatus-cartesius/metricserv/pkg/logger"
 	"github.com/renatus-cartesius/metricserv/pkg/metrics"
-	"github.com/renatus-cartesius/metricserv/pkg/utils"
 	"go.uber.org/zap"
 )
 
-var (
-	ErrWrongUpdateType = errors.New("wrong type when updating metric in storage")
-	ErrWrongGetType    = errors.New("wrong type when getting metric from storage")
-	ErrEmptyMemStorage = errors.New("memstorage is not initialized")
-)
+var ErrEmptyMemStorage = fmt.Errorf("%w: memstorage is not initialized", ErrUnavailable)
 
 // Storager represents data repository and working with some kind of underlying datastore (memory, file, dbms) and exposes CRUD operations. Data can be Load from underlying datastore on init phase.
+// Metrics are identified by key built with metrics.SeriesKey from metric name and its label set.
 type Storager interface {
 	// Add Adds new metric to storage.
 	Add(context.Context, string, metrics.Metric) error
 
-	// ListAll Listing all metrics in storage.
+	// ListAll Listing all metrics in storage. Returned metrics are point-in-time copies, which are not changed by updates.
 	ListAll(context.Context) (map[string]metrics.Metric, error)
 
+	// Iterate passes copies of metrics to fn one by one without listing all of them at once, walking is stopped
+	// by error of fn, which is returned. Unlike ListAll it is not a point-in-time view: metrics changed while walking
+	// are passed in either state. Database backends keep query open while walking, so fn should not call storage.
+	Iterate(ctx context.Context, fn func(key string, metric metrics.Metric) error) error
+
 	// CheckMetric checking if metric is in storage by it`s id.
 	CheckMetric(context.Context, string) (bool, error)
 
-	// Update updates already added to storage metric.
+	// Update updates already added to storage metric, ErrNotFound is returned if there is no metric and
+	// ErrTypeMismatch if metric is stored with other type.
 	Update(context.Context, string, string, any) error
 
-	// GetValue returning value of metric as strings.
+	// UpdateBatch applies all updates atomically: either every metric of batch is changed or none of them.
+	UpdateBatch(ctx context.Context, updates []BatchUpdate) error
+
+	// GetValue returning value of metric as strings, errors are the same as of Update.
 	GetValue(context.Context, string, string) (string, error)
 
+	// Delete removes metric of type with its history, errors are the same as of Update.
+	Delete(ctx context.Context, mtype, id string) error
+
+	// Stale returns keys of gauges last updated before time before.
+	Stale(ctx context.Context, before time.Time) ([]string, error)
+
+	// Evict deletes gauges last updated before time before with their history and returns their keys.
+	Evict(ctx context.Context, before time.Time) ([]string, error)
+
 	// Save saving all metrics to underlying datastore
 	Save(context.Context) error
 
 	// Load loads all metrics from underlying datastore.
 	Load(context.Context) error
 
-	// Ping checks if underlying datastore is available.
+	// History returns samples of metric recorded on updates in [from, to] time range.
+	History(ctx context.Context, id string, from, to time.Time) ([]Sample, error)
+
+	// Retain rolls samples older than policy allows into aggregates and drops outdated aggregates.
+	Retain(ctx context.Context, now time.Time, policy RetentionPolicy) error
+
+	// Aggregates returns aggregates of metric samples with given resolution in [from, to] time range.
+	Aggregates(ctx context.Context, id string, resolution time.Duration, from, to time.Time) ([]Aggregate, error)
+
+	// AddSilence stores new silence of alert notifications.
+	AddSilence(ctx context.Context, silence Silence) error
+
+	// Silences lists all stored silences including expired ones.
+	Silences(ctx context.Context) ([]Silence, error)
+
+	// ExpireSilence ends silence at time at, ErrSilenceNotFound is returned for unknown id.
+	ExpireSilence(ctx context.Context, id string, at time.Time) error
+
+	// SaveIdempotencyKey remembers response of request with idempotency key, replacing previous record of key.
+	SaveIdempotencyKey(ctx context.Context, record IdempotencyRecord) error
+
+	// IdempotencyKey returns remembered response, ErrIdempotencyKeyNotFound is returned for unknown or expired key.
+	IdempotencyKey(ctx context.Context, key string) (IdempotencyRecord, error)
+
+	// Ping checks if underlying datastore is available, error wraps ErrUnavailable if it is not.
 	Ping(context.Context) error
 
 	// Close free underlying datastore.
@@ -59,258 +100,1628 @@ type MemStorage struct {
 	mx       sync.RWMutex
 	Metrics  map[string]metrics.Metric `json:"metrics"`
 	savePath string
-}
+	// saveMx serializes saves, snapshot is written while changes are not blocked
+	saveMx sync.Mutex
 
-func NewMemStorage(savePath string) (Storager, error) {
-	return &MemStorage{
-		Metrics:  make(map[string]metrics.Metric, 0),
-		savePath: savePath,
-	}, nil
+	history         map[string]*ring
+	historyCapacity int
+	aggregates      map[string]map[time.Duration][]Aggregate
+
+	// updated is a time of last change of metrics, metrics restored by Load are considered changed on loading
+	updated map[string]time.Time
+
+	silencesMx   sync.RWMutex
+	silences     map[string]Silence
+	silencesPath string
+
+	idempotencyMx     sync.Mutex
+	idempotencyKeys   map[string]IdempotencyRecord
+	idempotencyExpiry expiryQueue
+
+	walPath   string
+	walPolicy SyncPolicy
+	wal       *wal
+
+	snapshotsKeep  int
+	snapshotFormat SnapshotFormat
 }
 
-func (s *MemStorage) Update(ctx context.Context, mtype, id string, value any) error {
-	s.mx.Lock()
-	defer s.mx.Unlock()
+// MemStorageOption configures optional parameters of MemStorage
+type MemStorageOption func(*MemStorage)
 
-	metric := s.Metrics[id]
-	if metric.GetType() != mtype {
-		return ErrWrongUpdateType
+// WithHistoryCapacity sets count of samples kept per series
+func WithHistoryCapacity(capacity int) MemStorageOption {
+	return func(s *MemStorage) {
+		s.historyCapacity = capacity
 	}
-	metric.Change(value)
+}
 
-	return nil
+// WithSilencesPath sets file where silences are persisted, silences are kept only in memory by default
+func WithSilencesPath(path string) MemStorageOption {
+	return func(s *MemStorage) {
+		s.silencesPath = path
+	}
 }
 
-func (s *MemStorage) Add(ctx context.Context, id string, metric metrics.Metric) error {
-	s.mx.Lock()
-	defer s.mx.Unlock()
-	s.Metrics[id] = metric
-	return nil
+// WithWAL logs every change of metrics to write-ahead log at path, which is replayed by Load on top of snapshot
+// and rotated after each Save. Rotated segments are kept while snapshots they follow are kept.
+func WithWAL(path string, policy SyncPolicy) MemStorageOption {
+	return func(s *MemStorage) {
+		s.walPath = path
+		s.walPolicy = policy
+	}
 }
 
-func (s *MemStorage) CheckMetric(ctx context.Context, id string) (bool, error) {
-	// TODO: need to add check of metric type
-	s.mx.RLock()
-	defer s.mx.RUnlock()
-	_, ok := s.Metrics[id]
-	return ok, nil
+// WithSnapshotsKeep sets count of snapshots kept by Save, older snapshots are used by Load if newer ones are corrupted
+func WithSnapshotsKeep(keep int) MemStorageOption {
+	return func(s *MemStorage) {
+		s.snapshotsKeep = keep
+	}
 }
 
-func (s *MemStorage) ListAll(ctx context.Context) (map[string]metrics.Metric, error) {
-	s.mx.RLock()
-	defer s.mx.RUnlock()
-	return s.Metrics, nil
+// WithSnapshotFormat sets encoding of snapshots written by Save, Load detects format of snapshot itself
+func WithSnapshotFormat(format SnapshotFormat) MemStorageOption {
+	return func(s *MemStorage) {
+		s.snapshotFormat = format
+	}
 }
 
-func (s *MemStorage) GetValue(ctx context.Context, mtype, id string) (string, error) {
-	s.mx.RLock()
-	defer s.mx.RUnlock()
-	metric := s.Metrics[id]
-	if metric.GetType() != mtype {
-		return "", nil
+func NewMemStorage(savePath string, opts ...MemStorageOption) (Storager, error) {
+	s, err := newMemStorage(savePath, opts...)
+	if err != nil {
+		return nil, err
 	}
-	return metric.GetValue(), nil
+	return s, nil
 }
 
-// Load loading metrics from file to MemStorage.Metrics
-func (s *MemStorage) Load(ctx context.Context) error {
+func newMemStorage(savePath string, opts ...MemStorageOption) (*MemStorage, error) {
+	s := &MemStorage{
+		Metrics:         make(map[string]metrics.Metric, 0),
+		savePath:        savePath,
+		history:         make(map[string]*ring),
+		historyCapacity: DefaultHistoryCapacity,
+		aggregates:      make(map[string]map[time.Duration][]Aggregate),
+		updated:         make(map[string]time.Time),
+		silences:        make(map[string]Silence),
+		idempotencyKeys: make(map[string]IdempotencyRecord),
+		snapshotsKeep:   DefaultSnapshotsKeep,
+	}
 
-	fileInfo, err := os.Stat(s.savePath)
-	if err != nil {
+	for _, opt := range opts {
+		opt(s)
+	}
 
-		if os.IsNotExist(err) {
-			return nil
+	if s.silencesPath != "" {
+		silences, err := loadSilences(s.silencesPath)
+		if err != nil {
+			logger.Log.Error(
+				"error on loading silences",
+				zap.String("filepath", s.silencesPath),
+				zap.Error(err),
+			)
+			return nil, err
 		}
+		s.silences = silences
+	}
 
-		if fileInfo.Size() == 0 {
-			return nil
+	if s.walPath != "" {
+		w, err := openWAL(s.walPath, s.walPolicy)
+		if err != nil {
+			logger.Log.Error(
+				"error on opening wal",
+				zap.String("filepath", s.walPath),
+				zap.Error(err),
+			)
+			return nil, err
 		}
+		s.wal = w
+	}
 
-		logger.Log.Error(
-			"error on getting info about file for loading storage",
-			zap.Error(err),
-		)
-		return err
+	return s, nil
+}
+
+func (s *MemStorage) AddSilence(ctx context.Context, silence Silence) error {
+	s.silencesMx.Lock()
+	defer s.silencesMx.Unlock()
+
+	s.silences[silence.ID] = silence
+
+	return s.persistSilences()
+}
+
+func (s *MemStorage) Silences(ctx context.Context) ([]Silence, error) {
+	s.silencesMx.RLock()
+	defer s.silencesMx.RUnlock()
+
+	return s.listSilences(), nil
+}
+
+func (s *MemStorage) ExpireSilence(ctx context.Context, id string, at time.Time) error {
+	s.silencesMx.Lock()
+	defer s.silencesMx.Unlock()
+
+	silence, ok := s.silences[id]
+	if !ok {
+		return ErrSilenceNotFound
 	}
 
-	logger.Log.Info(
-		"loading storage from file",
-		zap.String("filepath", s.savePath),
-	)
+	if at.Before(silence.EndsAt) {
+		silence.EndsAt = at
+		s.silences[id] = silence
+	}
 
-	file, err := os.OpenFile(s.savePath, os.O_RDONLY, 0666)
-	if err != nil {
-		logger.Log.Error(
-			"error on opening file for loading storage",
-			zap.Error(err),
-		)
-		return err
+	return s.persistSilences()
+}
+
+// listSilences returns silences ordered by start time, silencesMx must be held
+func (s *MemStorage) listSilences() []Silence {
+	silences := make([]Silence, 0, len(s.silences))
+	for _, silence := range s.silences {
+		silences = append(silences, silence)
 	}
-	defer utils.SafeClose(file)
 
-	// s.mx.Lock()
-	// defer s.mx.Unlock()
+	slices.SortFunc(silences, func(a, b Silence) int {
+		if c := a.StartsAt.Compare(b.StartsAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	return silences
+}
 
-	var tmp interface{}
+// persistSilences writes silences to file if it is configured, silencesMx must be held
+func (s *MemStorage) persistSilences() error {
+	if s.silencesPath == "" {
+		return nil
+	}
 
-	if err := json.NewDecoder(file).Decode(&tmp); err != nil {
+	if err := saveSilences(s.silencesPath, s.listSilences()); err != nil {
 		logger.Log.Error(
-			"error on unmarshaling file to object for loading storage",
+			"error on saving silences",
+			zap.String("filepath", s.silencesPath),
 			zap.Error(err),
 		)
 		return err
 	}
 
-	for _, v := range tmp.(map[string]interface{})["metrics"].(map[string]interface{}) {
-		m := v.(map[string]interface{})
+	return nil
+}
 
-		switch m["type"].(string) {
-		case metrics.TypeCounter:
-			// fmt.Println(m)
-			counter := metrics.NewCounter(m["id"].(string), int64(m["value"].(float64)))
-			s.Add(ctx, m["id"].(string), counter)
-		case metrics.TypeGauge:
-			gauge := metrics.NewGauge(m["id"].(string), m["value"].(float64))
-			// fmt.Println(m)
-			s.Add(ctx, m["id"].(string), gauge)
-		}
+// SaveIdempotencyKey remembers record in memory only, expired records are dropped on save in order of expiration
+func (s *MemStorage) SaveIdempotencyKey(ctx context.Context, record IdempotencyRecord) error {
+	s.idempotencyMx.Lock()
+	defer s.idempotencyMx.Unlock()
 
+	now := time.Now()
+	for _, key := range s.idempotencyExpiry.expired(now) {
+		if r, ok := s.idempotencyKeys[key]; ok && r.Expired(now) {
+			delete(s.idempotencyKeys, key)
+		}
 	}
 
-	logger.Log.Info(
-		"succesfully loaded storage from file",
-		zap.Int("metricsCount", len(s.Metrics)),
-	)
+	s.idempotencyKeys[record.Key] = record
+	heap.Push(&s.idempotencyExpiry, idempotencyExpiry{key: record.Key, expiresAt: record.ExpiresAt})
 
 	return nil
 }
 
-func (s *MemStorage) Save(ctx context.Context) error {
+func (s *MemStorage) IdempotencyKey(ctx context.Context, key string) (IdempotencyRecord, error) {
+	s.idempotencyMx.Lock()
+	defer s.idempotencyMx.Unlock()
 
-	logger.Log.Info(
-		"saving storage to file",
-	)
+	record, ok := s.idempotencyKeys[key]
+	if !ok || record.Expired(time.Now()) {
+		return IdempotencyRecord{}, ErrIdempotencyKeyNotFound
+	}
+
+	return record, nil
+}
 
-	file, err := os.OpenFile(s.savePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
-	defer utils.SafeClose(file)
+func (s *MemStorage) Update(ctx context.Context, mtype, id string, value any) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
 
+	metric, err := s.metric(mtype, id)
 	if err != nil {
-		logger.Log.Error(
-			"error on opening or creating storage file",
-		)
 		return err
 	}
 
-	if err := json.NewEncoder(file).Encode(s); err != nil {
-		logger.Log.Error(
-			"error on marshalling storage for saving",
-		)
+	if s.wal != nil {
+		// change is applied to copy, so metric is not changed if it can not be logged
+		changed, err := cloneMetric(metric)
+		if err != nil {
+			return err
+		}
+		if err = changed.Change(value); err != nil {
+			return err
+		}
+		if err = s.wal.append(newWALEntry(id, changed)); err != nil {
+			return err
+		}
+		s.Metrics[id] = changed
+		metric = changed
+	} else if err := metric.Change(value); err != nil {
 		return err
 	}
 
+	now := time.Now()
+	s.updated[id] = now
+
+	if value, ok := sampleValue(metric); ok {
+		series, ok := s.history[id]
+		if !ok {
+			series = newRing(s.historyCapacity)
+			s.history[id] = series
+		}
+		series.push(Sample{Timestamp: now, Value: value})
+	}
+
 	return nil
 }
 
-func (s *MemStorage) Ping(ctx context.Context) error {
-	if s.Metrics == nil {
-		return ErrEmptyMemStorage
+func (s *MemStorage) UpdateBatch(ctx context.Context, updates []BatchUpdate) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	// changes are applied to copies of metrics and stored only if all of them succeed
+	staged := make(map[string]metrics.Metric, len(updates))
+	order := make([]string, 0, len(updates))
+
+	for _, u := range updates {
+		metric, ok := staged[u.Key]
+		if !ok {
+			current, exists := s.Metrics[u.Key]
+			if !exists {
+				current = u.Metric
+			}
+
+			var err error
+			if metric, err = cloneMetric(current); err != nil {
+				return err
+			}
+			staged[u.Key] = metric
+			order = append(order, u.Key)
+		}
+
+		if metric.GetType() != u.Metric.GetType() {
+			return typeMismatch(u.Metric.GetType(), u.Key, metric.GetType())
+		}
+		if err := metric.Change(u.Value); err != nil {
+			return err
+		}
+	}
+
+	if s.wal != nil {
+		entries := make([]walEntry, 0, len(order))
+		for _, key := range order {
+			entries = append(entries, newWALEntry(key, staged[key]))
+		}
+		if err := s.wal.append(entries...); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	for _, key := range order {
+		metric := staged[key]
+		s.Metrics[key] = metric
+		s.updated[key] = now
+
+		if value, ok := sampleValue(metric); ok {
+			series, ok := s.history[key]
+			if !ok {
+				series = newRing(s.historyCapacity)
+				s.history[key] = series
+			}
+			series.push(Sample{Timestamp: now, Value: value})
+		}
 	}
+
 	return nil
 }
 
-func (s *MemStorage) Close() error {
+func (s *MemStorage) History(ctx context.Context, id string, from, to time.Time) ([]Sample, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	series, ok := s.history[id]
+	if !ok {
+		return []Sample{}, nil
+	}
+
+	return series.between(from, to), nil
+}
+
+func (s *MemStorage) Retain(ctx context.Context, now time.Time, policy RetentionPolicy) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for id, series := range s.history {
+		seriesAggregates, ok := s.aggregates[id]
+		if !ok {
+			seriesAggregates = make(map[time.Duration][]Aggregate, len(Resolutions))
+			s.aggregates[id] = seriesAggregates
+		}
+
+		retainSeries(series, seriesAggregates, now, policy)
+	}
+
 	return nil
 }
 
-type PGStorage struct {
-	Storager
-	db *sql.DB
+func (s *MemStorage) Aggregates(ctx context.Context, id string, resolution time.Duration, from, to time.Time) ([]Aggregate, error) {
+	if !validResolution(resolution) {
+		return nil, ErrUnknownResolution
+	}
+
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	return aggregatesBetween(s.aggregates[id][resolution], from, to), nil
 }
 
-func NewPGStorage(db *sql.DB) (Storager, error) {
-	return &PGStorage{
-		db: db,
-	}, nil
+func (s *MemStorage) Add(ctx context.Context, id string, metric metrics.Metric) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.wal != nil {
+		if err := s.wal.append(newWALEntry(id, metric)); err != nil {
+			return err
+		}
+	}
+
+	s.Metrics[id] = metric
+	s.updated[id] = time.Now()
+	return nil
 }
 
-func (pgs *PGStorage) Close() error {
-	return pgs.db.Close()
+// restore sets metric loaded from snapshot or wal without logging it, nil metric is deleted
+func (s *MemStorage) restore(id string, metric metrics.Metric) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if metric == nil {
+		s.forget(id)
+		return
+	}
+	s.Metrics[id] = metric
+	s.updated[id] = time.Now()
 }
 
-func (pgs *PGStorage) Ping(ctx context.Context) error {
-	return pgs.db.PingContext(ctx)
+// forget drops metric with its history, lock must be held
+func (s *MemStorage) forget(id string) {
+	delete(s.Metrics, id)
+	delete(s.updated, id)
+	delete(s.history, id)
+	delete(s.aggregates, id)
 }
 
-func (pgs *PGStorage) Add(ctx context.Context, id string, metric metrics.Metric) error {
-	_, err := pgs.db.ExecContext(ctx, "INSERT INTO metrics (id, type, value) VALUES ($1, $2, $3)", id, metric.GetType(), metric.GetValue())
-	return err
+func (s *MemStorage) Delete(ctx context.Context, mtype, id string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if _, err := s.metric(mtype, id); err != nil {
+		return err
+	}
+
+	if s.wal != nil {
+		if err := s.wal.append(newDeleteEntry(id, mtype)); err != nil {
+			return err
+		}
+	}
+
+	s.forget(id)
+	return nil
+}
+
+func (s *MemStorage) Stale(ctx context.Context, before time.Time) ([]string, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	return s.stale(before), nil
 }
 
-func (pgs *PGStorage) ListAll(ctx context.Context) (map[string]metrics.Metric, error) {
-	return nil, nil
+// stale returns keys of gauges last updated before time before, lock must be held
+func (s *MemStorage) stale(before time.Time) []string {
+	keys := make([]string, 0)
+	for key, metric := range s.Metrics {
+		if metric.GetType() == metrics.TypeGauge && s.updated[key].Before(before) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	return keys
 }
 
-func (pgs *PGStorage) CheckMetric(ctx context.Context, id string) (bool, error) {
-	row := pgs.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM metrics WHERE id = $1", id)
-	var count int
-	row.Scan(&count)
+func (s *MemStorage) Evict(ctx context.Context, before time.Time) ([]string, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	keys := s.stale(before)
+	if len(keys) == 0 {
+		return keys, nil
+	}
+
+	if s.wal != nil {
+		entries := make([]walEntry, 0, len(keys))
+		for _, key := range keys {
+			entries = append(entries, newDeleteEntry(key, metrics.TypeGauge))
+		}
+		if err := s.wal.append(entries...); err != nil {
+			return nil, err
+		}
+	}
 
-	if count != 0 {
-		return true, nil
+	for _, key := range keys {
+		s.forget(key)
 	}
 
-	err := row.Err()
-	return false, err
+	return keys, nil
 }
-func (pgs *PGStorage) Update(ctx context.Context, mtype, id string, value any) error {
 
-	// TODO: remove this workaround
-	if mtype == metrics.TypeCounter {
+func (s *MemStorage) CheckMetric(ctx context.Context, id string) (bool, error) {
+	// TODO: need to add check of metric type
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	_, ok := s.Metrics[id]
+	return ok, nil
+}
+
+func (s *MemStorage) ListAll(ctx context.Context) (map[string]metrics.Metric, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
 
-		stringValue, err := pgs.GetValue(ctx, mtype, id)
+	all := make(map[string]metrics.Metric, len(s.Metrics))
+	for key, metric := range s.Metrics {
+		copied, err := cloneMetric(metric)
 		if err != nil {
+			return nil, err
+		}
+		all[key] = copied
+	}
+
+	return all, nil
+}
+
+// Iterate copies keys only, each metric is copied right before passing it to fn, so lock is not held while fn runs
+func (s *MemStorage) Iterate(ctx context.Context, fn func(key string, metric metrics.Metric) error) error {
+	s.mx.RLock()
+	keys := make([]string, 0, len(s.Metrics))
+	for key := range s.Metrics {
+		keys = append(keys, key)
+	}
+	s.mx.RUnlock()
+
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
 			return err
 		}
 
-		currentValue, err := strconv.ParseInt(stringValue, 10, 64)
+		metric, err := s.copyMetric(key)
 		if err != nil {
 			return err
 		}
+		if metric == nil {
+			continue
+		}
 
-		value = value.(int64) + currentValue
+		if err = fn(key, metric); err != nil {
+			return err
+		}
 	}
 
-	_, err := pgs.db.ExecContext(ctx, "UPDATE metrics SET value = $1 where id = $2 AND type = $3", value, id, mtype)
-	if err != nil {
-		logger.Log.Error(
-			"error on inserting metric to db",
-		)
-		return err
-	}
 	return nil
 }
-func (pgs *PGStorage) GetValue(ctx context.Context, mtype, id string) (string, error) {
-	row := pgs.db.QueryRowContext(ctx, "SELECT value FROM metrics WHERE id = $1 and type = $2", id, mtype)
 
-	var value float64
+// copyMetric returns copy of metric or nil if it is not in storage
+func (s *MemStorage) copyMetric(key string) (metrics.Metric, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
 
-	row.Scan(&value)
-	if err := row.Err(); err != nil {
-		return "", err
+	metric, ok := s.Metrics[key]
+	if !ok {
+		return nil, nil
 	}
 
-	switch mtype {
-	case metrics.TypeCounter:
-		return fmt.Sprintf("%v", int64(value)), nil
+	return cloneMetric(metric)
+}
+
+func (s *MemStorage) GetValue(ctx context.Context, mtype, id string) (string, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	metric, err := s.metric(mtype, id)
+	if err != nil {
+		return "", err
+	}
+	return metric.GetValue(), nil
+}
+
+// metric returns stored metric of type, it must be called with lock held
+func (s *MemStorage) metric(mtype, id string) (metrics.Metric, error) {
+	metric, ok := s.Metrics[id]
+	if !ok {
+		return nil, notFound(mtype, id)
+	}
+	if metric.GetType() != mtype {
+		return nil, typeMismatch(mtype, id, metric.GetType())
+	}
+	return metric, nil
+}
+
+// Load loading metrics from file to MemStorage.Metrics and replays wal on top of them
+func (s *MemStorage) Load(ctx context.Context) error {
+	return s.load(ctx, s.restore)
+}
+
+// load passes metrics of snapshot and then of wal entries to restore, metrics deleted after snapshot are passed as nil
+func (s *MemStorage) load(ctx context.Context, restore func(string, metrics.Metric)) error {
+	loaded, err := s.loadSnapshot(ctx, restore)
+	if err != nil {
+		return err
+	}
+
+	if s.wal == nil {
+		return nil
+	}
+
+	replayed := 0
+	replay := func(entry walEntry) error {
+		if entry.Deleted {
+			restore(entry.Key, nil)
+			replayed++
+			return nil
+		}
+
+		metric, err := entry.metric()
+		if err != nil {
+			return err
+		}
+		restore(entry.Key, metric)
+		replayed++
+		return nil
+	}
+
+	// previous snapshot misses records of rotated segments written after it
+	if from := min(loaded, max(s.snapshotsKeep, 1)-1); from > 0 {
+		if err = replaySegments(s.walPath, from, replay); err != nil {
+			logger.Log.Error(
+				"error on replaying rotated wal segments",
+				zap.String("filepath", s.walPath),
+				zap.Error(err),
+			)
+			return err
+		}
+	}
+
+	if err = s.wal.replay(replay); err != nil {
+		logger.Log.Error(
+			"error on replaying wal",
+			zap.String("filepath", s.walPath),
+			zap.Error(err),
+		)
+		return err
+	}
+
+	logger.Log.Info(
+		"replayed wal",
+		zap.Int("entries", replayed),
+	)
+
+	return nil
+}
+
+// loadSnapshot passes metrics of the newest valid snapshot to restore and returns its index
+func (s *MemStorage) loadSnapshot(ctx context.Context, restore func(string, metrics.Metric)) (int, error) {
+
+	logger.Log.Info(
+		"loading storage from file",
+		zap.String("filepath", s.savePath),
+	)
+
+	index, err := readSnapshot(s.savePath, s.snapshotsKeep, func(snap snapshot) error {
+		loaded, err := snap.decode()
+		if err != nil {
+			return err
+		}
+
+		for key, metric := range loaded {
+			restore(key, metric)
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Log.Error(
+			"error on loading storage from file",
+			zap.String("filepath", s.savePath),
+			zap.Error(err),
+		)
+		return index, err
+	}
+
+	logger.Log.Info(
+		"succesfully loaded storage from file",
+	)
+
+	return index, nil
+}
+
+// decodeMetrics decodes JSON snapshot payload, metrics are returned only if whole payload is valid
+func decodeMetrics(payload []byte) (map[string]metrics.Metric, error) {
+	var tmp struct {
+		Metrics map[string]map[string]interface{} `json:"metrics"`
+	}
+
+	if err := json.Unmarshal(payload, &tmp); err != nil {
+		logger.Log.Error(
+			"error on unmarshaling file to object for loading storage",
+			zap.Error(err),
+		)
+		return nil, err
+	}
+
+	loaded := make(map[string]metrics.Metric, len(tmp.Metrics))
+
+	for _, m := range tmp.Metrics {
+		id, _ := m["id"].(string)
+		mtype, _ := m["type"].(string)
+
+		var labels map[string]string
+		if rawLabels, ok := m["labels"].(map[string]interface{}); ok {
+			labels = make(map[string]string, len(rawLabels))
+			for name, value := range rawLabels {
+				labels[name], _ = value.(string)
+			}
+		}
+		key := metrics.SeriesKey(id, labels)
+
+		switch mtype {
+		case metrics.TypeCounter:
+			value, _ := m["value"].(float64)
+			counter := metrics.NewCounter(id, int64(value))
+			counter.Labels = labels
+			loaded[key] = counter
+		case metrics.TypeGauge:
+			value, _ := m["value"].(float64)
+			gauge := metrics.NewGauge(id, value)
+			gauge.Labels = labels
+			loaded[key] = gauge
+		case metrics.TypeHistogram:
+			raw, err := json.Marshal(m)
+			if err != nil {
+				return nil, err
+			}
+			histogram, err := metrics.ParseHistogramValue(id, string(raw))
+			if err != nil {
+				logger.Log.Error(
+					"error on restoring histogram from file",
+					zap.String("metric", key),
+					zap.Error(err),
+				)
+				return nil, err
+			}
+			histogram.Labels = labels
+			loaded[key] = histogram
+		case metrics.TypeSummary:
+			raw, err := json.Marshal(m["sketch"])
+			if err != nil {
+				return nil, err
+			}
+			summary, err := metrics.ParseSummaryValue(id, string(raw))
+			if err != nil {
+				logger.Log.Error(
+					"error on restoring summary from file",
+					zap.String("metric", key),
+					zap.Error(err),
+				)
+				return nil, err
+			}
+			summary.Labels = labels
+			loaded[key] = summary
+		}
+	}
+
+	return loaded, nil
+}
+
+// Save atomically writes snapshot of metrics, previous snapshots are kept as fallback for Load
+func (s *MemStorage) Save(ctx context.Context) error {
+
+	logger.Log.Info(
+		"saving storage to file",
+	)
+
+	s.saveMx.Lock()
+	defer s.saveMx.Unlock()
+
+	// changes are blocked only until metrics are copied and wal is cut, so every cut record is included in snapshot
+	s.mx.RLock()
+	all := make(map[string]metrics.Metric, len(s.Metrics))
+	for key, metric := range s.Metrics {
+		copied, err := cloneMetric(metric)
+		if err != nil {
+			s.mx.RUnlock()
+			return err
+		}
+		all[key] = copied
+	}
+	err := s.cutWAL()
+	s.mx.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	return s.save(all)
+}
+
+// cutWAL moves logged records to pending segment, caller must block changes of metrics
+func (s *MemStorage) cutWAL() error {
+	if s.wal == nil {
+		return nil
+	}
+
+	if err := s.wal.cut(); err != nil {
+		logger.Log.Error(
+			"error on cutting wal",
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
+
+// save writes snapshot of metrics copied when wal was cut and rotates wal, saveMx must be held
+func (s *MemStorage) save(all map[string]metrics.Metric) error {
+	payload, err := encodeSnapshotPayload(s.snapshotFormat, all)
+	if err != nil {
+		logger.Log.Error(
+			"error on marshalling storage for saving",
+		)
+		return err
+	}
+
+	if err = writeSnapshot(s.savePath, s.snapshotsKeep, encodeSnapshot(s.snapshotFormat, payload)); err != nil {
+		logger.Log.Error(
+			"error on writing storage file",
+			zap.String("filepath", s.savePath),
+			zap.Error(err),
+		)
+		return err
+	}
+
+	if s.wal != nil {
+		if err := s.wal.rotate(s.snapshotsKeep); err != nil {
+			logger.Log.Error(
+				"error on rotating wal",
+				zap.Error(err),
+			)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *MemStorage) Ping(ctx context.Context) error {
+	if s.Metrics == nil {
+		return ErrEmptyMemStorage
+	}
+	return nil
+}
+
+func (s *MemStorage) Close() error {
+	if s.wal != nil {
+		return s.wal.close()
+	}
+	return nil
+}
+
+type PGStorage struct {
+	Storager
+	db *sql.DB
+}
+
+func NewPGStorage(db *sql.DB) (Storager, error) {
+	return &PGStorage{
+		db: db,
+	}, nil
+}
+
+func (pgs *PGStorage) Close() error {
+	return pgs.db.Close()
+}
+
+func (pgs *PGStorage) Ping(ctx context.Context) error {
+	return unavailable(pgs.db.PingContext(ctx))
+}
+
+// metricColumns returns values of metric for value, int_value, histogram and sketch columns.
+// Counters are stored in integer column to keep precision, histograms and summaries as json in separate columns.
+func metricColumns(metric metrics.Metric) ([]any, error) {
+	columns := make([]any, 4)
+	switch m := metric.(type) {
+	case *metrics.CounterMetric:
+		columns[1] = m.Value
+	case *metrics.GaugeMetric:
+		columns[0] = m.Value
+	case *metrics.HistogramMetric:
+		columns[2] = m.GetValue()
+	case *metrics.SummaryMetric:
+		columns[3] = m.GetValue()
+	default:
+		return nil, invalidType(metric.GetType(), metric.GetID())
+	}
+	return columns, nil
+}
+
+// Add inserts metric or replaces stored metric with the same key and type
+func (pgs *PGStorage) Add(ctx context.Context, id string, metric metrics.Metric) (err error) {
+	defer func() { err = unavailable(err) }()
+
+	labels, err := marshalLabels(metric.GetLabels())
+	if err != nil {
+		return err
+	}
+
+	columns, err := metricColumns(metric)
+	if err != nil {
+		return err
+	}
+
+	_, err = pgs.db.ExecContext(ctx, `
+		INSERT INTO metrics (id, name, labels, type, value, int_value, histogram, sketch) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (id) DO UPDATE SET
+			name = EXCLUDED.name,
+			type = EXCLUDED.type,
+			labels = EXCLUDED.labels,
+			value = EXCLUDED.value,
+			int_value = EXCLUDED.int_value,
+			histogram = EXCLUDED.histogram,
+			sketch = EXCLUDED.sketch,
+			updated_at = now()`,
+		append([]any{id, metric.GetID(), labels, metric.GetType()}, columns...)...)
+	return err
+}
+
+func (pgs *PGStorage) ListAll(ctx context.Context) (all map[string]metrics.Metric, err error) {
+	defer func() { err = unavailable(err) }()
+
+	rows, err := pgs.db.QueryContext(ctx, "SELECT id, name, labels, type, value, int_value, histogram, sketch FROM metrics")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanMetrics(rows)
+}
+
+func (pgs *PGStorage) Iterate(ctx context.Context, fn func(key string, metric metrics.Metric) error) (err error) {
+	defer func() { err = unavailable(err) }()
+
+	rows, err := pgs.db.QueryContext(ctx, "SELECT id, name, labels, type, value, int_value, histogram, sketch FROM metrics")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	return iterateRows(rows, fn)
+}
+
+// scanMetrics restores metrics from rows of id, name, labels, type, value, int_value, histogram and sketch columns
+func scanMetrics(rows *sql.Rows) (map[string]metrics.Metric, error) {
+	result := make(map[string]metrics.Metric)
+	err := iterateRows(rows, func(key string, metric metrics.Metric) error {
+		result[key] = metric
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// iterateRows passes metrics restored from rows of scanMetrics columns to fn
+func iterateRows(rows *sql.Rows, fn func(key string, metric metrics.Metric) error) error {
+	for rows.Next() {
+		var id, name, rawLabels, mtype string
+		var value sql.NullFloat64
+		var intValue sql.NullInt64
+		var histogram, sketch sql.NullString
+
+		if err := rows.Scan(&id, &name, &rawLabels, &mtype, &value, &intValue, &histogram, &sketch); err != nil {
+			return err
+		}
+
+		var labels map[string]string
+		if err := json.Unmarshal([]byte(rawLabels), &labels); err != nil {
+			return err
+		}
+		if len(labels) == 0 {
+			labels = nil
+		}
+
+		var metric metrics.Metric
+		switch mtype {
+		case metrics.TypeCounter:
+			counter := metrics.NewCounter(name, intValue.Int64)
+			counter.Labels = labels
+			metric = counter
+		case metrics.TypeGauge:
+			gauge := metrics.NewGauge(name, value.Float64)
+			gauge.Labels = labels
+			metric = gauge
+		case metrics.TypeHistogram:
+			h, err := metrics.ParseHistogramValue(name, histogram.String)
+			if err != nil {
+				return err
+			}
+			h.Labels = labels
+			metric = h
+		case metrics.TypeSummary:
+			summary, err := metrics.ParseSummaryValue(name, sketch.String)
+			if err != nil {
+				return err
+			}
+			summary.Labels = labels
+			metric = summary
+		default:
+			logger.Log.Warn(
+				"skipping metric of unknown type",
+				zap.String("id", id),
+				zap.String("type", mtype),
+			)
+			continue
+		}
+
+		if err := fn(id, metric); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (pgs *PGStorage) CheckMetric(ctx context.Context, id string) (bool, error) {
+	var exists bool
+	err := pgs.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM metrics WHERE id = $1)", id).Scan(&exists)
+	return exists, unavailable(err)
+}
+
+const (
+	// incrementCounterQuery adds delta to counter and records its new value as a sample
+	incrementCounterQuery = `
+		WITH updated AS (
+			UPDATE metrics SET int_value = int_value + $1, updated_at = now() WHERE id = $2 AND type = $3 RETURNING id, int_value
+		)
+		INSERT INTO samples (id, ts, value) SELECT id, now(), int_value FROM updated`
+
+	// setGaugeQuery sets gauge value and records it as a sample
+	setGaugeQuery = `
+		WITH updated AS (
+			UPDATE metrics SET value = $1, updated_at = now() WHERE id = $2 AND type = $3 RETURNING id, value
+		)
+		INSERT INTO samples (id, ts, value) SELECT id, now(), value FROM updated`
+
+	// insertMissingQuery adds metric in initial state if it is not stored yet
+	insertMissingQuery = `
+		INSERT INTO metrics (id, name, labels, type, value, int_value, histogram, sketch) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (id) DO NOTHING`
+)
+
+// scalarUpdateQuery returns query changing counter or gauge, checking type of value
+func scalarUpdateQuery(mtype string, value any) (string, error) {
+	switch mtype {
+	case metrics.TypeCounter:
+		if _, ok := value.(int64); !ok {
+			return "", metrics.ErrWrongChangeType
+		}
+		return incrementCounterQuery, nil
+	case metrics.TypeGauge:
+		if _, ok := value.(float64); !ok {
+			return "", metrics.ErrWrongChangeType
+		}
+		return setGaugeQuery, nil
+	default:
+		return "", ErrInvalidType
+	}
+}
+
+// Update changes metric in place: counters are incremented and gauges are set by single statement,
+// which also records new value as a sample, so concurrent updates are not lost
+func (pgs *PGStorage) Update(ctx context.Context, mtype, id string, value any) (err error) {
+	defer func() { err = unavailable(err) }()
+
+	if _, ok := jsonColumns[mtype]; ok {
+		tx, err := pgs.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if err = updateJSONMetric(ctx, tx, " FOR UPDATE", mtype, id, value); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	query, err := scalarUpdateQuery(mtype, value)
+	if err != nil {
+		return err
+	}
+
+	result, err := pgs.db.ExecContext(ctx, query, value, id, mtype)
+	if err != nil {
+		logger.Log.Error(
+			"error on updating metric in db",
+			zap.String("type", mtype),
+			zap.Error(err),
+		)
+		return err
+	}
+
+	return checkUpdated(ctx, pgs.db, result, mtype, id)
+}
+
+// checkUpdated returns error of missing metric if no metric was changed by statement
+func checkUpdated(ctx context.Context, db queryRower, result sql.Result, mtype, id string) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return missingMetric(ctx, db, mtype, id)
+	}
+	return nil
+}
+
+// UpdateBatch applies updates in single transaction using prepared statements
+func (pgs *PGStorage) UpdateBatch(ctx context.Context, updates []BatchUpdate) (err error) {
+	defer func() { err = unavailable(err) }()
+
+	tx, err := pgs.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	insertStmt, err := tx.PrepareContext(ctx, insertMissingQuery)
+	if err != nil {
+		return err
+	}
+	defer insertStmt.Close()
+
+	scalarStmts := make(map[string]*sql.Stmt, 2)
+	defer func() {
+		for _, stmt := range scalarStmts {
+			stmt.Close()
+		}
+	}()
+
+	for _, u := range updates {
+		mtype := u.Metric.GetType()
+
+		labels, err := marshalLabels(u.Metric.GetLabels())
+		if err != nil {
+			return err
+		}
+		columns, err := metricColumns(u.Metric)
+		if err != nil {
+			return err
+		}
+		if err = checkStoredType(ctx, tx, mtype, u.Key); err != nil {
+			return err
+		}
+		if _, err = insertStmt.ExecContext(ctx, append([]any{u.Key, u.Metric.GetID(), labels, mtype}, columns...)...); err != nil {
+			return err
+		}
+
+		if _, ok := jsonColumns[mtype]; ok {
+			if err = updateJSONMetric(ctx, tx, " FOR UPDATE", mtype, u.Key, u.Value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		query, err := scalarUpdateQuery(mtype, u.Value)
+		if err != nil {
+			return err
+		}
+
+		stmt, ok := scalarStmts[query]
+		if !ok {
+			if stmt, err = tx.PrepareContext(ctx, query); err != nil {
+				return err
+			}
+			scalarStmts[query] = stmt
+		}
+
+		result, err := stmt.ExecContext(ctx, u.Value, u.Key, mtype)
+		if err != nil {
+			logger.Log.Error(
+				"error on updating metric of batch in db",
+				zap.String("type", mtype),
+				zap.Error(err),
+			)
+			return err
+		}
+		if err = checkUpdated(ctx, tx, result, mtype, u.Key); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (pgs *PGStorage) History(ctx context.Context, id string, from, to time.Time) (samples []Sample, err error) {
+	defer func() { err = unavailable(err) }()
+
+	rows, err := pgs.db.QueryContext(ctx, "SELECT ts, value FROM samples WHERE id = $1 AND ts BETWEEN $2 AND $3 ORDER BY ts", id, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	samples = make([]Sample, 0)
+	for rows.Next() {
+		var sample Sample
+		if err = rows.Scan(&sample.Timestamp, &sample.Value); err != nil {
+			return nil, err
+		}
+		samples = append(samples, sample)
+	}
+
+	return samples, rows.Err()
+}
+
+func (pgs *PGStorage) Retain(ctx context.Context, now time.Time, policy RetentionPolicy) (err error) {
+	defer func() { err = unavailable(err) }()
+
+	tx, err := pgs.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rawBefore := now.Add(-policy.RawAge)
+
+	for _, resolution := range Resolutions {
+		seconds := int64(resolution.Seconds())
+
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO aggregates (id, resolution, ts, min, max, sum, count, last)
+			SELECT id, $1::integer, to_timestamp(floor(extract(epoch FROM ts) / $1::integer) * $1::integer) AS bucket,
+				min(value), max(value), sum(value), count(*), (array_agg(value ORDER BY ts DESC))[1]
+			FROM samples WHERE ts < $2
+			GROUP BY id, bucket
+			ON CONFLICT (id, resolution, ts) DO UPDATE SET
+				min = LEAST(aggregates.min, EXCLUDED.min),
+				max = GREATEST(aggregates.max, EXCLUDED.max),
+				sum = aggregates.sum + EXCLUDED.sum,
+				count = aggregates.count + EXCLUDED.count,
+				last = EXCLUDED.last`, seconds, rawBefore)
+		if err != nil {
+			logger.Log.Error(
+				"error on rolling up samples",
+				zap.Duration("resolution", resolution),
+				zap.Error(err),
+			)
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "DELETE FROM aggregates WHERE resolution = $1 AND ts < $2", seconds, now.Add(-policy.AggregateAge(resolution)))
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM samples WHERE ts < $1", rawBefore); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (pgs *PGStorage) Aggregates(ctx context.Context, id string, resolution time.Duration, from, to time.Time) (aggregates []Aggregate, err error) {
+	defer func() { err = unavailable(err) }()
+
+	if !validResolution(resolution) {
+		return nil, ErrUnknownResolution
+	}
+
+	rows, err := pgs.db.QueryContext(ctx, "SELECT ts, min, max, sum, count, last FROM aggregates WHERE id = $1 AND resolution = $2 AND ts BETWEEN $3 AND $4 ORDER BY ts", id, int64(resolution.Seconds()), from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	aggregates = make([]Aggregate, 0)
+	for rows.Next() {
+		var aggregate Aggregate
+		if err = rows.Scan(&aggregate.Timestamp, &aggregate.Min, &aggregate.Max, &aggregate.Sum, &aggregate.Count, &aggregate.Last); err != nil {
+			return nil, err
+		}
+		aggregate.Avg = aggregate.Sum / float64(aggregate.Count)
+		aggregates = append(aggregates, aggregate)
+	}
+
+	return aggregates, rows.Err()
+}
+
+// ImportHistory replaces samples and aggregates of series
+func (pgs *PGStorage) ImportHistory(ctx context.Context, id string, samples []Sample, aggregates map[time.Duration][]Aggregate) (err error) {
+	defer func() { err = unavailable(err) }()
+
+	tx, err := pgs.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM samples WHERE id = $1", id); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM aggregates WHERE id = $1", id); err != nil {
+		return err
+	}
+
+	for _, sample := range samples {
+		if _, err = tx.ExecContext(ctx, "INSERT INTO samples (id, ts, value) VALUES ($1, $2, $3)", id, sample.Timestamp, sample.Value); err != nil {
+			return err
+		}
+	}
+
+	for resolution, resolutionAggregates := range aggregates {
+		for _, a := range resolutionAggregates {
+			_, err = tx.ExecContext(ctx, "INSERT INTO aggregates (id, resolution, ts, min, max, sum, count, last) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+				id, int64(resolution.Seconds()), a.Timestamp, a.Min, a.Max, a.Sum, a.Count, a.Last)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// jsonColumns maps types of metrics stored as json to their columns
+var jsonColumns = map[string]string{
+	metrics.TypeHistogram: "histogram",
+	metrics.TypeSummary:   "sketch",
+}
+
+// parseJSONMetric restores metric stored as json by its type
+func parseJSONMetric(mtype, id, raw string) (metrics.Metric, error) {
+	switch mtype {
+	case metrics.TypeHistogram:
+		return metrics.ParseHistogramValue(id, raw)
+	case metrics.TypeSummary:
+		return metrics.ParseSummaryValue(id, raw)
+	default:
+		return nil, invalidType(mtype, id)
+	}
+}
+
+// updateJSONMetric merges metric stored as json in transaction tx. Row is selected with lock clause,
+// e.g. FOR UPDATE, so concurrent reports are not lost.
+func updateJSONMetric(ctx context.Context, tx *sql.Tx, lock, mtype, id string, value any) error {
+	column := jsonColumns[mtype]
+
+	var raw string
+	row := tx.QueryRowContext(ctx, "SELECT "+column+" FROM metrics WHERE id = $1 AND type = $2"+lock, id, mtype)
+	if err := row.Scan(&raw); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return missingMetric(ctx, tx, mtype, id)
+		}
+		return err
+	}
+
+	metric, err := parseJSONMetric(mtype, id, raw)
+	if err != nil {
+		return err
+	}
+
+	if err = metric.Change(value); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE metrics SET "+column+" = $1 WHERE id = $2 AND type = $3", metric.GetValue(), id, mtype); err != nil {
+		logger.Log.Error(
+			"error on updating metric in db",
+			zap.String("type", mtype),
+		)
+		return err
+	}
+
+	return nil
+}
+
+// valueColumn returns column holding value of metric of type
+func valueColumn(mtype, id string) (string, error) {
+	switch mtype {
+	case metrics.TypeCounter:
+		return "int_value", nil
 	case metrics.TypeGauge:
+		return "value", nil
+	}
+	if column, ok := jsonColumns[mtype]; ok {
+		return column, nil
+	}
+	return "", invalidType(mtype, id)
+}
+
+const (
+	// deleteMetricQuery deletes metric of type returning its id
+	deleteMetricQuery = "DELETE FROM metrics WHERE id = $1 AND type = $2 RETURNING id"
+
+	// staleQuery selects ids of metrics of type last updated before time
+	staleQuery = "SELECT id FROM metrics WHERE type = $1 AND updated_at < $2 ORDER BY id"
+
+	// evictQuery deletes metrics of type last updated before time returning their ids
+	evictQuery = "DELETE FROM metrics WHERE type = $1 AND updated_at < $2 RETURNING id"
+)
+
+// scanIDs reads ids from rows of single column and closes them
+func scanIDs(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// deleteMetrics deletes metrics by query returning their ids in transaction tx. Samples and aggregates of series
+// are deleted too, unless metric of other type with the same id is left.
+func deleteMetrics(ctx context.Context, tx *sql.Tx, query string, args ...any) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := scanIDs(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		for _, table := range []string{"samples", "aggregates"} {
+			_, err = tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE id = $1 AND NOT EXISTS (SELECT 1 FROM metrics WHERE id = $1)", id)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	slices.Sort(ids)
+
+	return ids, nil
+}
+
+func (pgs *PGStorage) Delete(ctx context.Context, mtype, id string) (err error) {
+	defer func() { err = unavailable(err) }()
+
+	tx, err := pgs.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	deleted, err := deleteMetrics(ctx, tx, deleteMetricQuery, id, mtype)
+	if err != nil {
+		return err
+	}
+	if len(deleted) == 0 {
+		return missingMetric(ctx, tx, mtype, id)
+	}
+
+	return tx.Commit()
+}
+
+func (pgs *PGStorage) Stale(ctx context.Context, before time.Time) (keys []string, err error) {
+	defer func() { err = unavailable(err) }()
+
+	rows, err := pgs.db.QueryContext(ctx, staleQuery, metrics.TypeGauge, before)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanIDs(rows)
+}
+
+func (pgs *PGStorage) Evict(ctx context.Context, before time.Time) (keys []string, err error) {
+	defer func() { err = unavailable(err) }()
+
+	tx, err := pgs.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	evicted, err := deleteMetrics(ctx, tx, evictQuery, metrics.TypeGauge, before)
+	if err != nil {
+		return nil, err
+	}
+
+	return evicted, tx.Commit()
+}
+
+func (pgs *PGStorage) GetValue(ctx context.Context, mtype, id string) (value string, err error) {
+	defer func() { err = unavailable(err) }()
+
+	column, err := valueColumn(mtype, id)
+	if err != nil {
+		return "", err
+	}
+
+	var raw sql.NullString
+	row := pgs.db.QueryRowContext(ctx, "SELECT "+column+"::text FROM metrics WHERE id = $1 and type = $2", id, mtype)
+	if err := row.Scan(&raw); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", missingMetric(ctx, pgs.db, mtype, id)
+		}
+		return "", err
+	}
+
+	if mtype == metrics.TypeGauge && raw.Valid {
+		// format gauges the same way as metrics.GaugeMetric does
+		value, err := strconv.ParseFloat(raw.String, 64)
+		if err != nil {
+			return "", err
+		}
 		return fmt.Sprintf("%v", value), nil
-	default:
-		return "", ErrWrongGetType
 	}
+
+	return raw.String, nil
+}
+
+func (pgs *PGStorage) AddSilence(ctx context.Context, silence Silence) (err error) {
+	defer func() { err = unavailable(err) }()
+
+	matchers, err := json.Marshal(silence.Matchers)
+	if err != nil {
+		return err
+	}
+
+	_, err = pgs.db.ExecContext(ctx, "INSERT INTO silences (id, matchers, starts_at, ends_at, created_by, comment) VALUES ($1, $2, $3, $4, $5, $6)",
+		silence.ID, string(matchers), silence.StartsAt, silence.EndsAt, silence.CreatedBy, silence.Comment)
+	return err
+}
+
+func (pgs *PGStorage) Silences(ctx context.Context) (silences []Silence, err error) {
+	defer func() { err = unavailable(err) }()
+
+	rows, err := pgs.db.QueryContext(ctx, "SELECT id, matchers, starts_at, ends_at, created_by, comment FROM silences ORDER BY starts_at, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	silences = make([]Silence, 0)
+	for rows.Next() {
+		var silence Silence
+		var matchers string
+		if err = rows.Scan(&silence.ID, &matchers, &silence.StartsAt, &silence.EndsAt, &silence.CreatedBy, &silence.Comment); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(matchers), &silence.Matchers); err != nil {
+			return nil, err
+		}
+		silences = append(silences, silence)
+	}
+
+	return silences, rows.Err()
+}
+
+func (pgs *PGStorage) ExpireSilence(ctx context.Context, id string, at time.Time) (err error) {
+	defer func() { err = unavailable(err) }()
+
+	result, err := pgs.db.ExecContext(ctx, "UPDATE silences SET ends_at = LEAST(ends_at, $2) WHERE id = $1", id, at)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrSilenceNotFound
+	}
+
+	return nil
+}
+
+// SaveIdempotencyKey upserts record and drops expired ones
+func (pgs *PGStorage) SaveIdempotencyKey(ctx context.Context, record IdempotencyRecord) (err error) {
+	defer func() { err = unavailable(err) }()
+
+	if record.Body == nil {
+		record.Body = []byte{}
+	}
+
+	tx, err := pgs.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at <= now()"); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO idempotency_keys (key, fingerprint, status, content_type, body, expires_at) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (key) DO UPDATE SET fingerprint = EXCLUDED.fingerprint, status = EXCLUDED.status, content_type = EXCLUDED.content_type, body = EXCLUDED.body, expires_at = EXCLUDED.expires_at`,
+		record.Key, record.Fingerprint, record.Status, record.ContentType, record.Body, record.ExpiresAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (pgs *PGStorage) IdempotencyKey(ctx context.Context, key string) (record IdempotencyRecord, err error) {
+	defer func() { err = unavailable(err) }()
+
+	record = IdempotencyRecord{Key: key}
+
+	err = pgs.db.QueryRowContext(ctx, "SELECT fingerprint, status, content_type, body, expires_at FROM idempotency_keys WHERE key = $1 AND expires_at > now()", key).
+		Scan(&record.Fingerprint, &record.Status, &record.ContentType, &record.Body, &record.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return IdempotencyRecord{}, ErrIdempotencyKeyNotFound
+		}
+		return IdempotencyRecord{}, err
+	}
+
+	return record, nil
+}
+
+func marshalLabels(labels map[string]string) (string, error) {
+	if labels == nil {
+		labels = map[string]string{}
+	}
+
+	raw, err := json.Marshal(labels)
+	if err != nil {
+		return "", err
+	}
+
+	return string(raw), nil
 }
+
+// Save does nothing, metrics are written to database on each change
 func (pgs *PGStorage) Save(ctx context.Context) error {
 	return nil
 }
+
+// Load checks that database is reachable, metrics are read from it on demand
 func (pgs *PGStorage) Load(ctx context.Context) error {
-	return nil
+	return unavailable(pgs.db.PingContext(ctx))
+}
+
+// Select returns all metrics with given name which labels satisfy all of the matchers
+func Select(ctx context.Context, s Storager, name string, matchers []*metrics.LabelMatcher) ([]metrics.Metric, error) {
+	selected := make([]metrics.Metric, 0)
+	err := s.Iterate(ctx, func(key string, metric metrics.Metric) error {
+		if metric.GetID() == name && metrics.MatchAll(metric.GetLabels(), matchers) {
+			selected = append(selected, metric)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(selected, func(a, b metrics.Metric) int {
+		return strings.Compare(metrics.SeriesKey(a.GetID(), a.GetLabels()), metrics.SeriesKey(b.GetID(), b.GetLabels()))
+	})
+
+	return selected, nil
 }
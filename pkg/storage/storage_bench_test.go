@@ -6,6 +6,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/renatus-cartesius/metricserv/pkg/metrics"
 	"math/rand"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -98,3 +99,140 @@ func BenchmarkMemStorage_CheckMetric(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkMemStorage_Load(b *testing.B) {
+	ctx := context.Background()
+	storageSize := 10000
+
+	for _, format := range []string{"json", "proto", "proto+zstd"} {
+		b.Run(format, func(b *testing.B) {
+			snapshotFormat, err := ParseSnapshotFormat(format)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			savePath := filepath.Join(b.TempDir(), "storage")
+			storage, err := NewMemStorage(savePath, WithSnapshotFormat(snapshotFormat))
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			for i := 0; i < storageSize; i++ {
+				id := uuid.NewString()
+				if i%2 == 0 {
+					storage.Add(ctx, id, metrics.NewGauge(id, rand.Float64()))
+				} else {
+					storage.Add(ctx, id, metrics.NewCounter(id, rand.Int63()))
+				}
+			}
+			if err = storage.Save(ctx); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				restored, err := NewMemStorage(savePath)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err = restored.Load(ctx); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkStorage_ParallelUpdate(b *testing.B) {
+	ctx := context.Background()
+	storageSize := 10000
+
+	backends := map[string]func() (Storager, error){
+		"mem": func() (Storager, error) {
+			return NewMemStorage("/dev/null")
+		},
+		"sharded": func() (Storager, error) {
+			return NewShardedStorage("/dev/null", DefaultShards)
+		},
+	}
+
+	for _, name := range []string{"mem", "sharded"} {
+		b.Run(name, func(b *testing.B) {
+			storage, err := backends[name]()
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			ids := make([]string, storageSize)
+			for i := range ids {
+				ids[i] = uuid.NewString()
+				if err := storage.Add(ctx, ids[i], metrics.NewCounter(ids[i], 0)); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(time.Now().UnixNano()))
+				for pb.Next() {
+					id := ids[r.Intn(len(ids))]
+					if err := storage.Update(ctx, metrics.TypeCounter, id, int64(1)); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkStorage_ParallelMixed(b *testing.B) {
+	ctx := context.Background()
+	storageSize := 10000
+
+	backends := map[string]func() (Storager, error){
+		"mem": func() (Storager, error) {
+			return NewMemStorage("/dev/null")
+		},
+		"sharded": func() (Storager, error) {
+			return NewShardedStorage("/dev/null", DefaultShards)
+		},
+	}
+
+	for _, name := range []string{"mem", "sharded"} {
+		b.Run(name, func(b *testing.B) {
+			storage, err := backends[name]()
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			ids := make([]string, storageSize)
+			for i := range ids {
+				ids[i] = uuid.NewString()
+				if err := storage.Add(ctx, ids[i], metrics.NewGauge(ids[i], 0)); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ResetTimer()
+
+			// one of four operations is update, others are reads
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(time.Now().UnixNano()))
+				for pb.Next() {
+					id := ids[r.Intn(len(ids))]
+					if r.Intn(4) == 0 {
+						if err := storage.Update(ctx, metrics.TypeGauge, id, r.Float64()); err != nil {
+							b.Error(err)
+						}
+						continue
+					}
+					if _, err := storage.GetValue(ctx, metrics.TypeGauge, id); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
@@ -2,8 +2,14 @@ package storage
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/renatus-cartesius/metricserv/pkg/metrics"
 )
@@ -42,3 +48,1084 @@ func TestMemStorageAdd(t *testing.T) {
 
 	fmt.Println("DEBUG:", metrics)
 }
+
+func TestMemStorageLabels(t *testing.T) {
+	ctx := context.Background()
+	savePath := filepath.Join(t.TempDir(), "storage.json")
+
+	storage, err := NewMemStorage(savePath)
+	if err != nil {
+		t.Fatalf("error on creating new storage\n")
+	}
+
+	for _, host := range []string{"web-1", "web-2", "db-1"} {
+		gauge := metrics.NewGauge("cpu_usage", 1)
+		gauge.Labels = map[string]string{"host": host}
+		storage.Add(ctx, metrics.SeriesKey(gauge.ID, gauge.Labels), gauge)
+	}
+
+	if err := storage.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := NewMemStorage(savePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	matcher, err := metrics.ParseLabelMatcher("host=~web-.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selected, err := Select(ctx, restored, "cpu_usage", []*metrics.LabelMatcher{matcher})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(selected) != 2 {
+		t.Fatalf("expected 2 selected metrics, got %d", len(selected))
+	}
+	if selected[0].GetLabels()["host"] != "web-1" || selected[1].GetLabels()["host"] != "web-2" {
+		t.Errorf("unexpected selected metrics: %v", selected)
+	}
+}
+
+func TestMemStorageHistogram(t *testing.T) {
+	ctx := context.Background()
+	savePath := filepath.Join(t.TempDir(), "storage.json")
+
+	storage, err := NewMemStorage(savePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	histogram := metrics.NewHistogram("latency", []float64{0.1, 1})
+	histogram.Observe(0.5)
+	storage.Add(ctx, histogram.ID, histogram)
+
+	delta := metrics.NewHistogram("latency", []float64{0.1, 1})
+	delta.Observe(0.05)
+	if err := storage.Update(ctx, metrics.TypeHistogram, histogram.ID, delta); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := storage.Update(ctx, metrics.TypeHistogram, histogram.ID, metrics.NewHistogram("latency", nil)); err != metrics.ErrBucketsMismatch {
+		t.Errorf("expected ErrBucketsMismatch, got %v", err)
+	}
+
+	if err := storage.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := NewMemStorage(savePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := restored.GetValue(ctx, metrics.TypeHistogram, histogram.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != histogram.GetValue() {
+		t.Errorf("unexpected restored histogram: %v, want %v", value, histogram.GetValue())
+	}
+}
+
+func TestMemStorageSummary(t *testing.T) {
+	ctx := context.Background()
+	savePath := filepath.Join(t.TempDir(), "storage.json")
+
+	storage, err := NewMemStorage(savePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary := metrics.NewSummary("latency")
+	storage.Add(ctx, summary.ID, summary)
+
+	for i := 1; i <= 1000; i++ {
+		if err := storage.Update(ctx, metrics.TypeSummary, summary.ID, float64(i)/7); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := storage.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := NewMemStorage(savePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := restored.GetValue(ctx, metrics.TypeSummary, summary.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != summary.GetValue() {
+		t.Errorf("summary changed after restoring: %v, want %v", value, summary.GetValue())
+	}
+}
+
+func TestMemStorageHistory(t *testing.T) {
+	ctx := context.Background()
+
+	storage, err := NewMemStorage("/dev/null", WithHistoryCapacity(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage.Add(ctx, "HeapAlloc", metrics.NewGauge("HeapAlloc", 0))
+	for i := 1; i <= 5; i++ {
+		if err := storage.Update(ctx, metrics.TypeGauge, "HeapAlloc", float64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	samples, err := storage.History(ctx, "HeapAlloc", time.Unix(0, 0), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := make([]float64, 0, len(samples))
+	for _, sample := range samples {
+		values = append(values, sample.Value)
+	}
+	if fmt.Sprint(values) != "[3 4 5]" {
+		t.Errorf("unexpected history values: %v", values)
+	}
+
+	samples, err = storage.History(ctx, "HeapAlloc", time.Now().Add(time.Hour), time.Now().Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 0 {
+		t.Errorf("expected no samples in future range, got %v", samples)
+	}
+}
+
+func TestMemStorageRetain(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := NewMemStorage("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := s.(*MemStorage)
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	series := newRing(10)
+	for i, value := range []float64{1, 3, 2, 10, 20} {
+		series.push(Sample{Timestamp: now.Add(-2*time.Hour + time.Duration(i)*30*time.Second), Value: value})
+	}
+	series.push(Sample{Timestamp: now.Add(-time.Minute), Value: 100})
+	storage.history["HeapAlloc"] = series
+
+	policy := RetentionPolicy{RawAge: time.Hour, MinuteAge: 24 * time.Hour, HourAge: 30 * 24 * time.Hour}
+	if err := storage.Retain(ctx, now, policy); err != nil {
+		t.Fatal(err)
+	}
+
+	samples, err := storage.History(ctx, "HeapAlloc", time.Unix(0, 0), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 1 || samples[0].Value != 100 {
+		t.Errorf("unexpected raw samples after retention: %v", samples)
+	}
+
+	minutes, err := storage.Aggregates(ctx, "HeapAlloc", time.Minute, time.Unix(0, 0), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(minutes) != 3 {
+		t.Fatalf("expected 3 minute aggregates, got %v", minutes)
+	}
+	if minutes[1].Min != 2 || minutes[1].Max != 10 || minutes[1].Count != 2 || minutes[1].Last != 10 {
+		t.Errorf("unexpected minute aggregate: %+v", minutes[1])
+	}
+
+	hours, err := storage.Aggregates(ctx, "HeapAlloc", time.Hour, time.Unix(0, 0), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hours) != 1 || hours[0].Count != 5 || hours[0].Avg != 7.2 || hours[0].Last != 20 {
+		t.Errorf("unexpected hour aggregates: %+v", hours)
+	}
+
+	if err := storage.Retain(ctx, now.Add(23*time.Hour), policy); err != nil {
+		t.Fatal(err)
+	}
+
+	minutes, err = storage.Aggregates(ctx, "HeapAlloc", time.Minute, time.Unix(0, 0), now.Add(23*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(minutes) != 1 {
+		t.Errorf("expected only the latest minute aggregate to be kept, got %v", minutes)
+	}
+
+	if _, err := storage.Aggregates(ctx, "HeapAlloc", time.Second, now, now); err != ErrUnknownResolution {
+		t.Errorf("expected ErrUnknownResolution, got %v", err)
+	}
+}
+
+func TestMemStorageSilences(t *testing.T) {
+	ctx := context.Background()
+	silencesPath := filepath.Join(t.TempDir(), "silences.json")
+
+	s, err := NewMemStorage("/dev/null", WithSilencesPath(silencesPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	silence := Silence{
+		ID:        "maintenance",
+		Matchers:  []string{"alertname=HighCPU", "host=~web-.*"},
+		StartsAt:  now.Add(-time.Minute),
+		EndsAt:    now.Add(time.Hour),
+		CreatedBy: "ops",
+		Comment:   "kernel upgrade",
+	}
+	if err = silence.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.AddSilence(ctx, silence); err != nil {
+		t.Fatal(err)
+	}
+
+	if !silence.Mutes(map[string]string{"alertname": "HighCPU", "host": "web-1"}, now) {
+		t.Error("expected silence to mute matching alert")
+	}
+	if silence.Mutes(map[string]string{"alertname": "HighCPU", "host": "db-1"}, now) {
+		t.Error("expected silence not to mute alert of other host")
+	}
+
+	// silences are restored from file by new storage
+	restored, err := NewMemStorage("/dev/null", WithSilencesPath(silencesPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	silences, err := restored.Silences(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(silences) != 1 || silences[0].Comment != silence.Comment || !silences[0].EndsAt.Equal(silence.EndsAt) {
+		t.Fatalf("unexpected restored silences: %v", silences)
+	}
+
+	if err = restored.ExpireSilence(ctx, silence.ID, now); err != nil {
+		t.Fatal(err)
+	}
+	if err = restored.ExpireSilence(ctx, "unknown", now); err != ErrSilenceNotFound {
+		t.Errorf("expected ErrSilenceNotFound, got %v", err)
+	}
+
+	silences, err = restored.Silences(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := silences[0].State(now); state != SilenceExpired {
+		t.Errorf("expected expired silence, got %s", state)
+	}
+}
+
+func TestSilenceValidate(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		silence Silence
+		wantErr bool
+	}{
+		{
+			name:    "valid",
+			silence: Silence{Matchers: []string{"host=web-1"}, StartsAt: now, EndsAt: now.Add(time.Hour)},
+		},
+		{
+			name:    "no matchers",
+			silence: Silence{StartsAt: now, EndsAt: now.Add(time.Hour)},
+			wantErr: true,
+		},
+		{
+			name:    "invalid matcher",
+			silence: Silence{Matchers: []string{"host~web"}, StartsAt: now, EndsAt: now.Add(time.Hour)},
+			wantErr: true,
+		},
+		{
+			name:    "ends before start",
+			silence: Silence{Matchers: []string{"host=web-1"}, StartsAt: now, EndsAt: now.Add(-time.Hour)},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.silence.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMemStorageUpdateBatch(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := NewMemStorage("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Add(ctx, "requests", metrics.NewCounter("requests", 10)); err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.UpdateBatch(ctx, []BatchUpdate{
+		{Key: "requests", Metric: metrics.NewCounter("requests", 0), Value: int64(5)},
+		{Key: "requests", Metric: metrics.NewCounter("requests", 0), Value: int64(1)},
+		{Key: "cpu", Metric: metrics.NewGauge("cpu", 0), Value: 42.5},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		key   string
+		mtype string
+		want  string
+	}{
+		{key: "requests", mtype: metrics.TypeCounter, want: "16"},
+		{key: "cpu", mtype: metrics.TypeGauge, want: "42.5"},
+	} {
+		value, err := s.GetValue(ctx, tt.mtype, tt.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != tt.want {
+			t.Errorf("unexpected value of %s: %s, want %s", tt.key, value, tt.want)
+		}
+	}
+
+	// batch with invalid update is not applied at all
+	err = s.UpdateBatch(ctx, []BatchUpdate{
+		{Key: "requests", Metric: metrics.NewCounter("requests", 0), Value: int64(100)},
+		{Key: "memory", Metric: metrics.NewGauge("memory", 0), Value: 1.0},
+		{Key: "cpu", Metric: metrics.NewCounter("cpu", 0), Value: int64(1)},
+	})
+	if !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("expected ErrTypeMismatch, got %v", err)
+	}
+
+	value, err := s.GetValue(ctx, metrics.TypeCounter, "requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "16" {
+		t.Errorf("counter changed by failed batch: %s", value)
+	}
+
+	if ok, _ := s.CheckMetric(ctx, "memory"); ok {
+		t.Error("metric added by failed batch")
+	}
+}
+
+func TestMemStorageDeleteWAL(t *testing.T) {
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	savePath := filepath.Join(dir, "storage.json")
+	walPath := filepath.Join(dir, "storage.wal")
+
+	s, err := NewMemStorage(savePath, WithWAL(walPath, SyncPolicy{Always: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Add(ctx, "requests", metrics.NewCounter("requests", 10))
+	s.Add(ctx, "cpu", metrics.NewGauge("cpu", 0.5))
+	s.Add(ctx, "memory", metrics.NewGauge("memory", 0.5))
+	if err = s.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// metrics of snapshot are deleted and evicted after it is saved
+	if err = s.Delete(ctx, metrics.TypeCounter, "requests"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Update(ctx, metrics.TypeGauge, "memory", 1.5); err != nil {
+		t.Fatal(err)
+	}
+	evicted, err := s.Evict(ctx, time.Now().Add(-time.Hour))
+	if err != nil || len(evicted) != 0 {
+		t.Fatalf("unexpected evicted %v, %v", evicted, err)
+	}
+	if evicted, err = s.Evict(ctx, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if len(evicted) != 2 {
+		t.Errorf("unexpected evicted %v", evicted)
+	}
+
+	// crash: storage is not saved
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := NewMemStorage(savePath, WithWAL(walPath, SyncPolicy{Always: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if err = restored.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := restored.ListAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 0 {
+		t.Errorf("deleted metrics are restored: %v", all)
+	}
+}
+
+func TestMemStorageWAL(t *testing.T) {
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	savePath := filepath.Join(dir, "storage.json")
+	walPath := filepath.Join(dir, "storage.wal")
+
+	s, err := NewMemStorage(savePath, WithWAL(walPath, SyncPolicy{Always: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Add(ctx, "requests", metrics.NewCounter("requests", 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Update(ctx, metrics.TypeCounter, "requests", int64(5)); err != nil {
+		t.Fatal(err)
+	}
+	err = s.UpdateBatch(ctx, []BatchUpdate{
+		{Key: "requests", Metric: metrics.NewCounter("requests", 0), Value: int64(1)},
+		{Key: "cpu", Metric: metrics.NewGauge("cpu", 0), Value: 42.5},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// crash: storage is not saved, and torn record is left at the end of log
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(walPath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 1, 0, 1, 2})
+	f.Close()
+
+	restored, err := NewMemStorage(savePath, WithWAL(walPath, SyncPolicy{Always: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	if err = restored.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		key   string
+		mtype string
+		want  string
+	}{
+		{key: "requests", mtype: metrics.TypeCounter, want: "16"},
+		{key: "cpu", mtype: metrics.TypeGauge, want: "42.5"},
+	} {
+		value, err := restored.GetValue(ctx, tt.mtype, tt.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != tt.want {
+			t.Errorf("unexpected value of %s: %s, want %s", tt.key, value, tt.want)
+		}
+	}
+
+	// replay is idempotent, records are states of metrics
+	if err = restored.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := restored.GetValue(ctx, metrics.TypeCounter, "requests"); value != "16" {
+		t.Errorf("unexpected value after second replay: %s", value)
+	}
+
+	if err = restored.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("wal is not truncated after save: %d bytes", info.Size())
+	}
+}
+
+func TestMemStorageWALCorruptedLength(t *testing.T) {
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	savePath := filepath.Join(dir, "storage.json")
+	walPath := filepath.Join(dir, "storage.wal")
+
+	s, err := NewMemStorage(savePath, WithWAL(walPath, SyncPolicy{Always: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Add(ctx, "requests", metrics.NewCounter("requests", 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// header of record claiming almost 4GiB payload, replay must not allocate it
+	f, err := os.OpenFile(walPath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0xff, 0xff, 0xff, 0xf0, 0, 0, 0, 0, '[', ']'})
+	f.Close()
+
+	restored, err := NewMemStorage(savePath, WithWAL(walPath, SyncPolicy{Always: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if err = restored.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > maxWALRecordSize {
+		t.Errorf("replay allocated %d bytes for corrupted record", allocated)
+	}
+
+	if value, err := restored.GetValue(ctx, metrics.TypeCounter, "requests"); err != nil || value != "10" {
+		t.Errorf("unexpected value %q: %v", value, err)
+	}
+
+	restoredInfo, err := os.Stat(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restoredInfo.Size() != info.Size() {
+		t.Errorf("wal is not truncated after the last valid record: %d bytes, want %d", restoredInfo.Size(), info.Size())
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		raw     string
+		want    SyncPolicy
+		wantErr bool
+	}{
+		{raw: "always", want: SyncPolicy{Always: true}},
+		{raw: "never", want: SyncPolicy{}},
+		{raw: "250", want: SyncPolicy{Interval: 250 * time.Millisecond}},
+		{raw: "0", wantErr: true},
+		{raw: "sometimes", wantErr: true},
+	} {
+		policy, err := ParseSyncPolicy(tt.raw)
+		if (err != nil) != tt.wantErr || policy != tt.want {
+			t.Errorf("ParseSyncPolicy(%q) = %+v, %v", tt.raw, policy, err)
+		}
+	}
+}
+
+func TestMemStorageSnapshots(t *testing.T) {
+	ctx := context.Background()
+	savePath := filepath.Join(t.TempDir(), "storage.json")
+
+	s, err := NewMemStorage(savePath, WithSnapshotsKeep(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Add(ctx, "requests", metrics.NewCounter("requests", 1))
+	if err = s.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Update(ctx, metrics.TypeCounter, "requests", int64(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Update(ctx, metrics.TypeCounter, "requests", int64(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(savePath + ".2"); !os.IsNotExist(err) {
+		t.Errorf("snapshot beyond kept count is not removed: %v", err)
+	}
+
+	load := func() (string, error) {
+		restored, err := NewMemStorage(savePath, WithSnapshotsKeep(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = restored.Load(ctx); err != nil {
+			return "", err
+		}
+		return restored.GetValue(ctx, metrics.TypeCounter, "requests")
+	}
+
+	if value, err := load(); err != nil || value != "3" {
+		t.Fatalf("unexpected newest snapshot value %q: %v", value, err)
+	}
+
+	// newest snapshot is corrupted, previous one is loaded
+	data, err := os.ReadFile(savePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-2] ^= 0xff
+	if err = os.WriteFile(savePath, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := load(); err != nil || value != "2" {
+		t.Errorf("unexpected fallback snapshot value %q: %v", value, err)
+	}
+
+	// torn write leaving empty file
+	if err = os.WriteFile(savePath, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := load(); err != nil || value != "2" {
+		t.Errorf("unexpected fallback snapshot value %q: %v", value, err)
+	}
+
+	if err = os.WriteFile(savePath+".1", data[:len(data)/2], 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = load(); !errors.Is(err, ErrSnapshotCorrupted) {
+		t.Errorf("expected ErrSnapshotCorrupted, got %v", err)
+	}
+
+	// snapshot saved before header was introduced
+	legacy := `{"metrics":{"requests":{"id":"requests","type":"counter","value":7}}}`
+	if err = os.WriteFile(savePath, []byte(legacy), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := load(); err != nil || value != "7" {
+		t.Errorf("unexpected legacy snapshot value %q: %v", value, err)
+	}
+}
+
+func TestMemStorageSnapshotFallbackWAL(t *testing.T) {
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	savePath := filepath.Join(dir, "storage.json")
+	walPath := filepath.Join(dir, "storage.wal")
+
+	s, err := NewMemStorage(savePath, WithSnapshotsKeep(3), WithWAL(walPath, SyncPolicy{Always: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gauges := []string{"cpu", "memory", "disk"}
+
+	s.Add(ctx, "requests", metrics.NewCounter("requests", 1))
+	for i := range gauges {
+		if err = s.Save(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err = s.Update(ctx, metrics.TypeCounter, "requests", int64(1)); err != nil {
+			t.Fatal(err)
+		}
+		// every segment has metric changed only in it
+		if err = s.Add(ctx, gauges[i], metrics.NewGauge(gauges[i], 0.5)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// crash: storage is not saved
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(walPath + ".3"); !os.IsNotExist(err) {
+		t.Errorf("wal segment beyond kept count is not removed: %v", err)
+	}
+
+	load := func() Storager {
+		restored, err := NewMemStorage(savePath, WithSnapshotsKeep(3), WithWAL(walPath, SyncPolicy{Always: true}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = restored.Load(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return restored
+	}
+
+	corrupt := func(path string) {
+		if err := os.WriteFile(path, []byte("corrupted"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// changes written after the newest snapshot are kept whichever snapshot is loaded
+	for _, corrupted := range [][]string{nil, {savePath}, {savePath, savePath + ".1"}} {
+		for _, path := range corrupted {
+			corrupt(path)
+		}
+
+		restored := load()
+		if value, err := restored.GetValue(ctx, metrics.TypeCounter, "requests"); err != nil || value != "4" {
+			t.Errorf("unexpected counter value %q with corrupted %v: %v", value, corrupted, err)
+		}
+		for _, gauge := range gauges {
+			if value, err := restored.GetValue(ctx, metrics.TypeGauge, gauge); err != nil || value != "0.5" {
+				t.Errorf("unexpected %s value %q with corrupted %v: %v", gauge, value, corrupted, err)
+			}
+		}
+		if err = restored.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMemStorageSaveFailureWAL(t *testing.T) {
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	snapshotDir := filepath.Join(dir, "snapshots")
+	if err := os.Mkdir(snapshotDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	savePath := filepath.Join(snapshotDir, "storage.json")
+	walPath := filepath.Join(dir, "storage.wal")
+
+	open := func() Storager {
+		s, err := NewMemStorage(savePath, WithWAL(walPath, SyncPolicy{Always: true}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.Load(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	s := open()
+	if err := s.Add(ctx, "requests", metrics.NewCounter("requests", 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Update(ctx, metrics.TypeCounter, "requests", int64(5)); err != nil {
+		t.Fatal(err)
+	}
+
+	// snapshot can not be written after wal is cut, cut records must be kept
+	if err := os.Rename(snapshotDir, snapshotDir+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(ctx); err == nil {
+		t.Fatal("expected error on writing snapshot")
+	}
+	if err := os.Rename(snapshotDir+".moved", snapshotDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Update(ctx, metrics.TypeCounter, "requests", int64(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := open()
+	if value, err := restored.GetValue(ctx, metrics.TypeCounter, "requests"); err != nil || value != "16" {
+		t.Errorf("unexpected value after failed save %q: %v", value, err)
+	}
+
+	if err := restored.Update(ctx, metrics.TypeCounter, "requests", int64(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(walPath + ".pending"); !os.IsNotExist(err) {
+		t.Errorf("pending wal segment is not removed after save: %v", err)
+	}
+
+	restored = open()
+	defer restored.Close()
+	if value, err := restored.GetValue(ctx, metrics.TypeCounter, "requests"); err != nil || value != "17" {
+		t.Errorf("unexpected value after save %q: %v", value, err)
+	}
+}
+
+func TestMemStorageSnapshotFormats(t *testing.T) {
+	ctx := context.Background()
+
+	gauge := metrics.NewGauge("load", 0.1)
+	gauge.Labels = map[string]string{"host": "web-1"}
+	histogram := metrics.NewHistogram("latency", []float64{0.1, 1})
+	histogram.Observe(0.5)
+	summary := metrics.NewSummary("duration")
+	summary.Change([]float64{1, 2, 3})
+
+	for _, format := range []string{"json", "proto", "proto+zstd"} {
+		t.Run(format, func(t *testing.T) {
+			snapshotFormat, err := ParseSnapshotFormat(format)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			savePath := filepath.Join(t.TempDir(), "storage")
+			s, err := NewMemStorage(savePath, WithSnapshotFormat(snapshotFormat))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s.Add(ctx, "requests", metrics.NewCounter("requests", 42))
+			s.Add(ctx, metrics.SeriesKey(gauge.ID, gauge.Labels), gauge)
+			s.Add(ctx, histogram.ID, histogram)
+			s.Add(ctx, summary.ID, summary)
+			if err = s.Save(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			// format is detected by Load regardless of configured one
+			restored, err := NewMemStorage(savePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = restored.Load(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			want, _ := s.ListAll(ctx)
+			got, _ := restored.ListAll(ctx)
+			if len(got) != len(want) {
+				t.Fatalf("unexpected restored metrics %v", got)
+			}
+			for key, metric := range want {
+				if got[key] == nil || got[key].GetValue() != metric.GetValue() || got[key].GetType() != metric.GetType() {
+					t.Errorf("metric %s restored as %v, want %v", key, got[key], metric)
+				}
+			}
+			if got[metrics.SeriesKey(gauge.ID, gauge.Labels)].GetLabels()["host"] != "web-1" {
+				t.Error("labels are not restored")
+			}
+		})
+	}
+
+	if _, err := ParseSnapshotFormat("xml"); !errors.Is(err, ErrInvalidSnapshotFormat) {
+		t.Errorf("expected ErrInvalidSnapshotFormat, got %v", err)
+	}
+}
+
+func TestListAllIterate(t *testing.T) {
+	ctx := context.Background()
+
+	backends := map[string]func() (Storager, error){
+		"mem": func() (Storager, error) {
+			return NewMemStorage("/dev/null")
+		},
+		"sharded": func() (Storager, error) {
+			return NewShardedStorage("/dev/null", 4)
+		},
+	}
+
+	for name, newStorage := range backends {
+		t.Run(name, func(t *testing.T) {
+			s, err := newStorage()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			histogram := metrics.NewHistogram("latency", []float64{1})
+			s.Add(ctx, "requests", metrics.NewCounter("requests", 1))
+			s.Add(ctx, "cpu", metrics.NewGauge("cpu", 0.5))
+			s.Add(ctx, "latency", histogram)
+
+			all, err := s.ListAll(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s.Update(ctx, metrics.TypeCounter, "requests", int64(1))
+			s.Update(ctx, metrics.TypeGauge, "cpu", 1.5)
+			s.Update(ctx, metrics.TypeHistogram, "latency", func() *metrics.HistogramMetric {
+				h := metrics.NewHistogram("latency", []float64{1})
+				h.Observe(0.5)
+				return h
+			}())
+
+			// listed metrics are not changed by later updates
+			if all["requests"].GetValue() != "1" || all["cpu"].GetValue() != "0.5" || all["latency"].(*metrics.HistogramMetric).Count != 0 {
+				t.Errorf("listed metrics are changed by updates: %v", all)
+			}
+
+			visited := make(map[string]string)
+			err = s.Iterate(ctx, func(key string, metric metrics.Metric) error {
+				visited[key] = metric.GetValue()
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(visited) != 3 || visited["requests"] != "2" || visited["cpu"] != "1.5" {
+				t.Errorf("unexpected visited metrics %v", visited)
+			}
+
+			stop := errors.New("stop")
+			calls := 0
+			err = s.Iterate(ctx, func(key string, metric metrics.Metric) error {
+				calls++
+				return stop
+			})
+			if !errors.Is(err, stop) || calls != 1 {
+				t.Errorf("iteration is not stopped by error: %v after %d calls", err, calls)
+			}
+		})
+	}
+}
+
+func TestPGStorageUnavailable(t *testing.T) {
+	ctx := context.Background()
+
+	// nothing listens on port 1, so connection is refused
+	db, err := sql.Open("pgx", "postgres://metricserv@127.0.0.1:1/metricserv?connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewPGStorage(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err = s.Ping(ctx); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("ping returned %v, want %v", err, ErrUnavailable)
+	}
+	if err = s.Load(ctx); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("load returned %v, want %v", err, ErrUnavailable)
+	}
+	if _, err = s.GetValue(ctx, metrics.TypeCounter, "requests"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("getting value returned %v, want %v", err, ErrUnavailable)
+	}
+	if err = s.Update(ctx, metrics.TypeCounter, "requests", int64(1)); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("update returned %v, want %v", err, ErrUnavailable)
+	}
+	if errors.Is(err, ErrNotFound) {
+		t.Errorf("unavailable storage reported missing metric: %v", err)
+	}
+
+	now := time.Now()
+	for name, call := range map[string]func() error{
+		"history": func() error {
+			_, err := s.History(ctx, "requests", now.Add(-time.Hour), now)
+			return err
+		},
+		"aggregates": func() error {
+			_, err := s.Aggregates(ctx, "requests", time.Minute, now.Add(-time.Hour), now)
+			return err
+		},
+		"retain": func() error {
+			return s.Retain(ctx, now, RetentionPolicy{RawAge: time.Hour, MinuteAge: time.Hour, HourAge: time.Hour})
+		},
+		"stale": func() error {
+			_, err := s.Stale(ctx, now)
+			return err
+		},
+		"evict": func() error {
+			_, err := s.Evict(ctx, now)
+			return err
+		},
+		"silences": func() error {
+			_, err := s.Silences(ctx)
+			return err
+		},
+		"expire silence": func() error {
+			return s.ExpireSilence(ctx, "silence", now)
+		},
+	} {
+		if err := call(); !errors.Is(err, ErrUnavailable) {
+			t.Errorf("%s returned %v, want %v", name, err, ErrUnavailable)
+		}
+	}
+}
+
+func TestMemStorageIdempotencyExpiry(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := newMemStorage("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for _, record := range []IdempotencyRecord{
+		{Key: "expired", ExpiresAt: now.Add(-time.Minute)},
+		{Key: "resaved", ExpiresAt: now.Add(-time.Second)},
+		{Key: "resaved", ExpiresAt: now.Add(time.Hour)},
+		{Key: "valid", ExpiresAt: now.Add(time.Minute)},
+	} {
+		if err = s.SaveIdempotencyKey(ctx, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// expired records are dropped on next save, key saved again is kept with its latest expiration
+	if err = s.SaveIdempotencyKey(ctx, IdempotencyRecord{Key: "new", ExpiresAt: now.Add(time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.idempotencyKeys["expired"]; ok {
+		t.Error("expired record is not dropped")
+	}
+	for _, key := range []string{"resaved", "valid", "new"} {
+		if _, err = s.IdempotencyKey(ctx, key); err != nil {
+			t.Errorf("record %s is not kept: %v", key, err)
+		}
+	}
+	if s.idempotencyExpiry.Len() != 3 {
+		t.Errorf("unexpected queued expirations %v", s.idempotencyExpiry)
+	}
+}
@@ -0,0 +1,576 @@
+// Package storagetest provides conformance tests checking that implementations of storage.Storager behave the same.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/renatus-cartesius/metricserv/pkg/metrics"
+	"github.com/renatus-cartesius/metricserv/pkg/storage"
+)
+
+// Open opens storage persisted in dir, storages opened with the same dir share persisted metrics.
+// Every test of suite uses its own dir, so storage opened with new dir must be empty.
+type Open func(dir string) (storage.Storager, error)
+
+// Run runs conformance tests of storage opened by open
+func Run(t *testing.T, open Open) {
+	for _, tt := range []struct {
+		name string
+		test func(t *testing.T, open Open)
+	}{
+		{name: "AddAndList", test: testAddAndList},
+		{name: "Update", test: testUpdate},
+		{name: "TypeMismatch", test: testTypeMismatch},
+		{name: "MissingMetric", test: testMissingMetric},
+		{name: "UpdateBatch", test: testUpdateBatch},
+		{name: "ConcurrentUpdates", test: testConcurrentUpdates},
+		{name: "LargeCounter", test: testLargeCounter},
+		{name: "Delete", test: testDelete},
+		{name: "Staleness", test: testStaleness},
+		{name: "Persistence", test: testPersistence},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, open)
+		})
+	}
+}
+
+// newStorage opens empty storage closed on test cleanup
+func newStorage(t *testing.T, open Open) storage.Storager {
+	t.Helper()
+
+	s, err := open(t.TempDir())
+	if err != nil {
+		t.Fatalf("error on opening storage: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+// testMetrics returns metric of every type keyed by series key. Memory storages keep added metrics and change them
+// by updates, so new metrics are made for adding and for expecting.
+func testMetrics() map[string]metrics.Metric {
+	gauge := metrics.NewGauge("cpu", 0.5)
+	gauge.Labels = map[string]string{"host": "web-1"}
+
+	histogram := metrics.NewHistogram("latency", []float64{0.1, 1})
+	histogram.Observe(0.05)
+
+	summary := metrics.NewSummary("size")
+	summary.Change(10.0)
+
+	return map[string]metrics.Metric{
+		"requests": metrics.NewCounter("requests", 10),
+		metrics.SeriesKey(gauge.ID, gauge.Labels): gauge,
+		"latency": histogram,
+		"size":    summary,
+	}
+}
+
+func addAll(t *testing.T, s storage.Storager, all map[string]metrics.Metric) {
+	t.Helper()
+
+	for key, metric := range all {
+		if err := s.Add(context.Background(), key, metric); err != nil {
+			t.Fatalf("error on adding %s: %v", key, err)
+		}
+	}
+}
+
+// checkMetrics checks that storage holds exactly want metrics, using both ListAll and Iterate
+func checkMetrics(t *testing.T, s storage.Storager, want map[string]metrics.Metric) {
+	t.Helper()
+	ctx := context.Background()
+
+	all, err := s.ListAll(ctx)
+	if err != nil {
+		t.Fatalf("error on listing metrics: %v", err)
+	}
+	compareMetrics(t, "ListAll", all, want)
+
+	iterated := make(map[string]metrics.Metric)
+	err = s.Iterate(ctx, func(key string, metric metrics.Metric) error {
+		iterated[key] = metric
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error on iterating metrics: %v", err)
+	}
+	compareMetrics(t, "Iterate", iterated, want)
+}
+
+func compareMetrics(t *testing.T, source string, got, want map[string]metrics.Metric) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Errorf("%s returned %d metrics, want %d", source, len(got), len(want))
+	}
+	for key, w := range want {
+		g, ok := got[key]
+		if !ok {
+			t.Errorf("%s: metric %s is missing", source, key)
+			continue
+		}
+		if err := compareMetric(g, w); err != nil {
+			t.Errorf("%s: metric %s: %v", source, key, err)
+		}
+	}
+}
+
+func compareMetric(got, want metrics.Metric) error {
+	switch {
+	case got.GetID() != want.GetID():
+		return fmt.Errorf("id %q, want %q", got.GetID(), want.GetID())
+	case got.GetType() != want.GetType():
+		return fmt.Errorf("type %q, want %q", got.GetType(), want.GetType())
+	case got.GetValue() != want.GetValue():
+		return fmt.Errorf("value %q, want %q", got.GetValue(), want.GetValue())
+	case !maps.Equal(got.GetLabels(), want.GetLabels()):
+		return fmt.Errorf("labels %v, want %v", got.GetLabels(), want.GetLabels())
+	}
+	return nil
+}
+
+func checkValue(t *testing.T, s storage.Storager, mtype, key, want string) {
+	t.Helper()
+
+	value, err := s.GetValue(context.Background(), mtype, key)
+	if err != nil {
+		t.Fatalf("error on getting value of %s: %v", key, err)
+	}
+	if value != want {
+		t.Errorf("value of %s %s is %q, want %q", mtype, key, value, want)
+	}
+}
+
+func checkValueError(t *testing.T, s storage.Storager, mtype, key string, want error) {
+	t.Helper()
+
+	value, err := s.GetValue(context.Background(), mtype, key)
+	if !errors.Is(err, want) {
+		t.Errorf("getting value of %s %s returned %q, %v, want %v", mtype, key, value, err, want)
+	}
+}
+
+func testAddAndList(t *testing.T, open Open) {
+	ctx := context.Background()
+	s := newStorage(t, open)
+
+	checkMetrics(t, s, map[string]metrics.Metric{})
+
+	want := testMetrics()
+	addAll(t, s, testMetrics())
+	checkMetrics(t, s, want)
+
+	for key := range want {
+		if ok, err := s.CheckMetric(ctx, key); err != nil || !ok {
+			t.Errorf("CheckMetric of %s returned %v, %v", key, ok, err)
+		}
+	}
+
+	// add replaces stored metric
+	want["requests"] = metrics.NewCounter("requests", 3)
+	addAll(t, s, map[string]metrics.Metric{"requests": metrics.NewCounter("requests", 3)})
+	checkMetrics(t, s, want)
+	checkValue(t, s, metrics.TypeCounter, "requests", "3")
+
+	// add replaces metric stored with other type as well, there is single metric of key
+	want["requests"] = metrics.NewGauge("requests", 2.5)
+	addAll(t, s, map[string]metrics.Metric{"requests": metrics.NewGauge("requests", 2.5)})
+	checkMetrics(t, s, want)
+	checkValue(t, s, metrics.TypeGauge, "requests", "2.5")
+	checkValueError(t, s, metrics.TypeCounter, "requests", storage.ErrTypeMismatch)
+
+	// listed metrics are copies, changing them does not change storage
+	all, err := s.ListAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, metric := range all {
+		metric.Change(int64(1))
+		metric.Change(1.0)
+	}
+	checkMetrics(t, s, want)
+}
+
+func testUpdate(t *testing.T, open Open) {
+	ctx := context.Background()
+	s := newStorage(t, open)
+
+	want := testMetrics()
+	addAll(t, s, testMetrics())
+
+	gaugeKey := metrics.SeriesKey("cpu", map[string]string{"host": "web-1"})
+	for _, u := range []struct {
+		mtype string
+		key   string
+		value any
+	}{
+		{mtype: metrics.TypeCounter, key: "requests", value: int64(5)},
+		{mtype: metrics.TypeCounter, key: "requests", value: int64(7)},
+		{mtype: metrics.TypeGauge, key: gaugeKey, value: 2.5},
+		{mtype: metrics.TypeHistogram, key: "latency", value: 0.5},
+		{mtype: metrics.TypeSummary, key: "size", value: 20.0},
+	} {
+		if err := s.Update(ctx, u.mtype, u.key, u.value); err != nil {
+			t.Fatalf("error on updating %s: %v", u.key, err)
+		}
+		if err := want[u.key].Change(u.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkValue(t, s, metrics.TypeCounter, "requests", "22")
+	checkValue(t, s, metrics.TypeGauge, gaugeKey, "2.5")
+	checkMetrics(t, s, want)
+
+	samples, err := s.History(ctx, "requests", time.Now().Add(-time.Minute), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("error on reading history: %v", err)
+	}
+	if len(samples) != 2 || samples[0].Value != 15 || samples[1].Value != 22 {
+		t.Errorf("unexpected history of counter %v", samples)
+	}
+}
+
+func testTypeMismatch(t *testing.T, open Open) {
+	ctx := context.Background()
+	s := newStorage(t, open)
+
+	want := testMetrics()
+	addAll(t, s, testMetrics())
+
+	err := s.Update(ctx, metrics.TypeGauge, "requests", 1.5)
+	if !errors.Is(err, storage.ErrTypeMismatch) {
+		t.Errorf("update of counter as gauge returned %v, want %v", err, storage.ErrTypeMismatch)
+	}
+	var metricErr *storage.MetricError
+	if !errors.As(err, &metricErr) || metricErr.Key != "requests" || metricErr.Type != metrics.TypeGauge || metricErr.StoredType != metrics.TypeCounter {
+		t.Errorf("update of counter as gauge returned error without details: %#v", err)
+	}
+	if err := s.Update(ctx, metrics.TypeCounter, "requests", 1.5); !errors.Is(err, metrics.ErrWrongChangeType) {
+		t.Errorf("update of counter by float value returned %v, want %v", err, metrics.ErrWrongChangeType)
+	}
+	if err := s.Update(ctx, metrics.TypeHistogram, "latency", int64(1)); !errors.Is(err, metrics.ErrWrongChangeType) {
+		t.Errorf("update of histogram by integer value returned %v, want %v", err, metrics.ErrWrongChangeType)
+	}
+
+	checkValueError(t, s, metrics.TypeGauge, "requests", storage.ErrTypeMismatch)
+	checkMetrics(t, s, want)
+}
+
+func testMissingMetric(t *testing.T, open Open) {
+	ctx := context.Background()
+	s := newStorage(t, open)
+
+	addAll(t, s, map[string]metrics.Metric{"requests": metrics.NewCounter("requests", 1)})
+
+	if ok, err := s.CheckMetric(ctx, "missing"); err != nil || ok {
+		t.Errorf("CheckMetric of missing metric returned %v, %v", ok, err)
+	}
+	for _, mtype := range []string{metrics.TypeCounter, metrics.TypeGauge, metrics.TypeHistogram, metrics.TypeSummary} {
+		checkValueError(t, s, mtype, "missing", storage.ErrNotFound)
+	}
+	if err := s.Update(ctx, metrics.TypeCounter, "missing", int64(1)); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("update of missing metric returned %v, want %v", err, storage.ErrNotFound)
+	}
+
+	// failed update does not add metric
+	if ok, err := s.CheckMetric(ctx, "missing"); err != nil || ok {
+		t.Errorf("CheckMetric of missing metric after update returned %v, %v", ok, err)
+	}
+}
+
+func testUpdateBatch(t *testing.T, open Open) {
+	ctx := context.Background()
+	s := newStorage(t, open)
+
+	addAll(t, s, map[string]metrics.Metric{"requests": metrics.NewCounter("requests", 10)})
+
+	// batch adds missing metrics and applies updates in order
+	err := s.UpdateBatch(ctx, []storage.BatchUpdate{
+		{Key: "requests", Metric: metrics.NewCounter("requests", 0), Value: int64(5)},
+		{Key: "cpu", Metric: metrics.NewGauge("cpu", 0), Value: 1.5},
+		{Key: "requests", Metric: metrics.NewCounter("requests", 0), Value: int64(1)},
+		{Key: "cpu", Metric: metrics.NewGauge("cpu", 0), Value: 2.5},
+	})
+	if err != nil {
+		t.Fatalf("error on updating batch: %v", err)
+	}
+	checkValue(t, s, metrics.TypeCounter, "requests", "16")
+	checkValue(t, s, metrics.TypeGauge, "cpu", "2.5")
+
+	// batch with invalid update is not applied at all
+	err = s.UpdateBatch(ctx, []storage.BatchUpdate{
+		{Key: "requests", Metric: metrics.NewCounter("requests", 0), Value: int64(100)},
+		{Key: "memory", Metric: metrics.NewGauge("memory", 0), Value: int64(1)},
+	})
+	if err == nil {
+		t.Fatal("batch with invalid update succeeded")
+	}
+	checkValue(t, s, metrics.TypeCounter, "requests", "16")
+	if ok, err := s.CheckMetric(ctx, "memory"); err != nil || ok {
+		t.Errorf("metric of failed batch is added: %v, %v", ok, err)
+	}
+
+	// metric stored with other type is not added again with type of update
+	err = s.UpdateBatch(ctx, []storage.BatchUpdate{
+		{Key: "cpu", Metric: metrics.NewGauge("cpu", 0), Value: 3.5},
+		{Key: "requests", Metric: metrics.NewGauge("requests", 0), Value: 1.5},
+	})
+	if !errors.Is(err, storage.ErrTypeMismatch) {
+		t.Fatalf("expected ErrTypeMismatch, got %v", err)
+	}
+	checkValue(t, s, metrics.TypeGauge, "cpu", "2.5")
+	if _, err = s.GetValue(ctx, metrics.TypeGauge, "requests"); !errors.Is(err, storage.ErrTypeMismatch) {
+		t.Errorf("expected ErrTypeMismatch on getting gauge of mismatched batch, got %v", err)
+	}
+}
+
+func testConcurrentUpdates(t *testing.T, open Open) {
+	ctx := context.Background()
+	s := newStorage(t, open)
+
+	keys := []string{"counter_0", "counter_1", "counter_2", "counter_3"}
+	for _, key := range keys {
+		addAll(t, s, map[string]metrics.Metric{key: metrics.NewCounter(key, 0)})
+	}
+
+	workers, updates := 8, 50
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < updates; i++ {
+				key := keys[(w+i)%len(keys)]
+
+				var err error
+				if i%5 == 0 {
+					err = s.UpdateBatch(ctx, []storage.BatchUpdate{
+						{Key: key, Metric: metrics.NewCounter(key, 0), Value: int64(1)},
+					})
+				} else {
+					err = s.Update(ctx, metrics.TypeCounter, key, int64(1))
+				}
+				if err != nil {
+					t.Errorf("error on updating %s: %v", key, err)
+					return
+				}
+
+				if _, err = s.GetValue(ctx, metrics.TypeCounter, key); err != nil {
+					t.Errorf("error on getting value of %s: %v", key, err)
+					return
+				}
+				if i%10 == 0 {
+					if _, err = s.ListAll(ctx); err != nil {
+						t.Errorf("error on listing metrics: %v", err)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	all, err := s.ListAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var total int64
+	for _, metric := range all {
+		total += metric.(*metrics.CounterMetric).Value
+	}
+	if total != int64(workers*updates) {
+		t.Errorf("lost updates: total %d, want %d", total, workers*updates)
+	}
+}
+
+// testLargeCounter checks that counters above 2^53, which are not exact in float64, keep precision
+func testLargeCounter(t *testing.T, open Open) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s, err := open(dir)
+	if err != nil {
+		t.Fatalf("error on opening storage: %v", err)
+	}
+
+	const large = int64(1)<<53 + 1
+
+	addAll(t, s, map[string]metrics.Metric{"bytes": metrics.NewCounter("bytes", large)})
+	if err = s.Update(ctx, metrics.TypeCounter, "bytes", int64(2)); err != nil {
+		t.Fatal(err)
+	}
+	err = s.UpdateBatch(ctx, []storage.BatchUpdate{
+		{Key: "bytes", Metric: metrics.NewCounter("bytes", 0), Value: int64(1)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValue(t, s, metrics.TypeCounter, "bytes", strconv.FormatInt(large+3, 10))
+
+	all, err := s.ListAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counter, ok := all["bytes"].(*metrics.CounterMetric); !ok || counter.Value != large+3 {
+		t.Errorf("listed counter is %v, want %d", all["bytes"], large+3)
+	}
+
+	if err = s.Save(ctx); err != nil {
+		t.Fatalf("error on saving storage: %v", err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatalf("error on closing storage: %v", err)
+	}
+
+	restored, err := open(dir)
+	if err != nil {
+		t.Fatalf("error on reopening storage: %v", err)
+	}
+	t.Cleanup(func() { restored.Close() })
+
+	if err = restored.Load(ctx); err != nil {
+		t.Fatalf("error on loading storage: %v", err)
+	}
+	checkValue(t, restored, metrics.TypeCounter, "bytes", strconv.FormatInt(large+3, 10))
+}
+
+func testDelete(t *testing.T, open Open) {
+	ctx := context.Background()
+	s := newStorage(t, open)
+
+	addAll(t, s, map[string]metrics.Metric{
+		"requests": metrics.NewCounter("requests", 10),
+		"cpu":      metrics.NewGauge("cpu", 0.5),
+	})
+	if err := s.Update(ctx, metrics.TypeCounter, "requests", int64(5)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Delete(ctx, metrics.TypeGauge, "requests"); !errors.Is(err, storage.ErrTypeMismatch) {
+		t.Errorf("delete of counter as gauge returned %v, want %v", err, storage.ErrTypeMismatch)
+	}
+	if err := s.Delete(ctx, metrics.TypeCounter, "missing"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("delete of missing metric returned %v, want %v", err, storage.ErrNotFound)
+	}
+
+	if err := s.Delete(ctx, metrics.TypeCounter, "requests"); err != nil {
+		t.Fatalf("error on deleting metric: %v", err)
+	}
+	if ok, err := s.CheckMetric(ctx, "requests"); err != nil || ok {
+		t.Errorf("CheckMetric of deleted metric returned %v, %v", ok, err)
+	}
+	checkValueError(t, s, metrics.TypeCounter, "requests", storage.ErrNotFound)
+	checkMetrics(t, s, map[string]metrics.Metric{"cpu": metrics.NewGauge("cpu", 0.5)})
+
+	// metric added again starts without history of deleted one
+	addAll(t, s, map[string]metrics.Metric{"requests": metrics.NewCounter("requests", 1)})
+	checkValue(t, s, metrics.TypeCounter, "requests", "1")
+
+	samples, err := s.History(ctx, "requests", time.Now().Add(-time.Minute), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 0 {
+		t.Errorf("history of deleted metric is left: %v", samples)
+	}
+}
+
+func testStaleness(t *testing.T, open Open) {
+	ctx := context.Background()
+	s := newStorage(t, open)
+
+	addAll(t, s, map[string]metrics.Metric{
+		"requests": metrics.NewCounter("requests", 10),
+		"old":      metrics.NewGauge("old", 1),
+		"fresh":    metrics.NewGauge("fresh", 1),
+	})
+
+	time.Sleep(10 * time.Millisecond)
+	before := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	if err := s.Update(ctx, metrics.TypeGauge, "fresh", 2.0); err != nil {
+		t.Fatal(err)
+	}
+
+	// counters are not stale, however long they are not updated
+	stale, err := s.Stale(ctx, before)
+	if err != nil {
+		t.Fatalf("error on listing stale metrics: %v", err)
+	}
+	if !slices.Equal(stale, []string{"old"}) {
+		t.Errorf("stale metrics are %v, want [old]", stale)
+	}
+
+	evicted, err := s.Evict(ctx, before)
+	if err != nil {
+		t.Fatalf("error on evicting metrics: %v", err)
+	}
+	if !slices.Equal(evicted, []string{"old"}) {
+		t.Errorf("evicted metrics are %v, want [old]", evicted)
+	}
+	checkMetrics(t, s, map[string]metrics.Metric{
+		"requests": metrics.NewCounter("requests", 10),
+		"fresh":    metrics.NewGauge("fresh", 2),
+	})
+
+	if stale, err = s.Stale(ctx, before); err != nil || len(stale) != 0 {
+		t.Errorf("stale metrics after eviction are %v, %v", stale, err)
+	}
+}
+
+func testPersistence(t *testing.T, open Open) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s, err := open(dir)
+	if err != nil {
+		t.Fatalf("error on opening storage: %v", err)
+	}
+
+	want := testMetrics()
+	addAll(t, s, testMetrics())
+	if err = s.Update(ctx, metrics.TypeCounter, "requests", int64(5)); err != nil {
+		t.Fatal(err)
+	}
+	if err = want["requests"].Change(int64(5)); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Delete(ctx, metrics.TypeSummary, "size"); err != nil {
+		t.Fatal(err)
+	}
+	delete(want, "size")
+
+	if err = s.Save(ctx); err != nil {
+		t.Fatalf("error on saving storage: %v", err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatalf("error on closing storage: %v", err)
+	}
+
+	restored, err := open(dir)
+	if err != nil {
+		t.Fatalf("error on reopening storage: %v", err)
+	}
+	t.Cleanup(func() { restored.Close() })
+
+	if err = restored.Load(ctx); err != nil {
+		t.Fatalf("error on loading storage: %v", err)
+	}
+	checkMetrics(t, restored, want)
+	checkValue(t, restored, metrics.TypeCounter, "requests", "15")
+}
@@ -0,0 +1,262 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/renatus-cartesius/metricserv/pkg/metrics"
+)
+
+const (
+	dumpFormat  = "metricserv-dump"
+	dumpVersion = 1
+)
+
+var ErrInvalidDump = errors.New("invalid storage dump")
+
+// HistoryImporter is implemented by storages persisting history of series, so it is copied to them along with metrics.
+// Memory storages keep history only until restart, so it is not copied to them.
+type HistoryImporter interface {
+	// ImportHistory replaces samples and aggregates of series.
+	ImportHistory(ctx context.Context, id string, samples []Sample, aggregates map[time.Duration][]Aggregate) error
+}
+
+// Series is a metric with its history, it is a unit of copying between storages and a record of dump
+type Series struct {
+	Key    string            `json:"key"`
+	ID     string            `json:"id"`
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  string            `json:"value"`
+
+	Samples []Sample `json:"samples,omitempty"`
+	// Aggregates are keyed by resolution, e.g. 1m0s
+	Aggregates map[string][]Aggregate `json:"aggregates,omitempty"`
+}
+
+// dumpHeader is the first line of dump
+type dumpHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+// Metric restores metric of series
+func (series *Series) Metric() (metrics.Metric, error) {
+	entry := walEntry{Key: series.Key, ID: series.ID, Type: series.Type, Labels: series.Labels, Value: series.Value}
+	return entry.metric()
+}
+
+// ReadSeries reads history of metric from storage
+func ReadSeries(ctx context.Context, s Storager, key string, metric metrics.Metric) (Series, error) {
+	series := Series{
+		Key:    key,
+		ID:     metric.GetID(),
+		Type:   metric.GetType(),
+		Labels: metric.GetLabels(),
+		Value:  metric.GetValue(),
+	}
+
+	from, to := time.Unix(0, 0), time.Now()
+
+	samples, err := s.History(ctx, key, from, to)
+	if err != nil {
+		return Series{}, err
+	}
+	if len(samples) > 0 {
+		series.Samples = samples
+	}
+
+	for _, resolution := range Resolutions {
+		aggregates, err := s.Aggregates(ctx, key, resolution, from, to)
+		if err != nil {
+			return Series{}, err
+		}
+		if len(aggregates) == 0 {
+			continue
+		}
+		if series.Aggregates == nil {
+			series.Aggregates = make(map[string][]Aggregate, len(Resolutions))
+		}
+		series.Aggregates[resolution.String()] = aggregates
+	}
+
+	return series, nil
+}
+
+// WriteSeries adds metric of series to storage replacing existing one, history is written if storage is HistoryImporter
+func WriteSeries(ctx context.Context, s Storager, series Series) error {
+	metric, err := series.Metric()
+	if err != nil {
+		return fmt.Errorf("error on restoring metric %s: %w", series.Key, err)
+	}
+
+	if err = s.Add(ctx, series.Key, metric); err != nil {
+		return err
+	}
+
+	importer, ok := s.(HistoryImporter)
+	if !ok || (len(series.Samples) == 0 && len(series.Aggregates) == 0) {
+		return nil
+	}
+
+	aggregates := make(map[time.Duration][]Aggregate, len(series.Aggregates))
+	for raw, resolutionAggregates := range series.Aggregates {
+		resolution, err := time.ParseDuration(raw)
+		if err != nil || !validResolution(resolution) {
+			return fmt.Errorf("%w: resolution %q of %s", ErrInvalidDump, raw, series.Key)
+		}
+		aggregates[resolution] = resolutionAggregates
+	}
+
+	return importer.ImportHistory(ctx, series.Key, series.Samples, aggregates)
+}
+
+// Copy copies all metrics with their history from src to dst and returns count of copied series
+func Copy(ctx context.Context, dst, src Storager) (int, error) {
+	// metrics are listed before reading history, because database storages keep query open while iterating
+	all, err := src.ListAll(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	copied := 0
+	for _, key := range sortedKeys(all) {
+		series, err := ReadSeries(ctx, src, key, all[key])
+		if err != nil {
+			return copied, fmt.Errorf("error on reading %s: %w", key, err)
+		}
+		if err = WriteSeries(ctx, dst, series); err != nil {
+			return copied, fmt.Errorf("error on writing %s: %w", key, err)
+		}
+		copied++
+	}
+
+	return copied, nil
+}
+
+// Mismatch is a metric differing in storages, empty value means metric is missing
+type Mismatch struct {
+	Key    string
+	Source string
+	Target string
+}
+
+// VerifyReport is a result of comparing metrics of storages
+type VerifyReport struct {
+	Source     int
+	Target     int
+	Mismatches []Mismatch
+}
+
+// OK reports if storages hold the same metrics
+func (r VerifyReport) OK() bool {
+	return r.Source == r.Target && len(r.Mismatches) == 0
+}
+
+// Verify compares counts and values of metrics in src and dst
+func Verify(ctx context.Context, dst, src Storager) (VerifyReport, error) {
+	srcMetrics, err := src.ListAll(ctx)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	dstMetrics, err := dst.ListAll(ctx)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+
+	report := VerifyReport{
+		Source: len(srcMetrics),
+		Target: len(dstMetrics),
+	}
+
+	for _, key := range sortedKeys(srcMetrics) {
+		want := srcMetrics[key]
+		got, ok := dstMetrics[key]
+		switch {
+		case !ok:
+			report.Mismatches = append(report.Mismatches, Mismatch{Key: key, Source: want.GetValue()})
+		case got.GetType() != want.GetType() || got.GetValue() != want.GetValue():
+			report.Mismatches = append(report.Mismatches, Mismatch{Key: key, Source: want.GetValue(), Target: got.GetValue()})
+		}
+	}
+	for _, key := range sortedKeys(dstMetrics) {
+		if _, ok := srcMetrics[key]; !ok {
+			report.Mismatches = append(report.Mismatches, Mismatch{Key: key, Target: dstMetrics[key].GetValue()})
+		}
+	}
+
+	return report, nil
+}
+
+// Export writes all metrics with their history from src as dump: header line followed by JSON line per series.
+// Count of exported series is returned.
+func Export(ctx context.Context, w io.Writer, src Storager) (int, error) {
+	all, err := src.ListAll(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	encoder := json.NewEncoder(w)
+	if err = encoder.Encode(dumpHeader{Format: dumpFormat, Version: dumpVersion}); err != nil {
+		return 0, err
+	}
+
+	exported := 0
+	for _, key := range sortedKeys(all) {
+		series, err := ReadSeries(ctx, src, key, all[key])
+		if err != nil {
+			return exported, fmt.Errorf("error on reading %s: %w", key, err)
+		}
+		if err = encoder.Encode(series); err != nil {
+			return exported, err
+		}
+		exported++
+	}
+
+	return exported, nil
+}
+
+// Import writes series of dump made by Export to dst and returns count of imported series
+func Import(ctx context.Context, r io.Reader, dst Storager) (int, error) {
+	decoder := json.NewDecoder(bufio.NewReader(r))
+
+	var header dumpHeader
+	if err := decoder.Decode(&header); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidDump, err)
+	}
+	if header.Format != dumpFormat || header.Version != dumpVersion {
+		return 0, fmt.Errorf("%w: unsupported format %s version %d", ErrInvalidDump, header.Format, header.Version)
+	}
+
+	imported := 0
+	for {
+		var series Series
+		if err := decoder.Decode(&series); err != nil {
+			if errors.Is(err, io.EOF) {
+				return imported, nil
+			}
+			return imported, fmt.Errorf("%w: %v", ErrInvalidDump, err)
+		}
+
+		if err := WriteSeries(ctx, dst, series); err != nil {
+			return imported, fmt.Errorf("error on writing %s: %w", series.Key, err)
+		}
+		imported++
+	}
+}
+
+func sortedKeys(all map[string]metrics.Metric) []string {
+	keys := make([]string, 0, len(all))
+	for key := range all {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	return keys
+}
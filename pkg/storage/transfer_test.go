@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/renatus-cartesius/metricserv/pkg/metrics"
+)
+
+func newTransferSource(t *testing.T) Storager {
+	t.Helper()
+	ctx := context.Background()
+
+	s, err := NewMemStorage("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Add(ctx, "requests", metrics.NewCounter("requests", 10))
+	cpu := metrics.NewGauge("cpu", 0.5)
+	cpu.Labels = map[string]string{"host": "a"}
+	s.Add(ctx, metrics.SeriesKey("cpu", cpu.Labels), cpu)
+	if err = s.Update(ctx, metrics.TypeCounter, "requests", int64(5)); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Update(ctx, metrics.TypeGauge, metrics.SeriesKey("cpu", cpu.Labels), 1.5); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+
+	src := newTransferSource(t)
+	dst := newTestSQLiteStorage(t)
+
+	// stale metric of target is reported by verify
+	dst.Add(ctx, "stale", metrics.NewGauge("stale", 1))
+
+	copied, err := Copy(ctx, dst, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied != 2 {
+		t.Errorf("unexpected copied count %d", copied)
+	}
+
+	report, err := Verify(ctx, dst, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK() || len(report.Mismatches) != 1 || report.Mismatches[0].Key != "stale" {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	report, err = Verify(ctx, src, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	from, to := time.Now().Add(-time.Hour), time.Now()
+	want, _ := src.History(ctx, "requests", from, to)
+	got, err := dst.History(ctx, "requests", from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) || got[len(got)-1].Value != 15 {
+		t.Errorf("unexpected copied history %v, want %v", got, want)
+	}
+
+	// copy replaces history instead of appending to it
+	if _, err = Copy(ctx, dst, src); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ = dst.History(ctx, "requests", from, to); len(got) != len(want) {
+		t.Errorf("history duplicated on second copy: %v", got)
+	}
+
+	value, _ := dst.GetValue(ctx, metrics.TypeGauge, metrics.SeriesKey("cpu", map[string]string{"host": "a"}))
+	if value != "1.5" {
+		t.Errorf("unexpected copied gauge %q", value)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+
+	src := newTransferSource(t)
+
+	var dump bytes.Buffer
+	exported, err := Export(ctx, &dump, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exported != 2 {
+		t.Errorf("unexpected exported count %d", exported)
+	}
+
+	savePath := filepath.Join(t.TempDir(), "storage")
+	dst, err := NewMemStorage(savePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := Import(ctx, bytes.NewReader(dump.Bytes()), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != 2 {
+		t.Errorf("unexpected imported count %d", imported)
+	}
+	if err = dst.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := NewMemStorage(savePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = restored.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Verify(ctx, restored, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	all, _ := restored.ListAll(ctx)
+	if labels := all[metrics.SeriesKey("cpu", map[string]string{"host": "a"})].GetLabels(); labels["host"] != "a" {
+		t.Errorf("labels are lost: %v", labels)
+	}
+
+	// history of dump is imported into database storage
+	db := newTestSQLiteStorage(t)
+	if _, err = Import(ctx, bytes.NewReader(dump.Bytes()), db); err != nil {
+		t.Fatal(err)
+	}
+	samples, err := db.History(ctx, "requests", time.Now().Add(-time.Hour), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) == 0 {
+		t.Error("history is not imported")
+	}
+
+	for _, invalid := range []string{
+		"",
+		`{"format":"other","version":1}`,
+		`{"format":"metricserv-dump","version":2}`,
+		"{\"format\":\"metricserv-dump\",\"version\":1}\n{\"key\":\"x\",\"id\":\"x\",\"type\":\"gauge\",\"value\":\"1\",\"aggregates\":{\"1s\":[]}}",
+	} {
+		if _, err = Import(ctx, strings.NewReader(invalid), db); !errors.Is(err, ErrInvalidDump) {
+			t.Errorf("expected ErrInvalidDump on %q, got %v", invalid, err)
+		}
+	}
+}
@@ -0,0 +1,444 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/renatus-cartesius/metricserv/pkg/logger"
+	"github.com/renatus-cartesius/metricserv/pkg/metrics"
+	"github.com/renatus-cartesius/metricserv/pkg/utils"
+)
+
+const (
+	WALSyncAlways = "always"
+	WALSyncNever  = "never"
+
+	// walHeaderSize is a size of record header: payload length and its crc32 checksum
+	walHeaderSize = 8
+	// maxWALRecordSize limits payload of single record, so corrupted length does not make replay allocate
+	// gigabytes of memory
+	maxWALRecordSize = 64 << 20
+)
+
+var (
+	ErrInvalidSyncPolicy = errors.New("invalid wal sync policy")
+	ErrWALRecordTooLarge = errors.New("wal record is too large")
+)
+
+// SyncPolicy defines when WAL is fsynced: after every record if Always is set, every Interval if it is positive,
+// otherwise flushing to disk is left to OS
+type SyncPolicy struct {
+	Always   bool
+	Interval time.Duration
+}
+
+// ParseSyncPolicy parses always, never or sync interval in milliseconds
+func ParseSyncPolicy(raw string) (SyncPolicy, error) {
+	switch raw {
+	case WALSyncAlways:
+		return SyncPolicy{Always: true}, nil
+	case WALSyncNever:
+		return SyncPolicy{}, nil
+	}
+
+	ms, err := strconv.Atoi(raw)
+	if err != nil || ms <= 0 {
+		return SyncPolicy{}, fmt.Errorf("%w: %q", ErrInvalidSyncPolicy, raw)
+	}
+
+	return SyncPolicy{Interval: time.Duration(ms) * time.Millisecond}, nil
+}
+
+// walEntry is a state of metric after change. Replaying states instead of deltas makes replay idempotent,
+// so records already included in snapshot are harmless.
+type walEntry struct {
+	Key    string            `json:"key"`
+	ID     string            `json:"id"`
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  string            `json:"value"`
+
+	// Deleted marks entry of deleted metric, which has key and type only
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+func newWALEntry(key string, metric metrics.Metric) walEntry {
+	return walEntry{
+		Key:    key,
+		ID:     metric.GetID(),
+		Type:   metric.GetType(),
+		Labels: metric.GetLabels(),
+		Value:  metric.GetValue(),
+	}
+}
+
+// newDeleteEntry returns entry of deleting metric of type mtype with key
+func newDeleteEntry(key, mtype string) walEntry {
+	return walEntry{Key: key, Type: mtype, Deleted: true}
+}
+
+// metric restores metric from its state
+func (e *walEntry) metric() (metrics.Metric, error) {
+	var metric metrics.Metric
+
+	switch e.Type {
+	case metrics.TypeCounter:
+		value, err := strconv.ParseInt(e.Value, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		counter := metrics.NewCounter(e.ID, value)
+		counter.Labels = e.Labels
+		metric = counter
+	case metrics.TypeGauge:
+		value, err := strconv.ParseFloat(e.Value, 64)
+		if err != nil {
+			return nil, err
+		}
+		gauge := metrics.NewGauge(e.ID, value)
+		gauge.Labels = e.Labels
+		metric = gauge
+	case metrics.TypeHistogram:
+		histogram, err := metrics.ParseHistogramValue(e.ID, e.Value)
+		if err != nil {
+			return nil, err
+		}
+		histogram.Labels = e.Labels
+		metric = histogram
+	case metrics.TypeSummary:
+		summary, err := metrics.ParseSummaryValue(e.ID, e.Value)
+		if err != nil {
+			return nil, err
+		}
+		summary.Labels = e.Labels
+		metric = summary
+	default:
+		return nil, invalidType(e.Type, e.Key)
+	}
+
+	return metric, nil
+}
+
+// wal is an append-only log of metrics changes. Each record holds entries of one change, e.g. whole batch,
+// and is framed by its length and crc32 checksum, so torn record written on crash is detected and dropped.
+type wal struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	policy SyncPolicy
+	dirty  bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func openWAL(path string, policy SyncPolicy) (*wal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &wal{
+		path:   path,
+		file:   file,
+		policy: policy,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	if policy.Interval > 0 {
+		go w.syncLoop()
+	} else {
+		close(w.done)
+	}
+
+	return w, nil
+}
+
+func (w *wal) syncLoop() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.policy.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			if err := w.sync(); err != nil {
+				logger.Log.Error(
+					"error on syncing wal",
+					zap.Error(err),
+				)
+			}
+		}
+	}
+}
+
+func (w *wal) sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.dirty {
+		return nil
+	}
+	w.dirty = false
+
+	return w.file.Sync()
+}
+
+// append writes entries as single record
+func (w *wal) append(entries ...walEntry) error {
+	payload, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxWALRecordSize {
+		return ErrWALRecordTooLarge
+	}
+
+	record := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[walHeaderSize:], payload)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, err = w.file.Write(record); err != nil {
+		return err
+	}
+
+	if w.policy.Always {
+		return w.file.Sync()
+	}
+	w.dirty = true
+
+	return nil
+}
+
+// replay calls fn for entries of every record of pending segment left by unfinished save and of log in order.
+// Records of pending segment end with states included in snapshot written after it is cut, so they are replayed
+// whether snapshot is written or not. Log is truncated after the last valid record, so new records are not appended
+// after torn one.
+func (w *wal) replay(fn func(walEntry) error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := replaySegment(w.pendingPath(), fn); err != nil {
+		return err
+	}
+
+	info, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err = w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	offset, err := readRecords(w.file, info.Size(), fn)
+	if err != nil {
+		return err
+	}
+
+	return w.file.Truncate(offset)
+}
+
+// readRecords calls fn for entries of every record read from r of size bytes in order and returns offset after
+// the last valid record
+func readRecords(r io.Reader, size int64, fn func(walEntry) error) (int64, error) {
+	reader := bufio.NewReader(r)
+	header := make([]byte, walHeaderSize)
+	var offset int64
+
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if !errors.Is(err, io.EOF) {
+				logger.Log.Warn(
+					"dropping torn wal record",
+					zap.Int64("offset", offset),
+				)
+			}
+			return offset, nil
+		}
+
+		// length is not trusted until checksum is verified, record longer than rest of log is torn as well
+		length := int64(binary.BigEndian.Uint32(header[0:4]))
+		if length > maxWALRecordSize || length > size-offset-walHeaderSize {
+			logger.Log.Warn(
+				"dropping torn wal record",
+				zap.Int64("offset", offset),
+				zap.Int64("length", length),
+			)
+			return offset, nil
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil || crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			logger.Log.Warn(
+				"dropping torn wal record",
+				zap.Int64("offset", offset),
+			)
+			return offset, nil
+		}
+
+		var entries []walEntry
+		if err := json.Unmarshal(payload, &entries); err != nil {
+			return offset, err
+		}
+		for _, entry := range entries {
+			if err := fn(entry); err != nil {
+				return offset, err
+			}
+		}
+
+		offset += int64(walHeaderSize + len(payload))
+	}
+}
+
+// pendingPath returns path of segment holding records cut from log until snapshot including them is written
+func (w *wal) pendingPath() string {
+	return w.path + ".pending"
+}
+
+// cut is called while changes are blocked, at the point snapshot state is copied. Records are moved to pending
+// segment and new log is started, so changes are logged while snapshot is written. Records are appended to pending
+// segment if it is left by failed save.
+func (w *wal) cut() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.dirty = false
+
+	if _, err := os.Stat(w.pendingPath()); err == nil {
+		return w.appendPending()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Rename(w.path, w.pendingPath()); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(w.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if err = w.file.Close(); err != nil {
+		logger.Log.Warn(
+			"error on closing cut wal segment",
+			zap.Error(err),
+		)
+	}
+	w.file = file
+
+	return syncDir(filepath.Dir(w.path))
+}
+
+// appendPending copies records of log to the end of pending segment and truncates log, w.mu must be held
+func (w *wal) appendPending() error {
+	pending, err := os.OpenFile(w.pendingPath(), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	defer utils.SafeClose(pending)
+
+	if _, err = w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err = io.Copy(pending, w.file); err != nil {
+		return err
+	}
+	if err = pending.Sync(); err != nil {
+		return err
+	}
+
+	if err = w.file.Truncate(0); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// rotate is called once snapshot including pending records is written. Pending segment is moved to path.1,
+// previous segments are shifted like snapshots, so keep-1 segments are left: segment path.i holds records written
+// after snapshot path.i and is replayed if Load falls back to it. Records are dropped if keep is 1.
+func (w *wal) rotate(keep int) error {
+	if keep <= 1 {
+		if err := os.Remove(w.pendingPath()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return syncDir(filepath.Dir(w.path))
+	}
+
+	paths := snapshotPaths(w.path, keep)
+	for i := len(paths) - 1; i > 1; i-- {
+		if err := os.Rename(paths[i-1], paths[i]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(w.pendingPath(), paths[1]); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return syncDir(filepath.Dir(w.path))
+}
+
+// replaySegments calls fn for entries of segments kept by rotate from path.from down to path.1, so records are
+// replayed in order they were written. Missing segments are skipped.
+func replaySegments(path string, from int, fn func(walEntry) error) error {
+	paths := snapshotPaths(path, from+1)
+	for i := from; i > 0; i-- {
+		if err := replaySegment(paths[i], fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replaySegment calls fn for entries of every record of segment at path, missing segment is skipped
+func replaySegment(path string, fn func(walEntry) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer utils.SafeClose(file)
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	_, err = readRecords(file, info.Size(), fn)
+	return err
+}
+
+func (w *wal) close() error {
+	close(w.stop)
+	<-w.done
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return errors.Join(w.file.Sync(), w.file.Close())
+}